@@ -14,11 +14,14 @@ NC='\033[0m' # No Color
 
 # Build information
 VERSION=$(date +"%Y%m%d-%H%M%S")
+GIT_COMMIT=$(git rev-parse --short HEAD 2>/dev/null || echo unknown)
+BUILD_DATE=$(date -u +"%Y-%m-%dT%H:%M:%SZ")
+LDFLAGS="-s -w -X main.Version=${VERSION} -X main.GitCommit=${GIT_COMMIT} -X main.BuildDate=${BUILD_DATE}"
 BUILD_DIR="dist"
 
 echo -e "${BLUE}RT6D Radio Flasher - Cross-platform Build Script${NC}"
 echo -e "${BLUE}=================================================${NC}"
-echo "Build version: $VERSION"
+echo "Build version: $VERSION ($GIT_COMMIT)"
 echo ""
 
 # Create build directory
@@ -62,7 +65,7 @@ build_binary() {
     fi
     
     # Build the binary
-    go build -ldflags="-s -w" -o "${BUILD_DIR}/${output_name}" "$source_file"
+    go build -ldflags="$LDFLAGS" -o "${BUILD_DIR}/${output_name}" "$source_file"
     
     if [ $? -eq 0 ]; then
         echo -e "${GREEN}✓ Successfully built: ${output_name}${NC}"
@@ -102,6 +105,22 @@ for platform in "${PLATFORMS[@]}"; do
     build_binary "spi-tool.go" "spi-tool" "$goos" "$goarch" ""
 done
 
+# Build rt6d-sign for all platforms
+echo -e "${YELLOW}Building rt6d-sign...${NC}"
+echo "======================"
+for platform in "${PLATFORMS[@]}"; do
+    IFS='/' read -r goos goarch <<< "$platform"
+    build_binary "cmd/sign/main.go" "rt6d-sign" "$goos" "$goarch" ""
+done
+
+# Build rt6d-patch for all platforms
+echo -e "${YELLOW}Building rt6d-patch...${NC}"
+echo "======================="
+for platform in "${PLATFORMS[@]}"; do
+    IFS='/' read -r goos goarch <<< "$platform"
+    build_binary "cmd/patch/main.go" "rt6d-patch" "$goos" "$goarch" ""
+done
+
 # Reset environment variables
 unset GOOS
 unset GOARCH
@@ -120,11 +139,11 @@ create_archive() {
     
     if [ "$platform" = "windows-amd64" ] || [ "$platform" = "windows-arm64" ]; then
         # Windows - create ZIP
-        zip -q "${archive_name}.zip" rt6d-flasher-${platform}.exe hex2bin-${platform}.exe spi-tool-${platform}.exe
+        zip -q "${archive_name}.zip" rt6d-flasher-${platform}.exe hex2bin-${platform}.exe spi-tool-${platform}.exe rt6d-sign-${platform}.exe rt6d-patch-${platform}.exe
         echo -e "${GREEN}✓ Created: ${archive_name}.zip${NC}"
     else
         # Unix-like - create tar.gz
-        tar -czf "${archive_name}.tar.gz" rt6d-flasher-${platform} hex2bin-${platform} spi-tool-${platform}
+        tar -czf "${archive_name}.tar.gz" rt6d-flasher-${platform} hex2bin-${platform} spi-tool-${platform} rt6d-sign-${platform} rt6d-patch-${platform}
         echo -e "${GREEN}✓ Created: ${archive_name}.tar.gz${NC}"
     fi
 }
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// patchEntry is one line of a patch file:
+// <hex_offset> <hex_byte> [<expected_hex_byte>]
+type patchEntry struct {
+	line        int
+	offset      int
+	value       byte
+	expected    byte
+	hasExpected bool
+}
+
+func parsePatchFile(patchFile string) ([]patchEntry, error) {
+	file, err := os.Open(patchFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open patch file: %v", err)
+	}
+	defer file.Close()
+
+	var entries []patchEntry
+	lineNum := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 && len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected <offset> <byte> [<expected byte>]", lineNum)
+		}
+		offset, err := strconv.ParseUint(fields[0], 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid offset '%s'", lineNum, fields[0])
+		}
+		value, err := strconv.ParseUint(fields[1], 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid byte '%s'", lineNum, fields[1])
+		}
+
+		entry := patchEntry{line: lineNum, offset: int(offset), value: byte(value)}
+		if len(fields) == 3 {
+			expected, err := strconv.ParseUint(fields[2], 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid expected byte '%s'", lineNum, fields[2])
+			}
+			entry.expected = byte(expected)
+			entry.hasExpected = true
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read patch file: %v", err)
+	}
+	return entries, nil
+}
+
+// readPatch reads the base binary and the patch file and counts the
+// entries whose expected byte differs from base, printing each of them
+func readPatch(base, patch string) (image []byte, entries []patchEntry, mismatches int, err error) {
+	image, err = os.ReadFile(base)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("failed to read base binary: %v", err)
+	}
+	entries, err = parsePatchFile(patch)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	for _, e := range entries {
+		if e.offset >= len(image) {
+			return nil, nil, 0, fmt.Errorf("line %d: offset 0x%X is beyond the end of %s (%d bytes)", e.line, e.offset, base, len(image))
+		}
+		if e.hasExpected && image[e.offset] != e.expected {
+			fmt.Printf("Line %d: expected 0x%02X at 0x%06X, found 0x%02X\n", e.line, e.expected, e.offset, image[e.offset])
+			mismatches++
+		}
+	}
+	return image, entries, mismatches, nil
+}
+
+// VerifyPatch checks that every expected byte of the patch matches base,
+// as done by --verify-before before anything is written
+func VerifyPatch(base, patch string) error {
+	_, _, mismatches, err := readPatch(base, patch)
+	if err != nil {
+		return err
+	}
+	if mismatches > 0 {
+		return fmt.Errorf("%d bytes of %s differ from the patch, not patching", mismatches, base)
+	}
+	return nil
+}
+
+// PatchBinary applies a patch file to base and writes the result to output.
+// Entries whose expected byte differs from base are reported as warnings,
+// use VerifyPatch first to refuse such a base.
+func PatchBinary(base, patch, output string) error {
+	image, entries, mismatches, err := readPatch(base, patch)
+	if err != nil {
+		return err
+	}
+	if mismatches > 0 {
+		fmt.Printf("Warning: %d bytes differ from the patch, patching anyway\n", mismatches)
+	}
+
+	for _, e := range entries {
+		image[e.offset] = e.value
+	}
+	if err := os.WriteFile(output, image, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", output, err)
+	}
+	fmt.Printf("Applied %d patch entries, written to %s\n", len(entries), output)
+	return nil
+}
+
+// CreatePatch writes a patch file with one line per byte that differs
+// between base and target, including the base byte as expected value
+func CreatePatch(base, target, patch string) error {
+	baseImage, err := os.ReadFile(base)
+	if err != nil {
+		return fmt.Errorf("failed to read base binary: %v", err)
+	}
+	targetImage, err := os.ReadFile(target)
+	if err != nil {
+		return fmt.Errorf("failed to read target binary: %v", err)
+	}
+	if len(baseImage) != len(targetImage) {
+		return fmt.Errorf("%s is %d bytes but %s is %d bytes, both must have the same size",
+			base, len(baseImage), target, len(targetImage))
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# %s -> %s\n# offset new expected\n", base, target)
+	changed := 0
+	for i := range baseImage {
+		if baseImage[i] != targetImage[i] {
+			fmt.Fprintf(&sb, "%06X %02X %02X\n", i, targetImage[i], baseImage[i])
+			changed++
+		}
+	}
+	if err := os.WriteFile(patch, []byte(sb.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", patch, err)
+	}
+	fmt.Printf("%d differing bytes written to %s\n", changed, patch)
+	return nil
+}
+
+func showUsage() {
+	fmt.Printf("Usage: %s apply [--verify-before] <base.bin> <patch.txt> <output.bin>\n", os.Args[0])
+	fmt.Printf("       %s create-patch <base.bin> <target.bin> <patch.txt>\n", os.Args[0])
+	fmt.Println("\nPatch files have one line per byte: <hex_offset> <hex_byte> [<expected_hex_byte>]")
+	fmt.Println("\nOptions:")
+	fmt.Println("  --verify-before - Abort if any expected byte differs from the base binary")
+	fmt.Println("\nExamples:")
+	fmt.Printf("  %s create-patch RT880_V1.14.bin RT880_V1.14a.bin fix.patch\n", os.Args[0])
+	fmt.Printf("  %s apply --verify-before RT880_V1.14.bin fix.patch RT880_patched.bin\n", os.Args[0])
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		showUsage()
+		os.Exit(1)
+	}
+
+	fs := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	fs.Usage = showUsage
+	verifyBefore := fs.Bool("verify-before", false, "abort if any expected byte differs")
+	fs.Parse(os.Args[2:])
+	args := fs.Args()
+
+	var err error
+	switch {
+	case os.Args[1] == "apply" && len(args) == 3:
+		if *verifyBefore {
+			err = VerifyPatch(args[0], args[1])
+		}
+		if err == nil {
+			err = PatchBinary(args[0], args[1], args[2])
+		}
+	case os.Args[1] == "create-patch" && len(args) == 3:
+		err = CreatePatch(args[0], args[1], args[2])
+	default:
+		showUsage()
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testdata/target.bin is testdata/base.bin with 5 bytes changed
+
+func TestPatchRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join("testdata", "base.bin")
+	target := filepath.Join("testdata", "target.bin")
+	patch := filepath.Join(dir, "fix.patch")
+	output := filepath.Join(dir, "patched.bin")
+
+	if err := CreatePatch(base, target, patch); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := parsePatchFile(patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 5 {
+		t.Errorf("patch has %d entries, want 5", len(entries))
+	}
+
+	if err := VerifyPatch(base, patch); err != nil {
+		t.Fatal(err)
+	}
+	if err := PatchBinary(base, patch, output); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("patched binary differs from the target")
+	}
+}
+
+func TestVerifyPatchMismatch(t *testing.T) {
+	dir := t.TempDir()
+	patch := filepath.Join(dir, "fix.patch")
+	if err := CreatePatch(filepath.Join("testdata", "base.bin"), filepath.Join("testdata", "target.bin"), patch); err != nil {
+		t.Fatal(err)
+	}
+
+	// The target already holds the new bytes, not the expected ones
+	if err := VerifyPatch(filepath.Join("testdata", "target.bin"), patch); err == nil {
+		t.Error("no error for a base that does not match the patch")
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// loadKey reads a signing key: either exactly 32 raw bytes or a text file
+// with 64 hex characters
+func loadKey(keyFile string) ([]byte, error) {
+	content, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %v", err)
+	}
+
+	text := strings.TrimSpace(string(content))
+	if len(text) == 64 {
+		if key, err := hex.DecodeString(text); err == nil {
+			return key, nil
+		}
+	}
+	if len(content) == 32 {
+		return content, nil
+	}
+	return nil, fmt.Errorf("key file must contain 32 bytes or 64 hex characters")
+}
+
+func signFirmware(firmwareFile, keyFile string) (string, error) {
+	key, err := loadKey(keyFile)
+	if err != nil {
+		return "", err
+	}
+
+	firmware, err := os.ReadFile(firmwareFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read firmware file: %v", err)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(firmware)
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	sigFile := firmwareFile + ".sig"
+	if err := os.WriteFile(sigFile, []byte(signature+"\n"), 0644); err != nil {
+		return "", fmt.Errorf("failed to write %s: %v", sigFile, err)
+	}
+	return sigFile, nil
+}
+
+func main() {
+	if len(os.Args) != 3 {
+		fmt.Printf("Usage: %s <firmware_file> <key_file>\n", os.Args[0])
+		fmt.Println("\nWrites <firmware_file>.sig with the HMAC-SHA256 of the firmware file.")
+		fmt.Println("The key file holds either 32 raw bytes or 64 hex characters.")
+		fmt.Println("\nExample:")
+		fmt.Printf("  %s RT880_V1.14.bin rt880.key\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	sigFile, err := signFirmware(os.Args[1], os.Args[2])
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Signature written to %s\n", sigFile)
+}
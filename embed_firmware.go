@@ -0,0 +1,20 @@
+//go:build embed_firmware
+
+package main
+
+import "embed"
+
+// Build a self-contained flasher with the firmware image inside, for
+// factory programming:
+//
+//	cp firmware.hex embedded_firmware.hex
+//	go build -tags embed_firmware -o rt6d-factory main.go embed_firmware.go
+//
+// and flash with "rt6d-factory -use-embedded <port>".
+
+//go:embed embedded_firmware.*
+var embeddedFirmware embed.FS
+
+func init() {
+	embeddedFirmwareFiles = &embeddedFirmware
+}
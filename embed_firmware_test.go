@@ -0,0 +1,38 @@
+//go:build embed_firmware
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Run with the firmware to embed in place, like the factory build:
+//
+//	go test -tags embed_firmware main.go embed_firmware.go main_test.go embed_firmware_test.go
+
+func TestEmbeddedFirmwareMatchesDisk(t *testing.T) {
+	embedded, err := writeEmbeddedFirmware()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(embedded))
+
+	fromEmbedded := NewFlasher(false)
+	if !fromEmbedded.initializeHex(embedded) {
+		t.Fatal("failed to load the embedded firmware")
+	}
+	fromDisk := NewFlasher(false)
+	if !fromDisk.initializeHex(filepath.Base(embedded)) {
+		t.Fatalf("failed to load %s", filepath.Base(embedded))
+	}
+
+	if !bytes.Equal(fromEmbedded.hex, fromDisk.hex) {
+		t.Error("the embedded firmware loads to a different image than the file on disk")
+	}
+	if fromEmbedded.sourceSize != fromDisk.sourceSize {
+		t.Errorf("embedded source size %d, on disk %d", fromEmbedded.sourceSize, fromDisk.sourceSize)
+	}
+}
@@ -1,12 +1,27 @@
 package main
 
 import (
+	"bufio"
+	"encoding/hex"
+	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
 )
 
+// firmwareBaseAddress is the device address of the first byte of the image
+const firmwareBaseAddress = 0x08002800
+
 type HexConverter struct {
+	HexSize  int // Size of the output image in bytes
+	SRECRecordSize int // Data bytes per S3 record in toSREC
+	FillByte byte // Value of the bytes no data record sets
 	hex      []byte
+	written  []bool // Which bytes of hex were set by a data record
+	source   string // Input file name, used in merge warnings
 	allcode  string
 	cntcode  int
 	writestep int
@@ -14,7 +29,9 @@ type HexConverter struct {
 
 func NewHexConverter() *HexConverter {
 	return &HexConverter{
-		hex: make([]byte, 251904),
+		HexSize: 251904,
+		hex:     make([]byte, 251904),
+		SRECRecordSize: 32,
 	}
 }
 
@@ -50,7 +67,9 @@ func (h *HexConverter) stringOperation() bool {
 		i++
 	}
 	
-	if h.cntcode+i >= len(h.allcode) {
+	// The last record runs to the end of the file, also when there is no
+	// end of file record after it
+	if h.cntcode >= len(h.allcode) {
 		return false
 	}
 
@@ -98,6 +117,7 @@ func (h *HexConverter) stringOperation() bool {
 			addr := num3 + j - 10240 + (h.writestep-1)*65536
 			if addr >= 0 && addr < len(h.hex) {
 				h.hex[addr] = byte(dataByte)
+				h.written[addr] = true
 				if addr < 10 {
 					fmt.Printf("Setting hex[%d] = 0x%02X (from addr 0x%04X+%d, writestep=%d)\n", 
 						addr, dataByte, num3, j, h.writestep)
@@ -110,7 +130,16 @@ func (h *HexConverter) stringOperation() bool {
 		return false
 		
 	case 4: // Extended linear address record
-		h.writestep++
+		if len(text) < 13 {
+			return false
+		}
+		// Segments are placed by their upper address, counting the
+		// records would pull a segment after a skipped 64K page down
+		upper := 0
+		for _, c := range text[9:13] {
+			upper = upper<<4 + h.charToInt(c)
+		}
+		h.writestep = upper - firmwareBaseAddress>>16 + 1
 		fmt.Printf("Extended address record - writestep now: %d\n", h.writestep)
 		return true
 		
@@ -119,11 +148,15 @@ func (h *HexConverter) stringOperation() bool {
 	}
 }
 
-func (h *HexConverter) loadAndConvert(inputFile, outputFile string) error {
-	// Initialize hex array with 0x00 (like C# original)
-	for i := 0; i < 251904; i++ {
-		h.hex[i] = 0x00
+// load parses inputFile into the hex array without writing any output
+func (h *HexConverter) load(inputFile string) error {
+	// Initialize hex array with FillByte (0x00 like C# original)
+	h.hex = make([]byte, h.HexSize)
+	for i := range h.hex {
+		h.hex[i] = h.FillByte
 	}
+	h.written = make([]bool, h.HexSize)
+	h.source = inputFile
 	h.writestep = 0
 	h.cntcode = 0
 	
@@ -133,7 +166,7 @@ func (h *HexConverter) loadAndConvert(inputFile, outputFile string) error {
 		return fmt.Errorf("error reading input file: %v", err)
 	}
 	
-	h.allcode = string(content)
+	h.allcode = stripHexComments(string(content))
 	fmt.Printf("Loaded %d characters from %s\n", len(h.allcode), inputFile)
 	fmt.Printf("First 100 chars: %s\n", h.allcode[:min(100, len(h.allcode))])
 	
@@ -145,6 +178,13 @@ func (h *HexConverter) loadAndConvert(inputFile, outputFile string) error {
 	
 	fmt.Printf("Processed %d Intel HEX records\n", recordCount)
 	fmt.Printf("Final writestep: %d\n", h.writestep)
+	return nil
+}
+
+func (h *HexConverter) loadAndConvert(inputFile, outputFile string) error {
+	if err := h.load(inputFile); err != nil {
+		return err
+	}
 	
 	// Show first and last 16 bytes
 	fmt.Printf("First 16 bytes: ")
@@ -154,13 +194,13 @@ func (h *HexConverter) loadAndConvert(inputFile, outputFile string) error {
 	fmt.Printf("\n")
 	
 	fmt.Printf("Last 16 bytes: ")
-	for i := 251904 - 16; i < 251904; i++ {
+	for i := len(h.hex) - 16; i < len(h.hex); i++ {
 		fmt.Printf("%02X ", h.hex[i])
 	}
 	fmt.Printf("\n")
 	
 	// Write binary output
-	err = os.WriteFile(outputFile, h.hex, 0644)
+	err := os.WriteFile(outputFile, h.hex, 0644)
 	if err != nil {
 		return fmt.Errorf("error writing output file: %v", err)
 	}
@@ -169,6 +209,480 @@ func (h *HexConverter) loadAndConvert(inputFile, outputFile string) error {
 	return nil
 }
 
+// toSREC writes the populated bytes of h.hex as Motorola S-records: an S0
+// header with the file name, S3 data records of SRECRecordSize bytes at
+// baseAddress + offset and an S7 end record pointing at baseAddress.
+func (h *HexConverter) toSREC(outputFile string, baseAddress uint32) error {
+	recordSize := h.SRECRecordSize
+	if recordSize < 1 || recordSize > 250 {
+		return fmt.Errorf("S-record data length must be 1-250 bytes, got %d", recordSize)
+	}
+
+	var out strings.Builder
+	name := []byte(filepath.Base(outputFile))
+	if len(name) > 252 {
+		name = name[:252]
+	}
+	out.WriteString(srecRecord('0', []byte{0, 0}, name))
+
+	records := 0
+	for start := 0; start < len(h.hex); {
+		if !h.written[start] {
+			start++
+			continue
+		}
+		end := start
+		for end < len(h.hex) && end-start < recordSize && h.written[end] {
+			end++
+		}
+		addr := baseAddress + uint32(start)
+		address := []byte{byte(addr >> 24), byte(addr >> 16), byte(addr >> 8), byte(addr)}
+		out.WriteString(srecRecord('3', address, h.hex[start:end]))
+		records++
+		start = end
+	}
+
+	address := []byte{byte(baseAddress >> 24), byte(baseAddress >> 16), byte(baseAddress >> 8), byte(baseAddress)}
+	out.WriteString(srecRecord('7', address, nil))
+
+	if err := os.WriteFile(outputFile, []byte(out.String()), 0644); err != nil {
+		return fmt.Errorf("error writing output file: %v", err)
+	}
+	fmt.Printf("Successfully wrote %d S3 records to %s\n", records, outputFile)
+	return nil
+}
+
+// srecRecord formats one S-record line. The count covers address, data and
+// checksum, the checksum is the one's complement of the sum of the count,
+// address and data bytes.
+func srecRecord(recordType byte, address, data []byte) string {
+	count := byte(len(address) + len(data) + 1)
+	sum := count
+	for _, b := range address {
+		sum += b
+	}
+	for _, b := range data {
+		sum += b
+	}
+	return fmt.Sprintf("S%c%02X%X%X%02X\n", recordType, count, address, data, ^sum)
+}
+
+// ValidationError describes one problem found in a HEX file
+type ValidationError struct {
+	LineNum int
+	Record  string
+	Message string
+}
+
+func (e ValidationError) String() string {
+	return fmt.Sprintf("line %d: %s (%s)", e.LineNum, e.Message, e.Record)
+}
+
+// validateIntelHex checks the syntax of an Intel HEX file without building
+// an image. The returned error is only set if the file can't be read.
+func validateIntelHex(filename string) ([]ValidationError, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening input file: %v", err)
+	}
+	defer file.Close()
+
+	var problems []ValidationError
+	report := func(lineNum int, record, format string, args ...interface{}) {
+		problems = append(problems, ValidationError{
+			LineNum: lineNum,
+			Record:  record,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	eofLine := 0
+	lastAddr := -1
+	lineNum := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, hexCommentPrefix) {
+			continue
+		}
+
+		if eofLine > 0 {
+			report(lineNum, line, "record after EOF record on line %d", eofLine)
+		}
+		if line[0] != ':' {
+			report(lineNum, line, "record does not start with ':'")
+			continue
+		}
+
+		data, err := hex.DecodeString(line[1:])
+		if err != nil {
+			report(lineNum, line, "invalid hex data: %v", err)
+			continue
+		}
+		if len(data) < 5 {
+			report(lineNum, line, "record too short")
+			continue
+		}
+
+		length := int(data[0])
+		address := int(data[1])<<8 | int(data[2])
+		recordType := data[3]
+		if len(data) != length+5 {
+			report(lineNum, line, "length field is %d but record has %d data bytes", length, len(data)-5)
+			continue
+		}
+
+		var sum byte
+		for _, b := range data {
+			sum += b
+		}
+		if sum != 0 {
+			expected := byte(0) - (sum - data[len(data)-1])
+			report(lineNum, line, "checksum is 0x%02X, expected 0x%02X", data[len(data)-1], expected)
+		}
+
+		switch recordType {
+		case 0: // Data record
+			if address < lastAddr {
+				report(lineNum, line, "address 0x%04X is below previous address 0x%04X", address, lastAddr)
+			}
+			lastAddr = address
+
+		case 1: // End of file record
+			if length != 0 {
+				report(lineNum, line, "EOF record has %d data bytes, expected 0", length)
+			}
+			if eofLine == 0 {
+				eofLine = lineNum
+			}
+
+		case 4: // Extended linear address record
+			if length != 2 {
+				report(lineNum, line, "extended linear address record has %d data bytes, expected 2", length)
+			}
+			lastAddr = -1
+
+		case 2, 3, 5:
+			// Segment and start address records carry nothing to check
+
+		default:
+			report(lineNum, line, "unknown record type 0x%02X", recordType)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading input file: %v", err)
+	}
+
+	if eofLine == 0 {
+		report(lineNum, "", "missing EOF record")
+	}
+	return problems, nil
+}
+
+// runValidate implements "hex2bin validate <file>"
+func runValidate(filename string) {
+	problems, err := validateIntelHex(filename)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("%s: %d problems found\n", filename, len(problems))
+		os.Exit(1)
+	}
+	fmt.Printf("%s: OK\n", filename)
+}
+
+// formatInfo describes a file format for list-formats. Header is the start
+// of a typical file, Detection how the format is chosen.
+type formatInfo struct {
+	Name        string
+	Extensions  string
+	Description string
+	Detection   []string
+	Header      []byte
+}
+
+// hexFormats lists the input format followed by the output formats
+var hexFormats = []formatInfo{
+	{
+		Name:        "Intel HEX (input)",
+		Extensions:  ".hex .txt",
+		Description: "Text records with absolute addresses, also written by --annotate",
+		Detection: []string{
+			"always, starts with ':' followed by length and address (100%)",
+			"text between records is skipped, validate reports it",
+		},
+		Header: []byte(":020000040800F2\n"),
+	},
+	{
+		Name:        "Binary (output)",
+		Extensions:  ".bin",
+		Description: "Raw image from 0x08002800, unset bytes filled with --fill-byte",
+		Detection: []string{
+			"default output, --output-format bin (100%)",
+			"first 4 bytes are ARM stack pointer (e.g., 98 92 00 20)",
+		},
+		Header: []byte{0x98, 0x92, 0x00, 0x20, 0xC1, 0x2A, 0x00, 0x08, 0x49, 0xA8, 0x01, 0x08, 0x45, 0x3B, 0x01, 0x08},
+	},
+	{
+		Name:        "S-record (output)",
+		Extensions:  ".srec",
+		Description: "Motorola S3 records with an S0 header holding the file name",
+		Detection: []string{
+			"--output-format srec (100%)",
+			"starts with 'S' followed by record type digit",
+		},
+		Header: []byte("S01000006669726D"),
+	},
+}
+
+func printFormats(formats []formatInfo, fallback string) {
+	for i, format := range formats {
+		if i > 0 {
+			fmt.Println()
+		}
+		ascii := make([]byte, len(format.Header))
+		for j, b := range format.Header {
+			ascii[j] = '.'
+			if b >= 0x20 && b < 0x7F {
+				ascii[j] = b
+			}
+		}
+		fmt.Printf("%s\n", format.Name)
+		fmt.Printf("  Extensions:  %s\n", format.Extensions)
+		fmt.Printf("  Description: %s\n", format.Description)
+		for j, detection := range format.Detection {
+			label := "Detection:"
+			if j > 0 {
+				label = ""
+			}
+			fmt.Printf("  %-12s %s\n", label, detection)
+		}
+		fmt.Printf("  Header:      % X  %s\n", format.Header, ascii)
+	}
+	fmt.Printf("\nFallback order: %s\n", fallback)
+}
+
+
+// hexCommentPrefix starts the comment lines written by AnnotateIntelHex.
+// Intel HEX has no comment syntax, most hex editors skip lines like these.
+const hexCommentPrefix = ";;"
+
+// stripHexComments removes the comment lines from HEX file content, they
+// would otherwise be parsed as part of the record before them
+func stripHexComments(content string) string {
+	if !strings.Contains(content, hexCommentPrefix) {
+		return content
+	}
+	lines := strings.SplitAfter(content, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if !strings.HasPrefix(strings.TrimSpace(line), hexCommentPrefix) {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "")
+}
+
+// FirmwareRegion is a named address range of the MCU flash
+type FirmwareRegion struct {
+	Name         string `yaml:"name"`
+	StartAddress uint32 `yaml:"start_address"`
+	Size         uint32 `yaml:"size"`
+}
+
+// FirmwareRegionMap is the layout read from a firmware region map YAML
+// file such as rt6d-firmware-regions.yaml
+type FirmwareRegionMap struct {
+	Regions []FirmwareRegion `yaml:"regions"`
+}
+
+// LoadFirmwareRegionMap reads a firmware region map, the regions may not
+// overlap
+func LoadFirmwareRegionMap(path string) (*FirmwareRegionMap, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read region map: %v", err)
+	}
+
+	m := &FirmwareRegionMap{}
+	if err := yaml.Unmarshal(content, m); err != nil {
+		return nil, fmt.Errorf("failed to parse region map: %v", err)
+	}
+
+	for i, r := range m.Regions {
+		if r.Name == "" || r.Size == 0 {
+			return nil, fmt.Errorf("region map entries need a name and a size")
+		}
+		if uint64(r.StartAddress)+uint64(r.Size) > 1<<32 {
+			return nil, fmt.Errorf("region %s ends beyond the 32 bit address space", r.Name)
+		}
+		for _, other := range m.Regions[:i] {
+			if r.StartAddress < other.StartAddress+other.Size && other.StartAddress < r.StartAddress+r.Size {
+				return nil, fmt.Errorf("regions %s and %s overlap", other.Name, r.Name)
+			}
+		}
+	}
+	return m, nil
+}
+
+// find returns the index of the region holding address, -1 if there is none
+func (m *FirmwareRegionMap) find(address uint32) int {
+	for i, r := range m.Regions {
+		if address >= r.StartAddress && address-r.StartAddress < r.Size {
+			return i
+		}
+	}
+	return -1
+}
+
+// AnnotateIntelHex copies inputHex to outputHex with a comment line before
+// the first data record of every region in the region map, such as
+// ";; Region: bootloader 0x08000000-0x08002800". Records are copied
+// unchanged, comment lines already in the input are dropped.
+func AnnotateIntelHex(inputHex, regionMapYAML, outputHex string) error {
+	regionMap, err := LoadFirmwareRegionMap(regionMapYAML)
+	if err != nil {
+		return err
+	}
+
+	content, err := os.ReadFile(inputHex)
+	if err != nil {
+		return fmt.Errorf("error reading input file: %v", err)
+	}
+
+	var out strings.Builder
+	var upper uint32 // Address bits set by the last extended linear address record
+	current := -1
+	comments := 0
+	for lineNum, line := range strings.SplitAfter(string(content), "\n") {
+		record := strings.TrimSpace(line)
+		if strings.HasPrefix(record, hexCommentPrefix) {
+			continue
+		}
+		if record == "" {
+			out.WriteString(line)
+			continue
+		}
+
+		data, err := hex.DecodeString(strings.TrimPrefix(record, ":"))
+		if record[0] != ':' || err != nil || len(data) < 5 || len(data) != int(data[0])+5 {
+			return fmt.Errorf("line %d: invalid record %q, run \"hex2bin validate\" for details", lineNum+1, record)
+		}
+
+		switch data[3] {
+		case 0: // Data record
+			address := upper | uint32(data[1])<<8 | uint32(data[2])
+			if i := regionMap.find(address); i != current {
+				if i >= 0 {
+					r := regionMap.Regions[i]
+					ending := line[len(strings.TrimRight(line, "\r\n")):]
+					if ending == "" {
+						ending = "\n"
+					}
+					fmt.Fprintf(&out, "%s Region: %s 0x%08X-0x%08X%s", hexCommentPrefix,
+						r.Name, r.StartAddress, uint64(r.StartAddress)+uint64(r.Size), ending)
+					comments++
+				}
+				current = i
+			}
+
+		case 4: // Extended linear address record
+			if data[0] == 2 {
+				upper = uint32(data[4])<<24 | uint32(data[5])<<16
+			}
+		}
+		out.WriteString(line)
+	}
+
+	if err := os.WriteFile(outputHex, []byte(out.String()), 0644); err != nil {
+		return fmt.Errorf("error writing output file: %v", err)
+	}
+	fmt.Printf("Successfully wrote %s with %d region comments\n", outputHex, comments)
+	return nil
+}
+
+// mergeToBinary combines loaded converters into one image, later files
+// laid over earlier ones. Bytes no file sets are fillByte. A byte set to
+// different values by two files is an error unless allowOverlap is true,
+// in which case the last file wins and a warning is printed.
+func mergeToBinary(converters []*HexConverter, fillByte byte, allowOverlap bool) ([]byte, error) {
+	size := 0
+	for _, c := range converters {
+		size = max(size, len(c.hex))
+	}
+
+	out := make([]byte, size)
+	for i := range out {
+		out[i] = fillByte
+	}
+	owner := make([]*HexConverter, size)
+
+	conflicts := 0
+	for _, c := range converters {
+		for addr, set := range c.written {
+			if !set {
+				continue
+			}
+			if prev := owner[addr]; prev != nil && out[addr] != c.hex[addr] {
+				if !allowOverlap {
+					return nil, fmt.Errorf("%s and %s both set offset 0x%05X (0x%02X vs 0x%02X), use --allow-overlap to let the last file win",
+						prev.source, c.source, addr, out[addr], c.hex[addr])
+				}
+				fmt.Printf("Warning: offset 0x%05X set to 0x%02X by %s, overridden with 0x%02X by %s\n",
+					addr, out[addr], prev.source, c.hex[addr], c.source)
+				conflicts++
+			}
+			out[addr] = c.hex[addr]
+			owner[addr] = c
+		}
+	}
+
+	if conflicts > 0 {
+		fmt.Printf("%d overlapping bytes resolved in favour of later files\n", conflicts)
+	}
+	return out, nil
+}
+
+// mergeAndConvert loads each HEX file into its own converter and writes
+// the merged image to outputFile
+func mergeAndConvert(inputFiles []string, outputFile string, fillByte byte, allowOverlap bool) error {
+	converters := make([]*HexConverter, 0, len(inputFiles))
+	for _, inputFile := range inputFiles {
+		c := NewHexConverter()
+		if err := c.load(inputFile); err != nil {
+			return err
+		}
+		converters = append(converters, c)
+	}
+
+	merged, err := mergeToBinary(converters, fillByte, allowOverlap)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(outputFile, merged, 0644)
+	if err != nil {
+		return fmt.Errorf("error writing output file: %v", err)
+	}
+
+	fmt.Printf("Successfully merged %d files into %d bytes in %s\n", len(inputFiles), len(merged), outputFile)
+	return nil
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -177,18 +691,77 @@ func min(a, b int) int {
 }
 
 func main() {
-	if len(os.Args) != 3 {
-		fmt.Printf("Usage: %s <input_hex_file> <output_bin_file>\n", os.Args[0])
+	if len(os.Args) == 3 && os.Args[1] == "validate" {
+		runValidate(os.Args[2])
+		return
+	}
+	if len(os.Args) == 2 && os.Args[1] == "list-formats" {
+		printFormats(hexFormats, "input is always Intel HEX, output is binary unless --output-format srec")
+		return
+	}
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	allowOverlap := fs.Bool("allow-overlap", false, "let later files override bytes set by earlier ones")
+	fillByte := fs.Uint("fill-byte", 0x00, "value for bytes not set by any file")
+	outputFormat := fs.String("output-format", "bin", "bin or srec")
+	srecRecordSize := fs.Int("srec-record-size", 32, "data bytes per S-record")
+	annotate := fs.String("annotate", "", "write the HEX file with region comments from this YAML region map")
+	fs.Parse(os.Args[1:])
+	args := fs.Args()
+
+	if len(args) < 2 || *fillByte > 0xFF || (*outputFormat != "bin" && *outputFormat != "srec") {
+		fmt.Printf("Usage: %s [--allow-overlap] [--fill-byte N] <input_hex_file>... <output_bin_file>\n", os.Args[0])
+		fmt.Printf("       %s --output-format srec [--srec-record-size N] <input_hex_file> <output_srec_file>\n", os.Args[0])
+		fmt.Printf("       %s --annotate <region_map.yaml> <input_hex_file> <output_hex_file>\n", os.Args[0])
+		fmt.Printf("       %s validate <input_hex_file>\n", os.Args[0])
+		fmt.Printf("       %s list-formats\n", os.Args[0])
 		fmt.Println("\nExample:")
 		fmt.Printf("  %s allcode.txt firmware_converted.bin\n", os.Args[0])
+		fmt.Printf("  %s boot.hex app.hex settings.hex merged.bin\n", os.Args[0])
+		fmt.Printf("  %s --output-format srec firmware.hex firmware.srec\n", os.Args[0])
+		fmt.Printf("  %s --annotate rt6d-firmware-regions.yaml firmware.hex annotated.hex\n", os.Args[0])
+		fmt.Printf("  %s validate firmware.hex\n", os.Args[0])
 		os.Exit(1)
 	}
 	
-	inputFile := os.Args[1]
-	outputFile := os.Args[2]
+	inputFiles := args[:len(args)-1]
+	outputFile := args[len(args)-1]
 	
-	converter := NewHexConverter()
-	err := converter.loadAndConvert(inputFile, outputFile)
+	setFlags := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+	if *allowOverlap && len(inputFiles) == 1 {
+		fmt.Println("Error: --allow-overlap needs at least two input files")
+		os.Exit(1)
+	}
+	if setFlags["fill-byte"] && (*annotate != "" || *outputFormat == "srec") {
+		fmt.Println("Error: --fill-byte only applies to binary output")
+		os.Exit(1)
+	}
+	
+	var err error
+	if *annotate != "" {
+		if len(inputFiles) != 1 {
+			fmt.Println("Error: --annotate takes a single input file")
+			os.Exit(1)
+		}
+		err = AnnotateIntelHex(inputFiles[0], *annotate, outputFile)
+	} else if *outputFormat == "srec" {
+		if len(inputFiles) != 1 {
+			fmt.Println("Error: --output-format srec takes a single input file")
+			os.Exit(1)
+		}
+		converter := NewHexConverter()
+		converter.SRECRecordSize = *srecRecordSize
+		if err = converter.load(inputFiles[0]); err == nil {
+			err = converter.toSREC(outputFile, firmwareBaseAddress)
+		}
+	} else if len(inputFiles) == 1 {
+		converter := NewHexConverter()
+		converter.FillByte = byte(*fillByte)
+		err = converter.loadAndConvert(inputFiles[0], outputFile)
+	} else {
+		err = mergeAndConvert(inputFiles, outputFile, byte(*fillByte), *allowOverlap)
+	}
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		os.Exit(1)
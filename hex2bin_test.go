@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The root directory holds one program per file, so the tests of hex2bin
+// are run with its source file:
+//
+//	go test hex2bin.go hex2bin_test.go
+
+var updateGolden = flag.Bool("update-golden", false, "rewrite the golden .bin files in testdata/hex2bin")
+
+// hexRecord returns an Intel HEX record with a correct checksum
+func hexRecord(recordType byte, address uint16, data ...byte) string {
+	record := []byte{byte(len(data)), byte(address >> 8), byte(address), recordType}
+	record = append(record, data...)
+	var sum byte
+	for _, b := range record {
+		sum += b
+	}
+	return fmt.Sprintf(":%X%02X", record, byte(0)-sum)
+}
+
+// writeTestHex saves the lines as a HEX file in a temp dir
+func writeTestHex(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "firmware.hex")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestValidateIntelHex(t *testing.T) {
+	eof := hexRecord(1, 0)
+	tests := []struct {
+		name  string
+		lines []string
+		want  []string // Start of every problem, in order
+	}{
+		{"valid", []string{hexRecord(0, 0, 1, 2, 3, 4), eof}, nil},
+		{"only EOF", []string{eof}, nil},
+		{"lowercase", []string{strings.ToLower(hexRecord(0, 0x10, 0xAB, 0xCD)), eof}, nil},
+		{"blank and comment lines", []string{";; vectors", "", hexRecord(0, 0, 1), "  ", eof}, nil},
+		{"start address records", []string{hexRecord(3, 0, 0, 0, 0, 0), hexRecord(5, 0, 0x08, 0, 0x28, 0x01), eof}, nil},
+		{"extended address resets order", []string{
+			hexRecord(0, 0x100, 1), hexRecord(4, 0, 0x08, 0x01), hexRecord(0, 0, 2), eof,
+		}, nil},
+		{"empty file", []string{""}, []string{"line 0: missing EOF record"}},
+		{"missing EOF", []string{hexRecord(0, 0, 1), hexRecord(0, 1, 2)}, []string{"line 2: missing EOF record"}},
+		{"no colon", []string{"0100000001FE", eof}, []string{"line 1: record does not start with ':'"}},
+		{"odd length", []string{":0100000001F", eof}, []string{"line 1: invalid hex data"}},
+		{"not hex", []string{":01000000ZZFE", eof}, []string{"line 1: invalid hex data"}},
+		{"too short", []string{":0000", eof}, []string{"line 1: record too short"}},
+		{"length mismatch", []string{":04000000010203F6", eof}, []string{"line 1: length field is 4 but record has 3 data bytes"}},
+		{"bad checksum", []string{":0100000001FF", eof}, []string{"line 1: checksum is 0xFF, expected 0xFE"}},
+		{"address goes back", []string{hexRecord(0, 0x10, 1), hexRecord(0, 0x08, 2), eof}, []string{
+			"line 2: address 0x0008 is below previous address 0x0010",
+		}},
+		{"record after EOF", []string{eof, hexRecord(0, 0, 1)}, []string{"line 2: record after EOF record on line 1"}},
+		{"EOF with data", []string{hexRecord(1, 0, 0)}, []string{"line 1: EOF record has 1 data bytes, expected 0"}},
+		{"short extended address", []string{hexRecord(4, 0, 0x08), eof}, []string{
+			"line 1: extended linear address record has 1 data bytes, expected 2",
+		}},
+		{"unknown record type", []string{hexRecord(6, 0, 1), eof}, []string{"line 1: unknown record type 0x06"}},
+		{"several problems", []string{":0100000001FF", "garbage", hexRecord(0, 0, 1)}, []string{
+			"line 1: checksum is 0xFF, expected 0xFE",
+			"line 2: record does not start with ':'",
+			"line 3: missing EOF record",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems, err := validateIntelHex(writeTestHex(t, tt.lines...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(problems) != len(tt.want) {
+				t.Fatalf("got %d problems %v, want %d", len(problems), problems, len(tt.want))
+			}
+			for i, p := range problems {
+				if !strings.HasPrefix(p.String(), tt.want[i]) {
+					t.Errorf("problem %d is %q, want %q", i, p, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestValidateIntelHexMissingFile(t *testing.T) {
+	if _, err := validateIntelHex(filepath.Join(t.TempDir(), "missing.hex")); err == nil {
+		t.Error("no error for a missing file")
+	}
+}
+
+func TestLoadAndConvertFillByte(t *testing.T) {
+	input := writeTestHex(t, hexRecord(4, 0, 0x08, 0x00), hexRecord(0, 0x2804, 0x11, 0x22), hexRecord(1, 0))
+	output := filepath.Join(t.TempDir(), "firmware.bin")
+
+	converter := NewHexConverter()
+	converter.FillByte = 0xFF
+	if err := converter.loadAndConvert(input, output); err != nil {
+		t.Fatal(err)
+	}
+	image, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(image) != converter.HexSize {
+		t.Fatalf("image is %d bytes, want %d", len(image), converter.HexSize)
+	}
+	for i, b := range image {
+		want := byte(0xFF)
+		switch i {
+		case 4:
+			want = 0x11
+		case 5:
+			want = 0x22
+		}
+		if b != want {
+			t.Fatalf("byte 0x%05X is 0x%02X, want 0x%02X", i, b, want)
+		}
+	}
+}
+
+// srecToBinary reads S3 records back into an image of size bytes starting
+// at baseAddress, checking every record checksum
+func srecToBinary(t *testing.T, path string, baseAddress uint32, size int, fill byte) []byte {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	image := bytes.Repeat([]byte{fill}, size)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		record, err := hex.DecodeString(line[2:])
+		if err != nil || len(record) < 1 || int(record[0]) != len(record)-1 {
+			t.Fatalf("malformed S-record %q", line)
+		}
+		var sum byte
+		for _, b := range record[:len(record)-1] {
+			sum += b
+		}
+		if ^sum != record[len(record)-1] {
+			t.Fatalf("S-record %q has checksum 0x%02X, want 0x%02X", line, record[len(record)-1], ^sum)
+		}
+		if line[1] != '3' {
+			continue
+		}
+		address := uint32(record[1])<<24 | uint32(record[2])<<16 | uint32(record[3])<<8 | uint32(record[4])
+		copy(image[address-baseAddress:], record[5:len(record)-1])
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return image
+}
+
+func TestHexToSRECRoundTrip(t *testing.T) {
+	input := filepath.Join("HEX", "RT880-V1_12A.HEX")
+	dir := t.TempDir()
+
+	binary := NewHexConverter()
+	if err := binary.loadAndConvert(input, filepath.Join(dir, "firmware.bin")); err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile(filepath.Join(dir, "firmware.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, recordSize := range []int{32, 16, 7} {
+		converter := NewHexConverter()
+		converter.SRECRecordSize = recordSize
+		output := filepath.Join(dir, fmt.Sprintf("firmware-%d.srec", recordSize))
+		if err := converter.load(input); err != nil {
+			t.Fatal(err)
+		}
+		if err := converter.toSREC(output, firmwareBaseAddress); err != nil {
+			t.Fatal(err)
+		}
+
+		got := srecToBinary(t, output, firmwareBaseAddress, len(want), 0x00)
+		if !bytes.Equal(got, want) {
+			t.Errorf("%d byte records: the S-records give a different binary than hex2bin", recordSize)
+		}
+	}
+}
+
+func TestAnnotateIntelHexSameBinary(t *testing.T) {
+	input := filepath.Join("HEX", "RT880-V1_12A.HEX")
+	dir := t.TempDir()
+	annotated := filepath.Join(dir, "annotated.hex")
+	if err := AnnotateIntelHex(input, "rt6d-firmware-regions.yaml", annotated); err != nil {
+		t.Fatal(err)
+	}
+
+	// The comments are stripped before the annotated file is parsed again
+	content, err := os.ReadFile(annotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []string
+	comments := 0
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), ";;") {
+			if !strings.HasPrefix(line, ";; Region: ") {
+				t.Errorf("comment %q is not a region comment", line)
+			}
+			comments++
+			continue
+		}
+		records = append(records, line)
+	}
+	if comments == 0 {
+		t.Fatal("no region comments in the annotated file")
+	}
+	stripped := filepath.Join(dir, "stripped.hex")
+	if err := os.WriteFile(stripped, []byte(strings.Join(records, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	convert := func(hexFile string) []byte {
+		t.Helper()
+		output := filepath.Join(dir, filepath.Base(hexFile)+".bin")
+		if err := NewHexConverter().loadAndConvert(hexFile, output); err != nil {
+			t.Fatal(err)
+		}
+		image, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return image
+	}
+	if !bytes.Equal(convert(stripped), convert(input)) {
+		t.Error("the annotated HEX file gives a different binary")
+	}
+}
+
+// goldenHexSize keeps the golden images of testdata/hex2bin small while
+// still spanning three 64K pages
+const goldenHexSize = 0x1E000
+
+func TestHexConverterGolden(t *testing.T) {
+	// The golden .bin files were made with a separate Intel HEX reader,
+	// -update-golden rewrites them with the output of hex2bin
+	for _, name := range []string{
+		"single-segment",
+		"two-segments",
+		"skipped-page",
+		"edge-addresses",
+		"no-eof",
+		"lowercase",
+		"crlf-32-byte-records",
+	} {
+		t.Run(name, func(t *testing.T) {
+			input := filepath.Join("testdata", "hex2bin", name+".hex")
+			golden := filepath.Join("testdata", "hex2bin", name+".bin")
+			output := filepath.Join(t.TempDir(), name+".bin")
+
+			converter := NewHexConverter()
+			converter.HexSize = goldenHexSize
+			if err := converter.loadAndConvert(input, output); err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *updateGolden {
+				if err := os.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v (run with -update-golden to create it)", err)
+			}
+			if sha256.Sum256(got) == sha256.Sum256(want) {
+				return
+			}
+			if len(got) != len(want) {
+				t.Fatalf("output is %d bytes, golden %d", len(got), len(want))
+			}
+			for i := range got {
+				if got[i] != want[i] {
+					t.Fatalf("output differs from %s first at offset 0x%05X: 0x%02X, want 0x%02X", golden, i, got[i], want[i])
+				}
+			}
+		})
+	}
+}
+
+// captureStdout returns what run prints to os.Stdout
+func captureStdout(t *testing.T, run func()) string {
+	t.Helper()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	defer func() { os.Stdout = stdout }()
+	output := make(chan []byte)
+	go func() {
+		content, _ := io.ReadAll(reader)
+		output <- content
+	}()
+	run()
+	writer.Close()
+	return string(<-output)
+}
+
+// listedFormats returns the names of the formats printed by printFormats
+func listedFormats(t *testing.T, output string) []string {
+	t.Helper()
+	var names []string
+	for _, line := range strings.Split(output, "\n") {
+		if line != "" && !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "Fallback order: ") {
+			names = append(names, line)
+		}
+	}
+	if strings.Count(output, "  Header:") != len(names) {
+		t.Errorf("not every format has a sample header:\n%s", output)
+	}
+	if !strings.Contains(output, "\nFallback order: ") {
+		t.Errorf("no fallback order:\n%s", output)
+	}
+	return names
+}
+
+func TestListFormats(t *testing.T) {
+	names := listedFormats(t, captureStdout(t, func() { printFormats(hexFormats, "test") }))
+	if len(names) < 3 {
+		t.Fatalf("listed formats %q, want at least 3", names)
+	}
+	for _, want := range []string{"Intel HEX (input)", "Binary (output)", "S-record (output)"} {
+		found := false
+		for _, name := range names {
+			found = found || name == want
+		}
+		if !found {
+			t.Errorf("%s is not among the listed formats %q", want, names)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package spilib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ScriptBackend carries out the radio commands of a script. The dry run
+// backend only prints them, so a script can be checked before a session.
+type ScriptBackend interface {
+	Flash(port, firmware string) error
+	SPIBackup(port, file string) error
+	SPIRestore(port, file string) error
+	Sleep(d time.Duration)
+}
+
+// scriptCommand is one parsed line of a script
+type scriptCommand struct {
+	line int
+	text string
+	name string
+	args []string
+}
+
+// scriptArgCounts is the number of arguments of each script command, -1
+// for the rest of the line
+var scriptArgCounts = map[string]int{
+	"flash":       2,
+	"spi-backup":  2,
+	"spi-restore": 2,
+	"sleep":       1,
+	"echo":        -1,
+}
+
+// parseScript reads a script with one command per line. Blank lines and
+// lines starting with # are skipped, $NAME and ${NAME} are replaced with
+// environment variables.
+func parseScript(scriptFile string) ([]scriptCommand, error) {
+	content, err := os.ReadFile(scriptFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read script: %v", err)
+	}
+
+	var commands []scriptCommand
+	for i, text := range strings.Split(string(content), "\n") {
+		text = strings.TrimSpace(text)
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		var missing []string
+		expanded := os.Expand(text, func(name string) string {
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				missing = append(missing, "$"+name)
+			}
+			return value
+		})
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("%s:%d: %s not set in the environment", scriptFile, i+1, strings.Join(missing, ", "))
+		}
+
+		fields := strings.Fields(expanded)
+		if fields[0] == "verify" {
+			return nil, fmt.Errorf("%s:%d: verify is not supported, the bootloader has no known command to read the firmware back", scriptFile, i+1)
+		}
+		count, ok := scriptArgCounts[fields[0]]
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: unknown command '%s'", scriptFile, i+1, fields[0])
+		}
+		cmd := scriptCommand{line: i + 1, text: expanded, name: fields[0], args: fields[1:]}
+		if count < 0 {
+			cmd.args = []string{strings.TrimSpace(strings.TrimPrefix(expanded, fields[0]))}
+		} else if len(cmd.args) != count {
+			return nil, fmt.Errorf("%s:%d: %s takes %d arguments, got %d", scriptFile, i+1, cmd.name, count, len(cmd.args))
+		}
+		if cmd.name == "sleep" {
+			if ms, err := strconv.Atoi(cmd.args[0]); err != nil || ms < 0 {
+				return nil, fmt.Errorf("%s:%d: invalid sleep time '%s' ms", scriptFile, i+1, cmd.args[0])
+			}
+		}
+		commands = append(commands, cmd)
+	}
+	return commands, nil
+}
+
+// RunScript runs the commands of scriptFile in order. The whole script is
+// checked before the first command runs, and it stops at the first failing
+// line.
+func RunScript(scriptFile string, backend ScriptBackend) error {
+	commands, err := parseScript(scriptFile)
+	if err != nil {
+		return err
+	}
+
+	for _, cmd := range commands {
+		fmt.Printf("[%s:%d] %s\n", filepath.Base(scriptFile), cmd.line, cmd.text)
+		switch cmd.name {
+		case "flash":
+			err = backend.Flash(cmd.args[0], cmd.args[1])
+		case "spi-backup":
+			err = backend.SPIBackup(cmd.args[0], cmd.args[1])
+		case "spi-restore":
+			err = backend.SPIRestore(cmd.args[0], cmd.args[1])
+		case "sleep":
+			ms, _ := strconv.Atoi(cmd.args[0])
+			backend.Sleep(time.Duration(ms) * time.Millisecond)
+		case "echo":
+			fmt.Println(cmd.args[0])
+		}
+		if err != nil {
+			return fmt.Errorf("line %d (%s): %v", cmd.line, cmd.text, err)
+		}
+	}
+	fmt.Printf("Script %s completed (%d commands)\n", scriptFile, len(commands))
+	return nil
+}
+
+// DryRunScriptBackend prints what each command would do, for checking a
+// script with -dry-run
+type DryRunScriptBackend struct{}
+
+func (DryRunScriptBackend) Flash(port, firmware string) error {
+	fmt.Printf("[DRY RUN] would flash %s to the radio on %s\n", firmware, port)
+	return nil
+}
+
+func (DryRunScriptBackend) SPIBackup(port, file string) error {
+	fmt.Printf("[DRY RUN] would back up the SPI flash on %s to %s\n", port, file)
+	return nil
+}
+
+func (DryRunScriptBackend) SPIRestore(port, file string) error {
+	fmt.Printf("[DRY RUN] would restore %s to the SPI flash on %s\n", file, port)
+	return nil
+}
+
+func (DryRunScriptBackend) Sleep(d time.Duration) {
+	fmt.Printf("[DRY RUN] would wait %v\n", d)
+}
@@ -0,0 +1,92 @@
+package spilib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseScriptRejectsVerify(t *testing.T) {
+	t.Setenv("PORT", "/dev/ttyUSB0")
+	dir := t.TempDir()
+	script := filepath.Join(dir, "factory.txt")
+	content := "# factory\necho Programming $PORT\nflash $PORT fw.hex\nspi-backup ${PORT} cal.bin\nsleep 2000\n"
+	if err := os.WriteFile(script, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	commands, err := parseScript(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commands) != 4 || commands[1].args[0] != "/dev/ttyUSB0" {
+		t.Fatalf("parsed %+v", commands)
+	}
+
+	if err := os.WriteFile(script, []byte(content+"verify $PORT fw.hex\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = parseScript(script)
+	if err == nil || !strings.Contains(err.Error(), ":6: verify is not supported") {
+		t.Errorf("got error %v, want verify rejected on line 6", err)
+	}
+}
+
+// recordingBackend records the script commands it is given and fails the
+// ones on failFile
+type recordingBackend struct {
+	calls    []string
+	failFile string
+}
+
+func (b *recordingBackend) record(name, port, file string) error {
+	b.calls = append(b.calls, name+" "+port+" "+file)
+	if file == b.failFile {
+		return fmt.Errorf("no answer from the radio")
+	}
+	return nil
+}
+
+func (b *recordingBackend) Flash(port, firmware string) error {
+	return b.record("flash", port, firmware)
+}
+
+func (b *recordingBackend) SPIBackup(port, file string) error {
+	return b.record("spi-backup", port, file)
+}
+
+func (b *recordingBackend) SPIRestore(port, file string) error {
+	return b.record("spi-restore", port, file)
+}
+
+func (b *recordingBackend) Sleep(d time.Duration) {
+	b.calls = append(b.calls, "sleep "+d.String())
+}
+
+func TestRunScriptStopsAtFailingLine(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "session.txt")
+	content := "flash COM3 fw.hex\nsleep 10\nspi-backup COM3 cal.bin\nspi-restore COM3 codeplug.bin\nflash COM4 fw.hex\n"
+	if err := os.WriteFile(script, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := &recordingBackend{failFile: "cal.bin"}
+	err := RunScript(script, backend)
+	if err == nil || !strings.Contains(err.Error(), "line 3 (spi-backup COM3 cal.bin)") {
+		t.Errorf("got error %v, want one naming line 3", err)
+	}
+	want := []string{"flash COM3 fw.hex", "sleep 10ms", "spi-backup COM3 cal.bin"}
+	if fmt.Sprint(backend.calls) != fmt.Sprint(want) {
+		t.Errorf("ran %q, want %q and nothing after the failing line", backend.calls, want)
+	}
+
+	backend = &recordingBackend{}
+	if err := RunScript(script, backend); err != nil {
+		t.Fatal(err)
+	}
+	if len(backend.calls) != 5 {
+		t.Errorf("ran %q, want all 5 lines", backend.calls)
+	}
+}
@@ -0,0 +1,962 @@
+// Package spilib talks to the radio in normal mode to read, write and erase
+// its SPI flash. It is shared by spi-tool and spi-flash, which only differ
+// in the flash size they dump and the checksum of their commands, and by
+// rt6d-flasher for its backup before flashing. It also runs the scripts of
+// rt6d-flasher and spi-tool.
+package spilib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+const (
+	CHUNK_SIZE          = 1024
+	SPI_FLASH_SIZE      = 4 * 1024 * 1024  // 4MB typical SPI flash size
+	SPI_FLASH_FULL_SIZE = 32 * 1024 * 1024 // 32MB full SPI flash size
+
+	// Read responses and write commands: 3 header bytes, a block of data
+	// and the checksum
+	PACKET_SIZE = 3 + CHUNK_SIZE + 1
+)
+
+// SPI Commands based on the Rust code
+const (
+	CMD_READ_SPI_FLASH  = 0x52
+	CMD_WRITE_SPI_FLASH = 0x57
+
+	// TODO: the sector erase command has not been confirmed on a radio yet.
+	// 0x45 ('E') follows the letter scheme of read (0x52 'R') and write
+	// (0x57 'W'): 0x45, address bits 23-16, 15-8, 7-0 and the checksum,
+	// answered with a single ACK (0x06) once the sector is erased.
+	CMD_ERASE_SPI_SECTOR = 0x45
+)
+
+const (
+	SPI_SECTOR_SIZE   = 4096
+	SPI_ERASE_TIMEOUT = 30 * time.Second // Sector erase can take much longer than a write
+)
+
+const (
+	portReadTimeout = 2 * time.Second        // Read timeout set by Connect
+	retryDelay      = 100 * time.Millisecond // Before the first read retry, doubled for every further one
+)
+
+// blockReadTimeout is how long ReadBlock waits for a complete response
+var blockReadTimeout = 3 * time.Second
+
+// SPI Write Commands for different ranges
+const (
+	CMD_WRITE_SPI_0x40 = 0x40 // Range 0-2949119
+	CMD_WRITE_SPI_0x41 = 0x41 // Range 2949120-3112959
+	CMD_WRITE_SPI_0x42 = 0x42 // Range 3112960-3252223
+	CMD_WRITE_SPI_0x43 = 0x43 // Range 3252224-3260415
+	CMD_WRITE_SPI_0x47 = 0x47 // Range 3887104-3928063
+	CMD_WRITE_SPI_0x48 = 0x48 // Range 3928064-3932159 (Calibration)
+	CMD_WRITE_SPI_0x49 = 0x49 // Range 3936256-3977215
+	CMD_WRITE_SPI_0x4B = 0x4B // Range 4030464-4071423
+	CMD_WRITE_SPI_0x4C = 0x4C // Range 3260416-3887103
+)
+
+// Byte offsets and sizes of the ranges of the CMD_WRITE_SPI_* commands
+const (
+	SPI_RANGE_0x40_OFFSET = 0
+	SPI_RANGE_0x40_SIZE   = 2949120
+	SPI_RANGE_0x41_OFFSET = 2949120
+	SPI_RANGE_0x41_SIZE   = 163840
+	SPI_RANGE_0x42_OFFSET = 3112960
+	SPI_RANGE_0x42_SIZE   = 139264
+	SPI_RANGE_0x43_OFFSET = 3252224
+	SPI_RANGE_0x43_SIZE   = 8192
+	SPI_RANGE_0x4C_OFFSET = 3260416
+	SPI_RANGE_0x4C_SIZE   = 626688
+	SPI_RANGE_0x47_OFFSET = 3887104
+	SPI_RANGE_0x47_SIZE   = 40960
+	SPI_RANGE_0x48_OFFSET = 3928064
+	SPI_RANGE_0x48_SIZE   = 4096
+	SPI_RANGE_0x49_OFFSET = 3936256
+	SPI_RANGE_0x49_SIZE   = 40960
+	SPI_RANGE_0x4B_OFFSET = 4030464
+	SPI_RANGE_0x4B_SIZE   = 40960
+)
+
+// SPIRange is the part of the SPI flash written with command cmd
+type SPIRange struct {
+	cmd    byte
+	offset uint32
+	size   uint32
+}
+
+// writeRanges lists the SPI flash ranges by offset. Blocks outside of
+// them are written with CMD_WRITE_SPI_FLASH.
+var writeRanges = []SPIRange{
+	{CMD_WRITE_SPI_0x40, SPI_RANGE_0x40_OFFSET, SPI_RANGE_0x40_SIZE},
+	{CMD_WRITE_SPI_0x41, SPI_RANGE_0x41_OFFSET, SPI_RANGE_0x41_SIZE},
+	{CMD_WRITE_SPI_0x42, SPI_RANGE_0x42_OFFSET, SPI_RANGE_0x42_SIZE},
+	{CMD_WRITE_SPI_0x43, SPI_RANGE_0x43_OFFSET, SPI_RANGE_0x43_SIZE},
+	{CMD_WRITE_SPI_0x4C, SPI_RANGE_0x4C_OFFSET, SPI_RANGE_0x4C_SIZE},
+	{CMD_WRITE_SPI_0x47, SPI_RANGE_0x47_OFFSET, SPI_RANGE_0x47_SIZE},
+	{CMD_WRITE_SPI_0x48, SPI_RANGE_0x48_OFFSET, SPI_RANGE_0x48_SIZE},
+	{CMD_WRITE_SPI_0x49, SPI_RANGE_0x49_OFFSET, SPI_RANGE_0x49_SIZE},
+	{CMD_WRITE_SPI_0x4B, SPI_RANGE_0x4B_OFFSET, SPI_RANGE_0x4B_SIZE},
+}
+
+// selectWriteCommand returns the write command for the range holding
+// block blockNum of blockSize bytes
+func selectWriteCommand(blockNum uint16, blockSize int) byte {
+	addr := uint32(blockNum) * uint32(blockSize)
+	for _, r := range writeRanges {
+		if addr >= r.offset && addr-r.offset < r.size {
+			return r.cmd
+		}
+	}
+	return CMD_WRITE_SPI_FLASH
+}
+
+// SPIClient is a connection to the radio for SPI flash access
+type SPIClient struct {
+	Port           serial.Port
+	FlashSize      uint32        // Bytes read by Dump
+	ChecksumOffset byte          // Added to the checksum of every command, 82 for the spi-flash protocol
+	StrictChecksum bool          // Fail reads with a bad checksum instead of accepting a valid header
+	BlockDelay     time.Duration // Pause after every block read by Dump
+	ReadDelay      time.Duration // Pause between a read command and its answer, 50 ms by NewSPIClient
+	Quiet          bool          // Don't print the packets of every block, for callers with their own progress line
+	ReadInterval   time.Duration // Minimum time between the starts of two block reads by Dump, 0 for no limit
+
+	// FlushBufferOnRetry drops the bytes waiting on the port before a read
+	// is retried, so a late answer to the failed read isn't taken for the
+	// answer to the retry. Set by NewSPIClient.
+	FlushBufferOnRetry bool
+
+	// CRC16, if set, replaces the byte sum checksum of commands and
+	// responses. Packets then end in 2 checksum bytes, high byte first,
+	// and are one byte longer than ResponseSize and CommandSize.
+	CRC16 func(data []byte) uint16
+
+	// Packet sizes including the 3 header bytes and the checksum,
+	// PACKET_SIZE by default. Radio variants with other block sizes
+	// exchange ResponseSize-4 and CommandSize-4 data bytes per block.
+	ResponseSize int
+	CommandSize  int
+
+	restoreLatency func() // Puts back the USB latency timer changed by Connect
+}
+
+// NewSPIClient returns a client for a flash of flashSize bytes
+func NewSPIClient(flashSize uint32, checksumOffset byte) *SPIClient {
+	return &SPIClient{
+		FlashSize:          flashSize,
+		ChecksumOffset:     checksumOffset,
+		ReadDelay:          50 * time.Millisecond,
+		ResponseSize:       PACKET_SIZE,
+		CommandSize:        PACKET_SIZE,
+		FlushBufferOnRetry: true,
+	}
+}
+
+// checksumSize is the number of checksum bytes at the end of a packet
+func (c *SPIClient) checksumSize() int {
+	if c.CRC16 != nil {
+		return 2
+	}
+	return 1
+}
+
+// setChecksum stores the checksum of a command in its last byte, or its
+// last 2 bytes with CRC16
+func (c *SPIClient) setChecksum(command []byte) {
+	if c.CRC16 != nil {
+		binary.BigEndian.PutUint16(command[len(command)-2:], c.CRC16(command[:len(command)-2]))
+		return
+	}
+	var sum byte = 0
+	for _, b := range command[:len(command)-1] {
+		sum += b
+	}
+	command[len(command)-1] = sum + c.ChecksumOffset
+}
+
+// responseChecksum returns the checksum a response should end in and the
+// one it ends in
+func (c *SPIClient) responseChecksum(block []byte) (expected, got uint16) {
+	if c.CRC16 != nil {
+		last := len(block) - 2
+		return c.CRC16(block[:last]), binary.BigEndian.Uint16(block[last:])
+	}
+	var sum byte = 0
+	for _, b := range block[:len(block)-1] {
+		sum += b
+	}
+	return uint16(sum), uint16(block[len(block)-1])
+}
+
+// verifyResponse checks the checksum at the end of a response
+func (c *SPIClient) verifyResponse(block []byte) bool {
+	if c.CRC16 == nil {
+		return VerifyChecksum(block)
+	}
+	expected, got := c.responseChecksum(block)
+	return expected == got
+}
+
+// VerifyChecksum checks the last byte of a response, the plain sum of the
+// bytes before it
+func VerifyChecksum(data []byte) bool {
+	if len(data) < 1 {
+		return false
+	}
+
+	lastIdx := len(data) - 1
+	var calculatedSum byte = 0
+
+	// Solo sumar los bytes de datos, no el checksum
+	for _, b := range data[:lastIdx] {
+		calculatedSum += b
+	}
+
+	return data[lastIdx] == calculatedSum
+}
+
+// ReadBlock reads block blockNum of the SPI flash, ResponseSize-4 bytes
+func (c *SPIClient) ReadBlock(blockNum uint16) ([]byte, error) {
+	if c.ResponseSize < 5 {
+		return nil, fmt.Errorf("response size must be at least 5 bytes, got %d", c.ResponseSize)
+	}
+
+	command := make([]byte, 3+c.checksumSize())
+	command[0] = CMD_READ_SPI_FLASH
+	command[1] = byte((blockNum >> 8) & 0xFF) // High byte del número de bloque
+	command[2] = byte(blockNum & 0xFF)        // Low byte del número de bloque
+	c.setChecksum(command)
+
+	c.logf("TX (read SPI flash block %d): ", blockNum)
+	c.logHex(command)
+
+	_, err := c.Port.Write(command)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write read command: %v", err)
+	}
+
+	// Añadir delay después del envío
+	time.Sleep(c.ReadDelay)
+
+	// Read response block (3 header + data + 1 or 2 checksum bytes)
+	block := make([]byte, c.ResponseSize-1+c.checksumSize())
+
+	// Try to read the complete response with timeout
+	totalRead := 0
+	startTime := time.Now()
+
+	for totalRead < len(block) {
+		if time.Since(startTime) > blockReadTimeout {
+			return nil, fmt.Errorf("timeout reading response after %v (got %d bytes)", blockReadTimeout, totalRead)
+		}
+
+		n, err := c.Port.Read(block[totalRead:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response at byte %d: %v", totalRead, err)
+		}
+
+		if n > 0 {
+			totalRead += n
+			c.logf("Read %d bytes, total: %d/%d\r", n, totalRead, len(block))
+		} else {
+			// No data available, small delay
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	c.logf("\nRX (read SPI flash, %d bytes): ", totalRead)
+	c.logHex(block[:min(16, len(block))]) // Print first 16 bytes for debugging
+	c.logf("...\n")
+
+	// Check if this looks like a valid SPI response (header matches command)
+	if block[0] != CMD_READ_SPI_FLASH || block[1] != command[1] || block[2] != command[2] {
+		return nil, fmt.Errorf("invalid SPI response header: got %02X %02X %02X, expected %02X %02X %02X",
+			block[0], block[1], block[2], CMD_READ_SPI_FLASH, command[1], command[2])
+	}
+	c.logf("Valid SPI response header detected\n")
+
+	// Verify checksum - if fails, try reading again (like in Rust code)
+	if !c.verifyResponse(block) {
+		c.logf("Checksum failed, trying second read...\n")
+
+		// Try reading again
+		_, err = c.Port.Read(block)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read second response: %v", err)
+		}
+
+		c.logf("RX (second read, %d bytes): ", len(block))
+		c.logHex(block[:min(16, len(block))])
+		c.logf("...\n")
+	}
+
+	last := len(block) - c.checksumSize()
+	if !c.verifyResponse(block) {
+		// Calculate what checksum should be
+		expected, got := c.responseChecksum(block)
+		digits := 2 * c.checksumSize()
+		if c.StrictChecksum {
+			return nil, fmt.Errorf("checksum mismatch: expected 0x%0*X, got 0x%0*X", digits, expected, digits, got)
+		}
+
+		// The header is correct, accept it anyway (SPI may be all FF)
+		c.logf("Checksum verification failed but header is valid - accepting response\n")
+		c.logf("Calculated checksum for debug: ")
+		c.logf("Expected: 0x%0*X, Got: 0x%0*X\n", digits, expected, digits, got)
+	}
+
+	// Extract data (skip 3 header bytes and the checksum)
+	data := make([]byte, last-3)
+	copy(data, block[3:last])
+
+	return data, nil
+}
+
+// WriteBlock writes CommandSize-4 bytes to block blockNum of the SPI flash
+func (c *SPIClient) WriteBlock(blockNum uint16, data []byte) error {
+	if len(data) != c.CommandSize-4 {
+		return fmt.Errorf("data must be exactly %d bytes, got %d", c.CommandSize-4, len(data))
+	}
+
+	command := make([]byte, c.CommandSize-1+c.checksumSize())
+	command[0] = selectWriteCommand(blockNum, c.CommandSize-4)
+	command[1] = byte((blockNum >> 8) & 0xFF) // High byte del número de bloque
+	command[2] = byte(blockNum & 0xFF)        // Low byte del número de bloque
+	copy(command[3:len(command)-c.checksumSize()], data)
+	c.setChecksum(command)
+
+	fmt.Printf("TX (write SPI flash block %d, command 0x%02X): ", blockNum, command[0])
+	PrintHex(command[:16])
+	fmt.Println("...")
+
+	_, err := c.Port.Write(command)
+	if err != nil {
+		return fmt.Errorf("failed to write command: %v", err)
+	}
+
+	// Añadir delay después del envío
+	time.Sleep(100 * time.Millisecond) // Longer delay for write operations
+
+	response, err := c.readResponse("write", 5*time.Second) // Longer timeout for writes
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("RX (write SPI flash): ")
+	PrintHex([]byte{response})
+
+	switch response {
+	case 0x06: // ACK
+		return nil
+	default:
+		return fmt.Errorf("device rejected write command, response: 0x%02X", response)
+	}
+}
+
+// EraseSector erases the 4096 byte sector starting at sectorAddr so all its
+// bytes read 0xFF
+func (c *SPIClient) EraseSector(sectorAddr uint32) error {
+	if sectorAddr%SPI_SECTOR_SIZE != 0 {
+		return fmt.Errorf("sector address 0x%06X is not aligned to %d bytes", sectorAddr, SPI_SECTOR_SIZE)
+	}
+
+	command := make([]byte, 4+c.checksumSize())
+	command[0] = CMD_ERASE_SPI_SECTOR
+	command[1] = byte(sectorAddr >> 16)
+	command[2] = byte(sectorAddr >> 8)
+	command[3] = byte(sectorAddr)
+	c.setChecksum(command)
+
+	fmt.Printf("TX (erase SPI sector 0x%06X): ", sectorAddr)
+	PrintHex(command)
+
+	_, err := c.Port.Write(command)
+	if err != nil {
+		return fmt.Errorf("failed to write erase command: %v", err)
+	}
+
+	response, err := c.readResponse("erase", SPI_ERASE_TIMEOUT)
+	if err != nil {
+		return err
+	}
+
+	switch response {
+	case 0x06: // ACK
+		return nil
+	default:
+		return fmt.Errorf("device rejected erase command, response: 0x%02X", response)
+	}
+}
+
+// readResponse waits up to timeout for the one byte answer to a write or
+// erase command
+func (c *SPIClient) readResponse(command string, timeout time.Duration) (byte, error) {
+	response := make([]byte, 1)
+	startTime := time.Now()
+	for {
+		if time.Since(startTime) > timeout {
+			return 0, fmt.Errorf("timeout waiting for %s response after %v", command, timeout)
+		}
+
+		n, err := c.Port.Read(response)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read response: %v", err)
+		}
+
+		if n > 0 {
+			return response[0], nil
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// logf prints the details of a block read unless Quiet is set
+func (c *SPIClient) logf(format string, args ...interface{}) {
+	if !c.Quiet {
+		fmt.Printf(format, args...)
+	}
+}
+
+// logHex is PrintHex unless Quiet is set
+func (c *SPIClient) logHex(data []byte) {
+	if !c.Quiet {
+		PrintHex(data)
+	}
+}
+
+// ReadBlockWithRetry reads one block, retrying up to 3 times after 100,
+// 200 and 400 ms
+func (c *SPIClient) ReadBlockWithRetry(block int) ([]byte, error) {
+	maxRetries := 3
+	delay := retryDelay
+
+	for retries := 0; ; retries++ {
+		result, err := c.ReadBlock(uint16(block))
+		if err == nil {
+			c.logf("\rDumping SPI flash from address %#06x", block*1024)
+			return result, nil
+		}
+
+		if retries == maxRetries {
+			fmt.Printf("\nFailed after %d retries at block %d: %v\n", maxRetries, block, err)
+			fmt.Println("Make sure the radio is ON and in normal mode (not programming mode).")
+			return nil, fmt.Errorf("failed to read block %d: %v", block, err)
+		}
+		fmt.Printf("\rTimeout at %#06x, retrying in %v (%d/%d)", block*1024, delay, retries+1, maxRetries)
+		time.Sleep(delay)
+		if c.FlushBufferOnRetry {
+			c.flushInput()
+		}
+		delay *= 2
+	}
+}
+
+// flushInput reads with a short timeout until nothing more arrives and
+// drops what was read
+func (c *SPIClient) flushInput() {
+	if err := c.Port.SetReadTimeout(10 * time.Millisecond); err != nil {
+		return
+	}
+	defer c.Port.SetReadTimeout(portReadTimeout)
+
+	buffer := make([]byte, 256)
+	dropped := 0
+	for {
+		n, err := c.Port.Read(buffer)
+		if err != nil || n == 0 {
+			break
+		}
+		dropped += n
+	}
+	if dropped > 0 {
+		fmt.Printf("\nDropped %d stale bytes before retrying\n", dropped)
+	}
+}
+
+// Dump reads the first FlashSize bytes of the SPI flash into w, in blocks
+// of ResponseSize-4 bytes. It returns the CRC32 and the read time in
+// microseconds of every block for the block index. progress, if not nil,
+// is called after every block.
+func (c *SPIClient) Dump(w io.Writer, progress func(block int, tracker *TransferTracker)) (crcs, readTimes []uint32, err error) {
+	blockSize := c.ResponseSize - 4
+	if blockSize <= 0 || c.FlashSize%uint32(blockSize) != 0 {
+		return nil, nil, fmt.Errorf("a %d byte response does not divide the %d byte flash into blocks", c.ResponseSize, c.FlashSize)
+	}
+	totalBlocks := int(c.FlashSize) / blockSize
+	crcs = make([]uint32, 0, totalBlocks)
+	readTimes = make([]uint32, 0, totalBlocks)
+	tracker := NewTransferTracker(int(c.FlashSize))
+	limiter := c.NewReadLimiter()
+	defer limiter.Stop()
+
+	for block := 0; block < totalBlocks; block++ {
+		if block > 0 {
+			limiter.Wait()
+		}
+		start := time.Now()
+		data, err := c.ReadBlockWithRetry(block)
+		if err != nil {
+			return nil, nil, err
+		}
+		readTimes = append(readTimes, ReadTimeMicros(time.Since(start)))
+		crcs = append(crcs, crc32.ChecksumIEEE(data))
+
+		if _, err := w.Write(data); err != nil {
+			return nil, nil, fmt.Errorf("failed to write to file: %v", err)
+		}
+
+		// Small delay between blocks to not overwhelm the radio
+		time.Sleep(c.BlockDelay)
+
+		tracker.Update(len(data))
+		if progress != nil {
+			progress(block, tracker)
+		}
+	}
+	return crcs, readTimes, nil
+}
+
+// ReadLimiter holds block reads to one per SPIClient.ReadInterval. The
+// interval runs from the start of one read to the start of the next, so the
+// round trip of a read counts toward it.
+type ReadLimiter struct {
+	ticker *time.Ticker
+}
+
+// NewReadLimiter starts a limiter for ReadInterval, call Wait before every
+// read but the first and Stop when done
+func (c *SPIClient) NewReadLimiter() *ReadLimiter {
+	if c.ReadInterval <= 0 {
+		return &ReadLimiter{}
+	}
+	return &ReadLimiter{ticker: time.NewTicker(c.ReadInterval)}
+}
+
+// Wait blocks until the next read may start
+func (l *ReadLimiter) Wait() {
+	if l.ticker != nil {
+		<-l.ticker.C
+	}
+}
+
+func (l *ReadLimiter) Stop() {
+	if l.ticker != nil {
+		l.ticker.Stop()
+	}
+}
+
+// Connect opens the serial port and lowers the USB latency timer of the
+// cable until Disconnect
+func (c *SPIClient) Connect(portName string, baudRate int) error {
+	mode := &serial.Mode{
+		BaudRate: baudRate,
+		DataBits: 8,
+		Parity:   serial.NoParity,
+		StopBits: serial.OneStopBit,
+	}
+
+	port, err := serial.Open(portName, mode)
+	if err != nil {
+		return fmt.Errorf("failed to open port %s: %v", portName, err)
+	}
+
+	// Set read timeout to 2 seconds like in Rust code
+	err = port.SetReadTimeout(portReadTimeout)
+	if err != nil {
+		port.Close()
+		return fmt.Errorf("failed to set read timeout: %v", err)
+	}
+
+	c.Port = port
+
+	// Restored by Disconnect
+	c.restoreLatency = func() {}
+	if old, ok := ReadUSBLatency(portName); ok && old > 1 {
+		if err := ConfigureUSBLatency(portName, 1); err != nil {
+			fmt.Printf("Warning: %v, the transfer may be slow\n", err)
+		} else {
+			fmt.Printf("USB latency timer: %d ms -> 1 ms\n", old)
+			c.restoreLatency = func() {
+				if err := ConfigureUSBLatency(portName, old); err != nil {
+					fmt.Printf("Warning: %v\n", err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Disconnect closes the port opened by Connect
+func (c *SPIClient) Disconnect() {
+	if c.Port != nil {
+		c.Port.Close()
+		c.Port = nil
+	}
+	if c.restoreLatency != nil {
+		c.restoreLatency()
+		c.restoreLatency = nil
+	}
+}
+
+// countdownStep is the time between the numbers of the -no-wait countdown
+var countdownStep = time.Second
+
+// WaitForStart waits for Enter after a tool printed its instructions. With
+// noWait it counts down 3 seconds on one line instead, for scripts that
+// can't press Enter, and with force it returns at once.
+func WaitForStart(noWait, force bool) {
+	switch {
+	case force:
+	case noWait:
+		fmt.Print("Starting in")
+		for i := 3; i > 0; i-- {
+			fmt.Printf(" %d...", i)
+			time.Sleep(countdownStep)
+		}
+		fmt.Println()
+	default:
+		var input string
+		fmt.Scanln(&input)
+	}
+}
+
+// AvailablePorts lists the serial ports in name order
+func AvailablePorts() []string {
+	ports, err := serial.GetPortsList()
+	if err != nil {
+		return []string{}
+	}
+	sort.Strings(ports)
+	return ports
+}
+
+// PrintHex prints data as hex bytes on one line
+func PrintHex(data []byte) {
+	for _, b := range data {
+		fmt.Printf("%02X ", b)
+	}
+	fmt.Println()
+}
+
+// FormatBlockDiff describes the first difference between two blocks: its
+// offset, then the expected and received bytes around it in two aligned
+// rows of 16 with a ^ under every byte that differs. Bytes past the end of
+// the shorter block are shown as --. It returns "" if the blocks are equal.
+func FormatBlockDiff(expected, got []byte) string {
+	size := max(len(expected), len(got))
+	first := -1
+	for i := 0; i < size; i++ {
+		if i >= len(expected) || i >= len(got) || expected[i] != got[i] {
+			first = i
+			break
+		}
+	}
+	if first < 0 {
+		return ""
+	}
+
+	// 16 bytes with the first difference in the middle, moved inside the block
+	start := max(0, min(first-8, size-16))
+	end := min(start+16, size)
+	hexRow := func(data []byte) string {
+		var row strings.Builder
+		for i := start; i < end; i++ {
+			if i < len(data) {
+				fmt.Fprintf(&row, " %02X", data[i])
+			} else {
+				row.WriteString(" --")
+			}
+		}
+		return row.String()
+	}
+
+	var carets strings.Builder
+	for i := start; i < end; i++ {
+		if i >= len(expected) || i >= len(got) || expected[i] != got[i] {
+			carets.WriteString(" ^^")
+		} else {
+			carets.WriteString("   ")
+		}
+	}
+
+	return fmt.Sprintf("first difference at byte %d (0x%03X)\n", first, first) +
+		fmt.Sprintf("expected 0x%03X:%s\n", start, hexRow(expected)) +
+		fmt.Sprintf("got      0x%03X:%s\n", start, hexRow(got)) +
+		fmt.Sprintf("               %s\n", strings.TrimRight(carets.String(), " "))
+}
+
+// usbLatencyTimerFile returns the sysfs latency timer of the USB serial
+// adapter behind portName, "" if there is none (not Linux, or a driver
+// without the setting)
+func usbLatencyTimerFile(portName string) string {
+	if runtime.GOOS != "linux" {
+		return ""
+	}
+	if resolved, err := filepath.EvalSymlinks(portName); err == nil {
+		portName = resolved
+	}
+	path := filepath.Join("/sys/bus/usb-serial/devices", filepath.Base(portName), "latency_timer")
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// ReadUSBLatency returns the latency timer of the adapter behind portName
+// in ms, false if it has none
+func ReadUSBLatency(portName string) (int, bool) {
+	path := usbLatencyTimerFile(portName)
+	if path == "" {
+		return 0, false
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	ms, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	return ms, err == nil
+}
+
+// ConfigureUSBLatency sets the latency timer of the FTDI or CH340 adapter
+// behind portName. The default of 16 ms delays every received byte, which
+// makes the one-byte ACKs slow. Does nothing on other systems or adapters.
+func ConfigureUSBLatency(portName string, latencyMs int) error {
+	path := usbLatencyTimerFile(portName)
+	if path == "" {
+		return nil
+	}
+	if err := os.WriteFile(path, []byte(strconv.Itoa(latencyMs)), 0644); err != nil {
+		return fmt.Errorf("failed to set USB latency timer: %v", err)
+	}
+	return nil
+}
+
+// WriteBlockIndex stores the CRC32 of every block of a backup in
+// <filename>.idx, 4 bytes little endian per block. The CRCs are over the
+// uncompressed data, also for .gz backups. They are followed by the read
+// time of every block in microseconds, in the same format.
+func WriteBlockIndex(filename string, crcs, readTimes []uint32) error {
+	index := make([]byte, 0, 4*(len(crcs)+len(readTimes)))
+	for _, v := range append(crcs, readTimes...) {
+		index = binary.LittleEndian.AppendUint32(index, v)
+	}
+
+	indexFile := filename + ".idx"
+	if err := os.WriteFile(indexFile, index, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", indexFile, err)
+	}
+	fmt.Printf("Block CRC index saved to %s\n", indexFile)
+	return nil
+}
+
+// LoadBlockIndex reads the .idx sidecar of a backup with the given number
+// of blocks, nil if there is none. readTimes is nil for indexes written
+// before read times were recorded.
+func LoadBlockIndex(filename string, blocks int) (crcs, readTimes []uint32, err error) {
+	index, err := os.ReadFile(filename + ".idx")
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read block index: %v", err)
+	}
+	if len(index) != 4*blocks && len(index) != 8*blocks {
+		return nil, nil, fmt.Errorf("block index %s.idx has %d bytes, expected %d or %d for %d blocks",
+			filename, len(index), 4*blocks, 8*blocks, blocks)
+	}
+
+	values := make([]uint32, len(index)/4)
+	for i := range values {
+		values[i] = binary.LittleEndian.Uint32(index[4*i:])
+	}
+	if len(values) > blocks {
+		return values[:blocks], values[blocks:], nil
+	}
+	return values, nil, nil
+}
+
+// TransferTracker estimates the rate and remaining time of a transfer,
+// from the updates of the last trackerWindow calls to Update
+type TransferTracker struct {
+	startTime        time.Time
+	bytesTransferred int
+	totalBytes       int
+	samples          []trackerSample
+
+	BytesPerSec float64       // Rate over the window
+	ETA         time.Duration // Time left at BytesPerSec
+}
+
+// trackerSample is the byte count of a transfer at a point in time
+type trackerSample struct {
+	at    time.Time
+	bytes int
+}
+
+const trackerWindow = 10
+
+func NewTransferTracker(totalBytes int) *TransferTracker {
+	now := time.Now()
+	return &TransferTracker{startTime: now, totalBytes: totalBytes, samples: []trackerSample{{at: now}}}
+}
+
+// Update records n more transferred bytes
+func (t *TransferTracker) Update(n int) {
+	t.update(n, time.Now())
+}
+
+func (t *TransferTracker) update(n int, now time.Time) {
+	t.bytesTransferred += n
+	t.samples = append(t.samples, trackerSample{at: now, bytes: t.bytesTransferred})
+	if len(t.samples) > trackerWindow+1 {
+		t.samples = t.samples[len(t.samples)-trackerWindow-1:]
+	}
+
+	first := t.samples[0]
+	if elapsed := now.Sub(first.at).Seconds(); elapsed > 0 {
+		t.BytesPerSec = float64(t.bytesTransferred-first.bytes) / elapsed
+	}
+	if t.BytesPerSec > 0 {
+		remaining := float64(t.totalBytes - t.bytesTransferred)
+		t.ETA = time.Duration(remaining / t.BytesPerSec * float64(time.Second))
+	}
+}
+
+// String returns e.g. "47.2% (15.1 MB / 32 MB) @ 8.3 KB/s ETA 27m 13s"
+func (t *TransferTracker) String() string {
+	percent := 0.0
+	if t.totalBytes > 0 {
+		percent = float64(t.bytesTransferred) / float64(t.totalBytes) * 100
+	}
+	return fmt.Sprintf("%.1f%% (%s / %s) @ %s/s ETA %s", percent, formatSize(float64(t.bytesTransferred)),
+		formatSize(float64(t.totalBytes)), formatSize(t.BytesPerSec), formatETA(t.ETA))
+}
+
+// formatSize prints a byte count with one decimal in B, KB or MB
+func formatSize(n float64) string {
+	unit := "B"
+	for _, u := range []string{"KB", "MB"} {
+		if n < 1024 {
+			break
+		}
+		n /= 1024
+		unit = u
+	}
+	return strings.TrimSuffix(fmt.Sprintf("%.1f", n), ".0") + " " + unit
+}
+
+// formatETA prints a duration as e.g. "1h 5m 3s", "27m 13s" or "8s"
+func formatETA(d time.Duration) string {
+	d = d.Round(time.Second)
+	h, m, s := int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60
+	switch {
+	case h > 0:
+		return fmt.Sprintf("%dh %dm %ds", h, m, s)
+	case m > 0:
+		return fmt.Sprintf("%dm %ds", m, s)
+	}
+	return fmt.Sprintf("%ds", s)
+}
+
+// ReadTimeMicros converts a block read time for the block index
+func ReadTimeMicros(d time.Duration) uint32 {
+	if us := d.Microseconds(); us < math.MaxUint32 {
+		return uint32(us)
+	}
+	return math.MaxUint32
+}
+
+// MedianReadTime returns the median of the non-zero read times, blocks
+// that were not read have a time of 0
+func MedianReadTime(readTimes []uint32) uint32 {
+	var times []uint32
+	for _, t := range readTimes {
+		if t > 0 {
+			times = append(times, t)
+		}
+	}
+	if len(times) == 0 {
+		return 0
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return times[len(times)/2]
+}
+
+// SlowBlocks returns the blocks that took more than 3 times the median to
+// read, these may sit in degraded flash cells
+func SlowBlocks(readTimes []uint32) []int {
+	median := MedianReadTime(readTimes)
+	var slow []int
+	for block, t := range readTimes {
+		if median > 0 && t > 3*median {
+			slow = append(slow, block)
+		}
+	}
+	return slow
+}
+
+// PrintReadTimes prints a histogram of the read times of blocks of
+// blockSize bytes and flags the blocks slower than 3 times the median
+func PrintReadTimes(readTimes []uint32, blockSize int) {
+	median := MedianReadTime(readTimes)
+	if median == 0 {
+		return
+	}
+
+	var lo, hi uint32 = math.MaxUint32, 0
+	for _, t := range readTimes {
+		if t > 0 {
+			lo = min(lo, t)
+			hi = max(hi, t)
+		}
+	}
+
+	const buckets = 10
+	width := (hi-lo)/buckets + 1
+	counts := make([]int, buckets)
+	most := 0
+	for _, t := range readTimes {
+		if t > 0 {
+			b := int((t - lo) / width)
+			counts[b]++
+			most = max(most, counts[b])
+		}
+	}
+
+	fmt.Printf("\nBlock read times (median %.1f ms):\n", float64(median)/1000)
+	for b, n := range counts {
+		from := lo + uint32(b)*width
+		fmt.Printf("  %7.1f - %7.1f ms | %-40s %d\n", float64(from)/1000, float64(from+width)/1000,
+			strings.Repeat("#", (n*40+most-1)/most), n)
+	}
+
+	// Includes the retry delays, so a block that needed retries shows here
+	slowest := 0
+	for block, t := range readTimes {
+		if t > readTimes[slowest] {
+			slowest = block
+		}
+	}
+	fmt.Printf("Slowest block: 0x%08X (%d ms)\n", slowest*blockSize, (readTimes[slowest]+500)/1000)
+
+	for _, block := range SlowBlocks(readTimes) {
+		fmt.Printf("Block %d (offset 0x%06X) took %.1f ms, potentially degraded\n",
+			block, block*blockSize, float64(readTimes[block])/1000)
+	}
+}
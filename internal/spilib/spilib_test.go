@@ -0,0 +1,286 @@
+package spilib
+
+import (
+	"bytes"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// blockPort is a radio answering read commands with responseSize byte
+// packets and everything else with an ACK. It records the size of every
+// buffer the client reads into.
+type blockPort struct {
+	mu           sync.Mutex
+	responseSize int
+	timeouts     int // Read commands still to be left unanswered
+	pending      []byte
+	writes       [][]byte
+	reads        []int
+}
+
+func (p *blockPort) Write(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.writes = append(p.writes, append([]byte(nil), data...))
+	if data[0] != CMD_READ_SPI_FLASH || len(data) != 4 {
+		p.pending = append(p.pending, 0x06)
+		return len(data), nil
+	}
+	if p.timeouts > 0 {
+		p.timeouts--
+		return len(data), nil
+	}
+	response := []byte{data[0], data[1], data[2]}
+	for i := 0; i < p.responseSize-4; i++ {
+		response = append(response, byte(int(data[2])+i))
+	}
+	var sum byte
+	for _, b := range response {
+		sum += b
+	}
+	p.pending = append(p.pending, append(response, sum)...)
+	return len(data), nil
+}
+
+func (p *blockPort) Read(buffer []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reads = append(p.reads, len(buffer))
+	n := copy(buffer, p.pending)
+	p.pending = p.pending[n:]
+	return n, nil
+}
+
+func (p *blockPort) SetMode(mode *serial.Mode) error      { return nil }
+func (p *blockPort) Drain() error                         { return nil }
+func (p *blockPort) ResetInputBuffer() error              { return nil }
+func (p *blockPort) ResetOutputBuffer() error             { return nil }
+func (p *blockPort) SetDTR(dtr bool) error                { return nil }
+func (p *blockPort) SetRTS(rts bool) error                { return nil }
+func (p *blockPort) SetReadTimeout(t time.Duration) error { return nil }
+func (p *blockPort) Close() error                         { return nil }
+func (p *blockPort) Break(d time.Duration) error          { return nil }
+
+func (p *blockPort) GetModemStatusBits() (*serial.ModemStatusBits, error) {
+	return &serial.ModemStatusBits{}, nil
+}
+
+func TestTransferTrackerETAConverges(t *testing.T) {
+	const blocks = 500
+	// Uneven block times, 120 ms on average
+	times := make([]time.Time, blocks+1)
+	times[0] = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 1; i <= blocks; i++ {
+		step := 100 * time.Millisecond
+		if i%2 == 0 {
+			step = 140 * time.Millisecond
+		}
+		times[i] = times[i-1].Add(step)
+	}
+
+	tracker := NewTransferTracker(blocks * CHUNK_SIZE)
+	tracker.startTime = times[0]
+	tracker.samples[0].at = times[0]
+	for i := 1; i < blocks; i++ {
+		tracker.update(CHUNK_SIZE, times[i])
+		// A single block left can be 100 or 140 ms, so stop a window early
+		if i < 2*trackerWindow || i > blocks-trackerWindow {
+			continue
+		}
+		actual := times[blocks].Sub(times[i])
+		if diff := tracker.ETA - actual; diff > actual/10 || diff < -actual/10 {
+			t.Fatalf("block %d: ETA %v, %v left", i, tracker.ETA, actual)
+		}
+	}
+}
+
+func TestFormatBlockDiff(t *testing.T) {
+	expected := make([]byte, 16)
+	for i := range expected {
+		expected[i] = byte(i)
+	}
+	got := append([]byte(nil), expected...)
+	got[0], got[7], got[15] = 0xFF, 0x70, 0xF0
+
+	want := "first difference at byte 0 (0x000)\n" +
+		"expected 0x000: 00 01 02 03 04 05 06 07 08 09 0A 0B 0C 0D 0E 0F\n" +
+		"got      0x000: FF 01 02 03 04 05 06 70 08 09 0A 0B 0C 0D 0E F0\n" +
+		"                ^^                   ^^                      ^^\n"
+	if diff := FormatBlockDiff(expected, got); diff != want {
+		t.Errorf("got\n%s\nwant\n%s", diff, want)
+	}
+	// A short read shows the missing bytes as --
+	want = "first difference at byte 14 (0x00E)\n" +
+		"expected 0x000: 00 01 02 03 04 05 06 07 08 09 0A 0B 0C 0D 0E 0F\n" +
+		"got      0x000: 00 01 02 03 04 05 06 07 08 09 0A 0B 0C 0D -- --\n" +
+		"                                                          ^^ ^^\n"
+	if diff := FormatBlockDiff(expected, expected[:14]); diff != want {
+		t.Errorf("got\n%s\nwant\n%s", diff, want)
+	}
+	if diff := FormatBlockDiff(expected, expected); diff != "" {
+		t.Errorf("equal blocks give %q", diff)
+	}
+}
+
+func TestWaitForStartSkipsPrompt(t *testing.T) {
+	// Nothing is ever typed, so reading stdin would block
+	stdin, typed, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer typed.Close()
+	defer stdin.Close()
+	saved := os.Stdin
+	os.Stdin = stdin
+	defer func() { os.Stdin = saved }()
+
+	// A 10 ms step keeps the whole no-wait countdown at 30 ms
+	defer func(step time.Duration) { countdownStep = step }(countdownStep)
+	countdownStep = 10 * time.Millisecond
+
+	for _, tt := range []struct {
+		name          string
+		noWait, force bool
+	}{
+		{"no-wait", true, false},
+		{"force", false, true},
+		{"no-wait and force", true, true},
+	} {
+		done := make(chan struct{})
+		start := time.Now()
+		go func() {
+			WaitForStart(tt.noWait, tt.force)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: still waiting for Enter", tt.name)
+		}
+		if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+			t.Errorf("%s: started after %v, want under 100ms", tt.name, elapsed)
+		}
+	}
+}
+
+func TestReadBlockResponseSize(t *testing.T) {
+	port := &blockPort{responseSize: 512}
+	client := NewSPIClient(SPI_FLASH_SIZE, 0)
+	client.Port = port
+	client.Quiet = true
+	client.ResponseSize = 512
+
+	data, err := client.ReadBlock(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(port.reads) == 0 || port.reads[0] != 512 {
+		t.Fatalf("read into buffers of %v bytes, want 512", port.reads)
+	}
+	want := make([]byte, 508)
+	for i := range want {
+		want[i] = byte(5 + i)
+	}
+	if !bytes.Equal(data, want) {
+		t.Errorf("got %d data bytes % X..., want the 508 sent", len(data), data[:min(8, len(data))])
+	}
+	if len(port.pending) != 0 {
+		t.Errorf("%d bytes of the response left unread", len(port.pending))
+	}
+}
+
+func TestSelectWriteCommand(t *testing.T) {
+	tests := []struct {
+		block uint16
+		want  byte
+	}{
+		{0, CMD_WRITE_SPI_0x40},
+		{2879, CMD_WRITE_SPI_0x40},
+		{2880, CMD_WRITE_SPI_0x41},
+		{3039, CMD_WRITE_SPI_0x41},
+		{3040, CMD_WRITE_SPI_0x42},
+		{3175, CMD_WRITE_SPI_0x42},
+		{3176, CMD_WRITE_SPI_0x43},
+		{3183, CMD_WRITE_SPI_0x43},
+		{3184, CMD_WRITE_SPI_0x4C},
+		{3795, CMD_WRITE_SPI_0x4C},
+		{3796, CMD_WRITE_SPI_0x47},
+		{3835, CMD_WRITE_SPI_0x47},
+		{3836, CMD_WRITE_SPI_0x48},
+		{3839, CMD_WRITE_SPI_0x48},
+		{3840, CMD_WRITE_SPI_FLASH}, // Gap after the calibration
+		{3843, CMD_WRITE_SPI_FLASH},
+		{3844, CMD_WRITE_SPI_0x49},
+		{3883, CMD_WRITE_SPI_0x49},
+		{3884, CMD_WRITE_SPI_FLASH},
+		{3935, CMD_WRITE_SPI_FLASH},
+		{3936, CMD_WRITE_SPI_0x4B},
+		{3975, CMD_WRITE_SPI_0x4B},
+		{3976, CMD_WRITE_SPI_FLASH},
+		{4095, CMD_WRITE_SPI_FLASH}, // Last block of SPI_FLASH_SIZE
+		{65535, CMD_WRITE_SPI_FLASH},
+	}
+	for _, tt := range tests {
+		if got := selectWriteCommand(tt.block, CHUNK_SIZE); got != tt.want {
+			t.Errorf("block %d: got 0x%02X, want 0x%02X", tt.block, got, tt.want)
+		}
+	}
+
+	// WriteBlock sends the command of the range, a few boundaries are
+	// enough as every write waits for the radio
+	port := &blockPort{}
+	client := NewSPIClient(SPI_FLASH_SIZE, 0)
+	client.Port = port
+	client.Quiet = true
+	for _, tt := range []struct {
+		block uint16
+		want  byte
+	}{{2879, CMD_WRITE_SPI_0x40}, {2880, CMD_WRITE_SPI_0x41}, {3840, CMD_WRITE_SPI_FLASH}} {
+		if err := client.WriteBlock(tt.block, make([]byte, CHUNK_SIZE)); err != nil {
+			t.Fatal(err)
+		}
+		command := port.writes[len(port.writes)-1]
+		if command[0] != tt.want || int(command[1])<<8|int(command[2]) != int(tt.block) {
+			t.Errorf("block %d written with % X, want command 0x%02X", tt.block, command[:3], tt.want)
+		}
+	}
+}
+
+func TestReadBlockWithRetryTimeouts(t *testing.T) {
+	defer func(timeout time.Duration) { blockReadTimeout = timeout }(blockReadTimeout)
+	blockReadTimeout = 100 * time.Millisecond
+
+	// Two timeouts are recovered by the second retry
+	port := &blockPort{responseSize: PACKET_SIZE, timeouts: 2}
+	client := NewSPIClient(SPI_FLASH_SIZE, 0)
+	client.Port = port
+	client.Quiet = true
+	data, err := client.ReadBlockWithRetry(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(port.writes) != 3 {
+		t.Errorf("sent %d read commands, want 3", len(port.writes))
+	}
+	want := make([]byte, CHUNK_SIZE)
+	for i := range want {
+		want[i] = byte(7 + i)
+	}
+	if !bytes.Equal(data, want) {
+		t.Error("the block read after the timeouts does not hold the data sent")
+	}
+
+	// One timeout more than the retries fails
+	port = &blockPort{responseSize: PACKET_SIZE, timeouts: 4}
+	client.Port = port
+	if _, err := client.ReadBlockWithRetry(7); err == nil {
+		t.Error("no error after a timeout on every retry")
+	}
+	if len(port.writes) != 4 {
+		t.Errorf("sent %d read commands, want the first and 3 retries", len(port.writes))
+	}
+}
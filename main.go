@@ -1,22 +1,61 @@
 package main
 
 import (
+	"archive/zip"
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"debug/elf"
+	"embed"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"log"
+	"math"
+	"math/bits"
+	"net"
+	"net/http"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"go.bug.st/serial"
+	"gopkg.in/yaml.v3"
+
+	"rt6d-flasher/internal/spilib"
+)
+
+// Build information, set by build.sh with
+// -ldflags "-X main.Version=... -X main.GitCommit=... -X main.BuildDate=..."
+var (
+	Version   = "dev"
+	GitCommit = "unknown"
+	BuildDate = "unknown"
 )
 
 type Flasher struct {
 	port         serial.Port
 	writestep    int
-	step         int
+	state        ProtocolState
 	recvcnt      int
 	sendcnt      int
 	gWritebytes  int
@@ -24,58 +63,368 @@ type Flasher struct {
 	recvbuf      []byte
 	hex          []byte
 	flgConnect   bool
+	lastReceived int // Last byte read from the radio, -1 before the first
 	allcode      string
 	cntcode      int
 	rep          int
 
 	// Retry and timeout logic
-	lastPacketTime time.Time
-	retryCount     int
-	maxRetries     int
-	packetTimeout  time.Duration
-	waitingForAck  bool
+	ConnectAttempts int           // Connect commands sent before giving up
+	ConnectTimeout  time.Duration // Wait for the answer to each connect command
+	lastPacketTime  time.Time
+	retryCount      int
+	maxRetries      int
+	packetTimeout   time.Duration
+	waitingForAck   bool
+	TotalTimeout    time.Duration // Limit for the whole transfer, 0 for none
+
+	// Blocks sent before the ACK of the previous one, for bootloaders that
+	// buffer blocks. 1 waits for every ACK like the original protocol.
+	WindowSize     int
+	sentButUnacked []SentBlock // Blocks in flight, oldest first
+
+	// Keep the bootloader from timing out during long waits for an ACK and
+	// re-enter it when the radio drops back to normal mode, see keepAlive
+	BootloaderKeepAlive bool
+	KeepAliveInterval   time.Duration // Quiet time before a keep-alive is sent, 0 disables it
+	keepAliveAcks       []int         // ACKs due before the one of each keep-alive in flight
+	lastKeepAlive       time.Time
+	reenterBootloader   chan struct{} // Signalled when the radio answers 0x32 mid-flash
+
+	InterPacketDelay time.Duration // Pause after each connect and update command
+	DataPacketDelay  time.Duration // Pause before each firmware block
+	timedOut       bool          // Set by the watchdog when TotalTimeout expired
+	abortErr       error         // Why the transfer went to StateError, returned by startUpdate
+
+	// Connection settings
+	baudRate         int
+	verifyAfterFlash bool
+	trace            io.Writer     // Optional TX/RX trace of the serial traffic
+	packetDump       *packetDumper // Optional file per TX/RX packet
+	LogLevel         LogLevel      // Diagnostic output printed by log, from logLevel by default
+
+	// Reopen the port when the cable is unplugged and plugged back in
+	// during a transfer, see reconnect
+	ReconnectOnDisconnect bool
+	ReconnectTimeout      time.Duration // How long to wait for the cable to come back
+	portName              string        // Port opened by startUpdate
+	usbID                 string        // VID:PID of the cable behind portName, "" if unknown
+	reconnectUnlock       func()        // Removes the lock of the port reconnect moved to, if any
+
+	DryRun             bool        // Talk to a dryRunPort instead of the radio
+	mockPort           serial.Port // Used instead of opening the port, e.g. a replayPort
+	AutoBaud           bool        // Probe BaudRateCandidates instead of using baudRate
+	BaudRateCandidates []int       // Rates tried in order by AutoBaud
+
+	// SPI flash backup taken in normal mode before flashing
+	BackupBeforeFlash bool
+	BackupPath        string        // Directory for the backup file
+	BackupTimeout     time.Duration // Limit for the whole backup, separate from packetTimeout
+
+	StatsFile string // Append a JSON line about every flash to this file when set
+
+	ProgressFile       string // Rewritten with a ProgressRecord after every block ACK when set
+	progressFileFailed bool   // A write of ProgressFile failed, only warned about once
+
+	// InfluxDB line protocol of the progress after every block ACK and of
+	// the result, see writeTelemetry. telemetrySink by default.
+	TelemetrySink   io.Writer
+	telemetryTags   string    // port and model tags of the current flash
+	telemetryStart  time.Time // When the current flash started, for rate_kbps
+	telemetryFailed bool      // A write to TelemetrySink failed, only warned about once
+
+	// Firmware image layout
+	GapFillByte  byte        // Value of addresses not covered by the firmware file
+	StrictGaps   bool        // Refuse HEX files with holes between regions
+	loadedRanges []hexRegion // Parts of f.hex written by the firmware file
+	sourceSize   int         // Image size in the file, may exceed len(f.hex)
+
+	MaxFirmwareBytes int  // Upper bound for the image size, 0 for no limit
+	SkipVectorCheck  bool // Flash images whose vector table looks wrong
+
+	// Part of the loaded image printed by initializeHex, none if the
+	// length is 0
+	HexdumpStart  int
+	HexdumpLength int
+	MemoryMap     bool // Print dumpMemoryMap of the loaded image
 
-	// Protocol constants
+	// Parts of the image that keep what is already on the radio, e.g.
+	// calibration data, see readProtectedRegions
+	ProtectedRegions []MemoryRegion
+	SkipProtected    bool   // Send 0xFF for protected bytes that can't be read from the radio
+	protectedData    []byte // Radio contents by image offset, nil without protected regions
+
+	SignatureKeyFile string // Require a matching <firmware>.sig HMAC when set
+
+	// Function names by address from LoadSymbolMap, shown next to block
+	// addresses in the packet log. nil without a symbol map.
+	Symbols     map[uint32]string
+	symbolAddrs []uint32 // Keys of Symbols, sorted
+
+	Metadata        *FirmwareMetadata // From the <firmware>.meta.json sidecar, nil without one
+	RequireMetadata bool              // Refuse firmware files without a sidecar
+
+	SerialNumber string // Only flash the radio reporting this serial number, empty for any
+	StrictSerial bool   // Refuse radios that don't report a serial number
+
+	NoRFC2217 bool // Send raw bytes to tcp:// ports instead of negotiating RFC 2217
+
+	FlashSize int // Size of the firmware area in bytes, sent in BlockSize byte blocks
+	BlockSize int // Data bytes per packet, 1024 by default, some bootloaders use 256
+
+	// Correction for HEX files with wrong extended linear address records.
+	// With an override the first segment of the file starts at
+	// *BaseAddressOverride and later segments keep their distance to it.
+	BaseAddressOverride   *uint32
+	BaseAddressAutodetect bool // Set BaseAddressOverride from the lowest data address
+	firstSegment          int  // Extended address of the first data, -1 before it is known
+
+	EntryPoint    uint32 // From a start address record (type 03 or 05)
+	hasEntryPoint bool
+
+	UseSparse bool            // Load HEX records into a SparseFirmware first
+	sparse    *SparseFirmware // HEX file contents by device address when UseSparse is set
+
+	// Protocol constants, set by WithProtocolConfig
+	protocolName string
 	sendConnect []byte
 	sendEnd     []byte
 	sendUpdate  []byte
+	sendKeepAlive []byte // Null command the bootloader ACKs, nil if none is known
 	sendbufRight []byte
 	sendbufError []byte
-	checksumOffset byte // Different checksum offset for different radio types
+	ChecksumAlgo ChecksumAlgorithm // Checksum of the data packets, differs between radio types
+
+	stats TransferStats
+	done  chan struct{} // Closed to stop the readData goroutine
+
+	// mu guards the transfer state shared between readData and the caller
+	// of startUpdate: state, sendcnt, gWritebytes, waitingForAck, retryCount,
+	// timedOut, abortErr, flgConnect, recvbuf/recvcnt and stats
+	mu sync.Mutex
+}
+
+// TransferStats counts the traffic of one firmware transfer
+type TransferStats struct {
+	BlocksSent int
+	BytesSent  int
+	Retries    int
+}
+
+// FlasherOption customizes a Flasher created by NewFlasher
+type FlasherOption func(*Flasher)
+
+// WithFlashSize sets the size of the firmware area, a multiple of the block
+// size
+func WithFlashSize(size int) FlasherOption {
+	return func(f *Flasher) {
+		f.FlashSize = size
+	}
+}
+
+// WithBlockSize sets the data bytes per packet, for bootloaders that don't
+// use 1024 byte blocks
+func WithBlockSize(size int) FlasherOption {
+	return func(f *Flasher) {
+		f.BlockSize = size
+	}
+}
+
+// WithInterPacketDelay sets the pause after each connect and update command
+func WithInterPacketDelay(delay time.Duration) FlasherOption {
+	return func(f *Flasher) {
+		f.InterPacketDelay = delay
+	}
+}
+
+// WithChecksumAlgorithm replaces the checksum of the protocol, for radio
+// variants that do not use the byte sum
+func WithChecksumAlgorithm(algo ChecksumAlgorithm) FlasherOption {
+	return func(f *Flasher) {
+		f.ChecksumAlgo = algo
+	}
+}
+
+// WithDataPacketDelay sets the pause before each firmware block
+func WithDataPacketDelay(delay time.Duration) FlasherOption {
+	return func(f *Flasher) {
+		f.DataPacketDelay = delay
+	}
+}
+
+// WithProtocolConfig sets the commands, checksum and block size of the
+// protocol, replacing the radtel or iradio defaults chosen by NewFlasher
+func WithProtocolConfig(cfg ProtocolConfig) FlasherOption {
+	return func(f *Flasher) {
+		f.protocolName = cfg.Description
+		if f.protocolName == "" {
+			f.protocolName = cfg.Name
+		}
+		f.sendConnect = cfg.SendConnect
+		f.sendEnd = cfg.SendEnd
+		f.sendUpdate = cfg.SendUpdate
+		f.sendKeepAlive = cfg.SendKeepAlive
+		f.ChecksumAlgo = SumChecksumAlgorithm{Offset: cfg.ChecksumOffset}
+		if cfg.BlockSize > 0 {
+			f.BlockSize = cfg.BlockSize
+		}
+	}
+}
+
+// ProtocolConfig describes the bootloader protocol of a radio family: the
+// connect, end and update commands, the offset added to the byte sum of
+// the data packets and the data bytes per packet
+type ProtocolConfig struct {
+	Name           string `json:"name"`
+	Description    string `json:"description"` // Shown when flashing, Name if empty
+	SendConnect    []byte `json:"send_connect"`
+	SendEnd        []byte `json:"send_end"`
+	SendUpdate     []byte `json:"send_update"`
+	SendKeepAlive  []byte `json:"send_keep_alive,omitempty"` // ACKed without changing the state, none known yet
+	ChecksumOffset byte   `json:"checksum_offset"`
+	BlockSize      int    `json:"block_size"` // 1024 if not given
+}
+
+// builtinProtocols is the JSON list of the protocols known without a
+// -protocol-file
+//
+//go:embed protocols.json
+var builtinProtocols []byte
+
+// knownProtocols holds the built-in protocols and those added by
+// loadProtocolFile
+var knownProtocols = mustParseProtocols(builtinProtocols, "protocols.json")
+
+// parseProtocols reads a JSON list of protocols and checks every entry
+func parseProtocols(content []byte, source string) ([]ProtocolConfig, error) {
+	var protocols []ProtocolConfig
+	if err := json.Unmarshal(content, &protocols); err != nil {
+		return nil, fmt.Errorf("failed to parse protocol file %s: %v", source, err)
+	}
+	for i := range protocols {
+		p := &protocols[i]
+		if p.Name == "" {
+			return nil, fmt.Errorf("protocol %d of %s has no name", i+1, source)
+		}
+		if len(p.SendConnect) == 0 || len(p.SendEnd) == 0 || len(p.SendUpdate) == 0 {
+			return nil, fmt.Errorf("protocol %s of %s needs send_connect, send_end and send_update", p.Name, source)
+		}
+		if p.BlockSize == 0 {
+			p.BlockSize = 1024
+		}
+		if p.BlockSize < 128 {
+			return nil, fmt.Errorf("protocol %s of %s: block size must be at least 128 bytes, got %d", p.Name, source, p.BlockSize)
+		}
+	}
+	return protocols, nil
+}
+
+func mustParseProtocols(content []byte, source string) []ProtocolConfig {
+	protocols, err := parseProtocols(content, source)
+	if err != nil {
+		panic(err)
+	}
+	return protocols
+}
+
+// loadProtocolFile adds the protocols of a JSON file to knownProtocols, a
+// protocol with the name of a known one replaces it
+func loadProtocolFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read protocol file: %v", err)
+	}
+	protocols, err := parseProtocols(content, path)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range protocols {
+		replaced := false
+		for i := range knownProtocols {
+			if knownProtocols[i].Name == p.Name {
+				knownProtocols[i] = p
+				replaced = true
+			}
+		}
+		if !replaced {
+			knownProtocols = append(knownProtocols, p)
+		}
+	}
+	return nil
+}
+
+// findProtocol returns the known protocol with the given name
+func findProtocol(name string) (ProtocolConfig, bool) {
+	for _, p := range knownProtocols {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return ProtocolConfig{}, false
+}
+
+// protocolNames lists the known protocols for error messages
+func protocolNames() string {
+	names := make([]string, len(knownProtocols))
+	for i, p := range knownProtocols {
+		names[i] = p.Name
+	}
+	return strings.Join(names, ", ")
 }
 
-func NewFlasher(useIRadio bool) *Flasher {
+func NewFlasher(useIRadio bool, opts ...FlasherOption) *Flasher {
 	f := &Flasher{
-		sendbuf:       make([]byte, 2052),
-		recvbuf:       make([]byte, 29),
-		hex:           make([]byte, 251904),
-		sendbufRight:  []byte{6},
-		sendbufError:  []byte{255},
-		allcode:       "", // Will be loaded from file or kept empty as requested
-		maxRetries:    3,
-		packetTimeout: 3 * time.Second,
+		recvbuf:            make([]byte, 29),
+		FlashSize:          251904,
+		BlockSize:          1024,
+		sendbufRight:       []byte{6},
+		sendbufError:       []byte{255},
+		allcode:            "", // Will be loaded from file or kept empty as requested
+		maxRetries:         3,
+		ConnectAttempts:    4,
+		ConnectTimeout:     200 * time.Millisecond,
+		packetTimeout:      3 * time.Second,
+		TotalTimeout:       5 * time.Minute,
+		InterPacketDelay:   50 * time.Millisecond,
+		baudRate:           115200,
+		BaudRateCandidates: []int{115200, 57600, 38400, 19200, 9600},
+		BackupPath:         ".",
+		BackupTimeout:      15 * time.Minute,
+		GapFillByte:        0xFF,
+		LogLevel:           logLevel,
+		TelemetrySink:      telemetrySink,
+		WindowSize:         1,
+		ReconnectTimeout:   30 * time.Second,
 	}
 	
+	// Retevis/Radtel (original/older protocol) unless iRadio is asked for,
+	// a WithProtocolConfig option replaces either
+	name := "radtel"
 	if useIRadio {
-		// iRadio parameters (current default)
-		f.sendConnect = []byte{57, 51, 5, 16, 129}
-		f.sendEnd = []byte{57, 51, 5, 238, 95}
-		f.sendUpdate = []byte{57, 51, 5, 85, 198}
-		f.checksumOffset = 0 // iRadio uses +82 offset
-		fmt.Println("Using iRadio protocol parameters")
-	} else {
-		// Retevis/Radtel parameters (original/older protocol)
-		f.sendConnect = []byte{57, 51, 5, 16, 211}
-		f.sendEnd = []byte{57, 51, 5, 238, 177}
-		f.sendUpdate = []byte{57, 51, 5, 85, 24}
-		f.checksumOffset = 82 // Retevis/Radtel uses no additional offset
-		fmt.Println("Using Retevis/Radtel protocol parameters")
+		name = "iradio"
+	}
+	if protocol, ok := findProtocol(name); ok {
+		WithProtocolConfig(protocol)(f)
 	}
 	
+	for _, opt := range opts {
+		opt(f)
+	}
+	f.log(LogNormal, "Using %s protocol parameters\n", f.protocolName)
+	f.hex = make([]byte, f.FlashSize)
+	
+	// 3 header bytes, the block data and the checksum
+	f.sendbuf = make([]byte, f.BlockSize+4)
 	f.sendbuf[0] = 87
 	return f
 }
 
+// totalBlocks returns the number of BlockSize blocks of the firmware area
+func (f *Flasher) totalBlocks() int {
+	return f.FlashSize / f.BlockSize
+}
+
 func (f *Flasher) generateCheckCode(codeCount int) string {
 	result := ""
 	num := time.Now().UnixNano() + int64(f.rep)
@@ -93,63 +442,532 @@ func (f *Flasher) generateCheckCode(codeCount int) string {
 	return result
 }
 
-func (f *Flasher) initializeHex(firmwareFile string) bool {
-	for i := 0; i < 251904; i++ {
-		f.hex[i] = 0xFF // Initialize with 0xFF instead of 0x00 (typical for flash memory)
+// FirmwareFormat is the file format of a FirmwareSource
+type FirmwareFormat int
+
+const (
+	FormatBin  FirmwareFormat = iota // Raw image starting at 0x08002800
+	FormatHex                        // Intel HEX
+	FormatSREC                       // Motorola S-record
+)
+
+func (ff FirmwareFormat) String() string {
+	switch ff {
+	case FormatBin:
+		return "binary"
+	case FormatHex:
+		return "Intel HEX"
+	case FormatSREC:
+		return "S-record"
 	}
-	f.gWritebytes = 0
-	f.writestep = 0
-	
-	// Load firmware based on file extension
-	var loaded bool
-	if strings.HasSuffix(strings.ToLower(firmwareFile), ".bin") {
-		loaded = f.loadBinaryFirmware(firmwareFile)
-		if loaded {
-			fmt.Printf("Loaded binary firmware: %s\n", firmwareFile)
+	return fmt.Sprintf("format %d", int(ff))
+}
+
+// FirmwareSource supplies a firmware image to LoadFirmwareFromReader, from a
+// file, a network stream or memory
+type FirmwareSource interface {
+	Read(p []byte) (n int, err error)
+	Format() FirmwareFormat
+}
+
+// memFirmwareSource is a FirmwareSource over a byte slice. A file that
+// could not be read is a memFirmwareSource returning err from Read.
+type memFirmwareSource struct {
+	*bytes.Reader
+	format FirmwareFormat
+	err    error
+}
+
+func (m *memFirmwareSource) Read(p []byte) (int, error) {
+	if m.err != nil {
+		return 0, m.err
+	}
+	return m.Reader.Read(p)
+}
+
+func (m *memFirmwareSource) Format() FirmwareFormat {
+	return m.format
+}
+
+// MemFirmwareSource returns a FirmwareSource reading data
+func MemFirmwareSource(data []byte, format FirmwareFormat) FirmwareSource {
+	return &memFirmwareSource{Reader: bytes.NewReader(data), format: format}
+}
+
+// FileFirmwareSource returns a FirmwareSource reading the file at path. The
+// format comes from the .bin/.hex/.srec extension, or from the content for
+// other names. A read error is returned by the first Read.
+func FileFirmwareSource(path string) FirmwareSource {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return &memFirmwareSource{Reader: bytes.NewReader(nil), err: err}
+	}
+	return MemFirmwareSource(content, detectFirmwareFormat(path, content))
+}
+
+// detectFirmwareFormat picks the format of a firmware file by extension,
+// HEX records start with ':' and S-records with 'S' and a digit
+func detectFirmwareFormat(path string, content []byte) FirmwareFormat {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".bin":
+		return FormatBin
+	case ".hex":
+		return FormatHex
+	case ".srec", ".s19", ".s28", ".s37", ".mot":
+		return FormatSREC
+	}
+
+	text := bytes.TrimLeft(content, " \t\r\n")
+	if len(text) > 0 && text[0] == ':' {
+		return FormatHex
+	}
+	if len(text) > 1 && text[0] == 'S' && text[1] >= '0' && text[1] <= '9' {
+		return FormatSREC
+	}
+	return FormatBin
+}
+
+// formatInfo describes a firmware file format for list-formats. Header is
+// the start of a typical file, Detection the checks that pick the format
+// with how sure each of them is.
+type formatInfo struct {
+	Name        string
+	Extensions  string
+	Description string
+	Detection   []string
+	Header      []byte
+}
+
+// firmwareFormats lists the formats in the order they are tried
+var firmwareFormats = []formatInfo{
+	{
+		Name:        "Firmware package",
+		Extensions:  ".rtpkg",
+		Description: "ZIP archive with firmware.bin, metadata.json and regions.yaml, see pack",
+		Detection:   []string{"extension .rtpkg (100%)"},
+		Header:      []byte("PK\x03\x04\x14\x00\x08\x00\x08\x00\x00\x00\x21\x00\x00\x00"),
+	},
+	{
+		Name:        "Intel HEX",
+		Extensions:  ".hex",
+		Description: "Text records with absolute addresses, as released by the manufacturer",
+		Detection: []string{
+			"extension .hex (100%)",
+			"starts with ':' followed by length and address (95%)",
+		},
+		Header: []byte(":020000040800F2\n"),
+	},
+	{
+		Name:        "S-record",
+		Extensions:  ".srec .s19 .s28 .s37 .mot",
+		Description: "Motorola text records, detected but not supported for flashing yet",
+		Detection: []string{
+			"extension .srec, .s19, .s28, .s37 or .mot (100%)",
+			"starts with 'S' followed by record type digit (90%)",
+		},
+		Header: []byte("S00F000068656C6C"),
+	},
+	{
+		Name:        "Binary",
+		Extensions:  ".bin",
+		Description: "Raw image loaded at 0x08002800, e.g. from hex2bin or read-firmware",
+		Detection: []string{
+			"extension .bin (100%)",
+			"anything else (50%), first 4 bytes are ARM stack pointer (e.g., 98 92 00 20)",
+		},
+		Header: []byte{0x98, 0x92, 0x00, 0x20, 0xC1, 0x2A, 0x00, 0x08, 0x49, 0xA8, 0x01, 0x08, 0x45, 0x3B, 0x01, 0x08},
+	},
+}
+
+// printFormats writes one block per format with a hex and ASCII dump of
+// its header, followed by the order the checks are tried in
+func printFormats(formats []formatInfo, fallback string) {
+	for i, format := range formats {
+		if i > 0 {
+			fmt.Println()
 		}
-	} else if strings.HasSuffix(strings.ToLower(firmwareFile), ".hex") {
-		loaded = f.loadStandardIntelHex(firmwareFile)
-		if loaded {
-			fmt.Printf("Loaded Intel HEX firmware: %s\n", firmwareFile)
+		ascii := make([]byte, len(format.Header))
+		for j, b := range format.Header {
+			ascii[j] = '.'
+			if b >= 0x20 && b < 0x7F {
+				ascii[j] = b
+			}
 		}
-	} else {
-		// Try to detect format by content
-		if f.loadStandardIntelHex(firmwareFile) {
-			loaded = true
-			fmt.Printf("Loaded Intel HEX firmware: %s\n", firmwareFile)
-		} else if f.loadBinaryFirmware(firmwareFile) {
-			loaded = true
-			fmt.Printf("Loaded binary firmware: %s\n", firmwareFile)
+		fmt.Printf("%s\n", format.Name)
+		fmt.Printf("  Extensions:  %s\n", format.Extensions)
+		fmt.Printf("  Description: %s\n", format.Description)
+		for j, detection := range format.Detection {
+			label := "Detection:"
+			if j > 0 {
+				label = ""
+			}
+			fmt.Printf("  %-12s %s\n", label, detection)
+		}
+		fmt.Printf("  Header:      % X  %s\n", format.Header, ascii)
+	}
+	fmt.Printf("\nFallback order: %s\n", fallback)
+}
+
+// embeddedFirmwareFiles holds embedded_firmware.bin or embedded_firmware.hex
+// when built with -tags embed_firmware, see embed_firmware.go
+var embeddedFirmwareFiles *embed.FS
+
+// EmbeddedFirmware returns the firmware image built into the binary. The
+// .bin file is used if both were embedded.
+func EmbeddedFirmware() ([]byte, FirmwareFormat, error) {
+	if embeddedFirmwareFiles == nil {
+		return nil, FormatBin, fmt.Errorf("no embedded firmware, build with -tags embed_firmware and embedded_firmware.bin or .hex next to main.go")
+	}
+	for _, name := range []string{"embedded_firmware.bin", "embedded_firmware.hex"} {
+		data, err := embeddedFirmwareFiles.ReadFile(name)
+		if err == nil {
+			return data, detectFirmwareFormat(name, data), nil
+		}
+	}
+	return nil, FormatBin, fmt.Errorf("embedded firmware must be named embedded_firmware.bin or embedded_firmware.hex")
+}
+
+// writeEmbeddedFirmware copies the embedded firmware to a temporary
+// directory, so it goes through the same checks as a firmware file
+func writeEmbeddedFirmware() (string, error) {
+	data, format, err := EmbeddedFirmware()
+	if err != nil {
+		return "", err
+	}
+	name := "embedded_firmware.bin"
+	if format == FormatHex {
+		name = "embedded_firmware.hex"
+	}
+
+	dir, err := os.MkdirTemp("", "rt6d-firmware-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create firmware directory: %v", err)
+	}
+	dest := filepath.Join(dir, name)
+	if err := os.WriteFile(dest, data, 0644); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("failed to write embedded firmware: %v", err)
+	}
+	return dest, nil
+}
+
+func (f *Flasher) initializeHex(firmwareFile string) bool {
+	if strings.EqualFold(filepath.Ext(firmwareFile), ".rtpkg") {
+		return f.initializePackage(firmwareFile)
+	}
+	if f.SignatureKeyFile != "" {
+		if err := verifyFirmwareSignature(firmwareFile, f.SignatureKeyFile); err != nil {
+			f.log(LogQuiet, "Error: %v\n", err)
+			f.log(LogQuiet, "The firmware may be for a different radio model, refusing to flash it.\n")
+			return false
 		}
+		f.log(LogNormal, "Firmware signature verified\n")
+	}
+
+	metadata, err := loadFirmwareMetadata(firmwareFile)
+	if err == nil && metadata == nil && f.RequireMetadata {
+		err = fmt.Errorf("metadata file %s.meta.json not found", firmwareFile)
+	}
+	if err != nil {
+		f.log(LogQuiet, "Error: %v\n", err)
+		return false
 	}
+	f.Metadata = metadata
 	
-	if !loaded {
-		fmt.Printf("Failed to load firmware file: %s\n", firmwareFile)
+	src := FileFirmwareSource(firmwareFile)
+	if err := f.LoadFirmwareFromReader(src); err != nil {
+		f.log(LogQuiet, "Error: %v\n", err)
+		f.log(LogQuiet, "Failed to load firmware file: %s\n", firmwareFile)
 		return false
 	}
+	f.log(LogNormal, "Loaded %s firmware: %s\n", src.Format(), firmwareFile)
+	if metadata != nil && f.LogLevel >= LogNormal {
+		printFirmwareMetadata(metadata)
+	}
+	if f.HexdumpLength > 0 {
+		fmt.Printf("Image bytes 0x%X-0x%X:\n", f.HexdumpStart, f.HexdumpStart+f.HexdumpLength-1)
+		if err := f.dumpHexArray(f.HexdumpStart, f.HexdumpLength, os.Stdout); err != nil {
+			f.log(LogQuiet, "Error: %v\n", err)
+			return false
+		}
+	}
+	if f.MemoryMap {
+		f.dumpMemoryMap(os.Stdout)
+	}
+	return true
+}
+
+// LoadFirmwareFromReader loads the firmware image from src into the flasher
+// and checks that it fits the firmware area
+func (f *Flasher) LoadFirmwareFromReader(src FirmwareSource) error {
+	f.hex = make([]byte, f.FlashSize)
+	for i := range f.hex {
+		f.hex[i] = f.GapFillByte // 0xFF by default (typical for flash memory)
+	}
+	f.gWritebytes = 0
+	f.writestep = 0
+	f.sourceSize = 0
+	
+	content, err := io.ReadAll(src)
+	if err != nil {
+		return protocolErrorf(ErrFirmwareLoad, -1, "failed to read firmware: %v", err)
+	}
+	
+	switch src.Format() {
+	case FormatBin:
+		f.loadBinaryData(content)
+	case FormatHex:
+		err = f.loadIntelHex(content)
+	default:
+		err = fmt.Errorf("%s firmware is not supported yet", src.Format())
+	}
+	if err != nil {
+		return protocolErrorf(ErrFirmwareLoad, -1, "%v", err)
+	}
+	
+	regions := mergeRegions(f.loadedRanges)
+	if f.LogLevel >= LogNormal {
+		printRegionSummary(regions)
+	}
+	if f.hasEntryPoint {
+		f.checkEntryPoint()
+	}
+	if f.StrictGaps && len(regions) > 1 {
+		return protocolErrorf(ErrFirmwareLoad, -1, "firmware has %d gaps between regions (-strict-gaps)", len(regions)-1)
+	}
+	
+	// Catch empty or oversized images before anything is sent to the radio
+	if err := f.validateFirmwareSize(); err != nil {
+		return protocolErrorf(ErrFirmwareLoad, -1, "%v", err)
+	}
+	if !f.SkipVectorCheck {
+		if err := f.validateVectorTable(); err != nil {
+			return protocolErrorf(ErrFirmwareLoad, -1, "%v", err)
+		}
+	}
 	
 	// Show some hex data for verification
-	fmt.Printf("First 16 bytes of hex array: ")
-	for i := 0; i < 16; i++ {
-		fmt.Printf("%02X ", f.hex[i])
+	var dump strings.Builder
+	if err := f.dumpHexArray(0, 64, &dump); err != nil {
+		f.log(LogVerbose, "Cannot show the first bytes of hex array: %v\n", err)
+	} else {
+		f.log(LogVerbose, "First 64 bytes of hex array:\n%s", dump.String())
 	}
-	fmt.Printf("\n")
-	return true
+	return nil
 }
 
-func (f *Flasher) loadStandardIntelHex(filename string) bool {
-	fmt.Printf("Attempting to load standard Intel HEX firmware: %s\n", filename)
+// dumpHexArray writes length bytes of the image from startOffset on like
+// hexdump -C: the offset, 16 bytes in two groups of 8 and their printable
+// ASCII characters on every line. The range is cut at the end of the image.
+func (f *Flasher) dumpHexArray(startOffset, length int, writer io.Writer) error {
+	if startOffset < 0 || startOffset >= len(f.hex) {
+		return fmt.Errorf("hexdump start 0x%X is outside the 0x%X byte image", startOffset, len(f.hex))
+	}
+	end := min(startOffset+length, len(f.hex))
 	
-	file, err := os.Open(filename)
+	for line := startOffset; line < end; line += 16 {
+		row := f.hex[line:min(line+16, end)]
+		
+		var hexPart, asciiPart strings.Builder
+		for i := 0; i < 16; i++ {
+			if i == 8 {
+				hexPart.WriteByte(' ')
+			}
+			if i >= len(row) {
+				hexPart.WriteString("   ")
+				continue
+			}
+			fmt.Fprintf(&hexPart, " %02x", row[i])
+			if row[i] >= 0x20 && row[i] < 0x7F {
+				asciiPart.WriteByte(row[i])
+			} else {
+				asciiPart.WriteByte('.')
+			}
+		}
+		if _, err := fmt.Fprintf(writer, "%08x %s  |%s|\n", line, hexPart.String(), asciiPart.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// memoryMapRows is the number of rows of dumpMemoryMap
+const memoryMapRows = 64
+
+// dumpMemoryMap writes a bar chart of the image with one line per 1/64th of
+// it: ▓ if more than half of its bytes are not 0xFF, ░ if some are and · if
+// none are. The addresses are printed where a run of ▓ or ░ rows starts and
+// ends.
+func (f *Flasher) dumpMemoryMap(writer io.Writer) {
+	rowSize := (len(f.hex) + memoryMapRows - 1) / memoryMapRows
+	symbols := make([]string, memoryMapRows)
+	for row := range symbols {
+		start := min(row*rowSize, len(f.hex))
+		end := min(start+rowSize, len(f.hex))
+		used := 0
+		for _, b := range f.hex[start:end] {
+			if b != 0xFF {
+				used++
+			}
+		}
+		switch {
+		case used == 0:
+			symbols[row] = "·"
+		case 2*used > end-start:
+			symbols[row] = "▓"
+		default:
+			symbols[row] = "░"
+		}
+	}
+
+	fmt.Fprintf(writer, "Memory map, %d rows of %d bytes (▓ over half used, ░ partly used, · empty):\n",
+		memoryMapRows, rowSize)
+	for row, symbol := range symbols {
+		first := row == 0 || symbols[row-1] != symbol
+		last := row == memoryMapRows-1 || symbols[row+1] != symbol
+		start := 0x08002800 + row*rowSize
+		end := 0x08002800 + min((row+1)*rowSize, len(f.hex)) - 1
+
+		var label string
+		switch {
+		case symbol == "·":
+		case first && last:
+			label = fmt.Sprintf("0x%08X-0x%08X", start, end)
+		case first:
+			label = fmt.Sprintf("0x%08X-", start)
+		case last:
+			label = fmt.Sprintf("          -0x%08X", end)
+		}
+		fmt.Fprintln(writer, strings.TrimRight(fmt.Sprintf("  %2d %s %s", row, symbol, label), " "))
+	}
+}
+
+// parseHexdumpRange parses the <start_hex>:<length_hex> of -hexdump-range
+func parseHexdumpRange(value string) (start, length int, err error) {
+	startArg, lengthArg, ok := strings.Cut(value, ":")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid range '%s', expected <start_hex>:<length_hex>", value)
+	}
+	startValue, err := strconv.ParseUint(strings.TrimPrefix(startArg, "0x"), 16, 31)
 	if err != nil {
-		fmt.Printf("Standard Intel HEX file not found: %s\n", filename)
-		return false
+		return 0, 0, fmt.Errorf("invalid start '%s'", startArg)
+	}
+	lengthValue, err := strconv.ParseUint(strings.TrimPrefix(lengthArg, "0x"), 16, 31)
+	if err != nil || lengthValue == 0 {
+		return 0, 0, fmt.Errorf("invalid length '%s'", lengthArg)
+	}
+	return int(startValue), int(lengthValue), nil
+}
+
+// MemoryRegion is a range of the firmware image as offsets from its start,
+// EndOffset is exclusive
+type MemoryRegion struct {
+	StartOffset int `yaml:"start" jsonschema:"required,description=First offset of the region in the image"`
+	EndOffset   int `yaml:"end" jsonschema:"required,description=Offset after the last byte of the region"`
+}
+
+// parseMemoryRegion parses the <start_hex>:<end_hex> of -protect-region
+func parseMemoryRegion(value string) (MemoryRegion, error) {
+	startArg, endArg, ok := strings.Cut(value, ":")
+	if !ok {
+		return MemoryRegion{}, fmt.Errorf("invalid region '%s', expected <start_hex>:<end_hex>", value)
+	}
+	start, err := strconv.ParseUint(strings.TrimPrefix(startArg, "0x"), 16, 31)
+	if err != nil {
+		return MemoryRegion{}, fmt.Errorf("invalid start '%s'", startArg)
+	}
+	end, err := strconv.ParseUint(strings.TrimPrefix(endArg, "0x"), 16, 31)
+	if err != nil || end <= start {
+		return MemoryRegion{}, fmt.Errorf("invalid end '%s', must be above the start", endArg)
+	}
+	return MemoryRegion{StartOffset: int(start), EndOffset: int(end)}, nil
+}
+
+// LoadSymbolMap reads the function symbols of the ELF file the firmware was
+// built from, so block addresses can be reported by function name
+func (f *Flasher) LoadSymbolMap(elfFile string) error {
+	file, err := elf.Open(elfFile)
+	if err != nil {
+		return fmt.Errorf("failed to open ELF file: %v", err)
 	}
 	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
+	symbols, err := file.Symbols()
+	if err != nil {
+		return fmt.Errorf("failed to read ELF symbols: %v", err)
+	}
+
+	f.Symbols = make(map[uint32]string)
+	f.symbolAddrs = nil
+	for _, sym := range symbols {
+		if elf.ST_TYPE(sym.Info) != elf.STT_FUNC || sym.Name == "" {
+			continue
+		}
+		// Bit 0 of Thumb function addresses is the Thumb bit
+		addr := uint32(sym.Value) &^ 1
+		if _, ok := f.Symbols[addr]; !ok {
+			f.symbolAddrs = append(f.symbolAddrs, addr)
+		}
+		f.Symbols[addr] = sym.Name
+	}
+	if len(f.Symbols) == 0 {
+		return fmt.Errorf("%s has no function symbols", elfFile)
+	}
+	sort.Slice(f.symbolAddrs, func(i, j int) bool { return f.symbolAddrs[i] < f.symbolAddrs[j] })
+
+	f.log(LogNormal, "Loaded %d function symbols from %s\n", len(f.Symbols), elfFile)
+	return nil
+}
+
+// describeAddress formats a device address with the nearest function
+// symbol at or below it, e.g. "0x0802F800 <_radio_init+0x200>". Without a
+// symbol map it is the bare address.
+func (f *Flasher) describeAddress(addr uint32) string {
+	if sym := f.symbolAt(addr); sym != "" {
+		return fmt.Sprintf("0x%08X %s", addr, sym)
+	}
+	return fmt.Sprintf("0x%08X", addr)
+}
+
+// symbolAt returns the nearest function symbol at or below addr, e.g.
+// "<_radio_init+0x200>", or "" if there is none
+func (f *Flasher) symbolAt(addr uint32) string {
+	i := sort.Search(len(f.symbolAddrs), func(i int) bool { return f.symbolAddrs[i] > addr })
+	if i == 0 {
+		return ""
+	}
+	sym := f.symbolAddrs[i-1]
+	if addr == sym {
+		return fmt.Sprintf("<%s>", f.Symbols[sym])
+	}
+	return fmt.Sprintf("<%s+0x%X>", f.Symbols[sym], addr-sym)
+}
+
+// loadIntelHex loads the records of an Intel HEX file
+func (f *Flasher) loadIntelHex(content []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(content))
 	recordCount := 0
 	extendedAddress := 0
+	f.loadedRanges = nil
+	f.firstSegment = -1
+	f.EntryPoint = 0
+	f.hasEntryPoint = false
+	if f.BaseAddressAutodetect {
+		base, err := detectHexBaseAddress(content)
+		if err != nil {
+			return fmt.Errorf("base address autodetection failed: %v", err)
+		}
+		f.log(LogNormal, "WARNING: Detected base address 0x%08X, the file's own addresses are ignored\n", base)
+		f.BaseAddressOverride = &base
+	} else if f.BaseAddressOverride != nil {
+		f.log(LogNormal, "WARNING: Using base address 0x%08X, the file's own addresses are ignored\n", *f.BaseAddressOverride)
+	}
+	if f.UseSparse {
+		f.sparse = NewSparseFirmware()
+		f.sparse.FillByte = f.GapFillByte
+	} else {
+		f.sparse = nil
+	}
 	
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
@@ -158,24 +976,29 @@ func (f *Flasher) loadStandardIntelHex(filename string) bool {
 		}
 		
 		if !f.processIntelHexRecord(line, &extendedAddress) {
-			fmt.Printf("Error processing Intel HEX record: %s\n", line)
-			return false
+			return fmt.Errorf("invalid Intel HEX record: %s", line)
 		}
 		recordCount++
 	}
 	
 	if err := scanner.Err(); err != nil {
-		fmt.Printf("Error reading Intel HEX file: %v\n", err)
-		return false
+		return fmt.Errorf("failed to read Intel HEX data: %v", err)
+	}
+	if recordCount == 0 {
+		return fmt.Errorf("no Intel HEX records found")
 	}
 	
-	fmt.Printf("Processed %d Intel HEX records\n", recordCount)
-	return recordCount > 0
+	f.log(LogNormal, "Processed %d Intel HEX records\n", recordCount)
+	if f.sparse != nil {
+		f.log(LogNormal, "Sparse image: %d bytes populated in %d regions\n", f.sparse.Len(), len(f.sparse.PopulatedRegions()))
+		f.hex = f.sparse.ToSlice(0x08002800, uint32(f.FlashSize))
+	}
+	return nil
 }
 
 func (f *Flasher) processIntelHexRecord(record string, extendedAddress *int) bool {
 	if len(record) < 11 {
-		fmt.Printf("Skipping short record: %s\n", record)
+		f.log(LogNormal, "Skipping short record: %s\n", record)
 		return true // Skip short records instead of failing
 	}
 	
@@ -199,10 +1022,16 @@ func (f *Flasher) processIntelHexRecord(record string, extendedAddress *int) boo
 	
 	switch recordType {
 	case 0: // Data record
+		if f.firstSegment < 0 {
+			f.firstSegment = *extendedAddress
+		}
 		fullAddress := *extendedAddress + int(addr)
+		if f.BaseAddressOverride != nil {
+			fullAddress = int(*f.BaseAddressOverride) + *extendedAddress - f.firstSegment + int(addr)
+		}
 		// Map ARM addresses to our hex array (subtract base address 0x08002800)
 		targetBase := fullAddress - 0x08002800
-		if targetBase < 0 {
+		if targetBase < 0 && f.sparse == nil {
 			return true // Skip records before our target area  
 		}
 		
@@ -215,15 +1044,25 @@ func (f *Flasher) processIntelHexRecord(record string, extendedAddress *int) boo
 				return false
 			}
 			
+			if f.sparse != nil {
+				f.sparse.Set(uint32(fullAddress+i), byte(dataByte))
+				continue
+			}
+
 			targetAddr := targetBase + i
 			if targetAddr >= 0 && targetAddr < len(f.hex) {
 				f.hex[targetAddr] = byte(dataByte)
 			}
 		}
+		if targetBase < 0 {
+			return true // Only kept in the sparse image
+		}
+		f.addLoadedRange(targetBase, targetBase+int(length))
+		f.sourceSize = max(f.sourceSize, targetBase+int(length))
 	case 1: // End of file
 		return true
 	case 4: // Extended Linear Address
-		if length != 2 {
+		if length != 2 || len(record) < 13 {
 			return false
 		}
 		extAddr, err := strconv.ParseInt(record[9:13], 16, 32)
@@ -231,514 +1070,6932 @@ func (f *Flasher) processIntelHexRecord(record string, extendedAddress *int) boo
 			return false
 		}
 		*extendedAddress = int(extAddr) << 16
+	case 3: // Start Segment Address (CS:IP)
+		if length != 4 || len(record) < 17 {
+			return false
+		}
+		cs, err1 := strconv.ParseUint(record[9:13], 16, 16)
+		ip, err2 := strconv.ParseUint(record[13:17], 16, 16)
+		if err1 != nil || err2 != nil {
+			return false
+		}
+		f.EntryPoint = uint32(cs)<<4 + uint32(ip)
+		f.hasEntryPoint = true
+	case 5: // Start Linear Address
+		if length != 4 || len(record) < 17 {
+			return false
+		}
+		eip, err := strconv.ParseUint(record[9:17], 16, 32)
+		if err != nil {
+			return false
+		}
+		f.EntryPoint = uint32(eip)
+		f.hasEntryPoint = true
 	}
 	
 	return true
 }
 
-func (f *Flasher) loadBinaryFirmware(filename string) bool {
-	fmt.Printf("Attempting to load binary firmware: %s\n", filename)
-	
-	// Check if file exists and get info
-	fileInfo, err := os.Stat(filename)
-	if err != nil {
-		fmt.Printf("Binary file not found: %s\n", filename)
-		return false
+// checkEntryPoint prints the entry point of a HEX file and warns if it is
+// not the start of the firmware area, as for firmware built for another
+// memory layout
+func (f *Flasher) checkEntryPoint() {
+	f.log(LogNormal, "Entry point: 0x%08X\n", f.EntryPoint)
+
+	if f.EntryPoint != 0x08002800 {
+		f.log(LogNormal, "WARNING: entry point 0x%08X differs from expected 0x08002800 - verify firmware is correct\n", f.EntryPoint)
 	}
-	fmt.Printf("Binary file size: %d bytes\n", fileInfo.Size())
-	
-	// Read binary file content
-	content, err := os.ReadFile(filename)
-	if err != nil {
-		fmt.Printf("Error reading binary file %s: %v\n", filename, err)
-		return false
+}
+
+// validateVectorTable checks the start of the Cortex-M vector table at the
+// beginning of the image: the initial stack pointer must point into SRAM
+// and the reset handler into flash with the Thumb bit set. Anything else
+// usually means the image was loaded at the wrong offset.
+func (f *Flasher) validateVectorTable() error {
+	if len(f.hex) < 8 {
+		return fmt.Errorf("firmware is too short for a vector table")
 	}
-	
-	// Copy binary data directly to hex array
+	stack := binary.LittleEndian.Uint32(f.hex[0:4])
+	reset := binary.LittleEndian.Uint32(f.hex[4:8])
+
+	if stack < 0x20000000 || stack > 0x20100000 {
+		return fmt.Errorf("initial stack pointer 0x%08X is not in SRAM (0x20000000-0x20100000), "+
+			"the firmware may be loaded at the wrong offset (-skip-vector-check to flash it anyway)", stack)
+	}
+	if reset < 0x08000001 || reset >= 0x08040000 || reset&1 == 0 {
+		return fmt.Errorf("reset vector 0x%08X is not a Thumb address in flash (0x08000001-0x08040000), "+
+			"the firmware may be loaded at the wrong offset (-skip-vector-check to flash it anyway)", reset)
+	}
+	f.log(LogNormal, "Stack: 0x%08X, Reset: 0x%08X\n", stack, reset)
+	return nil
+}
+
+// detectHexBaseAddress returns the base address that moves the lowest data
+// address of a HEX file to the start of the firmware area (0x08002800)
+func detectHexBaseAddress(content []byte) (uint32, error) {
+	extendedAddress := 0
+	firstSegment := -1
+	lowest := -1
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) < 11 || line[0] != ':' {
+			continue
+		}
+		length, err1 := strconv.ParseInt(line[1:3], 16, 32)
+		addr, err2 := strconv.ParseInt(line[3:7], 16, 32)
+		recordType, err3 := strconv.ParseInt(line[7:9], 16, 32)
+		if err1 != nil || err2 != nil || err3 != nil {
+			return 0, fmt.Errorf("invalid record: %s", line)
+		}
+
+		switch recordType {
+		case 0:
+			if length == 0 {
+				continue
+			}
+			if firstSegment < 0 {
+				firstSegment = extendedAddress
+			}
+			if full := extendedAddress + int(addr); lowest < 0 || full < lowest {
+				lowest = full
+			}
+		case 4:
+			if len(line) < 13 {
+				return 0, fmt.Errorf("invalid record: %s", line)
+			}
+			extAddr, err := strconv.ParseInt(line[9:13], 16, 32)
+			if err != nil {
+				return 0, fmt.Errorf("invalid record: %s", line)
+			}
+			extendedAddress = int(extAddr) << 16
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read HEX data: %v", err)
+	}
+	if lowest < 0 {
+		return 0, fmt.Errorf("no data records")
+	}
+
+	offset := lowest - firstSegment
+	if offset > 0x08002800 {
+		return 0, fmt.Errorf("lowest data address 0x%08X is too far into its segment", lowest)
+	}
+	return uint32(0x08002800 - offset), nil
+}
+
+// loadBinaryData copies a raw image to the start of the firmware area
+func (f *Flasher) loadBinaryData(content []byte) {
 	copySize := min(len(content), len(f.hex))
 	copy(f.hex[:copySize], content)
+	f.loadedRanges = []hexRegion{{start: 0, end: copySize}}
+	f.sourceSize = len(content)
 	
-	fmt.Printf("Loaded %d bytes of binary firmware\n", copySize)
-	return true
+	f.log(LogNormal, "Loaded %d bytes of binary firmware\n", copySize)
 }
 
 func (f *Flasher) loadFirmwareFromFile(filename string) bool {
-	fmt.Printf("Attempting to load Intel HEX firmware: %s\n", filename)
+	f.log(LogNormal, "Attempting to load Intel HEX firmware: %s\n", filename)
 	
 	// Check if file exists and get info
 	fileInfo, err := os.Stat(filename)
 	if err != nil {
-		fmt.Printf("Intel HEX file not found: %s\n", filename)
+		f.log(LogNormal, "Intel HEX file not found: %s\n", filename)
 		return false
 	}
-	fmt.Printf("Intel HEX file size: %d bytes\n", fileInfo.Size())
+	f.log(LogVerbose, "Intel HEX file size: %d bytes\n", fileInfo.Size())
 	
 	// Read entire file content
 	content, err := os.ReadFile(filename)
 	if err != nil {
-		fmt.Printf("Error reading Intel HEX file %s: %v\n", filename, err)
+		f.log(LogQuiet, "Error reading Intel HEX file %s: %v\n", filename, err)
 		return false
 	}
 	
 	f.allcode = string(content)
 	f.cntcode = 0
-	fmt.Printf("Loaded Intel HEX data from %s (%d chars)\n", filename, len(f.allcode))
+	f.log(LogNormal, "Loaded Intel HEX data from %s (%d chars)\n", filename, len(f.allcode))
 	
 	if len(f.allcode) > 0 {
-		fmt.Printf("First 100 chars: %s\n", f.allcode[:min(100, len(f.allcode))])
+		f.log(LogVerbose, "First 100 chars: %s\n", f.allcode[:min(100, len(f.allcode))])
 		return true
 	} else {
-		fmt.Printf("Warning: File was read but content is empty!\n")
+		f.log(LogNormal, "Warning: File was read but content is empty!\n")
 		return false
 	}
 }
 
-func min(a, b int) int {
-	if a < b {
-		return a
+// validateFirmwareSize checks that the loaded image is neither empty, nor
+// completely filled, nor larger than the firmware area (246 blocks by
+// default)
+func (f *Flasher) validateFirmwareSize() error {
+	if f.sourceSize > len(f.hex) {
+		return fmt.Errorf("firmware is %d bytes, larger than the %d byte flash region", f.sourceSize, len(f.hex))
 	}
-	return b
-}
-
-func (f *Flasher) checksum(array []byte, length int) byte {
-	var sum byte = 0
-	for i := 0; i < length-1; i++ {
-		sum += array[i]
+	if f.MaxFirmwareBytes > 0 && f.sourceSize > f.MaxFirmwareBytes {
+		return fmt.Errorf("firmware is %d bytes, more than the limit of %d bytes", f.sourceSize, f.MaxFirmwareBytes)
 	}
-	return sum + f.checksumOffset
-}
 
-func (f *Flasher) charToInt(char rune) int {
-	num := int(char)
-	if num > 47 && num < 58 {
-		return num - 48
+	last := -1
+	filled := 0
+	for i, b := range f.hex {
+		if b != f.GapFillByte {
+			last = i
+			filled++
+		}
 	}
-	if num > 64 && num < 71 {
-		return num - 55
+	if filled == 0 {
+		return fmt.Errorf("firmware is empty (all bytes are 0x%02X)", f.GapFillByte)
 	}
-	if num > 96 && num < 103 {
-		return num - 87
+	// A real image leaves some bytes erased, none at all means the load
+	// filled the buffer with something else
+	if filled == len(f.hex) {
+		return fmt.Errorf("firmware fills all %d bytes of the flash region without a single 0x%02X byte, the load probably failed",
+			len(f.hex), f.GapFillByte)
 	}
-	fmt.Printf("发现无效字符: %c\n", char)
-	return 0
+
+	// The image is sent in BlockSize blocks
+	blocks := last/f.BlockSize + 1
+	if blocks > len(f.hex)/f.BlockSize {
+		return fmt.Errorf("firmware needs %d blocks, only %d fit", blocks, len(f.hex)/f.BlockSize)
+	}
+	f.log(LogNormal, "Firmware footprint: %d bytes across %d blocks\n", blocks*f.BlockSize, blocks)
+	return nil
 }
 
-func (f *Flasher) stringOperation() bool {
-	if f.allcode == "" {
-		return false
+// loadSignatureKey reads an HMAC key: exactly 32 raw bytes or a text file
+// with 64 hex characters (same format as rt6d-sign)
+func loadSignatureKey(keyFile string) ([]byte, error) {
+	content, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %v", err)
 	}
-	
-	i := 0
-	defer func() {
-		if r := recover(); r != nil {
-			// Handle panic gracefully
-		}
-	}()
 
-	// Find next ':'
-	for f.cntcode+i < len(f.allcode) && (f.allcode[f.cntcode+i] != ':' || i == 0) {
-		i++
+	text := strings.TrimSpace(string(content))
+	if len(text) == 64 {
+		if key, err := hex.DecodeString(text); err == nil {
+			return key, nil
+		}
 	}
-	
-	if f.cntcode+i >= len(f.allcode) {
-		return false
+	if len(content) == 32 {
+		return content, nil
 	}
+	return nil, fmt.Errorf("key file must contain 32 bytes or 64 hex characters")
+}
 
-	text := f.allcode[f.cntcode : f.cntcode+i]
-	f.cntcode += i
+// verifyFirmwareSignature checks <firmwareFile>.sig, the hex encoded
+// HMAC-SHA256 of the firmware file created by rt6d-sign
+func verifyFirmwareSignature(firmwareFile, keyFile string) error {
+	key, err := loadSignatureKey(keyFile)
+	if err != nil {
+		return err
+	}
 
-	if len(text) < 9 {
-		return false
+	sigText, err := os.ReadFile(firmwareFile + ".sig")
+	if err != nil {
+		return fmt.Errorf("signature file %s.sig not found", firmwareFile)
+	}
+	signature, err := hex.DecodeString(strings.TrimSpace(string(sigText)))
+	if err != nil {
+		return fmt.Errorf("invalid signature file %s.sig: %v", firmwareFile, err)
 	}
 
-	num := f.charToInt(rune(text[7]))
-	num <<= 4
-	recordType := num + f.charToInt(rune(text[8]))
+	firmware, err := os.ReadFile(firmwareFile)
+	if err != nil {
+		return fmt.Errorf("failed to read firmware file: %v", err)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(firmware)
+	if !hmac.Equal(mac.Sum(nil), signature) {
+		return fmt.Errorf("firmware signature does not match %s.sig", firmwareFile)
+	}
+	return nil
+}
 
-	switch recordType {
-	case 0: // Data record
-		if len(text) < 10 {
-			return true
-		}
-		
-		num2 := f.charToInt(rune(text[1]))
-		num2 <<= 4
-		num2 += f.charToInt(rune(text[2]))
-		
-		num3 := f.charToInt(rune(text[3]))
-		num3 <<= 4
-		num3 += f.charToInt(rune(text[4]))
-		num3 <<= 4
-		num3 += f.charToInt(rune(text[5]))
-		num3 <<= 4
-		num3 += f.charToInt(rune(text[6]))
-		
-		for j := 0; j < num2; j++ {
-			if 9+j*2+1 >= len(text) {
-				break
-			}
-			num := f.charToInt(rune(text[9+j*2]))
-			num <<= 4
-			num += f.charToInt(rune(text[10+j*2]))
-			
-			addr := num3 + j - 10240 + (f.writestep-1)*65536
-			if addr >= 0 && addr < len(f.hex) {
-				f.hex[addr] = byte(num)
-			}
-		}
-		return true
-	case 1: // End of file record
-		return false
-	case 4: // Extended linear address record
-		f.writestep++
-		return true
-	default:
-		return true
+// queryForChecks queries the radio on f.port once for checkSerialNumber and
+// checkHardwareRevision, only if one of them needs it. The query is a
+// connect command, so acked reports whether the radio ACKed one and the
+// handshake has to go on from there.
+func (f *Flasher) queryForChecks() (info *DeviceInfo, acked bool, err error) {
+	m := f.Metadata
+	limitsRevision := m != nil && (m.MinHardwareRevision != "" || m.MaxHardwareRevision != "")
+	if f.SerialNumber == "" && !limitsRevision {
+		return nil, false, nil
 	}
+	// The query sets a short read timeout, readData expects blocking reads
+	defer f.port.SetReadTimeout(serial.NoTimeout)
+	info, err = f.QueryDeviceInfo()
+	return info, err == nil, err
 }
 
-func (f *Flasher) getAvailablePorts() []string {
-	ports, err := serial.GetPortsList()
+// checkHardwareRevision warns when the radio is outside the hardware
+// revisions of the firmware metadata. info and err are the result of
+// queryForChecks.
+func (f *Flasher) checkHardwareRevision(info *DeviceInfo, err error) {
+	m := f.Metadata
+	if m == nil || (m.MinHardwareRevision == "" && m.MaxHardwareRevision == "") {
+		return
+	}
 	if err != nil {
-		return []string{}
+		f.log(LogNormal, "Warning: could not read the hardware revision of the radio: %v\n", err)
+		return
+	}
+	inRange, ok := m.checkHardwareRevision(info.HardwareRevision)
+	switch {
+	case !ok:
+		f.log(LogNormal, "Warning: the radio did not report its hardware revision, the firmware is for %s - %s\n",
+			m.MinHardwareRevision, m.MaxHardwareRevision)
+	case !inRange:
+		f.log(LogQuiet, "Warning: hardware revision %s is outside %s - %s supported by this firmware\n",
+			info.HardwareRevision, m.MinHardwareRevision, m.MaxHardwareRevision)
+	default:
+		f.log(LogVerbose, "Hardware revision %s is supported by the firmware\n", info.HardwareRevision)
 	}
-	sort.Strings(ports)
-	return ports
 }
 
-func (f *Flasher) clearRecvbuf() {
-	for i := 0; i < len(f.recvbuf); i++ {
-		f.recvbuf[i] = 255
+// checkSerialNumber refuses to flash when the radio reports a serial number
+// other than f.SerialNumber, ignoring case. info and err are the result of
+// the query by queryForChecks. A radio that doesn't report one is flashed
+// with a warning, unless StrictSerial is set.
+func (f *Flasher) checkSerialNumber(info *DeviceInfo, err error) error {
+	if f.SerialNumber == "" {
+		return nil
 	}
-	f.recvcnt = 0
+	reported := ""
+	if err == nil && info.SerialNumber != "unknown" {
+		reported = strings.TrimSpace(info.SerialNumber)
+	}
+	if reported == "" {
+		reason := "the radio did not report a serial number"
+		if err != nil {
+			reason = fmt.Sprintf("could not read the serial number of the radio: %v", err)
+		}
+		if f.StrictSerial {
+			return fmt.Errorf("%s, refusing to flash with -strict-serial", reason)
+		}
+		f.log(LogQuiet, "Warning: %s, flashing without checking it\n", reason)
+		return nil
+	}
+	if !strings.EqualFold(reported, f.SerialNumber) {
+		return fmt.Errorf("Expected serial %s but got %s — refusing to flash wrong device", f.SerialNumber, reported)
+	}
+	f.log(LogNormal, "Serial number %s matches\n", reported)
+	return nil
 }
 
-func (f *Flasher) dataSum(array []byte) byte {
-	var sum byte = 0
-	for i := 0; i < int(array[2])-1; i++ {
-		sum += array[i]
-	}
-	return sum
+// FirmwareMetadata describes a firmware file, read from the
+// <firmware>.meta.json sidecar published next to it
+type FirmwareMetadata struct {
+	Version             string `json:"version"`
+	RadioModel          string `json:"radio_model"`
+	MinHardwareRevision string `json:"min_hardware_revision"` // Empty for no lower bound
+	MaxHardwareRevision string `json:"max_hardware_revision"` // Empty for no upper bound
+	CRC32               string `json:"crc32"`                 // Of the firmware file, 8 hex digits
+	Description         string `json:"description"`
+	ReleaseDate         string `json:"release_date"`
 }
 
-func (f *Flasher) revDateOperation() {
-	if f.recvcnt != 1 {
-		return
+// loadFirmwareMetadata reads <firmwareFile>.meta.json, nil if there is none.
+// A CRC32 in the sidecar has to match the firmware file.
+func loadFirmwareMetadata(firmwareFile string) (*FirmwareMetadata, error) {
+	metaFile := firmwareFile + ".meta.json"
+	if _, err := os.Stat(metaFile); os.IsNotExist(err) {
+		return nil, nil
 	}
+	return readFirmwareMetadata(metaFile, firmwareFile)
+}
 
-	fmt.Printf("Processing received byte: 0x%02X in step %d\n", f.recvbuf[0], f.step)
+// readFirmwareMetadata reads the metadata of firmwareFile from metaFile
+func readFirmwareMetadata(metaFile, firmwareFile string) (*FirmwareMetadata, error) {
+	content, err := os.ReadFile(metaFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata file: %v", err)
+	}
 
-	switch f.recvbuf[0] {
-	case 50: // 0x32
-		// Do nothing
-		break
-	case 0: // Connection established
-		f.recvcnt = 0
-		break
-	case 255: // NAK - Error
-		if f.step == 4 && f.sendcnt > 0 {
-			// NAK during data transfer - retry the packet
-			fmt.Printf("NAK received! Block %d rejected. Data at offset %d--%d\n", 
-				f.gWritebytes, f.sendcnt-1024, f.sendcnt-1)
-			
-			// Show first few bytes of the rejected block for debugging
-			fmt.Printf("Rejected block data (first 16 bytes): ")
-			startOffset := f.sendcnt - 1024
-			if startOffset >= 0 {
-				for i := 0; i < 16 && startOffset+i < len(f.hex); i++ {
-					fmt.Printf("%02X ", f.hex[startOffset+i])
-				}
-			}
-			fmt.Printf("\n")
-			
-			// Show the checksum that was sent
-			fmt.Printf("Sent checksum: 0x%02X\n", f.sendbuf[1027])
-			
-			// Retry the packet
-			f.retryLastPacket()
-		} else {
-			// NAK during connection phase
-			fmt.Printf("NAK received during connection phase (step %d)\n", f.step)
-			f.port.Close()
-			f.step = 0
-			fmt.Println("Communication Error - NAK received!")
-			f.clearRecvbuf()
+	var metadata FirmwareMetadata
+	if err := json.Unmarshal(content, &metadata); err != nil {
+		return nil, fmt.Errorf("invalid metadata file %s: %v", metaFile, err)
+	}
+	if metadata.CRC32 != "" {
+		firmware, err := os.ReadFile(firmwareFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read firmware file: %v", err)
 		}
-		break
-	case 6: // ACK - acknowledgment
-		f.recvcnt = 0
-		f.waitingForAck = false // Clear waiting state
-		f.retryCount = 0        // Reset retry counter
-		
-		if f.step < 3 {
-			f.step++
-			fmt.Printf("Connection step %d, sending connect command\n", f.step)
-			f.port.Write(f.sendConnect)
-			time.Sleep(50 * time.Millisecond)
-		} else if f.step == 3 {
-			fmt.Println("Sending update command")
-			f.port.Write(f.sendUpdate)
-			time.Sleep(50 * time.Millisecond)
-			f.step = 4
-		} else if f.step == 4 {
-			// Data transfer phase - ACK received, can send next packet
-			fmt.Printf("ACK received for block %d\n", f.gWritebytes)
-			
-			// Send next packet
-			f.gWritebytes++
-			fmt.Printf("Progress: %03d/246 (sending block at offset %d)\n", f.gWritebytes, f.sendcnt)
-			
-			f.sendbuf[1] = byte(f.sendcnt >> 8)
-			f.sendbuf[2] = byte(f.sendcnt & 0xFF)
-			
-			for i := 0; i < 1024; i++ {
-				f.sendbuf[3+i] = f.hex[f.sendcnt+i]
-			}
-			f.sendbuf[1027] = f.checksum(f.sendbuf, 1028)
-			
-			f.sendDataPacket()
-			f.sendcnt += 1024
-			
-			if f.sendcnt >= 251904 {
-				f.step = 5
-				fmt.Println("Data transfer completed! Sending end command...")
-				f.port.Write(f.sendEnd)
-				time.Sleep(100 * time.Millisecond)
-				f.port.Close()
-			}
+		crc := fmt.Sprintf("%08X", crc32.ChecksumIEEE(firmware))
+		if !strings.EqualFold(strings.TrimPrefix(metadata.CRC32, "0x"), crc) {
+			return nil, fmt.Errorf("firmware CRC32 is %s, %s says %s", crc, metaFile, metadata.CRC32)
 		}
-		break
-	default:
-		fmt.Printf("Unknown response: 0x%02X\n", f.recvbuf[0])
-		f.recvcnt = 0
-		break
 	}
+	return &metadata, nil
 }
 
-func (f *Flasher) sendDataPacket() {
-	fmt.Printf("Sending block data (first 16 bytes): ")
-	for i := 0; i < 16; i++ {
-		fmt.Printf("%02X ", f.sendbuf[3+i])
+// printFirmwareMetadata shows the fields of a metadata sidecar that are set
+func printFirmwareMetadata(m *FirmwareMetadata) {
+	hardware := ""
+	if m.MinHardwareRevision != "" || m.MaxHardwareRevision != "" {
+		hardware = fmt.Sprintf("%s - %s", m.MinHardwareRevision, m.MaxHardwareRevision)
 	}
-	fmt.Printf("\n")
-	fmt.Printf("Block header: %02X %02X %02X, checksum: %02X\n", 
-		f.sendbuf[0], f.sendbuf[1], f.sendbuf[2], f.sendbuf[1027])
-	
-	n, err := f.port.Write(f.sendbuf[:1028])
-	if err != nil {
-		fmt.Printf("Write error: %v\n", err)
-	} else {
-		fmt.Printf("Sent %d bytes\n", n)
+	fmt.Println("\nFirmware metadata:")
+	for _, field := range []struct{ name, value string }{
+		{"Version", m.Version},
+		{"Radio model", m.RadioModel},
+		{"Hardware revisions", hardware},
+		{"CRC32", m.CRC32},
+		{"Release date", m.ReleaseDate},
+		{"Description", m.Description},
+	} {
+		if field.value != "" {
+			fmt.Printf("  %-19s %s\n", field.name+":", field.value)
+		}
 	}
-	
-	f.lastPacketTime = time.Now()
-	f.waitingForAck = true
-	f.retryCount = 0
 }
 
-func (f *Flasher) retryLastPacket() {
-	if f.retryCount < f.maxRetries {
-		f.retryCount++
-		fmt.Printf("Timeout! Retrying packet (attempt %d/%d) - going back to block %d\n", 
-			f.retryCount, f.maxRetries, f.gWritebytes-1)
-		
-		// Go back one packet
-		f.sendcnt -= 1024
-		f.gWritebytes--
-		f.waitingForAck = false
-		
-		fmt.Printf("Reset state: sendcnt=%d, gWritebytes=%d, waitingForAck=%t\n", 
-			f.sendcnt, f.gWritebytes, f.waitingForAck)
-	} else {
-		fmt.Printf("Max retries exceeded. Aborting transfer.\n")
-		f.port.Close()
-		f.step = 0
+// checkHardwareRevision reports whether a hardware revision lies in the
+// range of the metadata, ok is false if it can't be told
+func (m *FirmwareMetadata) checkHardwareRevision(revision string) (inRange, ok bool) {
+	if revision == "" || revision == "unknown" {
+		return false, false
 	}
+	if m.MinHardwareRevision != "" && compareRevisions(revision, m.MinHardwareRevision) < 0 {
+		return false, true
+	}
+	if m.MaxHardwareRevision != "" && compareRevisions(revision, m.MaxHardwareRevision) > 0 {
+		return false, true
+	}
+	return true, true
 }
 
-func (f *Flasher) checkTimeout() {
-	if f.waitingForAck && time.Since(f.lastPacketTime) > f.packetTimeout {
-		fmt.Printf("Timeout detected! Waiting for ACK for %.1f seconds\n", time.Since(f.lastPacketTime).Seconds())
-		f.retryLastPacket()
+var revisionPart = regexp.MustCompile(`[0-9]+|[^0-9]+`)
+
+// compareRevisions compares revision strings like "V1.2" and "V1.10" part by
+// part, numbers by value and everything else case insensitive
+func compareRevisions(a, b string) int {
+	pa := revisionPart.FindAllString(strings.ToUpper(a), -1)
+	pb := revisionPart.FindAllString(strings.ToUpper(b), -1)
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		na, errA := strconv.Atoi(pa[i])
+		nb, errB := strconv.Atoi(pb[i])
+		switch {
+		case errA == nil && errB == nil && na != nb:
+			if na < nb {
+				return -1
+			}
+			return 1
+		case (errA != nil || errB != nil) && pa[i] != pb[i]:
+			return strings.Compare(pa[i], pb[i])
+		}
 	}
+	return len(pa) - len(pb)
 }
 
-func (f *Flasher) readData() {
-	buffer := make([]byte, 1)
-	for f.port != nil {
-		// Check for timeout on each loop
-		f.checkTimeout()
-		
-		n, err := f.port.Read(buffer)
-		if err != nil || n == 0 {
-			time.Sleep(1 * time.Millisecond)
+// Files of a .rtpkg firmware package, a ZIP archive
+const (
+	packageFirmware  = "firmware.bin"
+	packageMetadata  = "metadata.json"
+	packageRegions   = "regions.yaml"
+	packageSignature = "signature.hmac" // Optional, <firmware>.sig of rt6d-sign
+)
+
+// PackageRegion is a named address range of the MCU flash, as in
+// rt6d-firmware-regions.yaml
+type PackageRegion struct {
+	Name         string `yaml:"name"`
+	StartAddress uint32 `yaml:"start_address"`
+	Size         uint32 `yaml:"size"`
+}
+
+// loadPackageRegions reads the region map of a firmware package
+func loadPackageRegions(path string) ([]PackageRegion, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read region map: %v", err)
+	}
+	var m struct {
+		Regions []PackageRegion `yaml:"regions"`
+	}
+	if err := yaml.Unmarshal(content, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse region map: %v", err)
+	}
+	for _, r := range m.Regions {
+		if r.Name == "" || r.Size == 0 {
+			return nil, fmt.Errorf("region map entries need a name and a size")
+		}
+	}
+	return m.Regions, nil
+}
+
+// imageSpace returns the bytes available to the image in the region holding
+// the image base 0x08002800
+func imageSpace(regions []PackageRegion) (PackageRegion, int, error) {
+	const base = 0x08002800
+	for _, r := range regions {
+		if base >= r.StartAddress && base-r.StartAddress < r.Size {
+			return r, int(r.StartAddress + r.Size - base), nil
+		}
+	}
+	return PackageRegion{}, 0, fmt.Errorf("region map has no region at the image base 0x%08X", base)
+}
+
+// PackFirmware writes a .rtpkg package of a binary firmware image, its
+// metadata and region map. A <binFile>.sig signature is added when present.
+func PackFirmware(binFile, metaFile, regionsFile string, outPkg string) error {
+	content, err := os.ReadFile(binFile)
+	if err != nil {
+		return fmt.Errorf("failed to read firmware file: %v", err)
+	}
+	if detectFirmwareFormat(binFile, content) != FormatBin {
+		return fmt.Errorf("%s is not a binary image, packages hold firmware.bin", binFile)
+	}
+	if _, err := readFirmwareMetadata(metaFile, binFile); err != nil {
+		return err
+	}
+	regions, err := loadPackageRegions(regionsFile)
+	if err != nil {
+		return err
+	}
+	if _, space, err := imageSpace(regions); err != nil {
+		return err
+	} else if len(content) > space {
+		return fmt.Errorf("firmware is %d bytes, the region map leaves %d bytes for it", len(content), space)
+	}
+
+	files := []struct{ name, path string }{
+		{packageFirmware, binFile},
+		{packageMetadata, metaFile},
+		{packageRegions, regionsFile},
+	}
+	if _, err := os.Stat(binFile + ".sig"); err == nil {
+		files = append(files, struct{ name, path string }{packageSignature, binFile + ".sig"})
+	}
+
+	out, err := os.Create(outPkg)
+	if err != nil {
+		return fmt.Errorf("failed to create package: %v", err)
+	}
+	defer out.Close()
+	archive := zip.NewWriter(out)
+	for _, file := range files {
+		data, err := os.ReadFile(file.path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", file.path, err)
+		}
+		info, err := os.Stat(file.path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", file.path, err)
+		}
+		w, err := archive.CreateHeader(&zip.FileHeader{Name: file.name, Method: zip.Deflate, Modified: info.ModTime()})
+		if err != nil {
+			return fmt.Errorf("failed to add %s to the package: %v", file.name, err)
+		}
+		if _, err := w.Write(data); err != nil {
+			return fmt.Errorf("failed to add %s to the package: %v", file.name, err)
+		}
+		fmt.Printf("Added %s (%d bytes) as %s\n", file.path, len(data), file.name)
+	}
+	if err := archive.Close(); err != nil {
+		return fmt.Errorf("failed to write package: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to write package: %v", err)
+	}
+	fmt.Printf("Package written to %s\n", outPkg)
+	return nil
+}
+
+// UnpackFirmware extracts the files of a .rtpkg package into outDir. Any
+// other file in the archive is an error, so no path can leave outDir.
+func UnpackFirmware(pkgFile, outDir string) error {
+	archive, err := zip.OpenReader(pkgFile)
+	if err != nil {
+		return fmt.Errorf("failed to open package %s: %v", pkgFile, err)
+	}
+	defer archive.Close()
+
+	found := map[string]bool{}
+	for _, file := range archive.File {
+		switch file.Name {
+		case packageFirmware, packageMetadata, packageRegions, packageSignature:
+		default:
+			return fmt.Errorf("package %s contains unexpected file %s", pkgFile, file.Name)
+		}
+		r, err := file.Open()
+		if err != nil {
+			return fmt.Errorf("failed to read %s from the package: %v", file.Name, err)
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read %s from the package: %v", file.Name, err)
+		}
+		if err := os.WriteFile(filepath.Join(outDir, file.Name), data, 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %v", file.Name, err)
+		}
+		found[file.Name] = true
+	}
+	for _, name := range []string{packageFirmware, packageMetadata, packageRegions} {
+		if !found[name] {
+			return fmt.Errorf("package %s has no %s", pkgFile, name)
+		}
+	}
+	return nil
+}
+
+// initializePackage loads the firmware of a .rtpkg package. Its metadata
+// and signature are checked like the sidecars of a firmware file, and the
+// image may not be larger than its region of the region map.
+func (f *Flasher) initializePackage(pkgFile string) bool {
+	dir, err := os.MkdirTemp("", "rt6d-rtpkg-")
+	if err != nil {
+		f.log(LogQuiet, "Error: failed to create package directory: %v\n", err)
+		return false
+	}
+	defer os.RemoveAll(dir)
+
+	if err := UnpackFirmware(pkgFile, dir); err != nil {
+		f.log(LogQuiet, "Error: %v\n", err)
+		return false
+	}
+	regions, err := loadPackageRegions(filepath.Join(dir, packageRegions))
+	if err != nil {
+		f.log(LogQuiet, "Error: %v\n", err)
+		return false
+	}
+	region, space, err := imageSpace(regions)
+	if err != nil {
+		f.log(LogQuiet, "Error: %v\n", err)
+		return false
+	}
+	if f.MaxFirmwareBytes == 0 || space < f.MaxFirmwareBytes {
+		f.MaxFirmwareBytes = space
+	}
+	f.log(LogNormal, "Package %s: image limited to %d bytes by region %s\n", pkgFile, space, region.Name)
+
+	// Give the metadata and signature the sidecar names initializeHex
+	// looks for
+	firmware := filepath.Join(dir, packageFirmware)
+	if err := os.Rename(filepath.Join(dir, packageMetadata), firmware+".meta.json"); err != nil {
+		f.log(LogQuiet, "Error: %v\n", err)
+		return false
+	}
+	if err := os.Rename(filepath.Join(dir, packageSignature), firmware+".sig"); err == nil && f.SignatureKeyFile == "" {
+		f.log(LogNormal, "The package is signed, give -verify-sig to check the signature\n")
+	}
+	return f.initializeHex(firmware)
+}
+
+// SparseFirmware holds only the bytes present in a firmware file, keyed by
+// device address. It avoids a large dense buffer for images that are
+// mostly empty.
+type SparseFirmware struct {
+	FillByte byte // Value returned for addresses without data
+	data     map[uint32]byte
+}
+
+// AddressRange is a run of populated addresses, End is exclusive
+type AddressRange struct {
+	Start uint32
+	End   uint32
+}
+
+func NewSparseFirmware() *SparseFirmware {
+	return &SparseFirmware{
+		FillByte: 0xFF,
+		data:     make(map[uint32]byte),
+	}
+}
+
+func (s *SparseFirmware) Set(addr uint32, val byte) {
+	s.data[addr] = val
+}
+
+// Get returns the byte at addr, or FillByte if the file has no data there
+func (s *SparseFirmware) Get(addr uint32) byte {
+	if val, ok := s.data[addr]; ok {
+		return val
+	}
+	return s.FillByte
+}
+
+// Len returns the number of populated addresses
+func (s *SparseFirmware) Len() int {
+	return len(s.data)
+}
+
+// ToSlice returns the dense image of size bytes starting at base
+func (s *SparseFirmware) ToSlice(base, size uint32) []byte {
+	out := make([]byte, size)
+	for i := range out {
+		out[i] = s.FillByte
+	}
+	for addr, val := range s.data {
+		if addr >= base && addr-base < size {
+			out[addr-base] = val
+		}
+	}
+	return out
+}
+
+// PopulatedRegions returns the contiguous populated ranges in address order
+func (s *SparseFirmware) PopulatedRegions() []AddressRange {
+	addrs := make([]uint32, 0, len(s.data))
+	for addr := range s.data {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+
+	var regions []AddressRange
+	for _, addr := range addrs {
+		last := len(regions) - 1
+		if last >= 0 && regions[last].End == addr {
+			regions[last].End++
+			continue
+		}
+		regions = append(regions, AddressRange{Start: addr, End: addr + 1})
+	}
+	return regions
+}
+
+// hexRegion is a range of offsets into the hex array, end is exclusive
+type hexRegion struct {
+	start int
+	end   int
+}
+
+func (f *Flasher) addLoadedRange(start, end int) {
+	end = min(end, len(f.hex))
+	if start >= end {
+		return
+	}
+	f.loadedRanges = append(f.loadedRanges, hexRegion{start: start, end: end})
+}
+
+// mergeRegions sorts the ranges and joins the ones that touch or overlap
+func mergeRegions(ranges []hexRegion) []hexRegion {
+	sorted := append([]hexRegion(nil), ranges...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].start < sorted[j].start })
+
+	var merged []hexRegion
+	for _, r := range sorted {
+		last := len(merged) - 1
+		if last >= 0 && r.start <= merged[last].end {
+			merged[last].end = max(merged[last].end, r.end)
 			continue
 		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+func printRegionSummary(regions []hexRegion) {
+	fmt.Printf("Firmware regions (%d):\n", len(regions))
+	for i, r := range regions {
+		if i > 0 {
+			fmt.Printf("  gap of %d bytes\n", r.start-regions[i-1].end)
+		}
+		fmt.Printf("  0x%08X-0x%08X  %d bytes\n", 0x08002800+r.start, 0x08002800+r.end-1, r.end-r.start)
+	}
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// ChecksumAlgorithm computes the checksum byte of a packet
+type ChecksumAlgorithm interface {
+	Compute(data []byte) byte
+}
+
+// SumChecksumAlgorithm adds up all bytes plus Offset, as the RT6D
+// bootloaders do
+type SumChecksumAlgorithm struct {
+	Offset byte
+}
+
+func (a SumChecksumAlgorithm) Compute(data []byte) byte {
+	sum := a.Offset
+	for _, b := range data {
+		sum += b
+	}
+	return sum
+}
+
+// XORChecksumAlgorithm XORs all bytes
+type XORChecksumAlgorithm struct{}
+
+func (XORChecksumAlgorithm) Compute(data []byte) byte {
+	var x byte
+	for _, b := range data {
+		x ^= b
+	}
+	return x
+}
+
+// CRC8ChecksumAlgorithm is CRC-8 with polynomial 0x07, initial value 0
+// and no reflection
+type CRC8ChecksumAlgorithm struct{}
+
+func (CRC8ChecksumAlgorithm) Compute(data []byte) byte {
+	var crc byte
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// checksum returns the checksum of the first length-1 bytes of array, the
+// last byte of a packet holds the checksum
+func (f *Flasher) checksum(array []byte, length int) byte {
+	return f.ChecksumAlgo.Compute(array[:length-1])
+}
+
+func (f *Flasher) charToInt(char rune) int {
+	num := int(char)
+	if num > 47 && num < 58 {
+		return num - 48
+	}
+	if num > 64 && num < 71 {
+		return num - 55
+	}
+	if num > 96 && num < 103 {
+		return num - 87
+	}
+	f.log(LogNormal, "发现无效字符: %c\n", char)
+	return 0
+}
+
+func (f *Flasher) stringOperation() bool {
+	if f.allcode == "" {
+		return false
+	}
+	
+	i := 0
+	defer func() {
+		if r := recover(); r != nil {
+			// Handle panic gracefully
+		}
+	}()
+
+	// Find next ':'
+	for f.cntcode+i < len(f.allcode) && (f.allcode[f.cntcode+i] != ':' || i == 0) {
+		i++
+	}
+	
+	if f.cntcode+i >= len(f.allcode) {
+		return false
+	}
+
+	text := f.allcode[f.cntcode : f.cntcode+i]
+	f.cntcode += i
+
+	if len(text) < 9 {
+		return false
+	}
+
+	num := f.charToInt(rune(text[7]))
+	num <<= 4
+	recordType := num + f.charToInt(rune(text[8]))
+
+	switch recordType {
+	case 0: // Data record
+		if len(text) < 10 {
+			return true
+		}
+		
+		num2 := f.charToInt(rune(text[1]))
+		num2 <<= 4
+		num2 += f.charToInt(rune(text[2]))
+		
+		num3 := f.charToInt(rune(text[3]))
+		num3 <<= 4
+		num3 += f.charToInt(rune(text[4]))
+		num3 <<= 4
+		num3 += f.charToInt(rune(text[5]))
+		num3 <<= 4
+		num3 += f.charToInt(rune(text[6]))
 		
-		if f.recvcnt < len(f.recvbuf) {
-			f.recvbuf[f.recvcnt] = buffer[0]
-			f.recvcnt++
-			fmt.Printf("Received byte: 0x%02X (step: %d, recvcnt: %d)\n", buffer[0], f.step, f.recvcnt)
+		for j := 0; j < num2; j++ {
+			if 9+j*2+1 >= len(text) {
+				break
+			}
+			num := f.charToInt(rune(text[9+j*2]))
+			num <<= 4
+			num += f.charToInt(rune(text[10+j*2]))
 			
-			if f.recvbuf[0] == 0 {
-				f.sendcnt = 0
-				f.flgConnect = true
-				time.Sleep(200 * time.Millisecond)
-			} else {
-				f.flgConnect = false
-				time.Sleep(1 * time.Millisecond)
-				f.revDateOperation()
+			addr := num3 + j - 10240 + (f.writestep-1)*65536
+			if addr >= 0 && addr < len(f.hex) {
+				f.hex[addr] = byte(num)
 			}
 		}
+		return true
+	case 1: // End of file record
+		return false
+	case 4: // Extended linear address record
+		f.writestep++
+		return true
+	default:
+		return true
+	}
+}
+
+func (f *Flasher) getAvailablePorts() []string {
+	ports, err := serial.GetPortsList()
+	if err != nil {
+		return []string{}
+	}
+	sort.Strings(ports)
+	return ports
+}
+
+// validatePort checks that name is one of the listed serial ports
+func validatePort(name string, ports []string) error {
+	for _, port := range ports {
+		if port == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("Port '%s' not found", name)
+}
+
+// PortInfo is a serial port together with a description of the device
+type PortInfo struct {
+	Name        string
+	Description string
+}
+
+// getPortsWithNames lists the serial ports like getAvailablePorts. On Windows
+// each port is described by the friendly name its device has in the
+// registry, e.g. "USB-SERIAL CH340 (COM3)", and on macOS by the USB product
+// name and IDs, so the programming cable can be told apart from other
+// adapters. Elsewhere the description is empty.
+func (f *Flasher) getPortsWithNames() []PortInfo {
+	if runtime.GOOS == "darwin" {
+		return f.getIOKitPortNames()
+	}
+
+	ports := f.getAvailablePorts()
+	infos := make([]PortInfo, len(ports))
+	for i, port := range ports {
+		infos[i].Name = port
+	}
+	if runtime.GOOS != "windows" {
+		return infos
+	}
+
+	// reg.exe is used instead of the registry API so main.go still builds
+	// as a single file for every platform
+	output, err := exec.Command("reg", "query", `HKLM\SYSTEM\CurrentControlSet\Enum`,
+		"/s", "/v", "FriendlyName").Output()
+	if err != nil {
+		f.log(LogVerbose, "Could not read port descriptions from the registry: %v\n", err)
+		return infos
+	}
+	names := parseFriendlyNames(string(output))
+	for i := range infos {
+		infos[i].Description = names[strings.ToUpper(infos[i].Name)]
+	}
+	return infos
+}
+
+// printPorts lists the ports one per line, with the description if known
+func printPorts(ports []PortInfo, writer io.Writer) {
+	for _, port := range ports {
+		if port.Description != "" {
+			fmt.Fprintf(writer, "  %s  - %s\n", port.Name, port.Description)
+		} else {
+			fmt.Fprintf(writer, "  %s\n", port.Name)
+		}
+	}
+}
+
+// friendlyNamePort matches the port Windows appends to the friendly name of
+// a serial device
+var friendlyNamePort = regexp.MustCompile(`(?i)\((COM\d+)\)\s*$`)
+
+// parseFriendlyNames maps port names to the FriendlyName values in the
+// output of reg query
+func parseFriendlyNames(output string) map[string]string {
+	names := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		_, value, found := strings.Cut(line, "REG_SZ")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if m := friendlyNamePort.FindStringSubmatch(value); m != nil {
+			names[strings.ToUpper(m[1])] = value
+		}
+	}
+	return names
+}
+
+// usbDevice is a USB device from the I/O Registry with the serial ports
+// it provides
+type usbDevice struct {
+	Product      string
+	VendorID     int
+	ProductID    int
+	SerialNumber string
+	Ports        []string
+}
+
+// ioregProperty matches a property line of ioreg -l, after the tree drawing
+var ioregProperty = regexp.MustCompile(`^[\s|]*"([^"]+)" = (.*)$`)
+
+// getIOKitPortNames lists the serial ports on macOS described by the USB
+// device behind them, e.g. "CH340 USB Serial (1A86:7523)". Ports that can't
+// be matched to a device keep an empty description.
+func (f *Flasher) getIOKitPortNames() []PortInfo {
+	ports := f.getAvailablePorts()
+	infos := make([]PortInfo, len(ports))
+	for i, port := range ports {
+		infos[i].Name = port
+	}
+
+	output, err := exec.Command("ioreg", "-r", "-c", "IOUSBHostDevice", "-l").Output()
+	if err != nil {
+		f.log(LogVerbose, "Could not read USB devices from the I/O Registry: %v\n", err)
+		return infos
+	}
+	devices := parseIORegDevices(string(output))
+	for i := range infos {
+		if device := matchUSBDevice(devices, infos[i].Name); device != nil {
+			infos[i].Description = device.description()
+		}
+	}
+	return infos
+}
+
+// description returns e.g. "CH340 USB Serial (1A86:7523)"
+func (d *usbDevice) description() string {
+	product := d.Product
+	if product == "" {
+		product = "USB device"
+	}
+	return fmt.Sprintf("%s (%04X:%04X)", product, d.VendorID, d.ProductID)
+}
+
+// parseIORegDevices reads the output of ioreg -r -c IOUSBHostDevice -l. Every
+// device starts a tree at the left margin; the serial ports are the
+// IOCalloutDevice and IODialinDevice properties of the IOSerialBSDClient
+// further down its tree.
+func parseIORegDevices(output string) []usbDevice {
+	var devices []usbDevice
+	var device *usbDevice
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "+-o ") {
+			devices = append(devices, usbDevice{})
+			device = &devices[len(devices)-1]
+			continue
+		}
+		m := ioregProperty.FindStringSubmatch(line)
+		if m == nil || device == nil {
+			continue
+		}
+		value := strings.Trim(strings.TrimSpace(m[2]), `"`)
+		switch m[1] {
+		case "USB Product Name":
+			device.Product = value
+		case "USB Serial Number":
+			device.SerialNumber = value
+		case "idVendor":
+			device.VendorID, _ = strconv.Atoi(value)
+		case "idProduct":
+			device.ProductID, _ = strconv.Atoi(value)
+		case "IOCalloutDevice", "IODialinDevice":
+			device.Ports = append(device.Ports, value)
+		}
+	}
+	return devices
+}
+
+// matchUSBDevice finds the device of a port, by the ports in its tree or
+// else by its serial number, which drivers like FTDI's put at the end of
+// the port name (/dev/cu.usbserial-A50285BI)
+func matchUSBDevice(devices []usbDevice, port string) *usbDevice {
+	for i := range devices {
+		for _, p := range devices[i].Ports {
+			if p == port {
+				return &devices[i]
+			}
+		}
+	}
+	for i := range devices {
+		if serial := devices[i].SerialNumber; serial != "" && strings.HasSuffix(port, serial) {
+			return &devices[i]
+		}
+	}
+	return nil
+}
+
+func (f *Flasher) clearRecvbuf() {
+	for i := 0; i < len(f.recvbuf); i++ {
+		f.recvbuf[i] = 255
+	}
+	f.recvcnt = 0
+}
+
+func (f *Flasher) dataSum(array []byte) byte {
+	return f.ChecksumAlgo.Compute(array[:int(array[2])-1])
+}
+
+func (f *Flasher) revDateOperation() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.recvcnt != 1 {
+		return
+	}
+
+	f.log(LogVerbose, "Processing received byte: 0x%02X in state %s\n", f.recvbuf[0], f.state)
+
+	switch f.recvbuf[0] {
+	case 50: // 0x32
+		// A radio running normally, the bootloader timed out
+		if f.reenterBootloader != nil && f.state == StateTransferring {
+			select {
+			case f.reenterBootloader <- struct{}{}:
+			default:
+			}
+		}
+		break
+	case 0: // Connection established
+		f.recvcnt = 0
+		break
+	case 255: // NAK - Error
+		if err := f.transition(EventNAK); err != nil {
+			f.log(LogVerbose, "Ignoring NAK: %v\n", err)
+			f.clearRecvbuf()
+			break
+		}
+		
+		if f.state == StateTransferring {
+			// NAK during data transfer - retry the packet
+			f.log(LogNormal, "NAK received! Block %d rejected. Data at offset %d--%d (%s)\n", 
+				f.gWritebytes, f.sendcnt-f.BlockSize, f.sendcnt-1, f.describeAddress(uint32(0x08002800+f.sendcnt-f.BlockSize)))
+			
+			// Show first few bytes of the rejected block for debugging
+			f.log(LogVerbose, "Rejected block data (first 16 bytes): ")
+			startOffset := f.sendcnt - f.BlockSize
+			if startOffset >= 0 {
+				for i := 0; i < 16 && startOffset+i < len(f.hex); i++ {
+					f.log(LogVerbose, "%02X ", f.hex[startOffset+i])
+				}
+			}
+			f.log(LogVerbose, "\n")
+			
+			// Show the checksum that was sent
+			f.log(LogVerbose, "Sent checksum: 0x%02X\n", f.sendbuf[f.BlockSize+3])
+			
+			// Retry the packet
+			f.retryLastPacket()
+		} else {
+			// NAK during connection phase
+			f.log(LogNormal, "NAK received during connection phase\n")
+			f.abortErr = protocolErrorf(ErrNAKReceived, -1, "NAK received while %s", f.state)
+			f.port.Close()
+			f.log(LogNormal, "Communication Error - NAK received!\n")
+			f.clearRecvbuf()
+		}
+		break
+	case 6: // ACK - acknowledgment
+		f.recvcnt = 0
+		if f.state == StateTransferring && f.takeKeepAliveAck() {
+			f.log(LogVerbose, "Keep-alive ACKed\n")
+			break
+		}
+		f.waitingForAck = false // Clear waiting state
+		f.retryCount = 0        // Reset retry counter
+		
+		if err := f.transition(EventACK); err != nil {
+			f.log(LogVerbose, "Ignoring ACK: %v\n", err)
+			break
+		}
+		
+		switch f.state {
+		case StateConnecting2, StateConnecting3:
+			f.progressf("%s, sending connect command\n", f.state)
+			f.write(f.sendConnect)
+			time.Sleep(f.InterPacketDelay)
+		case StateSendingUpdate:
+			f.progressf("Sending update command\n")
+			f.write(f.sendUpdate)
+			time.Sleep(f.InterPacketDelay)
+		case StateTransferring:
+			// Data transfer phase - the ACK is for the oldest block in
+			// flight, the first one for the update command
+			if len(f.sentButUnacked) > 0 {
+				acked := f.sentButUnacked[0]
+				f.sentButUnacked = f.sentButUnacked[1:]
+				f.progressf("ACK received for block %d\n", acked.Block+1)
+				f.log(LogVerbose, "ACKed block header sequence: 0x%04X\n", acked.Sequence)
+			} else {
+				f.progressf("ACK received for block %d\n", f.gWritebytes)
+			}
+			if f.ProgressFile != "" {
+				f.writeProgress("uploading", f.gWritebytes-len(f.sentButUnacked), f.stats.Retries, "")
+			}
+			if f.TelemetrySink != nil {
+				f.writeBlockTelemetry(f.gWritebytes - len(f.sentButUnacked))
+			}
+			
+			// Send packets until WindowSize are in flight again
+			for len(f.sentButUnacked) < max(f.WindowSize, 1) && f.sendcnt < f.FlashSize {
+				f.sendNextBlock()
+			}
+			f.waitingForAck = len(f.sentButUnacked) > 0
+			
+			// Like with a window of 1 the ACK of the last block is not
+			// waited for, only those of the blocks before it
+			if f.sendcnt >= f.FlashSize && len(f.sentButUnacked) <= 1 {
+				f.transition(EventDataSent)
+				f.progressf("Data transfer completed! Sending end command...\n")
+				f.write(f.sendEnd)
+				time.Sleep(100 * time.Millisecond)
+				f.port.Close()
+			}
+		}
+		break
+	default:
+		if hint := diagnoseUnknownByte(f.recvbuf[0]); hint != "" {
+			f.log(LogNormal, "Unknown response: 0x%02X - %s\n", f.recvbuf[0], hint)
+		} else {
+			f.log(LogNormal, "Unknown response: 0x%02X\n", f.recvbuf[0])
+		}
+		f.recvcnt = 0
+		break
+	}
+}
+
+// diagnoseUnknownByte returns the likely cause of an unexpected byte from
+// the radio and what to try, "" for bytes without a known meaning
+func diagnoseUnknownByte(b byte) string {
+	switch b {
+	case 0x15:
+		return "possible NAK from alternate protocol, try another -protocol (see list-protocols)"
+	case 0x0D, 0x0A:
+		return "newline detected — device may be sending text, check baud rate (-baud or -auto-baud)"
+	case 0x57:
+		return "device echoing our own send byte — loopback or TX-RX short, check the cable with loopback-test"
+	case 0xAA, 0x55:
+		return "possible calibration bootloader response, switch the radio on again while holding PTT"
+	}
+	return ""
+}
+
+// ProtocolState is the position of a Flasher in the bootloader handshake
+type ProtocolState int
+
+const (
+	StateIdle          ProtocolState = iota
+	StateConnecting1                 // First connect command sent
+	StateConnecting2                 // Second connect command sent
+	StateConnecting3                 // Third connect command sent
+	StateSendingUpdate               // Update command sent
+	StateTransferring                // Firmware blocks being sent
+	StateComplete                    // All blocks and the end command sent
+	StateError                       // Transfer abandoned
+)
+
+var protocolStateNames = map[ProtocolState]string{
+	StateIdle:          "idle",
+	StateConnecting1:   "connecting (1/3)",
+	StateConnecting2:   "connecting (2/3)",
+	StateConnecting3:   "connecting (3/3)",
+	StateSendingUpdate: "sending update command",
+	StateTransferring:  "transferring",
+	StateComplete:      "complete",
+	StateError:         "error",
+}
+
+func (s ProtocolState) String() string {
+	if name, ok := protocolStateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("state %d", int(s))
+}
+
+// active reports whether the transfer is still in progress
+func (s ProtocolState) active() bool {
+	return s >= StateConnecting1 && s <= StateTransferring
+}
+
+// ProtocolEvent is something that moves the handshake to another state
+type ProtocolEvent int
+
+const (
+	EventACK      ProtocolEvent = iota // 0x06 received
+	EventNAK                           // 0xFF received
+	EventTimeout                       // No ACK within packetTimeout
+	EventDataSent                      // Last firmware block sent
+)
+
+var protocolEventNames = map[ProtocolEvent]string{
+	EventACK:      "ACK",
+	EventNAK:      "NAK",
+	EventTimeout:  "timeout",
+	EventDataSent: "data sent",
+}
+
+func (e ProtocolEvent) String() string {
+	if name, ok := protocolEventNames[e]; ok {
+		return name
+	}
+	return fmt.Sprintf("event %d", int(e))
+}
+
+// protocolTransitions lists every valid state change. A NAK or timeout
+// while transferring keeps the state and resends the block, retryLastPacket
+// moves to StateError once the retries are used up.
+var protocolTransitions = map[ProtocolState]map[ProtocolEvent]ProtocolState{
+	StateConnecting1: {
+		EventACK: StateConnecting2,
+		EventNAK: StateError,
+	},
+	StateConnecting2: {
+		EventACK: StateConnecting3,
+		EventNAK: StateError,
+	},
+	StateConnecting3: {
+		EventACK: StateSendingUpdate,
+		EventNAK: StateError,
+	},
+	StateSendingUpdate: {
+		EventACK: StateTransferring,
+		EventNAK: StateError,
+	},
+	StateTransferring: {
+		EventACK:      StateTransferring,
+		EventNAK:      StateTransferring,
+		EventTimeout:  StateTransferring,
+		EventDataSent: StateComplete,
+	},
+}
+
+// TransitionError is returned for an event that is not valid in a state
+type TransitionError struct {
+	State ProtocolState
+	Event ProtocolEvent
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("unexpected %s while %s", e.Event, e.State)
+}
+
+// ProtocolErrorCode tells callers what kind of problem a ProtocolError is
+type ProtocolErrorCode int
+
+const (
+	ErrTimeout            ProtocolErrorCode = iota + 1 // The radio did not answer in time
+	ErrChecksumMismatch                                // A response from the radio is corrupted
+	ErrNAKReceived                                     // The radio rejected a command
+	ErrMaxRetriesExceeded                              // A block was retried too often
+	ErrPortOpen                                        // The serial port could not be opened
+	ErrFirmwareLoad                                    // The firmware file could not be loaded
+	ErrVerificationFailed                              // Not every block reached the radio
+)
+
+var protocolErrorCodeNames = map[ProtocolErrorCode]string{
+	ErrTimeout:            "timeout",
+	ErrChecksumMismatch:   "checksum mismatch",
+	ErrNAKReceived:        "NAK received",
+	ErrMaxRetriesExceeded: "max retries exceeded",
+	ErrPortOpen:           "port open failed",
+	ErrFirmwareLoad:       "firmware load failed",
+	ErrVerificationFailed: "verification failed",
+}
+
+func (c ProtocolErrorCode) String() string {
+	if name, ok := protocolErrorCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("error code %d", int(c))
+}
+
+// Error lets the codes be used as targets of errors.Is, e.g.
+// errors.Is(err, ErrTimeout)
+func (c ProtocolErrorCode) Error() string {
+	return c.String()
+}
+
+// ProtocolError is returned by the flashing protocol, errors.As gives
+// access to the code and block
+type ProtocolError struct {
+	Code   ProtocolErrorCode
+	Block  int    // Block the error happened at, -1 if it is not about a block
+	Detail string // Complete message, returned by Error
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Detail
+}
+
+// Is reports whether target is the code of e
+func (e *ProtocolError) Is(target error) bool {
+	code, ok := target.(ProtocolErrorCode)
+	return ok && code == e.Code
+}
+
+// protocolErrorf returns a ProtocolError with a formatted Detail
+func protocolErrorf(code ProtocolErrorCode, block int, format string, args ...interface{}) *ProtocolError {
+	return &ProtocolError{Code: code, Block: block, Detail: fmt.Sprintf(format, args...)}
+}
+
+// transition moves to the state that follows event, must be called with
+// f.mu held. The state is left unchanged if the event is not valid.
+func (f *Flasher) transition(event ProtocolEvent) error {
+	next, ok := protocolTransitions[f.state][event]
+	if !ok {
+		return &TransitionError{State: f.state, Event: event}
+	}
+	f.state = next
+	return nil
+}
+
+// progressf prints a transfer progress line, marked as simulated in a dry run
+func (f *Flasher) progressf(format string, args ...interface{}) {
+	if f.DryRun {
+		format = "[DRY RUN] " + format
+	}
+	f.log(LogNormal, format, args...)
+}
+
+// log prints a message if the flasher's log level is at least level
+func (f *Flasher) log(level LogLevel, format string, args ...interface{}) {
+	if f.LogLevel >= level {
+		fmt.Printf(format, args...)
+	}
+}
+
+// dryRunPort stands in for the serial port with -dry-run. Every write is
+// answered with an ACK after 1 ms, as if the radio accepted it.
+type dryRunPort struct {
+	mu          sync.Mutex
+	pending     []byte
+	closed      bool
+	readTimeout time.Duration
+}
+
+func newDryRunPort() *dryRunPort {
+	return &dryRunPort{readTimeout: 10 * time.Millisecond}
+}
+
+func (p *dryRunPort) Write(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return 0, fmt.Errorf("port closed")
+	}
+	time.AfterFunc(time.Millisecond, func() {
+		p.mu.Lock()
+		p.pending = append(p.pending, 6)
+		p.mu.Unlock()
+	})
+	return len(data), nil
+}
+
+func (p *dryRunPort) Read(buffer []byte) (int, error) {
+	deadline := time.Now().Add(p.readTimeout)
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return 0, fmt.Errorf("port closed")
+		}
+		if len(p.pending) > 0 {
+			n := copy(buffer, p.pending)
+			p.pending = p.pending[n:]
+			p.mu.Unlock()
+			return n, nil
+		}
+		p.mu.Unlock()
+
+		if time.Now().After(deadline) {
+			return 0, nil
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (p *dryRunPort) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	return nil
+}
+
+func (p *dryRunPort) SetReadTimeout(t time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.readTimeout = t
+	return nil
+}
+
+func (p *dryRunPort) ResetInputBuffer() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending = nil
+	return nil
+}
+
+func (p *dryRunPort) SetMode(mode *serial.Mode) error { return nil }
+func (p *dryRunPort) Drain() error                     { return nil }
+func (p *dryRunPort) ResetOutputBuffer() error         { return nil }
+func (p *dryRunPort) SetDTR(dtr bool) error            { return nil }
+func (p *dryRunPort) SetRTS(rts bool) error            { return nil }
+func (p *dryRunPort) Break(d time.Duration) error      { return nil }
+
+func (p *dryRunPort) GetModemStatusBits() (*serial.ModemStatusBits, error) {
+	return &serial.ModemStatusBits{}, nil
+}
+
+// Telnet bytes and the RFC 2217 COM-PORT-OPTION commands used by
+// tcpSerialPort
+const (
+	telnetIAC  = 255 // Starts a command, doubled for a 0xFF data byte
+	telnetDONT = 254
+	telnetDO   = 253
+	telnetWONT = 252
+	telnetWILL = 251
+	telnetSB   = 250 // Starts an option subnegotiation, ended by IAC SE
+	telnetSE   = 240
+
+	comPortOption      = 44
+	comPortSetBaudRate = 1
+	comPortSetDataSize = 2
+	comPortSetParity   = 3
+	comPortSetStopSize = 4
+	comPortSetControl  = 5
+	comPortPurgeData   = 12
+)
+
+// tcpSerialPort is a serial port shared over the network by a serial port
+// server, e.g. ser2net or socat on a Raspberry Pi next to the radio. With
+// rfc2217 the stream is telnet: the serial settings are sent as RFC 2217
+// options and 0xFF data bytes are doubled. Otherwise the bytes go through
+// unchanged and the server's settings are used.
+type tcpSerialPort struct {
+	conn      net.Conn
+	rfc2217   bool
+	announced bool // WILL COM-PORT-OPTION was sent
+
+	mu          sync.Mutex
+	readTimeout time.Duration
+	data        []byte // Received data bytes not returned by Read yet
+	telnet      []byte // Start of a telnet command split across reads
+}
+
+// isTCPPort reports whether a port name is tcp://host:port
+func isTCPPort(name string) bool {
+	return strings.HasPrefix(name, "tcp://")
+}
+
+// parseTCPPort splits a tcp://host:port port name
+func parseTCPPort(name string) (string, int, error) {
+	host, portText, err := net.SplitHostPort(strings.TrimPrefix(name, "tcp://"))
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port %s, expected tcp://host:port: %v", name, err)
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil || port < 1 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid TCP port number in %s", name)
+	}
+	return host, port, nil
+}
+
+// OpenTCPPort connects to a serial port server and makes it f.port. Unless
+// NoRFC2217 is set, the baud rate, 8 data bits, no parity and one stop bit
+// are requested with RFC 2217.
+func (f *Flasher) OpenTCPPort(host string, port int) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s:%d: %v", host, port, err)
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		// Blocks and ACKs are small, don't let Nagle hold them back
+		tcp.SetNoDelay(true)
+	}
+	if err := f.useTCPConn(conn); err != nil {
+		return fmt.Errorf("failed to set up %s:%d: %v", host, port, err)
+	}
+	return nil
+}
+
+// useTCPConn requests the serial settings over a connection to a serial
+// port server and makes it f.port. conn is closed if that fails.
+func (f *Flasher) useTCPConn(conn net.Conn) error {
+	tcpPort := &tcpSerialPort{conn: conn, rfc2217: !f.NoRFC2217, readTimeout: serial.NoTimeout}
+	mode := &serial.Mode{
+		BaudRate: f.baudRate,
+		DataBits: 8,
+		Parity:   serial.NoParity,
+		StopBits: serial.OneStopBit,
+	}
+	if err := tcpPort.SetMode(mode); err != nil {
+		conn.Close()
+		return err
+	}
+	f.port = tcpPort
+	return nil
+}
+
+// Read returns the received data bytes, or 0 bytes once the read timeout
+// expired like a serial port
+func (p *tcpSerialPort) Read(b []byte) (int, error) {
+	p.mu.Lock()
+	deadline := time.Time{}
+	if p.readTimeout >= 0 {
+		deadline = time.Now().Add(p.readTimeout)
+	}
+	p.mu.Unlock()
+	if err := p.conn.SetReadDeadline(deadline); err != nil {
+		return 0, err
+	}
+
+	buffer := make([]byte, 4096)
+	for {
+		p.mu.Lock()
+		if len(p.data) > 0 {
+			n := copy(b, p.data)
+			p.data = p.data[n:]
+			p.mu.Unlock()
+			return n, nil
+		}
+		p.mu.Unlock()
+
+		n, err := p.conn.Read(buffer)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return 0, nil
+			}
+			return 0, err
+		}
+		p.mu.Lock()
+		p.decode(buffer[:n])
+		p.mu.Unlock()
+	}
+}
+
+// decode appends the data bytes of raw to p.data. With RFC 2217 doubled
+// 0xFF bytes are undone and telnet commands, such as the server's answers
+// to our options, are dropped.
+func (p *tcpSerialPort) decode(raw []byte) {
+	if !p.rfc2217 {
+		p.data = append(p.data, raw...)
+		return
+	}
+	raw = append(p.telnet, raw...)
+	p.telnet = nil
+	for i := 0; i < len(raw); {
+		if raw[i] != telnetIAC {
+			p.data = append(p.data, raw[i])
+			i++
+			continue
+		}
+		size := telnetCommandSize(raw[i:])
+		if size == 0 {
+			p.telnet = append([]byte(nil), raw[i:]...)
+			return
+		}
+		if raw[i+1] == telnetIAC {
+			p.data = append(p.data, telnetIAC)
+		}
+		i += size
+	}
+}
+
+// telnetCommandSize returns the length of the telnet command at the start
+// of b, 0 if b ends before the command does
+func telnetCommandSize(b []byte) int {
+	if len(b) < 2 {
+		return 0
+	}
+	switch b[1] {
+	case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+		if len(b) < 3 {
+			return 0
+		}
+		return 3
+	case telnetSB:
+		for i := 2; i+1 < len(b); i++ {
+			if b[i] != telnetIAC {
+				continue
+			}
+			if b[i+1] == telnetSE {
+				return i + 2
+			}
+			i++ // Doubled 0xFF in the option value
+		}
+		return 0
+	}
+	return 2
+}
+
+func (p *tcpSerialPort) Write(b []byte) (int, error) {
+	if !p.rfc2217 {
+		return p.conn.Write(b)
+	}
+	if _, err := p.conn.Write(bytes.ReplaceAll(b, []byte{telnetIAC}, []byte{telnetIAC, telnetIAC})); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// comPortCommand sends an RFC 2217 COM-PORT-OPTION subnegotiation. The
+// answers of the server are dropped by decode.
+func (p *tcpSerialPort) comPortCommand(command byte, value ...byte) error {
+	var packet []byte
+	if !p.announced {
+		packet = append(packet, telnetIAC, telnetWILL, comPortOption)
+		p.announced = true
+	}
+	packet = append(packet, telnetIAC, telnetSB, comPortOption, command)
+	packet = append(packet, bytes.ReplaceAll(value, []byte{telnetIAC}, []byte{telnetIAC, telnetIAC})...)
+	packet = append(packet, telnetIAC, telnetSE)
+	_, err := p.conn.Write(packet)
+	return err
+}
+
+func (p *tcpSerialPort) SetMode(mode *serial.Mode) error {
+	if !p.rfc2217 {
+		return nil
+	}
+	parity := map[serial.Parity]byte{serial.NoParity: 1, serial.OddParity: 2, serial.EvenParity: 3,
+		serial.MarkParity: 4, serial.SpaceParity: 5}[mode.Parity]
+	stopBits := map[serial.StopBits]byte{serial.OneStopBit: 1, serial.TwoStopBits: 2,
+		serial.OnePointFiveStopBits: 3}[mode.StopBits]
+	baudRate := binary.BigEndian.AppendUint32(nil, uint32(mode.BaudRate))
+	if err := p.comPortCommand(comPortSetBaudRate, baudRate...); err != nil {
+		return err
+	}
+	if err := p.comPortCommand(comPortSetDataSize, byte(mode.DataBits)); err != nil {
+		return err
+	}
+	if err := p.comPortCommand(comPortSetParity, parity); err != nil {
+		return err
+	}
+	return p.comPortCommand(comPortSetStopSize, stopBits)
+}
+
+// setControl sends an RFC 2217 SET-CONTROL value, e.g. 8 for DTR on
+func (p *tcpSerialPort) setControl(value byte) error {
+	if !p.rfc2217 {
+		return fmt.Errorf("DTR, RTS and break need RFC 2217, remove -no-rfc2217")
+	}
+	return p.comPortCommand(comPortSetControl, value)
+}
+
+func (p *tcpSerialPort) SetDTR(dtr bool) error {
+	if dtr {
+		return p.setControl(8)
+	}
+	return p.setControl(9)
+}
+
+func (p *tcpSerialPort) SetRTS(rts bool) error {
+	if rts {
+		return p.setControl(11)
+	}
+	return p.setControl(12)
+}
+
+func (p *tcpSerialPort) Break(d time.Duration) error {
+	if err := p.setControl(5); err != nil {
+		return err
+	}
+	time.Sleep(d)
+	return p.setControl(6)
+}
+
+// ResetInputBuffer drops the received bytes not read yet and asks the
+// server to drop its own. Bytes already on their way over the network
+// still arrive.
+func (p *tcpSerialPort) ResetInputBuffer() error {
+	p.mu.Lock()
+	p.data = nil
+	p.mu.Unlock()
+	if !p.rfc2217 {
+		return nil
+	}
+	return p.comPortCommand(comPortPurgeData, 1)
+}
+
+func (p *tcpSerialPort) ResetOutputBuffer() error {
+	if !p.rfc2217 {
+		return nil
+	}
+	return p.comPortCommand(comPortPurgeData, 2)
+}
+
+func (p *tcpSerialPort) SetReadTimeout(t time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.readTimeout = t
+	return nil
+}
+
+func (p *tcpSerialPort) Drain() error { return nil }
+func (p *tcpSerialPort) Close() error { return p.conn.Close() }
+
+func (p *tcpSerialPort) GetModemStatusBits() (*serial.ModemStatusBits, error) {
+	return nil, fmt.Errorf("modem status lines are not available over TCP")
+}
+
+// traceEvent is one line of a -trace file
+type traceEvent struct {
+	at        time.Duration // Time of day
+	direction string        // TX or RX
+	data      []byte
+}
+
+// loadTrace parses a file written with -trace, lines of the form
+// "15:04:05.000 TX 39 33 05 10 D3"
+func loadTrace(traceFile string) ([]traceEvent, error) {
+	content, err := os.ReadFile(traceFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trace: %v", err)
+	}
+
+	var events []traceEvent
+	var dayOffset time.Duration
+	for i, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 || (fields[1] != "TX" && fields[1] != "RX") {
+			return nil, fmt.Errorf("%s:%d: expected \"<time> TX|RX <hex bytes>\"", traceFile, i+1)
+		}
+		t, err := time.Parse("15:04:05.000", fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid time '%s'", traceFile, i+1, fields[0])
+		}
+		data, err := hex.DecodeString(strings.Join(fields[2:], ""))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid hex bytes: %v", traceFile, i+1, err)
+		}
+
+		// The trace only has the time of day, a capture may run past midnight
+		at := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+			time.Duration(t.Second())*time.Second + time.Duration(t.Nanosecond()) + dayOffset
+		if len(events) > 0 && at < events[len(events)-1].at {
+			dayOffset += 24 * time.Hour
+			at += 24 * time.Hour
+		}
+		events = append(events, traceEvent{at: at, direction: fields[1], data: data})
+	}
+	return events, nil
+}
+
+// replayPort stands in for the serial port in trace-replay. Every write is
+// compared with the next TX of the trace, and the RX bytes recorded after
+// that TX are returned by Read. With strictTiming the RX bytes arrive with
+// the recorded delay after the write, otherwise at once.
+type replayPort struct {
+	mu           sync.Mutex
+	events       []traceEvent
+	next         int // Index of the next unused event
+	pending      []replayBytes
+	closed       bool
+	readTimeout  time.Duration
+	strictTiming bool
+	txCount      int
+	mismatches   int
+}
+
+// replayBytes are received bytes that become readable at the given time
+type replayBytes struct {
+	at   time.Time
+	data []byte
+}
+
+func newReplayPort(events []traceEvent, strictTiming bool) *replayPort {
+	p := &replayPort{events: events, readTimeout: 10 * time.Millisecond, strictTiming: strictTiming}
+	// Anything the radio sent before the first TX
+	p.queueRX(time.Now(), 0)
+	return p
+}
+
+// queueRX makes the RX events up to the next TX readable, must be called
+// with p.mu held
+func (p *replayPort) queueRX(now time.Time, since time.Duration) {
+	for ; p.next < len(p.events) && p.events[p.next].direction == "RX"; p.next++ {
+		at := now
+		if p.strictTiming && since > 0 {
+			at = now.Add(p.events[p.next].at - since)
+		}
+		p.pending = append(p.pending, replayBytes{at: at, data: p.events[p.next].data})
+	}
+}
+
+func (p *replayPort) Write(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return 0, fmt.Errorf("port closed")
+	}
+	p.txCount++
+
+	if p.next >= len(p.events) {
+		p.mismatches++
+		fmt.Printf("TX %d is not in the trace (%d bytes): % X\n", p.txCount, len(data), data[:min(len(data), 16)])
+		return len(data), nil
+	}
+	expected := p.events[p.next]
+	p.next++
+	if !bytes.Equal(data, expected.data) {
+		p.mismatches++
+		printTXDiff(p.txCount, expected.data, data)
+	}
+	p.queueRX(time.Now(), expected.at)
+	return len(data), nil
+}
+
+// printTXDiff lists the bytes of a TX that differ from the trace
+func printTXDiff(tx int, expected, actual []byte) {
+	fmt.Printf("TX %d differs from the trace:\n", tx)
+	if len(expected) != len(actual) {
+		fmt.Printf("  length: expected %d, got %d\n", len(expected), len(actual))
+	}
+	shown := 0
+	for i := 0; i < max(len(expected), len(actual)); i++ {
+		want, got := "--", "--"
+		if i < len(expected) {
+			want = fmt.Sprintf("%02X", expected[i])
+		}
+		if i < len(actual) {
+			got = fmt.Sprintf("%02X", actual[i])
+		}
+		if want == got {
+			continue
+		}
+		if shown == 16 {
+			fmt.Println("  ...")
+			break
+		}
+		fmt.Printf("  byte %4d: expected %s, got %s\n", i, want, got)
+		shown++
+	}
+}
+
+func (p *replayPort) Read(buffer []byte) (int, error) {
+	deadline := time.Now().Add(p.readTimeout)
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return 0, fmt.Errorf("port closed")
+		}
+		if len(p.pending) > 0 && !time.Now().Before(p.pending[0].at) {
+			n := copy(buffer, p.pending[0].data)
+			p.pending[0].data = p.pending[0].data[n:]
+			if len(p.pending[0].data) == 0 {
+				p.pending = p.pending[1:]
+			}
+			p.mu.Unlock()
+			return n, nil
+		}
+		p.mu.Unlock()
+
+		if time.Now().After(deadline) {
+			return 0, nil
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (p *replayPort) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	return nil
+}
+
+func (p *replayPort) SetReadTimeout(t time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.readTimeout = t
+	return nil
+}
+
+func (p *replayPort) SetMode(mode *serial.Mode) error { return nil }
+func (p *replayPort) Drain() error                     { return nil }
+func (p *replayPort) ResetInputBuffer() error          { return nil }
+func (p *replayPort) ResetOutputBuffer() error         { return nil }
+func (p *replayPort) SetDTR(dtr bool) error            { return nil }
+func (p *replayPort) SetRTS(rts bool) error            { return nil }
+func (p *replayPort) Break(d time.Duration) error      { return nil }
+
+func (p *replayPort) GetModemStatusBits() (*serial.ModemStatusBits, error) {
+	return &serial.ModemStatusBits{}, nil
+}
+
+// replayTrace runs a flash against the radio responses recorded in a -trace
+// file and checks that the flasher sends the same bytes as in the capture.
+// The firmware image and protocol are taken from the trace itself.
+func replayTrace(traceFile string, strictTiming bool) error {
+	events, err := loadTrace(traceFile)
+	if err != nil {
+		return err
+	}
+
+	var firstTX []byte
+	var image []byte
+	var last []byte
+	for _, ev := range events {
+		if ev.direction != "TX" {
+			continue
+		}
+		if firstTX == nil {
+			firstTX = ev.data
+		}
+		// Data packets are 87, the offset, a block and the checksum. A
+		// retry sends the same block again.
+		if len(ev.data) > 5 && ev.data[0] == 87 && !bytes.Equal(ev.data, last) {
+			if last != nil && len(ev.data) != len(last) {
+				return fmt.Errorf("%s has data packets of %d and %d bytes", traceFile, len(last), len(ev.data))
+			}
+			image = append(image, ev.data[3:len(ev.data)-1]...)
+			last = ev.data
+		}
+	}
+	if firstTX == nil {
+		return fmt.Errorf("%s has no TX data", traceFile)
+	}
+	if len(image) == 0 {
+		return fmt.Errorf("%s has no firmware blocks", traceFile)
+	}
+
+	// The connect command tells the protocol
+	var protocol ProtocolConfig
+	found := false
+	for _, p := range knownProtocols {
+		if bytes.Equal(p.SendConnect, firstTX) {
+			protocol, found = p, true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("%s starts with % X, which is not the connect command of a known protocol", traceFile, firstTX)
+	}
+	f := NewFlasher(false, WithProtocolConfig(protocol), WithFlashSize(len(image)), WithBlockSize(len(last)-4))
+	if err := f.LoadFirmwareFromReader(MemFirmwareSource(image, FormatBin)); err != nil {
+		return err
+	}
+	port := newReplayPort(events, strictTiming)
+	f.mockPort = port
+
+	fmt.Printf("Replaying %s: %d events, %d firmware blocks of %d bytes\n", traceFile, len(events), f.totalBlocks(), f.BlockSize)
+	updateErr := f.startUpdate("replay")
+	if updateErr != nil {
+		fmt.Printf("Transfer result: %v\n", updateErr)
+	} else {
+		fmt.Println("Transfer result: complete")
+	}
+
+	port.mu.Lock()
+	defer port.mu.Unlock()
+	var remaining int
+	for _, ev := range events[port.next:] {
+		if ev.direction == "TX" {
+			remaining++
+		}
+	}
+	switch {
+	case port.mismatches > 0:
+		return fmt.Errorf("%d of %d TX packets differ from the trace", port.mismatches, port.txCount)
+	case remaining > 0:
+		return fmt.Errorf("the flasher stopped with %d recorded TX packets left", remaining)
+	}
+	fmt.Printf("All %d TX packets match the trace\n", port.txCount)
+	return nil
+}
+
+// write sends data to the radio, recording it in the trace file if enabled
+func (f *Flasher) write(data []byte) (int, error) {
+	f.traceBytes("TX", data)
+	return f.port.Write(data)
+}
+
+func (f *Flasher) traceBytes(direction string, data []byte) {
+	if f.packetDump != nil {
+		if err := f.packetDump.record(direction, data); err != nil {
+			f.log(LogQuiet, "Packet dump stopped: %v\n", err)
+		}
+	}
+	if f.trace == nil {
+		return
+	}
+	fmt.Fprintf(f.trace, "%s %s % X\n", time.Now().Format("15:04:05.000"), direction, data)
+}
+
+// packetDumper writes every packet sent to the radio to tx_NNN.bin and the
+// bytes received after it to rx_NNN.bin in dir, numbered from 001. With
+// hexDump a tx_NNN.hex or rx_NNN.hex with a hexdump is written next to
+// each file.
+type packetDumper struct {
+	mu      sync.Mutex
+	dir     string
+	hexDump bool
+	count   int    // Number of the last TX packet
+	rx      []byte // Bytes received since that packet
+	failed  bool   // Set after the first write error, which stops the dump
+}
+
+// newPacketDumper creates dir if needed
+func newPacketDumper(dir string, hexDump bool) (*packetDumper, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create packet dump directory: %v", err)
+	}
+	return &packetDumper{dir: dir, hexDump: hexDump}, nil
+}
+
+// record adds a TX packet or RX bytes to the dump. The radio's answer
+// arrives a byte at a time, so rx_NNN is rewritten as it grows. Only the
+// first error is returned.
+func (d *packetDumper) record(direction string, data []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.failed {
+		return nil
+	}
+
+	var err error
+	if direction == "TX" {
+		d.count++
+		d.rx = nil
+		err = d.writePacket(fmt.Sprintf("tx_%03d", d.count), data)
+	} else {
+		d.rx = append(d.rx, data...)
+		err = d.writePacket(fmt.Sprintf("rx_%03d", d.count), d.rx)
+	}
+	if err != nil {
+		d.failed = true
+	}
+	return err
+}
+
+func (d *packetDumper) writePacket(name string, data []byte) error {
+	if err := os.WriteFile(filepath.Join(d.dir, name+".bin"), data, 0644); err != nil {
+		return err
+	}
+	if d.hexDump {
+		return os.WriteFile(filepath.Join(d.dir, name+".hex"), []byte(hex.Dump(data)), 0644)
+	}
+	return nil
+}
+
+// SentBlock is a firmware block waiting for its ACK
+type SentBlock struct {
+	Block    int    // Block number, from 0
+	Sequence uint16 // Bytes 1-2 of the packet header
+}
+
+// sendNextBlock packs the block at sendcnt and sends it, must be called
+// with f.mu held
+func (f *Flasher) sendNextBlock() {
+	f.gWritebytes++
+	f.progressf("Progress: %03d/%d (sending block at offset %d)\n", f.gWritebytes, f.totalBlocks(), f.sendcnt)
+	
+	f.sendbuf[1] = byte(f.sendcnt >> 8)
+	f.sendbuf[2] = byte(f.sendcnt & 0xFF)
+	
+	for i := 0; i < f.BlockSize; i++ {
+		f.sendbuf[3+i] = f.hex[f.sendcnt+i]
+	}
+	f.protectBlock(f.sendbuf[3:f.BlockSize+3], f.sendcnt)
+	f.sendbuf[f.BlockSize+3] = f.checksum(f.sendbuf, f.BlockSize+4)
+	
+	if f.DataPacketDelay > 0 {
+		time.Sleep(f.DataPacketDelay)
+	}
+	f.sendDataPacket()
+	f.sentButUnacked = append(f.sentButUnacked, SentBlock{
+		Block:    f.gWritebytes - 1,
+		Sequence: uint16(f.sendbuf[1])<<8 | uint16(f.sendbuf[2]),
+	})
+	f.sendcnt += f.BlockSize
+}
+
+// readProtectedRegions reads the blocks overlapping ProtectedRegions from
+// the radio before anything is written, so protectBlock can send their
+// protected bytes back unchanged. Blocks that can't be read are refused,
+// or filled with 0xFF when SkipProtected is set, which erases the protected
+// bytes instead of keeping them.
+func (f *Flasher) readProtectedRegions() error {
+	f.protectedData = nil
+	if len(f.ProtectedRegions) == 0 {
+		return nil
+	}
+
+	data := make([]byte, f.FlashSize)
+	unread := 0
+	var readErr error
+	for block := 0; block < f.totalBlocks(); block++ {
+		start := block * f.BlockSize
+		if !f.isProtected(start, start+f.BlockSize) {
+			continue
+		}
+		contents, err := f.readFirmwareBlock(block)
+		if err != nil {
+			if !f.SkipProtected {
+				return fmt.Errorf("failed to read protected block %d from the radio, not flashing "+
+					"(-skip-protected writes 0xFF there instead): %w", block, err)
+			}
+			contents = bytes.Repeat([]byte{0xFF}, f.BlockSize)
+			unread++
+			readErr = err
+		}
+		copy(data[start:start+f.BlockSize], contents)
+	}
+	if unread > 0 {
+		f.log(LogNormal, "Warning: %d protected blocks could not be read from the radio (%v), "+
+			"their protected bytes are written as 0xFF and are lost\n", unread, readErr)
+	}
+	f.protectedData = data
+	return nil
+}
+
+// isProtected reports whether any byte of [start, end) lies in one of the
+// ProtectedRegions
+func (f *Flasher) isProtected(start, end int) bool {
+	for _, r := range f.ProtectedRegions {
+		if r.StartOffset < end && start < r.EndOffset {
+			return true
+		}
+	}
+	return false
+}
+
+// protectBlock replaces the bytes of the block at offset that lie in a
+// protected region with those read by readProtectedRegions, must be called
+// with f.mu held
+func (f *Flasher) protectBlock(data []byte, offset int) {
+	if f.protectedData == nil {
+		return
+	}
+	for _, r := range f.ProtectedRegions {
+		start := max(r.StartOffset, offset)
+		end := min(r.EndOffset, offset+len(data))
+		if start >= end {
+			continue
+		}
+		copy(data[start-offset:end-offset], f.protectedData[start:end])
+		f.log(LogVerbose, "Block %d: keeping protected bytes 0x%X-0x%X\n", offset/f.BlockSize, start, end-1)
+	}
+}
+
+// sendDataPacket must be called with f.mu held
+func (f *Flasher) sendDataPacket() {
+	f.log(LogVerbose, "Block %d (%s)\n", f.sendcnt/f.BlockSize, f.describeAddress(uint32(0x08002800+f.sendcnt)))
+	f.log(LogVerbose, "Sending block data (first 16 bytes): % X\n", f.sendbuf[3:19])
+	f.log(LogVerbose, "Block header: %02X %02X %02X, checksum: %02X\n", 
+		f.sendbuf[0], f.sendbuf[1], f.sendbuf[2], f.sendbuf[f.BlockSize+3])
+	
+	n, err := f.write(f.sendbuf[:f.BlockSize+4])
+	if err != nil {
+		f.log(LogQuiet, "Write error: %v\n", err)
+	} else {
+		f.log(LogVerbose, "Sent %d bytes\n", n)
+		f.stats.BlocksSent++
+		f.stats.BytesSent += n
+	}
+	
+	f.lastPacketTime = time.Now()
+	f.waitingForAck = true
+	f.retryCount = 0
+}
+
+// retryLastPacket must be called with f.mu held
+func (f *Flasher) retryLastPacket() {
+	if f.retryCount < f.maxRetries {
+		f.retryCount++
+		f.stats.Retries++
+		
+		// Go back to the oldest block in flight, with a window of 1 the
+		// last one sent. A second NAK before the retried block went out
+		// again must not go back before block 0.
+		resend := max(f.gWritebytes-1, 0)
+		if len(f.sentButUnacked) > 0 {
+			resend = f.sentButUnacked[0].Block
+		}
+		f.log(LogNormal, "Timeout! Retrying packet (attempt %d/%d) - going back to block %d\n", 
+			f.retryCount, f.maxRetries, resend)
+		
+		f.sendcnt = resend * f.BlockSize
+		f.gWritebytes = resend
+		f.sentButUnacked = f.sentButUnacked[:0]
+		f.keepAliveAcks = nil
+		f.waitingForAck = false
+		
+		f.log(LogVerbose, "Reset state: sendcnt=%d, gWritebytes=%d, waitingForAck=%t\n", 
+			f.sendcnt, f.gWritebytes, f.waitingForAck)
+	} else {
+		f.log(LogQuiet, "Max retries exceeded. Aborting transfer.\n")
+		f.abortErr = protocolErrorf(ErrMaxRetriesExceeded, f.gWritebytes-1,
+			"block %d failed after %d retries", f.gWritebytes-1, f.maxRetries)
+		f.port.Close()
+		f.state = StateError
+	}
+}
+
+func (f *Flasher) checkTimeout() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.waitingForAck && time.Since(f.lastPacketTime) > f.packetTimeout {
+		f.log(LogNormal, "Timeout detected! Waiting for ACK for %.1f seconds\n", time.Since(f.lastPacketTime).Seconds())
+		if err := f.transition(EventTimeout); err != nil {
+			f.log(LogVerbose, "Ignoring timeout: %v\n", err)
+			return
+		}
+		f.retryLastPacket()
+	}
+}
+
+func (f *Flasher) readData() {
+	buffer := make([]byte, 1)
+	for f.port != nil {
+		select {
+		case <-f.done:
+			return
+		default:
+		}
+		
+		// Check for timeout on each loop
+		f.checkTimeout()
+		
+		n, err := f.port.Read(buffer)
+		if err != nil && f.shouldReconnect() {
+			f.reconnect(err)
+			continue
+		}
+		if err != nil || n == 0 {
+			time.Sleep(1 * time.Millisecond)
+			continue
+		}
+		f.traceBytes("RX", buffer[:n])
+		
+		f.mu.Lock()
+		if f.recvcnt >= len(f.recvbuf) {
+			f.mu.Unlock()
+			continue
+		}
+		f.recvbuf[f.recvcnt] = buffer[0]
+		f.recvcnt++
+		f.lastReceived = int(buffer[0])
+		f.log(LogVerbose, "Received byte: 0x%02X (state: %s, recvcnt: %d)\n", buffer[0], f.state, f.recvcnt)
+		
+		connecting := f.recvbuf[0] == 0
+		if connecting {
+			f.sendcnt = 0
+			f.flgConnect = true
+		} else {
+			f.flgConnect = false
+		}
+		f.mu.Unlock()
+		
+		if connecting {
+			time.Sleep(200 * time.Millisecond)
+		} else {
+			time.Sleep(1 * time.Millisecond)
+			f.revDateOperation()
+		}
+	}
+}
+
+// shouldReconnect reports whether a port error is a lost cable worth
+// waiting for, and not the port being closed at the end of the transfer
+func (f *Flasher) shouldReconnect() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.ReconnectOnDisconnect && f.portName != "" && f.state.active() && f.abortErr == nil && !f.timedOut
+}
+
+// reconnect looks for the cable every 500 ms until ReconnectTimeout. On
+// Linux it may come back under another name and is recognized by its USB
+// VID:PID, elsewhere only the original port name is tried. The transfer
+// then resumes from the oldest block the radio has not acknowledged.
+func (f *Flasher) reconnect(cause error) {
+	f.log(LogQuiet, "Port disconnected, waiting for reconnect...\n")
+	f.log(LogVerbose, "Port error: %v\n", cause)
+	f.mu.Lock()
+	f.port.Close()
+	portName, usbID := f.portName, f.usbID
+	f.mu.Unlock()
+	
+	mode := &serial.Mode{
+		BaudRate: f.baudRate,
+		DataBits: 8,
+		Parity:   serial.NoParity,
+		StopBits: serial.OneStopBit,
+	}
+	deadline := time.Now().Add(f.ReconnectTimeout)
+	for time.Now().Before(deadline) {
+		select {
+		case <-f.done:
+			return
+		case <-time.After(500 * time.Millisecond):
+		}
+		
+		for _, name := range f.getAvailablePorts() {
+			if name != portName && (usbID == "" || portUSBID(name) != usbID) {
+				continue
+			}
+			// startUpdate holds the lock of the original port
+			unlock := func() {}
+			if name != portName {
+				var err error
+				if unlock, err = lockPort(name); err != nil {
+					f.log(LogVerbose, "Not reopening %s: %v\n", name, err)
+					continue
+				}
+			}
+			port, err := serial.Open(name, mode)
+			if err != nil {
+				unlock()
+				f.log(LogVerbose, "Reopening %s failed: %v\n", name, err)
+				continue
+			}
+			f.resumeOnPort(port, name, unlock)
+			return
+		}
+	}
+	
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.log(LogQuiet, "Cable not reconnected within %v, aborting\n", f.ReconnectTimeout)
+	f.abortErr = protocolErrorf(ErrPortOpen, f.gWritebytes-1, "port %s disconnected and did not come back within %v: %v",
+		portName, f.ReconnectTimeout, cause)
+	f.waitingForAck = false
+	f.state = StateError
+}
+
+// releaseReconnectLock removes the lock of the port reconnect moved to
+func (f *Flasher) releaseReconnectLock() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.reconnectUnlock != nil {
+		f.reconnectUnlock()
+		f.reconnectUnlock = nil
+	}
+}
+
+// resumeOnPort continues the transfer on a reopened port by resending the
+// command of the current handshake step, or the blocks from the oldest
+// one in flight on. unlock removes the lock of the port if reconnect took
+// one.
+func (f *Flasher) resumeOnPort(port serial.Port, name string, unlock func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	
+	f.port = port
+	f.portName = name
+	if f.reconnectUnlock != nil {
+		f.reconnectUnlock()
+	}
+	f.reconnectUnlock = unlock
+	f.recvcnt = 0
+	
+	switch f.state {
+	case StateTransferring:
+		if len(f.sentButUnacked) > 0 {
+			resend := f.sentButUnacked[0].Block
+			f.sendcnt = resend * f.BlockSize
+			f.gWritebytes = resend
+			f.sentButUnacked = f.sentButUnacked[:0]
+		}
+		f.keepAliveAcks = nil
+		f.log(LogQuiet, "Reconnected on %s, resuming at block %d/%d\n", name, f.gWritebytes+1, f.totalBlocks())
+		for len(f.sentButUnacked) < max(f.WindowSize, 1) && f.sendcnt < f.FlashSize {
+			f.sendNextBlock()
+		}
+		f.waitingForAck = len(f.sentButUnacked) > 0
+	case StateSendingUpdate:
+		f.log(LogQuiet, "Reconnected on %s, resending the update command\n", name)
+		f.write(f.sendUpdate)
+	default:
+		f.log(LogQuiet, "Reconnected on %s, resending the connect command\n", name)
+		f.write(f.sendConnect)
+	}
+	f.lastPacketTime = time.Now()
+}
+
+// State returns the current protocol state
+func (f *Flasher) State() ProtocolState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.state
+}
+
+// BlocksWritten returns the number of firmware blocks sent so far
+func (f *Flasher) BlocksWritten() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.gWritebytes
+}
+
+// BytesSent returns the image offset of the next block to send
+func (f *Flasher) BytesSent() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sendcnt
+}
+
+// WaitingForAck reports whether a block was sent and is not yet acknowledged
+func (f *Flasher) WaitingForAck() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.waitingForAck
+}
+
+// RetryCount returns the retries of the current block
+func (f *Flasher) RetryCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.retryCount
+}
+
+// TimedOut reports whether the watchdog aborted the transfer
+func (f *Flasher) TimedOut() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.timedOut
+}
+
+// Stats returns the transfer statistics
+func (f *Flasher) Stats() TransferStats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.stats
+}
+
+// waitConnectTimeout waits ConnectTimeout for the answer to a connect
+// command, returning early when the watchdog aborts the transfer
+func (f *Flasher) waitConnectTimeout() {
+	deadline := time.Now().Add(f.ConnectTimeout)
+	for !f.TimedOut() {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return
+		}
+		if remaining > 10*time.Millisecond {
+			remaining = 10 * time.Millisecond
+		}
+		time.Sleep(remaining)
+	}
+}
+
+// connectWithRetry sends the connect command until the radio answers, at
+// most attempts times. When it never does, the port is closed and what was
+// seen of the radio is logged to help finding the cause.
+func (f *Flasher) connectWithRetry(attempts int) error {
+	err := f.sendConnects(attempts)
+	if err != nil {
+		f.port.Close()
+	}
+	return err
+}
+
+// sendConnects is connectWithRetry without closing the port
+func (f *Flasher) sendConnects(attempts int) error {
+	attempts = max(attempts, 1)
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if f.TimedOut() || (attempt > 1 && !f.retryConnect()) {
+			break
+		}
+		f.log(LogNormal, "Connection attempt %d/%d...\n", attempt, attempts)
+		f.write(f.sendConnect)
+		f.waitConnectTimeout()
+	}
+
+	if !f.retryConnect() {
+		return nil
+	}
+	if f.TimedOut() {
+		return protocolErrorf(ErrTimeout, -1, "transfer timed out after %v", f.TotalTimeout)
+	}
+
+	f.mu.Lock()
+	state, last := f.state, f.lastReceived
+	f.mu.Unlock()
+	lastByte := "none"
+	if last >= 0 {
+		lastByte = fmt.Sprintf("0x%02X", last)
+	}
+	f.log(LogQuiet, "No answer to the connect command after %d attempts\n", attempts)
+	f.log(LogQuiet, "  State reached: %s\n", state)
+	f.log(LogQuiet, "  Last byte received: %s\n", lastByte)
+	f.log(LogQuiet, "Check that:\n")
+	f.log(LogQuiet, "  - the radio is in bootloader mode (hold PTT while switching it on)\n")
+	f.log(LogQuiet, "  - the protocol matches the radio, see -protocol and \"rt6d-flasher list-protocols\"\n")
+	f.log(LogQuiet, "  - the cable works, see \"rt6d-flasher loopback-test\"\n")
+	return protocolErrorf(ErrTimeout, -1, "communication error - no response from device after %d connection attempts", attempts)
+}
+
+// retryConnect reports whether the device has not answered the connect
+// command yet, resetting the block offset for the next attempt
+func (f *Flasher) retryConnect() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.flgConnect {
+		f.sendcnt = 0
+	}
+	return f.flgConnect
+}
+
+// backupSPIFlash dumps the 4MB SPI flash (calibration and settings) to a
+// timestamped file in BackupPath and returns the file name. The blocks are
+// read like spi-tool does, with spilib.
+func (f *Flasher) backupSPIFlash(portName string) (string, error) {
+	client := spilib.NewSPIClient(spilib.SPI_FLASH_SIZE, 0)
+	client.Quiet = true
+	if err := client.Connect(portName, f.baudRate); err != nil {
+		return "", protocolErrorf(ErrPortOpen, -1, "%v", err)
+	}
+	defer client.Disconnect()
+
+	filename := filepath.Join(f.BackupPath, fmt.Sprintf("spi_backup_%s.bin", time.Now().Format("20060102-150405")))
+	file, err := os.Create(filename)
+	if err != nil {
+		return "", fmt.Errorf("failed to create backup file: %v", err)
+	}
+	defer file.Close()
+
+	deadline := time.Now().Add(f.BackupTimeout)
+	totalBlocks := spilib.SPI_FLASH_SIZE / spilib.CHUNK_SIZE
+	tracker := spilib.NewTransferTracker(spilib.SPI_FLASH_SIZE)
+	for block := 0; block < totalBlocks; block++ {
+		if time.Now().After(deadline) {
+			return "", protocolErrorf(ErrTimeout, block, "backup timed out after %v at block %d/%d", f.BackupTimeout, block, totalBlocks)
+		}
+
+		data, err := client.ReadBlockWithRetry(block)
+		if err != nil {
+			return "", fmt.Errorf("failed to read SPI block %d: %w", block, err)
+		}
+
+		if _, err := file.Write(data); err != nil {
+			return "", fmt.Errorf("failed to write backup file: %v", err)
+		}
+		tracker.Update(len(data))
+		if (block+1)%10 == 0 {
+			f.log(LogNormal, "\rBacking up SPI flash: %-60s", tracker)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	f.log(LogNormal, "\n")
+
+	// Only continue to flash once the complete backup is on disk
+	if err := file.Sync(); err != nil {
+		return "", fmt.Errorf("failed to flush backup file: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return "", fmt.Errorf("failed to check backup file: %v", err)
+	}
+	if info.Size() != spilib.SPI_FLASH_SIZE {
+		return "", fmt.Errorf("backup file is incomplete: %d of %d bytes", info.Size(), spilib.SPI_FLASH_SIZE)
+	}
+	return filename, nil
+}
+
+// readFirmwareBlock requests block blockNum of the installed firmware.
+//
+// TODO: no read command of the bootloader is known yet. By analogy with the
+// write packet it is expected to be 0x52 ('R'), offset high, offset low and
+// the checksum (f.ChecksumAlgo), answered with a 1028 byte packet:
+// 0x52, offset high, offset low, 1024 data bytes and the checksum.
+// Implement it once the command is confirmed on a radio.
+func (f *Flasher) readFirmwareBlock(blockNum int) ([]byte, error) {
+	return nil, fmt.Errorf("reading firmware is not supported by the bootloader protocol yet")
+}
+
+// readFirmware downloads the installed firmware into a .bin file, or an
+// Intel HEX file when hexOutput is set
+func (f *Flasher) readFirmware(portName, filename string, hexOutput bool) error {
+	mode := &serial.Mode{
+		BaudRate: f.baudRate,
+		DataBits: 8,
+		Parity:   serial.NoParity,
+		StopBits: serial.OneStopBit,
+	}
+
+	port, err := serial.Open(portName, mode)
+	if err != nil {
+		return protocolErrorf(ErrPortOpen, -1, "failed to open port %s: %v", portName, err)
+	}
+	f.port = port
+	defer f.port.Close()
+
+	image := make([]byte, 0, len(f.hex))
+	totalBlocks := f.totalBlocks()
+	for block := 0; block < totalBlocks; block++ {
+		data, err := f.readFirmwareBlock(block)
+		if err != nil {
+			return fmt.Errorf("failed to read block %d: %w", block, err)
+		}
+		image = append(image, data...)
+		f.log(LogNormal, "\rReading firmware: %03d/%d", block+1, totalBlocks)
+	}
+	f.log(LogNormal, "\n")
+
+	output := image
+	if hexOutput {
+		output = []byte(binToIntelHex(image, 0x08002800))
+	}
+	if err := os.WriteFile(filename, output, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", filename, err)
+	}
+	f.log(LogQuiet, "Firmware saved to %s (%d bytes)\n", filename, len(image))
+	return nil
+}
+
+// DeviceInfo identifies the radio connected to the programming cable
+type DeviceInfo struct {
+	ModelName        string `json:"model_name"`
+	FirmwareVersion  string `json:"firmware_version"`
+	HardwareRevision string `json:"hardware_revision"`
+	SerialNumber     string `json:"serial_number"`
+}
+
+// QueryDeviceInfo asks the radio in programming mode to identify itself.
+// f.port must be open.
+//
+// TODO: no identification command of the bootloader is known yet. The
+// query sends the connect command, which the bootloader is known to answer,
+// and reads the reply for 500 ms. A plain ACK (0x06) only confirms that a
+// bootloader is listening and leaves the fields "unknown". A longer reply
+// is expected to be the ACK followed by NUL separated ASCII fields: model,
+// firmware version, hardware revision and serial number. Replace the
+// command once it is confirmed on a radio.
+func (f *Flasher) QueryDeviceInfo() (*DeviceInfo, error) {
+	if err := f.port.SetReadTimeout(50 * time.Millisecond); err != nil {
+		return nil, fmt.Errorf("failed to set read timeout: %v", err)
+	}
+	f.port.ResetInputBuffer()
+
+	if _, err := f.write(f.sendConnect); err != nil {
+		return nil, fmt.Errorf("failed to send query: %v", err)
+	}
+
+	var response []byte
+	buffer := make([]byte, 64)
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		n, err := f.port.Read(buffer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response: %v", err)
+		}
+		f.traceBytes("RX", buffer[:n])
+		response = append(response, buffer[:n]...)
+	}
+
+	return parseDeviceInfo(response)
+}
+
+// parseDeviceInfo decodes the reply to QueryDeviceInfo
+func parseDeviceInfo(response []byte) (*DeviceInfo, error) {
+	if len(response) == 0 {
+		return nil, protocolErrorf(ErrTimeout, -1, "no response from device")
+	}
+	if response[0] == 255 {
+		return nil, protocolErrorf(ErrNAKReceived, -1, "device rejected the query: % X", response)
+	}
+	if response[0] != 6 {
+		return nil, fmt.Errorf("unexpected response: % X", response)
+	}
+
+	info := &DeviceInfo{
+		ModelName:        "unknown",
+		FirmwareVersion:  "unknown",
+		HardwareRevision: "unknown",
+		SerialNumber:     "unknown",
+	}
+	fields := []*string{&info.ModelName, &info.FirmwareVersion, &info.HardwareRevision, &info.SerialNumber}
+	for i, value := range bytes.Split(response[1:], []byte{0}) {
+		if i >= len(fields) {
+			break
+		}
+		if len(value) > 0 {
+			*fields[i] = string(value)
+		}
+	}
+	return info, nil
+}
+
+// DiagReport summarizes the link quality measured by DiagnosePort
+type DiagReport struct {
+	MinLatencyMs   float64
+	MeanLatencyMs  float64
+	MaxLatencyMs   float64
+	ThroughputKBps float64
+	ErrorRate      float64 // Share of connect frames without any response
+	Recommendation string
+}
+
+// DiagnosePort measures the round trip time of 10 connect commands and the
+// time to send a 1 KB block, to tell cable problems from protocol problems.
+// The radio must be in programming mode. The block is made of connect
+// commands so the bootloader doesn't take it for data.
+func (f *Flasher) DiagnosePort(portName string) (*DiagReport, error) {
+	mode := &serial.Mode{
+		BaudRate: f.baudRate,
+		DataBits: 8,
+		Parity:   serial.NoParity,
+		StopBits: serial.OneStopBit,
+	}
+
+	port, err := serial.Open(portName, mode)
+	if err != nil {
+		return nil, protocolErrorf(ErrPortOpen, -1, "failed to open port %s: %v", portName, err)
+	}
+	f.port = port
+	defer port.Close()
+	if err := port.SetReadTimeout(10 * time.Millisecond); err != nil {
+		return nil, fmt.Errorf("failed to set read timeout: %v", err)
+	}
+
+	const pings = 10
+	report := &DiagReport{}
+	var total time.Duration
+	answered := 0
+	buffer := make([]byte, 64)
+	for i := 0; i < pings; i++ {
+		port.ResetInputBuffer()
+		start := time.Now()
+		if _, err := f.write(f.sendConnect); err != nil {
+			return nil, fmt.Errorf("failed to send connect command: %v", err)
+		}
+
+		var latency time.Duration
+		for time.Since(start) < time.Second {
+			n, err := port.Read(buffer)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read response: %v", err)
+			}
+			if n > 0 {
+				latency = time.Since(start)
+				f.traceBytes("RX", buffer[:n])
+				break
+			}
+		}
+		if latency == 0 {
+			f.log(LogNormal, "Ping %d: no response\n", i+1)
+			continue
+		}
+		f.log(LogNormal, "Ping %d: %.1f ms\n", i+1, latency.Seconds()*1000)
+
+		ms := latency.Seconds() * 1000
+		if answered == 0 || ms < report.MinLatencyMs {
+			report.MinLatencyMs = ms
+		}
+		if ms > report.MaxLatencyMs {
+			report.MaxLatencyMs = ms
+		}
+		total += latency
+		answered++
+		time.Sleep(50 * time.Millisecond)
+	}
+	report.ErrorRate = float64(pings-answered) / pings
+	if answered == 0 {
+		return nil, protocolErrorf(ErrTimeout, -1, "no response from device to %d connect commands", pings)
+	}
+	report.MeanLatencyMs = total.Seconds() * 1000 / float64(answered)
+
+	block := bytes.Repeat(f.sendConnect, 1024/len(f.sendConnect))
+	start := time.Now()
+	if _, err := f.write(block); err != nil {
+		return nil, fmt.Errorf("failed to send test block: %v", err)
+	}
+	if err := port.Drain(); err != nil {
+		return nil, fmt.Errorf("failed to send test block: %v", err)
+	}
+	report.ThroughputKBps = float64(len(block)) / 1024 / time.Since(start).Seconds()
+
+	var advice []string
+	if report.MeanLatencyMs > 50 {
+		advice = append(advice, "check cable or USB adapter")
+	}
+	if report.ThroughputKBps < 10 {
+		advice = append(advice, "consider higher baud rate")
+	}
+	if report.ErrorRate > 0 {
+		advice = append(advice, "some commands were not answered, check the connection")
+	}
+	if len(advice) == 0 {
+		advice = append(advice, "link looks good")
+	}
+	report.Recommendation = strings.Join(advice, "; ")
+	return report, nil
+}
+
+// LoopbackResult summarizes a TestLoopback run
+type LoopbackResult struct {
+	Packets       int
+	BytesSent     int
+	BytesReceived int
+	BytesMatched  int     // Received bytes equal to the byte sent at the same position
+	ErrorRate     float64 // Share of sent bytes that did not come back unchanged
+	MinLatencyMs  float64 // Round trip of the packets that came back complete
+	MeanLatencyMs float64
+	MaxLatencyMs  float64
+}
+
+// TestLoopback checks the cable on its own: with TX and RX shorted on the
+// adapter, every packet of 16 random bytes sent must come back unchanged.
+// No radio may be connected.
+func (f *Flasher) TestLoopback(portName string, iterations int) (*LoopbackResult, error) {
+	mode := &serial.Mode{
+		BaudRate: f.baudRate,
+		DataBits: 8,
+		Parity:   serial.NoParity,
+		StopBits: serial.OneStopBit,
+	}
+
+	port := f.mockPort
+	if port == nil {
+		var err error
+		port, err = serial.Open(portName, mode)
+		if err != nil {
+			return nil, protocolErrorf(ErrPortOpen, -1, "failed to open port %s: %v", portName, err)
+		}
+	}
+	f.port = port
+	defer port.Close()
+	if err := port.SetReadTimeout(10 * time.Millisecond); err != nil {
+		return nil, fmt.Errorf("failed to set read timeout: %v", err)
+	}
+
+	const packetSize = 16
+	result := &LoopbackResult{Packets: iterations}
+	var total time.Duration
+	complete := 0
+	packet := make([]byte, packetSize)
+	buffer := make([]byte, 64)
+	for i := 0; i < iterations; i++ {
+		if _, err := rand.Read(packet); err != nil {
+			return nil, fmt.Errorf("failed to generate test packet: %v", err)
+		}
+		port.ResetInputBuffer()
+		start := time.Now()
+		if _, err := f.write(packet); err != nil {
+			return nil, fmt.Errorf("failed to send test packet: %v", err)
+		}
+		result.BytesSent += packetSize
+
+		var received []byte
+		var latency time.Duration
+		for len(received) < packetSize && time.Since(start) < time.Second {
+			n, err := port.Read(buffer)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read test packet: %v", err)
+			}
+			received = append(received, buffer[:n]...)
+			if len(received) >= packetSize {
+				latency = time.Since(start)
+			}
+		}
+		if len(received) > 0 {
+			f.traceBytes("RX", received)
+		}
+		result.BytesReceived += len(received)
+		for j := 0; j < packetSize && j < len(received); j++ {
+			if received[j] == packet[j] {
+				result.BytesMatched++
+			}
+		}
+
+		if latency == 0 {
+			f.log(LogVerbose, "Packet %d: %d of %d bytes back\n", i+1, len(received), packetSize)
+			continue
+		}
+		f.log(LogVerbose, "Packet %d: %.1f ms\n", i+1, latency.Seconds()*1000)
+
+		ms := latency.Seconds() * 1000
+		if complete == 0 || ms < result.MinLatencyMs {
+			result.MinLatencyMs = ms
+		}
+		if ms > result.MaxLatencyMs {
+			result.MaxLatencyMs = ms
+		}
+		total += latency
+		complete++
+	}
+	if result.BytesSent > 0 {
+		result.ErrorRate = float64(result.BytesSent-result.BytesMatched) / float64(result.BytesSent)
+	}
+	if complete > 0 {
+		result.MeanLatencyMs = total.Seconds() * 1000 / float64(complete)
+	}
+	return result, nil
+}
+
+// HardwareTestStep is one check of HardwareTest
+type HardwareTestStep struct {
+	Name   string
+	Passed bool
+	Detail string
+}
+
+// HardwareTestResult lists the checks of HardwareTest in the order they
+// ran. Checks after a failed port open are not run.
+type HardwareTestResult struct {
+	Steps           []HardwareTestStep
+	IdleBytesPerSec float64 // Bytes received while nothing was sent
+	Summary         string
+}
+
+// Passed reports whether every check passed
+func (r *HardwareTestResult) Passed() bool {
+	for _, step := range r.Steps {
+		if !step.Passed {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *HardwareTestResult) add(name string, passed bool, format string, args ...interface{}) {
+	r.Steps = append(r.Steps, HardwareTestStep{Name: name, Passed: passed, Detail: fmt.Sprintf(format, args...)})
+}
+
+// HardwareTest checks the cable from end to end before a flash: the port
+// opens, the driver handles the modem lines, the radio answers a connect
+// command and the line is quiet when nothing is sent. The radio must be in
+// programming mode.
+func (f *Flasher) HardwareTest(portName string) (*HardwareTestResult, error) {
+	result := &HardwareTestResult{}
+	mode := &serial.Mode{
+		BaudRate: f.baudRate,
+		DataBits: 8,
+		Parity:   serial.NoParity,
+		StopBits: serial.OneStopBit,
+	}
+
+	port := f.mockPort
+	if port == nil {
+		var err error
+		port, err = serial.Open(portName, mode)
+		if err != nil {
+			result.add("Open port", false, "%v", err)
+			result.Summary = "the port can't be opened: check the port name and that the cable driver is installed"
+			return result, nil
+		}
+	}
+	result.add("Open port", true, "%d baud", f.baudRate)
+	f.port = port
+	defer port.Close()
+
+	// Most cables leave CTS and DSR unconnected, so only the driver
+	// support is checked; the lines are shown for cables that wire them
+	var lines [2]*serial.ModemStatusBits
+	var err error
+	for i, level := range []bool{false, true} {
+		if err = port.SetDTR(level); err == nil {
+			err = port.SetRTS(level)
+		}
+		if err == nil {
+			time.Sleep(100 * time.Millisecond)
+			lines[i], err = port.GetModemStatusBits()
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err != nil {
+		result.add("Modem lines", false, "%v", err)
+	} else {
+		onOff := map[bool]string{false: "off", true: "on"}
+		result.add("Modem lines", true, "DTR/RTS off then on: CTS %s->%s, DSR %s->%s",
+			onOff[lines[0].CTS], onOff[lines[1].CTS], onOff[lines[0].DSR], onOff[lines[1].DSR])
+	}
+
+	if err := port.SetReadTimeout(10 * time.Millisecond); err != nil {
+		return nil, fmt.Errorf("failed to set read timeout: %v", err)
+	}
+	port.ResetInputBuffer()
+	if _, err := f.write(f.sendConnect); err != nil {
+		return nil, fmt.Errorf("failed to send connect command: %v", err)
+	}
+	var response []byte
+	buffer := make([]byte, 64)
+	start := time.Now()
+	for len(response) == 0 && time.Since(start) < time.Second {
+		n, err := port.Read(buffer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response: %v", err)
+		}
+		response = append(response, buffer[:n]...)
+	}
+	switch {
+	case len(response) == 0:
+		result.add("Connect", false, "no response within 1 s")
+	case response[0] == 0x06:
+		f.traceBytes("RX", response)
+		result.add("Connect", true, "ACK after %.1f ms", time.Since(start).Seconds()*1000)
+	case bytes.HasPrefix(f.sendConnect, response):
+		f.traceBytes("RX", response)
+		result.add("Connect", false, "the connect command came back unchanged")
+	default:
+		f.traceBytes("RX", response)
+		result.add("Connect", true, "answered % X instead of ACK", response)
+	}
+
+	// Let the rest of the answer arrive before listening to the idle line
+	time.Sleep(100 * time.Millisecond)
+	port.ResetInputBuffer()
+	idle := 0
+	start = time.Now()
+	for time.Since(start) < time.Second {
+		n, err := port.Read(buffer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read idle line: %v", err)
+		}
+		idle += n
+	}
+	result.IdleBytesPerSec = float64(idle) / time.Since(start).Seconds()
+	result.add("Idle line", idle == 0, "%.0f bytes/s received while nothing was sent", result.IdleBytesPerSec)
+
+	var advice []string
+	for _, step := range result.Steps {
+		switch {
+		case step.Passed:
+		case step.Name == "Modem lines":
+			advice = append(advice, "the driver can't set or read the modem lines, try another driver or adapter")
+		case step.Name == "Connect" && len(response) > 0:
+			advice = append(advice, "TX and RX look shorted, check the cable with loopback-test")
+		case step.Name == "Connect":
+			advice = append(advice, "no answer, check that the radio is on and in programming mode and that the cable is a programming cable")
+		case step.Name == "Idle line":
+			advice = append(advice, "noise on the line, check the baud rate and the cable")
+		}
+	}
+	if len(advice) == 0 {
+		advice = append(advice, "cable and radio look good")
+	}
+	result.Summary = strings.Join(advice, "; ")
+	return result, nil
+}
+
+// BenchmarkResult summarizes a BenchmarkPort run
+type BenchmarkResult struct {
+	Duration        time.Duration // Time actually spent sending and waiting
+	PacketsSent     int
+	PacketsReceived int // Packets that came back complete, intact or not
+	BytesSent       int
+	BytesReceived   int
+	ThroughputKBps  float64 // Bytes sent per second
+	PacketLossRate  float64 // Share of sent packets that did not come back complete
+	CRCErrorRate    float64 // Share of received packets with a different CRC32
+	MinRoundTripMs  float64
+	MeanRoundTripMs float64
+	MaxRoundTripMs  float64
+
+	// Three times the slowest round trip, a -timeout that leaves room for
+	// the slowest packets seen
+	RecommendedBlockTimeout time.Duration
+}
+
+// BenchmarkPort sends 1028 byte packets, the size of a firmware packet,
+// for duration and waits for each to be echoed back. The port must echo
+// what it receives, e.g. with TX and RX shorted as for loopback-test.
+func (f *Flasher) BenchmarkPort(portName string, duration time.Duration) (*BenchmarkResult, error) {
+	mode := &serial.Mode{
+		BaudRate: f.baudRate,
+		DataBits: 8,
+		Parity:   serial.NoParity,
+		StopBits: serial.OneStopBit,
+	}
+
+	port := f.mockPort
+	if port == nil {
+		var err error
+		port, err = serial.Open(portName, mode)
+		if err != nil {
+			return nil, protocolErrorf(ErrPortOpen, -1, "failed to open port %s: %v", portName, err)
+		}
+	}
+	f.port = port
+	defer port.Close()
+	if err := port.SetReadTimeout(10 * time.Millisecond); err != nil {
+		return nil, fmt.Errorf("failed to set read timeout: %v", err)
+	}
+
+	const packetSize = 1028
+	result := &BenchmarkResult{}
+	var total time.Duration
+	corrupted := 0
+	packet := make([]byte, packetSize)
+	received := make([]byte, 0, packetSize)
+	buffer := make([]byte, packetSize)
+	start := time.Now()
+	for time.Since(start) < duration {
+		if _, err := rand.Read(packet); err != nil {
+			return nil, fmt.Errorf("failed to generate test packet: %v", err)
+		}
+		port.ResetInputBuffer()
+		sent := time.Now()
+		if _, err := f.write(packet); err != nil {
+			return nil, fmt.Errorf("failed to send test packet: %v", err)
+		}
+		result.PacketsSent++
+		result.BytesSent += packetSize
+
+		received = received[:0]
+		for len(received) < packetSize && time.Since(sent) < 2*time.Second {
+			n, err := port.Read(buffer[:packetSize-len(received)])
+			if err != nil {
+				return nil, fmt.Errorf("failed to read test packet: %v", err)
+			}
+			received = append(received, buffer[:n]...)
+		}
+		result.BytesReceived += len(received)
+		if len(received) < packetSize {
+			f.log(LogVerbose, "Packet %d: %d of %d bytes back\n", result.PacketsSent, len(received), packetSize)
+			continue
+		}
+
+		roundTrip := time.Since(sent)
+		result.PacketsReceived++
+		if crc32.ChecksumIEEE(received) != crc32.ChecksumIEEE(packet) {
+			corrupted++
+			f.log(LogVerbose, "Packet %d: CRC error\n", result.PacketsSent)
+		}
+		ms := roundTrip.Seconds() * 1000
+		if result.PacketsReceived == 1 || ms < result.MinRoundTripMs {
+			result.MinRoundTripMs = ms
+		}
+		if ms > result.MaxRoundTripMs {
+			result.MaxRoundTripMs = ms
+		}
+		total += roundTrip
+	}
+	result.Duration = time.Since(start)
+
+	result.ThroughputKBps = float64(result.BytesSent) / 1024 / result.Duration.Seconds()
+	if result.PacketsSent > 0 {
+		result.PacketLossRate = float64(result.PacketsSent-result.PacketsReceived) / float64(result.PacketsSent)
+	}
+	if result.PacketsReceived > 0 {
+		result.CRCErrorRate = float64(corrupted) / float64(result.PacketsReceived)
+		result.MeanRoundTripMs = total.Seconds() * 1000 / float64(result.PacketsReceived)
+		result.RecommendedBlockTimeout = time.Duration(3 * (result.MaxRoundTripMs / 1000.0) * float64(time.Second))
+	}
+	return result, nil
+}
+
+// hexEncoder builds an Intel HEX file with 16 byte data records from one
+// or more runs of data
+type hexEncoder struct {
+	sb    strings.Builder
+	upper int // Upper 16 address bits of the last extended address record
+}
+
+func newHexEncoder() *hexEncoder {
+	return &hexEncoder{upper: -1}
+}
+
+func (e *hexEncoder) writeRecord(addr uint16, recordType byte, payload []byte) {
+	sum := byte(len(payload)) + byte(addr>>8) + byte(addr) + recordType
+	fmt.Fprintf(&e.sb, ":%02X%04X%02X", len(payload), addr, recordType)
+	for _, b := range payload {
+		fmt.Fprintf(&e.sb, "%02X", b)
+		sum += b
+	}
+	fmt.Fprintf(&e.sb, "%02X\n", -sum)
+}
+
+// writeData adds data records for data starting at baseAddress
+func (e *hexEncoder) writeData(data []byte, baseAddress uint32) {
+	for offset := 0; offset < len(data); {
+		addr := baseAddress + uint32(offset)
+		if int(addr>>16) != e.upper {
+			e.upper = int(addr >> 16)
+			e.writeRecord(0, 4, []byte{byte(e.upper >> 8), byte(e.upper)})
+		}
+
+		// Records must not cross a 64K boundary
+		n := min(16, len(data)-offset)
+		n = min(n, int(0x10000-(addr&0xFFFF)))
+		e.writeRecord(uint16(addr), 0, data[offset:offset+n])
+		offset += n
+	}
+}
+
+// finish adds the EOF record and returns the file contents
+func (e *hexEncoder) finish() string {
+	e.writeRecord(0, 1, nil)
+	return e.sb.String()
+}
+
+// binToIntelHex encodes data as Intel HEX with 16 byte data records,
+// starting at baseAddress
+func binToIntelHex(data []byte, baseAddress uint32) string {
+	e := newHexEncoder()
+	e.writeData(data, baseAddress)
+	return e.finish()
+}
+
+// SplitRegion is one output of SplitIntelHex, EndAddress is exclusive
+type SplitRegion struct {
+	Name         string
+	StartAddress uint32
+	EndAddress   uint32
+	OutputFile   string
+}
+
+// SplitIntelHex writes the data of a HEX file that falls into each region
+// to the region's own HEX file. Data outside all regions goes to
+// overflowFile, or is reported as a warning if overflowFile is empty.
+func SplitIntelHex(inputFile string, regions []SplitRegion, overflowFile string) error {
+	content, err := os.ReadFile(inputFile)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", inputFile, err)
+	}
+	f := &Flasher{UseSparse: true, GapFillByte: 0xFF}
+	if err := f.loadIntelHex(content); err != nil {
+		return fmt.Errorf("failed to load %s: %v", inputFile, err)
+	}
+
+	// Index len(regions) collects the overflow
+	encoders := make([]*hexEncoder, len(regions)+1)
+	sizes := make([]int, len(regions)+1)
+	for i := range encoders {
+		encoders[i] = newHexEncoder()
+	}
+	regionOf := func(addr uint32) int {
+		for i, region := range regions {
+			if addr >= region.StartAddress && addr < region.EndAddress {
+				return i
+			}
+		}
+		return len(regions)
+	}
+
+	for _, run := range f.sparse.PopulatedRegions() {
+		for start := run.Start; start < run.End; {
+			dest := regionOf(start)
+			end := start + 1
+			for end < run.End && regionOf(end) == dest {
+				end++
+			}
+
+			chunk := make([]byte, end-start)
+			for i := range chunk {
+				chunk[i] = f.sparse.Get(start + uint32(i))
+			}
+			if dest == len(regions) && overflowFile == "" {
+				fmt.Printf("Warning: 0x%08X-0x%08X (%d bytes) is not in any region, dropped\n", start, end-1, len(chunk))
+			}
+			encoders[dest].writeData(chunk, start)
+			sizes[dest] += len(chunk)
+			start = end
+		}
+	}
+
+	for i, region := range regions {
+		if err := os.WriteFile(region.OutputFile, []byte(encoders[i].finish()), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %v", region.OutputFile, err)
+		}
+		fmt.Printf("%s: %d bytes written to %s\n", region.Name, sizes[i], region.OutputFile)
+	}
+	if overflowFile != "" {
+		if err := os.WriteFile(overflowFile, []byte(encoders[len(regions)].finish()), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %v", overflowFile, err)
+		}
+		fmt.Printf("overflow: %d bytes written to %s\n", sizes[len(regions)], overflowFile)
+	}
+	return nil
+}
+
+// parseSplitRegion parses "name,start,end,output" with inclusive start and
+// exclusive end addresses
+func parseSplitRegion(spec string) (SplitRegion, error) {
+	fields := strings.Split(spec, ",")
+	if len(fields) != 4 {
+		return SplitRegion{}, fmt.Errorf("region '%s' must be name,start,end,output", spec)
+	}
+	start, err := strconv.ParseUint(fields[1], 0, 32)
+	if err != nil {
+		return SplitRegion{}, fmt.Errorf("invalid start address '%s'", fields[1])
+	}
+	end, err := strconv.ParseUint(fields[2], 0, 32)
+	if err != nil {
+		return SplitRegion{}, fmt.Errorf("invalid end address '%s'", fields[2])
+	}
+	if end <= start {
+		return SplitRegion{}, fmt.Errorf("region '%s' ends before it starts", fields[0])
+	}
+	return SplitRegion{Name: fields[0], StartAddress: uint32(start), EndAddress: uint32(end), OutputFile: fields[3]}, nil
+}
+
+// detectBaudRate opens the port at each of BaudRateCandidates in turn and
+// sends the connect command, until one answers with an ACK within 300 ms.
+// The port is returned open at the detected rate. The bootloader has no
+// known command to switch rates, so the transfer continues at that rate.
+func (f *Flasher) detectBaudRate(portName string) (serial.Port, int, error) {
+	for _, rate := range f.BaudRateCandidates {
+		f.log(LogNormal, "Trying %d baud...\n", rate)
+		mode := &serial.Mode{
+			BaudRate: rate,
+			DataBits: 8,
+			Parity:   serial.NoParity,
+			StopBits: serial.OneStopBit,
+		}
+
+		port, err := serial.Open(portName, mode)
+		if err != nil {
+			return nil, 0, protocolErrorf(ErrPortOpen, -1, "failed to open port %s: %v", portName, err)
+		}
+		if waitForConnectACK(port, f.sendConnect, f.traceBytes) {
+			return port, rate, nil
+		}
+		port.Close()
+	}
+	return nil, 0, protocolErrorf(ErrTimeout, -1, "no response from device at %v baud", f.BaudRateCandidates)
+}
+
+// waitForConnectACK sends the connect command and reports whether an ACK
+// (0x06) arrives within 300 ms
+func waitForConnectACK(port serial.Port, connect []byte, trace func(string, []byte)) bool {
+	if err := port.SetReadTimeout(50 * time.Millisecond); err != nil {
+		return false
+	}
+	port.ResetInputBuffer()
+
+	trace("TX", connect)
+	if _, err := port.Write(connect); err != nil {
+		return false
+	}
+
+	buffer := make([]byte, 1)
+	deadline := time.Now().Add(300 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		n, err := port.Read(buffer)
+		if err != nil {
+			return false
+		}
+		if n == 0 {
+			continue
+		}
+		trace("RX", buffer[:n])
+		if buffer[0] == 6 {
+			return true
+		}
+	}
+	return false
+}
+
+// queryMode sends one connect command on f.port. The bootloader answers
+// with an ACK, a radio running normally with 0x32.
+func (f *Flasher) queryMode() (bootloaderMode bool, err error) {
+	if err := f.port.SetReadTimeout(50 * time.Millisecond); err != nil {
+		return false, fmt.Errorf("failed to set read timeout: %v", err)
+	}
+	f.port.ResetInputBuffer()
+	if _, err := f.write(f.sendConnect); err != nil {
+		return false, fmt.Errorf("failed to send connect command: %v", err)
+	}
+
+	var received []byte
+	buffer := make([]byte, 1)
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		n, err := f.port.Read(buffer)
+		if err != nil {
+			return false, fmt.Errorf("failed to read from port: %v", err)
+		}
+		if n == 0 {
+			continue
+		}
+		f.traceBytes("RX", buffer[:n])
+		switch buffer[0] {
+		case 6:
+			return true, nil
+		case 50:
+			return false, nil
+		}
+		received = append(received, buffer[0])
+	}
+
+	if len(received) > 0 {
+		return false, fmt.Errorf("unexpected answer from the radio: % X", received)
+	}
+	return false, protocolErrorf(ErrTimeout, -1, "no answer within 500 ms, check the cable and that the radio is on")
+}
+
+func (f *Flasher) startUpdate(portName string) (err error) {
+	if f.StatsFile != "" {
+		start := time.Now()
+		defer func() {
+			if statsErr := f.appendStats(portName, start, err); statsErr != nil {
+				f.log(LogQuiet, "Warning: %v\n", statsErr)
+			}
+		}()
+	}
+	if f.ProgressFile != "" {
+		defer func() {
+			if err != nil {
+				f.writeProgress("error", f.BlocksWritten(), f.Stats().Retries, err.Error())
+			} else {
+				f.writeProgress("done", f.BlocksWritten(), f.Stats().Retries, "")
+			}
+		}()
+	}
+	if f.TelemetrySink != nil {
+		model := "RT6D"
+		if f.Metadata != nil && f.Metadata.RadioModel != "" {
+			model = f.Metadata.RadioModel
+		}
+		f.telemetryTags = "port=" + escapeInfluxTag(portName) + ",model=" + escapeInfluxTag(model)
+		f.telemetryStart = time.Now()
+		defer func() {
+			f.writeTelemetry("flash_result", fmt.Sprintf("success=%t,blocks=%di,retries=%di,duration_s=%.1f",
+				err == nil, f.BlocksWritten(), f.Stats().Retries, time.Since(f.telemetryStart).Seconds()))
+		}()
+	}
+
+	if f.ReconnectOnDisconnect && isTCPPort(portName) {
+		return protocolErrorf(ErrPortOpen, -1, "reconnect needs a local port, not %s", portName)
+	}
+	if !f.DryRun && f.mockPort == nil {
+		unlock, err := lockPort(portName)
+		if err != nil {
+			return protocolErrorf(ErrPortOpen, -1, "%v", err)
+		}
+		defer unlock()
+		defer f.releaseReconnectLock()
+	}
+
+	if f.BackupBeforeFlash {
+		f.log(LogNormal, "Backing up SPI flash before flashing (radio must be in normal mode)...\n")
+		filename, err := f.backupSPIFlash(portName)
+		if err != nil {
+			return fmt.Errorf("SPI backup failed, not flashing: %w", err)
+		}
+		f.log(LogNormal, "SPI flash backup saved to %s\n", filename)
+
+		// The radio has to be restarted into programming mode by hand
+		printFlashInstructions()
+	}
+
+	var port serial.Port
+	if f.mockPort != nil {
+		port = f.mockPort
+	} else if f.DryRun {
+		port = newDryRunPort()
+	} else if isTCPPort(portName) {
+		host, tcpPort, err := parseTCPPort(portName)
+		if err == nil {
+			err = f.OpenTCPPort(host, tcpPort)
+		}
+		if err != nil {
+			return protocolErrorf(ErrPortOpen, -1, "%v", err)
+		}
+		port = f.port
+	} else if f.AutoBaud {
+		var rate int
+		port, rate, err = f.detectBaudRate(portName)
+		if err != nil {
+			return err
+		}
+		f.log(LogNormal, "Detected baud rate: %d\n", rate)
+		f.baudRate = rate
+	} else {
+		mode := &serial.Mode{
+			BaudRate: f.baudRate,
+			DataBits: 8,
+			Parity:   serial.NoParity,
+			StopBits: serial.OneStopBit,
+		}
+
+		port, err = serial.Open(portName, mode)
+		if err != nil {
+			return protocolErrorf(ErrPortOpen, -1, "failed to open port %s: %v", portName, err)
+		}
+	}
+	f.port = port
+	// Connect commands the bootloader has ACKed before the handshake
+	connectsAcked := 0
+	if f.AutoBaud && !f.DryRun && f.mockPort == nil {
+		connectsAcked++
+	}
+	if !f.DryRun && f.mockPort == nil {
+		defer f.lowerUSBLatency(portName)()
+		if f.ReconnectOnDisconnect {
+			f.portName = portName
+			f.usbID = portUSBID(portName)
+		}
+	}
+	if !f.DryRun {
+		// One query for both checks, a second connect command would be
+		// one more than the handshake expects
+		info, acked, queryErr := f.queryForChecks()
+		if acked {
+			connectsAcked++
+		}
+		if err := f.checkSerialNumber(info, queryErr); err != nil {
+			f.port.Close()
+			return err
+		}
+		f.checkHardwareRevision(info, queryErr)
+	}
+	if err := f.readProtectedRegions(); err != nil {
+		f.port.Close()
+		return err
+	}
+
+	f.resetTransfer(connectsAcked)
+	defer f.stopReader()
+
+	if f.TotalTimeout > 0 {
+		cancelWatchdog := make(chan struct{})
+		defer close(cancelWatchdog)
+		go f.watchdog(cancelWatchdog)
+	}
+	f.reenterBootloader = nil
+	if f.BootloaderKeepAlive && f.KeepAliveInterval > 0 {
+		f.reenterBootloader = make(chan struct{}, 1)
+		cancelKeepAlive := make(chan struct{})
+		defer close(cancelKeepAlive)
+		go f.keepAlive(cancelKeepAlive)
+	}
+
+	registerActiveFlasher(f, portName)
+	defer unregisterActiveFlasher(f)
+
+	// Start reading in goroutine
+	go f.readData()
+
+	if err := f.connectWithRetry(f.ConnectAttempts); err != nil {
+		return err
+	}
+	
+	f.log(LogNormal, "Device connected, starting firmware upload...\n")
+	
+	// Keep the connection alive until the transfer completes or is aborted
+	for state := f.State(); state.active() && f.port != nil; state = f.State() {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if f.TimedOut() {
+		return protocolErrorf(ErrTimeout, f.BlocksWritten(), "transfer timed out after %v at block %d/%d",
+			f.TotalTimeout, f.BlocksWritten(), f.totalBlocks())
+	}
+	if f.State() != StateComplete {
+		// Left open by a failed reenterAfterTimeout
+		f.port.Close()
+		f.mu.Lock()
+		abortErr := f.abortErr
+		f.mu.Unlock()
+		if abortErr != nil {
+			return fmt.Errorf("transfer aborted at block %d/%d: %w", f.BlocksWritten(), f.totalBlocks(), abortErr)
+		}
+		return fmt.Errorf("transfer aborted at block %d/%d", f.BlocksWritten(), f.totalBlocks())
+	}
+
+	if f.verifyAfterFlash {
+		// The bootloader has no read-back command, so the best we can check
+		// is that every block of the image went out before the end command
+		if f.BytesSent() < f.FlashSize {
+			return protocolErrorf(ErrVerificationFailed, f.BlocksWritten(),
+				"verification failed: only %d/%d blocks were transferred", f.BlocksWritten(), f.totalBlocks())
+		}
+		f.log(LogNormal, "Verified: all %d blocks transferred\n", f.BlocksWritten())
+	}
+
+	return nil
+}
+
+// resetTransfer prepares the state of a new flash. connectsAcked is the
+// number of connect commands the bootloader already ACKed, to detectBaudRate
+// or a device query, so the handshake continues after them.
+func (f *Flasher) resetTransfer(connectsAcked int) {
+	// Monitors may already poll State and the other accessors
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.gWritebytes = 0
+	// connectWithRetry sends one more connect command in any case
+	f.state = StateConnecting1 + ProtocolState(min(connectsAcked, 2))
+	f.sendcnt = 0
+	f.sentButUnacked = nil
+	f.keepAliveAcks = nil
+	// Set after ACKed connect commands too, so connectWithRetry still resends
+	// the connect command and reports a radio that stops answering
+	f.flgConnect = true
+	f.lastReceived = -1
+	f.stats = TransferStats{}
+	f.timedOut = false
+	f.abortErr = nil
+	f.done = make(chan struct{})
+}
+
+// FlashRecord is one line of the stats file, written after every flash
+type FlashRecord struct {
+	Timestamp     time.Time `json:"ts" jsonschema:"description=Time the flash started, UTC"`
+	Hostname      string    `json:"hostname" jsonschema:"description=Host the flash ran on"`
+	Port          string    `json:"port" jsonschema:"description=Serial port of the flash"`
+	Firmware      string    `json:"firmware" jsonschema:"description=Version found in the image"` // See detectFirmwareVersion
+	FirmwareCRC32 string    `json:"firmware_crc32" jsonschema:"description=CRC32 of the flashed image, 8 hex digits"`
+	Blocks        int       `json:"blocks" jsonschema:"description=Blocks sent to the radio"`
+	Retries       int       `json:"retries" jsonschema:"description=Packets resent after a NAK or timeout"`
+	DurationMs    int64     `json:"duration_ms" jsonschema:"description=Duration of the flash in milliseconds"`
+	Result        string    `json:"result" jsonschema:"description=ok or error"`
+	Error         string    `json:"error,omitempty" jsonschema:"description=Error message of a failed flash"`
+	ErrorCode     string    `json:"error_code,omitempty" jsonschema:"description=Kind of the error, groups errors in stats-report"` // Kind of ProtocolError
+}
+
+// statsFileMu serializes appends of the workers of FlashMany
+var statsFileMu sync.Mutex
+
+// appendStats adds a FlashRecord for a flash that started at start and
+// ended with err to f.StatsFile, one JSON object per line
+func (f *Flasher) appendStats(portName string, start time.Time, err error) error {
+	image := f.hex[:min(f.FlashSize, len(f.hex))]
+	record := FlashRecord{
+		Timestamp:     start.UTC().Truncate(time.Second),
+		Port:          portName,
+		Firmware:      detectFirmwareVersion(image),
+		FirmwareCRC32: fmt.Sprintf("%08X", crc32.ChecksumIEEE(image)),
+		Blocks:        f.BlocksWritten(),
+		Retries:       f.Stats().Retries,
+		DurationMs:    time.Since(start).Milliseconds(),
+		Result:        "ok",
+	}
+	record.Hostname, _ = os.Hostname()
+	if err != nil {
+		record.Result = "error"
+		record.Error = err.Error()
+		var protocolErr *ProtocolError
+		if errors.As(err, &protocolErr) {
+			record.ErrorCode = protocolErr.Code.String()
+		}
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode flash stats: %v", err)
+	}
+
+	statsFileMu.Lock()
+	defer statsFileMu.Unlock()
+	file, err := os.OpenFile(f.StatsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open stats file: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write stats file: %v", err)
+	}
+	return nil
+}
+
+// ProgressRecord is the content of the -progress-file, for GUIs that poll
+// a file instead of parsing the output
+type ProgressRecord struct {
+	Phase      string  `json:"phase"` // uploading, done or error
+	BlockDone  int     `json:"block_done"`
+	BlockTotal int     `json:"block_total"`
+	Pct        float64 `json:"pct"`
+	Errors     int     `json:"errors"` // Packets resent after a NAK or timeout
+	Timestamp  int64   `json:"ts"`     // Unix time
+	Message    string  `json:"message,omitempty"`
+}
+
+// progressFileMu keeps the writes of progress files from interleaving
+var progressFileMu sync.Mutex
+
+// writeProgress replaces f.ProgressFile with the current progress. The
+// record goes to <file>.tmp first and is renamed over the file, so a GUI
+// polling it never reads a partial record.
+func (f *Flasher) writeProgress(phase string, blocksDone, retries int, message string) {
+	record := ProgressRecord{
+		Phase:      phase,
+		BlockDone:  blocksDone,
+		BlockTotal: f.totalBlocks(),
+		Errors:     retries,
+		Timestamp:  time.Now().Unix(),
+		Message:    message,
+	}
+	if record.BlockTotal > 0 {
+		record.Pct = math.Round(float64(blocksDone)*1000/float64(record.BlockTotal)) / 10
+	}
+	content, err := json.Marshal(record)
+	if err == nil {
+		progressFileMu.Lock()
+		tmp := f.ProgressFile + ".tmp"
+		if err = os.WriteFile(tmp, content, 0644); err == nil {
+			err = os.Rename(tmp, f.ProgressFile)
+		}
+		progressFileMu.Unlock()
+	}
+	if err != nil && !f.progressFileFailed {
+		f.progressFileFailed = true
+		f.log(LogQuiet, "Warning: failed to write progress file: %v\n", err)
+	}
+}
+
+// telemetrySink is the TelemetrySink of new Flashers, set by
+// -telemetry-file and -telemetry-udp
+var telemetrySink io.Writer
+
+// telemetryMu keeps the lines of flashers sharing a sink from interleaving
+var telemetryMu sync.Mutex
+
+// writeBlockTelemetry writes the flash_progress line after the ACK of
+// block blocksDone, e.g.
+//
+//	flash_progress,port=COM3,model=RT6D block=47i,pct=19.1,rate_kbps=8.3 1736123456000000000
+func (f *Flasher) writeBlockTelemetry(blocksDone int) {
+	pct := 0.0
+	if total := f.totalBlocks(); total > 0 {
+		pct = float64(blocksDone) * 100 / float64(total)
+	}
+	rate := 0.0
+	if elapsed := time.Since(f.telemetryStart).Seconds(); elapsed > 0 {
+		rate = float64(blocksDone*f.BlockSize) / 1024 / elapsed
+	}
+	f.writeTelemetry("flash_progress", fmt.Sprintf("block=%di,pct=%.1f,rate_kbps=%.1f", blocksDone, pct, rate))
+}
+
+// writeTelemetry writes one InfluxDB line protocol line with the tags of
+// the current flash and a nanosecond timestamp to f.TelemetrySink, in a
+// single Write so a UDP sink sends it as one datagram
+func (f *Flasher) writeTelemetry(measurement, fields string) {
+	line := fmt.Sprintf("%s,%s %s %d\n", measurement, f.telemetryTags, fields, time.Now().UnixNano())
+	telemetryMu.Lock()
+	_, err := io.WriteString(f.TelemetrySink, line)
+	telemetryMu.Unlock()
+	if err != nil && !f.telemetryFailed {
+		f.telemetryFailed = true
+		f.log(LogQuiet, "Warning: failed to write telemetry: %v\n", err)
+	}
+}
+
+// escapeInfluxTag escapes the commas, spaces and equal signs of a line
+// protocol tag value
+func escapeInfluxTag(value string) string {
+	return strings.NewReplacer(",", "\\,", " ", "\\ ", "=", "\\=").Replace(value)
+}
+
+// openTelemetrySink opens the file ("-" for stdout) and UDP address given
+// for telemetry, either may be empty
+func openTelemetrySink(file, udpAddr string) (io.Writer, error) {
+	var sinks []io.Writer
+	switch file {
+	case "":
+	case "-":
+		sinks = append(sinks, os.Stdout)
+	default:
+		out, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open telemetry file: %v", err)
+		}
+		sinks = append(sinks, out)
+	}
+	if udpAddr != "" {
+		conn, err := net.Dial("udp", udpAddr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open telemetry address %s: %v", udpAddr, err)
+		}
+		sinks = append(sinks, conn)
+	}
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+	return io.MultiWriter(sinks...), nil
+}
+
+// portLockFile is the lock file of a port in the temp directory, e.g.
+// rt6d-dev_ttyUSB0.lock for /dev/ttyUSB0
+func portLockFile(portName string) string {
+	return filepath.Join(os.TempDir(), "rt6d-"+sanitizePortName(portName)+".lock")
+}
+
+// lockPort creates the lock file of a port holding our PID, so a second
+// flasher on the same port stops with the PID of the first instead of an
+// OS error. A lock left by a process that is no longer running is taken
+// over. The returned function removes the lock.
+func lockPort(portName string) (func(), error) {
+	path := portLockFile(portName)
+	for attempt := 0; ; attempt++ {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			_, err = fmt.Fprintf(file, "%d\n", os.Getpid())
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(path)
+				return nil, fmt.Errorf("failed to write lock file %s: %v", path, err)
+			}
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to create lock file %s: %v", path, err)
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read lock file %s: %v", path, err)
+		}
+		pid, parseErr := strconv.Atoi(strings.TrimSpace(string(content)))
+		if err == nil && parseErr != nil {
+			// Just created by another process that has not written its PID yet
+			return nil, fmt.Errorf("port %s is in use (locked by %s)", portName, path)
+		}
+		if err == nil && processRunning(pid) {
+			return nil, fmt.Errorf("port %s is in use by PID %d", portName, pid)
+		}
+		if attempt > 0 {
+			return nil, fmt.Errorf("failed to take over the stale lock file %s", path)
+		}
+		if err == nil {
+			fmt.Printf("Removing stale lock of PID %d on %s\n", pid, portName)
+			os.Remove(path)
+		}
+	}
+}
+
+// processRunning reports whether a process with the given PID exists
+func processRunning(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		// FindProcess opens the process there, which fails once it exited
+		process.Release()
+		return true
+	}
+	err = process.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// lowerUSBLatency sets the USB latency timer of the cable to 1 ms for the
+// transfer and returns a function that restores the old value
+func (f *Flasher) lowerUSBLatency(portName string) func() {
+	old, ok := spilib.ReadUSBLatency(portName)
+	if !ok || old <= 1 {
+		return func() {}
+	}
+	if err := spilib.ConfigureUSBLatency(portName, 1); err != nil {
+		f.log(LogNormal, "Warning: %v, the transfer may be slow\n", err)
+		return func() {}
+	}
+	f.log(LogNormal, "USB latency timer: %d ms -> 1 ms\n", old)
+	return func() {
+		if err := spilib.ConfigureUSBLatency(portName, old); err != nil {
+			f.log(LogNormal, "Warning: %v\n", err)
+			return
+		}
+		f.log(LogVerbose, "USB latency timer restored to %d ms\n", old)
+	}
+}
+
+// watchdog aborts the transfer if it is still running after TotalTimeout,
+// in case the state machine stops advancing without a packet timeout.
+// Closing cancel stops it.
+func (f *Flasher) watchdog(cancel <-chan struct{}) {
+	timer := time.NewTimer(f.TotalTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-cancel:
+		return
+	case <-timer.C:
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.timedOut = true
+	f.log(LogQuiet, "Watchdog: transfer still running after %v, aborting\n", f.TotalTimeout)
+	f.log(LogQuiet, "Watchdog: last state %s, block %d/%d, waiting for ACK: %t\n",
+		f.state, f.gWritebytes, f.totalBlocks(), f.waitingForAck)
+	f.state = StateError
+	if f.port != nil {
+		f.port.Close()
+	}
+}
+
+// keepAlive sends the keep-alive command of the protocol when nothing was
+// sent for KeepAliveInterval during the transfer, e.g. while waiting for
+// the ACK of a block with a long packet timeout, so the bootloader does not
+// time out. When the radio answers 0x32 it has left the bootloader anyway
+// and reenterBootloader restarts the flash. Closing cancel stops it.
+func (f *Flasher) keepAlive(cancel <-chan struct{}) {
+	tick := f.KeepAliveInterval / 2
+	if tick < time.Millisecond {
+		tick = time.Millisecond
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cancel:
+			return
+		case <-f.reenterBootloader:
+			f.reenterAfterTimeout()
+		case <-ticker.C:
+			f.mu.Lock()
+			quiet := time.Since(f.lastPacketTime) >= f.KeepAliveInterval && time.Since(f.lastKeepAlive) >= f.KeepAliveInterval
+			if f.state == StateTransferring && len(f.sendKeepAlive) > 0 && quiet {
+				f.log(LogVerbose, "Sending keep-alive\n")
+				if _, err := f.write(f.sendKeepAlive); err == nil {
+					// The bootloader answers in order, after the blocks
+					// and keep-alives already in flight
+					f.keepAliveAcks = append(f.keepAliveAcks, len(f.sentButUnacked)+len(f.keepAliveAcks))
+				}
+				f.lastKeepAlive = time.Now()
+			}
+			f.mu.Unlock()
+		}
+	}
+}
+
+// takeKeepAliveAck reports whether an ACK received during the transfer
+// answers a keep-alive rather than a block, must be called with f.mu held
+func (f *Flasher) takeKeepAliveAck() bool {
+	keepAlive := len(f.keepAliveAcks) > 0 && f.keepAliveAcks[0] == 0
+	if keepAlive {
+		f.keepAliveAcks = f.keepAliveAcks[1:]
+	}
+	for i := range f.keepAliveAcks {
+		f.keepAliveAcks[i]--
+	}
+	return keepAlive
+}
+
+// reenterAfterTimeout brings a radio that dropped out of the bootloader
+// back with a DTR/RTS pulse and starts the flash again from the connect
+// command, as the bootloader starts over as well. Cables that don't wire
+// DTR or RTS to the radio ignore the pulse and the flash fails after
+// ConnectAttempts. The failure is only reported through abortErr, the port
+// is left to startUpdate so the reader doesn't see it closed under it.
+func (f *Flasher) reenterAfterTimeout() {
+	f.mu.Lock()
+	f.log(LogQuiet, "Radio left the bootloader at block %d/%d, re-entering it with DTR/RTS\n", f.gWritebytes, f.totalBlocks())
+	port := f.port
+	f.mu.Unlock()
+
+	if err := pulseResetLines(port); err != nil {
+		f.log(LogQuiet, "Warning: %v\n", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	f.mu.Lock()
+	f.gWritebytes = 0
+	f.sendcnt = 0
+	f.sentButUnacked = nil
+	f.keepAliveAcks = nil
+	f.waitingForAck = false
+	f.recvcnt = 0
+	f.flgConnect = true
+	f.state = StateConnecting1
+	f.mu.Unlock()
+
+	if err := f.sendConnects(f.ConnectAttempts); err != nil {
+		f.mu.Lock()
+		f.abortErr = err
+		f.state = StateError
+		f.mu.Unlock()
+		return
+	}
+	f.log(LogQuiet, "Bootloader re-entered, flashing again from block 1\n")
+}
+
+func (f *Flasher) stopReader() {
+	select {
+	case <-f.done:
+	default:
+		close(f.done)
+	}
+}
+
+// AbortFlash stops a running transfer and sends the end command before
+// closing the port, so the bootloader exits and the radio restarts in
+// normal mode instead of waiting for a power cycle. startUpdate then
+// returns an error. Used on Ctrl-C and by GUI wrappers. Nothing is sent
+// when no transfer is in progress.
+func (f *Flasher) AbortFlash() error {
+	// Under f.mu the end command can't land in the middle of a block, and
+	// the port can't be swapped by a reconnect
+	f.mu.Lock()
+	port := f.port
+	if port == nil || !f.state.active() {
+		f.mu.Unlock()
+		return fmt.Errorf("no flash in progress")
+	}
+	f.state = StateError
+	f.abortErr = fmt.Errorf("flash aborted")
+	_, err := f.write(f.sendEnd)
+	f.mu.Unlock()
+	if f.done != nil {
+		f.stopReader()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	port.Close()
+	if err != nil {
+		return fmt.Errorf("failed to send end command: %v", err)
+	}
+	return nil
+}
+
+// Flashers with an open port, so a signal can abort all of them
+var activeFlashers = struct {
+	sync.Mutex
+	ports map[*Flasher]string
+}{ports: make(map[*Flasher]string)}
+
+func registerActiveFlasher(f *Flasher, portName string) {
+	activeFlashers.Lock()
+	activeFlashers.ports[f] = portName
+	activeFlashers.Unlock()
+}
+
+func unregisterActiveFlasher(f *Flasher) {
+	activeFlashers.Lock()
+	delete(activeFlashers.ports, f)
+	activeFlashers.Unlock()
+}
+
+// tempFirmwareDir holds the firmware downloaded with -firmware-url or
+// written by -use-embedded while it is flashed, removed by exitProgram
+var tempFirmwareDir string
+
+// exitProgram ends the program with code after removing tempFirmwareDir,
+// which a deferred RemoveAll would miss on os.Exit
+func exitProgram(code int) {
+	if tempFirmwareDir != "" {
+		os.RemoveAll(tempFirmwareDir)
+	}
+	os.Exit(code)
+}
+
+// handleSignals aborts all running transfers with AbortFlash on SIGINT or
+// SIGTERM and exits with the conventional 128+SIGINT code
+func handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		fmt.Printf("\nReceived %v, stopping...\n", sig)
+
+		activeFlashers.Lock()
+		for f, portName := range activeFlashers.ports {
+			err := f.AbortFlash()
+			fmt.Printf("%s: Flash aborted at block %d/%d\n", portName, f.BlocksWritten(), f.totalBlocks())
+			if err != nil {
+				fmt.Printf("%s: %v, power cycle the radio to leave bootloader mode\n", portName, err)
+			} else {
+				fmt.Println("Flash aborted cleanly — radio should restart in normal mode")
+			}
+		}
+		activeFlashers.Unlock()
+
+		exitProgram(130)
+	}()
+}
+
+// FlashJob describes one radio to flash with FlashMany
+type FlashJob struct {
+	JobID        string // Defaults to the port name
+	PortName     string
+	FirmwareFile string
+	Config       *Config // Flasher settings, defaults are used when nil
+
+	port serial.Port // Used instead of opening PortName, e.g. in tests
+}
+
+// FlashResult is the outcome of a FlashJob
+type FlashResult struct {
+	JobID         string
+	Error         error
+	Duration      time.Duration
+	TransferStats TransferStats
+}
+
+// newConfiguredFlasher creates a Flasher with the settings from cfg
+func newConfiguredFlasher(cfg *Config) *Flasher {
+	var opts []FlasherOption
+	if protocol, ok := findProtocol(cfg.Protocol); ok {
+		opts = append(opts, WithProtocolConfig(protocol))
+	}
+	opts = append(opts, WithFlashSize(cfg.FlashSize), WithInterPacketDelay(cfg.InterPacketDelay),
+		WithDataPacketDelay(cfg.DataPacketDelay))
+	if cfg.BlockSize > 0 {
+		opts = append(opts, WithBlockSize(cfg.BlockSize))
+	}
+	f := NewFlasher(false, opts...)
+	f.baudRate = cfg.BaudRate
+	f.maxRetries = cfg.MaxRetries
+	f.ConnectAttempts = cfg.ConnectAttempts
+	f.ConnectTimeout = cfg.ConnectTimeout
+	f.BootloaderKeepAlive = cfg.KeepAlive > 0
+	f.KeepAliveInterval = cfg.KeepAlive
+	f.packetTimeout = cfg.PacketTimeout
+	f.TotalTimeout = cfg.TotalTimeout
+	f.verifyAfterFlash = cfg.VerifyAfterFlash
+	f.GapFillByte = cfg.FillByte
+	f.StrictGaps = cfg.StrictGaps
+	f.SkipVectorCheck = cfg.SkipVectorCheck
+	f.MaxFirmwareBytes = cfg.MaxFirmwareBytes
+	f.SignatureKeyFile = cfg.VerifySigKeyFile
+	f.RequireMetadata = cfg.RequireMetadata
+	f.UseSparse = cfg.Sparse
+	f.BaseAddressOverride = cfg.BaseAddress
+	f.BaseAddressAutodetect = cfg.BaseAutodetect
+	f.AutoBaud = cfg.AutoBaud
+	f.StatsFile = cfg.StatsFile
+	f.ProgressFile = cfg.ProgressFile
+	f.WindowSize = cfg.WindowSize
+	f.ReconnectOnDisconnect = cfg.Reconnect
+	f.NoRFC2217 = cfg.NoRFC2217
+	f.ReconnectTimeout = cfg.ReconnectTimeout
+	f.ProtectedRegions = cfg.ProtectRegions
+	f.SkipProtected = cfg.SkipProtected
+	if len(cfg.BaudCandidates) > 0 {
+		f.BaudRateCandidates = cfg.BaudCandidates
+	}
+	return f
+}
+
+// FlashMany flashes several radios at once using a pool of concurrency
+// workers. Results are returned in the same order as jobs.
+func FlashMany(jobs []FlashJob, concurrency int) []FlashResult {
+	results := make([]FlashResult, len(jobs))
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	// Jobs flashing the same file share one loaded image, the hex array
+	// is only read during the transfer
+	images := make(map[string][]byte)
+	loadErrors := make(map[string]error)
+	for _, job := range jobs {
+		if _, ok := images[job.FirmwareFile]; ok || loadErrors[job.FirmwareFile] != nil {
+			continue
+		}
+		cfg := job.Config
+		if cfg == nil {
+			cfg = defaultConfig()
+		}
+		loader := newConfiguredFlasher(cfg)
+		if loader.initializeHex(job.FirmwareFile) {
+			images[job.FirmwareFile] = loader.hex
+		} else {
+			loadErrors[job.FirmwareFile] = protocolErrorf(ErrFirmwareLoad, -1, "failed to load firmware file: %s", job.FirmwareFile)
+		}
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = runFlashJob(jobs[i], images, loadErrors, len(jobs) > 1)
+			}
+		}()
+	}
+
+	for i := range jobs {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	return results
+}
+
+// runFlashJob flashes one radio of FlashMany. With several jobs the trace
+// file of the config gets the port name added, see jobTraceFile.
+func runFlashJob(job FlashJob, images map[string][]byte, loadErrors map[string]error, tracePerPort bool) FlashResult {
+	result := FlashResult{JobID: job.JobID}
+	if result.JobID == "" {
+		result.JobID = job.PortName
+	}
+
+	if err := loadErrors[job.FirmwareFile]; err != nil {
+		result.Error = err
+		return result
+	}
+
+	cfg := job.Config
+	if cfg == nil {
+		cfg = defaultConfig()
+	}
+	f := newConfiguredFlasher(cfg)
+	f.hex = images[job.FirmwareFile]
+	f.mockPort = job.port
+
+	if cfg.TraceFile != "" {
+		traceFile := cfg.TraceFile
+		if tracePerPort {
+			traceFile = jobTraceFile(traceFile, job.PortName)
+		}
+		trace, err := os.Create(traceFile)
+		if err != nil {
+			result.Error = fmt.Errorf("failed to create trace file: %v", err)
+			return result
+		}
+		defer trace.Close()
+		f.trace = trace
+	}
+
+	start := time.Now()
+	result.Error = f.startUpdate(job.PortName)
+	result.Duration = time.Since(start)
+	result.TransferStats = f.Stats()
+	return result
+}
+
+// jobTraceFile is the trace file of one port when several radios are
+// flashed at once, e.g. trace-dev_ttyUSB0.txt for trace.txt
+func jobTraceFile(traceFile, portName string) string {
+	ext := filepath.Ext(traceFile)
+	return strings.TrimSuffix(traceFile, ext) + "-" + sanitizePortName(portName) + ext
+}
+
+// sanitizePortName turns a port name into a file name part, e.g.
+// dev_ttyUSB0 for /dev/ttyUSB0
+func sanitizePortName(portName string) string {
+	name := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, portName)
+	return strings.Trim(name, "_")
+}
+
+// LogLevel selects how much diagnostic output is printed
+type LogLevel int
+
+const (
+	LogQuiet   LogLevel = iota // Fatal errors and the final result only
+	LogNormal                  // Progress and warnings
+	LogVerbose                 // Per-byte protocol chatter and hex dumps
+)
+
+// logLevel is the level of new flashers and of the messages printed by main
+var logLevel = LogNormal
+
+// parseLogLevel accepts the level names, "info" and "debug" are the names
+// older configs use for normal and verbose
+func parseLogLevel(name string) (LogLevel, error) {
+	switch strings.ToLower(name) {
+	case "quiet":
+		return LogQuiet, nil
+	case "normal", "info", "":
+		return LogNormal, nil
+	case "verbose", "debug":
+		return LogVerbose, nil
+	}
+	return 0, fmt.Errorf("unknown log level '%s' (use quiet, normal or verbose)", name)
+}
+
+// logf prints a message of main if the log level is at least level
+func logf(level LogLevel, format string, args ...interface{}) {
+	if logLevel >= level {
+		fmt.Printf(format, args...)
+	}
+}
+
+// Config mirrors the command line flags so the settings used for a given
+// radio can be kept in a YAML file instead of being typed on every run.
+
+type Config struct {
+	Port             string         `yaml:"port" jsonschema:"description=Serial port of the programming cable, e.g. /dev/ttyUSB0 or COM3, or tcp://host:port of a serial port server"`
+	NoRFC2217        bool           `yaml:"no_rfc2217" jsonschema:"description=Send raw bytes to tcp:// ports without RFC 2217 serial settings"`
+	FirmwareFile     string         `yaml:"firmware_file" jsonschema:"description=Firmware image to flash (.hex or .bin)"`
+	Protocol         string         `yaml:"protocol" jsonschema:"description=Radio protocol: radtel, iradio or one from protocol_file"`
+	ProtocolFile     string         `yaml:"protocol_file" jsonschema:"description=JSON file with more protocols"`
+	BaudRate         int            `yaml:"baud_rate" jsonschema:"description=Serial speed used to talk to the bootloader"`
+	MaxRetries       int            `yaml:"max_retries" jsonschema:"description=Number of times a block is resent before the transfer is aborted"`
+	ConnectAttempts  int            `yaml:"connect_attempts" jsonschema:"description=Connect commands sent before giving up on the radio"`
+	ConnectTimeout   time.Duration  `yaml:"connect_timeout" jsonschema:"description=How long to wait for the answer to each connect command, 50ms-30s"`
+	KeepAlive        time.Duration  `yaml:"keep_alive" jsonschema:"description=Send the keep-alive command after this long without traffic and re-enter the bootloader when the radio leaves it, 0 to disable"`
+	PacketTimeout    time.Duration  `yaml:"packet_timeout" jsonschema:"description=How long to wait for the ACK of a block"`
+	VerifyAfterFlash bool           `yaml:"verify_after_flash" jsonschema:"description=Fail if not every block of the image was transferred"`
+	TraceFile        string         `yaml:"trace_file" jsonschema:"description=Write a timestamped hex trace of all serial traffic to this file"`
+	StatsFile        string         `yaml:"stats_file" jsonschema:"description=Append a JSON line about every flash to this file"`
+	ProgressFile     string         `yaml:"progress_file" jsonschema:"description=Rewrite this file with the JSON progress after every block, for GUIs"`
+	TelemetryFile    string         `yaml:"telemetry_file" jsonschema:"description=Append InfluxDB line protocol of the progress and result to this file, - for stdout"`
+	TelemetryUDP     string         `yaml:"telemetry_udp" jsonschema:"description=Send InfluxDB line protocol of the progress and result to this host:port over UDP"`
+	LogLevel         string         `yaml:"log_level" jsonschema:"description=Diagnostic output: quiet, normal or verbose"`
+	FillByte         byte           `yaml:"fill_byte" jsonschema:"description=Value for addresses not covered by the firmware file"`
+	StrictGaps       bool           `yaml:"strict_gaps" jsonschema:"description=Refuse HEX files with gaps between regions"`
+	SkipVectorCheck  bool           `yaml:"skip_vector_check" jsonschema:"description=Flash images whose vector table does not look valid"`
+	MaxFirmwareBytes int            `yaml:"max_firmware_bytes" jsonschema:"description=Refuse firmware images larger than this many bytes, 0 for no limit"`
+	VerifySigKeyFile string         `yaml:"verify_sig_key_file" jsonschema:"description=Only flash firmware with a <firmware>.sig created with this key"`
+	RequireMetadata  bool           `yaml:"require_metadata" jsonschema:"description=Refuse firmware without a <firmware>.meta.json metadata file"`
+	FlashSize        int            `yaml:"flash_size" jsonschema:"description=Size of the firmware area in bytes"`
+	BlockSize        int            `yaml:"block_size" jsonschema:"description=Data bytes per packet, 0 for the block size of the protocol"`
+	WindowSize       int            `yaml:"window_size" jsonschema:"description=Blocks sent before waiting for an ACK"`
+	Reconnect        bool           `yaml:"reconnect_on_disconnect" jsonschema:"description=Wait for the cable when it is unplugged during a transfer"`
+	ReconnectTimeout time.Duration  `yaml:"reconnect_timeout" jsonschema:"description=How long to wait for the cable to come back"`
+	ProtectRegions   []MemoryRegion `yaml:"protect_regions" jsonschema:"description=Parts of the image that keep what is already on the radio"`
+	SkipProtected    bool           `yaml:"skip_protected" jsonschema:"description=Write 0xFF to protected bytes that cannot be read from the radio"`
+	Sparse           bool           `yaml:"sparse" jsonschema:"description=Load HEX files through a sparse address map"`
+	BaseAddress      *uint32        `yaml:"base_address" jsonschema:"description=Place the first segment of the HEX file at this address"`
+	BaseAutodetect   bool           `yaml:"base_address_autodetect" jsonschema:"description=Pick the base address so the lowest data address lands at 0x08002800"`
+	TotalTimeout     time.Duration  `yaml:"total_timeout" jsonschema:"description=Abort the whole transfer if it takes longer than this, 0 for no limit"`
+	InterPacketDelay time.Duration  `yaml:"inter_packet_delay" jsonschema:"description=Pause after each connect and update command"`
+	DataPacketDelay  time.Duration  `yaml:"data_packet_delay" jsonschema:"description=Pause before each firmware block"`
+	AutoBaud         bool           `yaml:"auto_baud" jsonschema:"description=Probe the bootloader's baud rate instead of using baud_rate"`
+	BaudCandidates   []int          `yaml:"baud_candidates" jsonschema:"description=Rates tried in order by auto_baud"`
+	FirmwareURL      string         `yaml:"firmware_url" jsonschema:"description=Download the firmware from this URL instead of using firmware_file"`
+	DownloadTimeout  time.Duration  `yaml:"download_timeout" jsonschema:"description=Limit for the whole firmware download"`
+}
+
+const exampleConfig = `# rt6d-flasher configuration
+# Values in this file are used as defaults, flags given on the command line
+# always take precedence.
+
+# Serial port of the programming cable (e.g. /dev/ttyUSB0, COM3), or
+# tcp://host:port of a serial port server such as ser2net or socat
+port: /dev/ttyUSB0
+
+# With a tcp:// port, send raw bytes instead of setting the baud rate with
+# RFC 2217, for servers in raw mode
+no_rfc2217: false
+
+# Firmware image to flash (.hex or .bin)
+firmware_file: RT880_V1.14.bin
+
+# Download the firmware from this URL instead of using firmware_file, .gz
+# files are decompressed
+# firmware_url: https://example.com/RT880_V1.14.hex.gz
+
+# Limit for the whole firmware download
+download_timeout: 60s
+
+# Radio protocol: radtel (Retevis/Radtel), iradio (Iradio UV98 Plus) or one
+# from protocol_file
+protocol: radtel
+
+# JSON file with more protocols, see "rt6d-flasher list-protocols"
+# protocol_file: protocols.json
+
+# Serial speed used to talk to the bootloader
+baud_rate: 115200
+
+# Number of times a block is resent before the transfer is aborted
+max_retries: 3
+
+# Connect commands sent before giving up on the radio
+connect_attempts: 4
+
+# How long to wait for the answer to each connect command, 50ms-30s
+connect_timeout: 200ms
+
+# Send the keep-alive command of the protocol after this long without
+# traffic, and re-enter the bootloader with DTR/RTS when the radio leaves it
+# keep_alive: 1s
+
+# How long to wait for the ACK of a block
+packet_timeout: 3s
+
+# Abort the whole transfer if it takes longer than this, 0 for no limit
+total_timeout: 5m
+
+# Pause after each connect and update command, raise for slow bootloaders
+inter_packet_delay: 50ms
+
+# Pause before each firmware block
+data_packet_delay: 0s
+
+# Fail if not every block of the image was transferred
+verify_after_flash: false
+
+# Write a timestamped hex trace of all serial traffic to this file
+# trace_file: flash-trace.log
+
+# Append a JSON line about every flash (port, firmware, retries, duration,
+# result) to this file, summarized by "rt6d-flasher stats-report"
+# stats_file: flash-stats.jsonl
+
+# Rewrite this file with the transfer progress as JSON after every block,
+# for GUIs that poll a file instead of parsing the output
+# progress_file: flash-progress.json
+
+# Write InfluxDB line protocol of the progress and the result of every
+# flash to a file ("-" for stdout) or a host:port over UDP, for dashboards
+# telemetry_file: flash-telemetry.lp
+# telemetry_udp: influxdb.local:8089
+
+# Diagnostic output: quiet, normal or verbose (per-byte protocol chatter)
+log_level: normal
+
+# Value for addresses not covered by the firmware file
+fill_byte: 0xFF
+
+# Refuse HEX files with gaps between regions (e.g. accidentally split files)
+strict_gaps: false
+
+# Flash images whose Cortex-M vector table (initial stack pointer and reset
+# vector) does not look valid, normally a sign of a wrong load offset
+skip_vector_check: false
+
+# Refuse firmware images larger than this many bytes, 0 for no limit
+max_firmware_bytes: 0
+
+# Only flash firmware with a <firmware>.sig created by rt6d-sign with this key
+# verify_sig_key_file: rt880.key
+
+# Refuse firmware without a <firmware>.meta.json metadata file
+require_metadata: false
+
+# Size of the firmware area in bytes (246 blocks of 1024 bytes on the RT6D)
+flash_size: 251904
+
+# Data bytes per packet, some bootloader variants use 256. Defaults to the
+# block size of the protocol (1024 for radtel and iradio).
+# block_size: 1024
+
+# Blocks sent before waiting for an ACK. Only raise this for bootloaders
+# that buffer blocks, the RT6D bootloader needs 1.
+window_size: 1
+
+# Wait for the cable when it is unplugged during a transfer and continue
+# from the last acknowledged block once it is back, on Linux even under
+# another port name (recognized by its USB VID:PID)
+reconnect_on_disconnect: false
+
+# How long to wait for the cable to come back
+reconnect_timeout: 30s
+
+# Parts of the image (offsets from its start, end exclusive) that keep what
+# is already on the radio instead of the firmware file's bytes, e.g. for
+# calibration data stored in the MCU flash
+# protect_regions:
+#   - start: 0x3C000
+#     end: 0x3D000
+
+# Write 0xFF to protected bytes that can't be read from the radio instead
+# of refusing to flash. This erases them, it doesn't keep them
+skip_protected: false
+
+# Load HEX files through a sparse address map (for images with large gaps)
+sparse: false
+
+# Ignore the extended linear address records of the HEX file and place its
+# first segment at this address instead. A wrong value produces garbage
+# firmware, only use it for files known to have a wrong base address.
+# base_address: 0x08000000
+
+# Pick the base address so the lowest data address lands at 0x08002800
+base_address_autodetect: false
+
+# Probe the bootloader's baud rate instead of using baud_rate
+auto_baud: false
+
+# Rates tried in order by auto_baud
+baud_candidates: [115200, 57600, 38400, 19200, 9600]
+`
+
+func defaultConfig() *Config {
+	return &Config{
+		Protocol:         "radtel",
+		BaudRate:         115200,
+		MaxRetries:       3,
+		ConnectAttempts:  4,
+		ConnectTimeout:   200 * time.Millisecond,
+		PacketTimeout:    3 * time.Second,
+		TotalTimeout:     5 * time.Minute,
+		InterPacketDelay: 50 * time.Millisecond,
+		LogLevel:         "normal",
+		FillByte:         0xFF,
+		FlashSize:        251904,
+		WindowSize:       1,
+		ReconnectTimeout: 30 * time.Second,
+		BaudCandidates:   []int{115200, 57600, 38400, 19200, 9600},
+		DownloadTimeout:  60 * time.Second,
+	}
+}
+
+// LoadConfig reads a YAML config file, keys missing from the file keep
+// their default values
+func LoadConfig(path string) (*Config, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file %s: %v", path, err)
+	}
+
+	cfg := defaultConfig()
+	if err := yaml.Unmarshal(content, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// GenerateConfigSchema returns a JSON Schema (draft-07) of the config file.
+// No top-level key is required, keys missing from the file keep their
+// defaults, only the keys of list items like protect_regions are.
+func GenerateConfigSchema() string {
+	schema := structSchema(reflect.TypeOf(Config{}), "yaml")
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "rt6d-flasher config file"
+	schema["description"] = "YAML config file, see rt6d-flasher config example"
+	out, _ := json.MarshalIndent(schema, "", "  ")
+	return string(out)
+}
+
+// GenerateStatsSchema returns a JSON Schema (draft-07) of one line of the
+// stats file
+func GenerateStatsSchema() string {
+	schema := structSchema(reflect.TypeOf(FlashRecord{}), "json")
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "rt6d-flasher stats record"
+	schema["description"] = "One line of the JSONL stats file, written after every flash"
+	out, _ := json.MarshalIndent(schema, "", "  ")
+	return string(out)
+}
+
+// structSchema describes a struct by the keys of its tagName tags, with the
+// descriptions of their jsonschema:"description=..." tags. Fields tagged
+// jsonschema:"required,description=..." are required, and for JSON so are
+// the fields without omitempty, which are always written.
+func structSchema(t reflect.Type, tagName string) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, options, _ := strings.Cut(field.Tag.Get(tagName), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+
+		property := typeSchema(field.Type, tagName)
+		schemaTag := field.Tag.Get("jsonschema")
+		rest, isRequired := strings.CutPrefix(schemaTag, "required")
+		if isRequired && (rest == "" || rest[0] == ',') {
+			schemaTag = strings.TrimPrefix(rest, ",")
+		} else {
+			isRequired = false
+		}
+		if description, ok := strings.CutPrefix(schemaTag, "description="); ok {
+			property["description"] = description
+		}
+		properties[name] = property
+		if isRequired || (tagName == "json" && !strings.Contains(options, "omitempty")) {
+			required = append(required, name)
+		}
+	}
+
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// typeSchema describes a value of type t
+func typeSchema(t reflect.Type, tagName string) map[string]interface{} {
+	switch t {
+	case reflect.TypeOf(time.Duration(0)):
+		return map[string]interface{}{"type": "string", "pattern": "^([0-9]+(\\.[0-9]+)?(ns|us|ms|s|m|h))+$"}
+	case reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem(), tagName)
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Uint8:
+		return map[string]interface{}{"type": "integer", "minimum": 0, "maximum": 255}
+	case reflect.Int, reflect.Int64, reflect.Uint32:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem(), tagName)}
+	case reflect.Struct:
+		return structSchema(t, tagName)
+	default:
+		return map[string]interface{}{"type": "string"}
+	}
+}
+
+func defaultConfigPath() string {
+	if runtime.GOOS == "windows" {
+		appData := os.Getenv("APPDATA")
+		if appData == "" {
+			return ""
+		}
+		return filepath.Join(appData, "rt6d-flasher", "config.yaml")
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "rt6d-flasher", "config.yaml")
+}
+
+// loadStartupConfig loads the file named by -config, or the default config
+// file if it exists. It runs before flag parsing so the values can be used
+// as flag defaults.
+func loadStartupConfig(args []string) (*Config, error) {
+	for i, arg := range args {
+		name := strings.TrimLeft(arg, "-")
+		if name == arg {
+			continue
+		}
+		if strings.HasPrefix(name, "config=") {
+			return LoadConfig(strings.TrimPrefix(name, "config="))
+		}
+		if name == "config" {
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("flag -config needs a file argument")
+			}
+			return LoadConfig(args[i+1])
+		}
+	}
+
+	path := defaultConfigPath()
+	if path == "" {
+		return defaultConfig(), nil
+	}
+	if _, err := os.Stat(path); err != nil {
+		return defaultConfig(), nil
+	}
+	logf(LogNormal, "Using config file: %s\n", path)
+	return LoadConfig(path)
+}
+
+// parseArgs parses flags that may appear before, between or after the
+// positional arguments (e.g. "<port> <firmware> -iradio")
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// parseDelay accepts a plain number of milliseconds or a duration like 1.5s
+func parseDelay(value string, delay *time.Duration) error {
+	if ms, err := strconv.Atoi(value); err == nil {
+		*delay = time.Duration(ms) * time.Millisecond
+		return nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid delay '%s'", value)
+	}
+	*delay = d
+	return nil
+}
+
+// clampTimeout limits a timeout to 50ms-30s, warning when it was outside
+func clampTimeout(name string, timeout time.Duration) time.Duration {
+	clamped := timeout
+	if clamped < 50*time.Millisecond {
+		clamped = 50 * time.Millisecond
+	} else if clamped > 30*time.Second {
+		clamped = 30 * time.Second
+	}
+	if clamped != timeout {
+		fmt.Fprintf(os.Stderr, "Warning: %s %v is outside 50ms-30s, using %v\n", name, timeout, clamped)
+	}
+	return clamped
+}
+
+// knownCables are the USB serial adapters used in RT6D programming cables
+var knownCables = []struct {
+	VID, PID    string
+	Description string
+}{
+	{"1A86", "7523", "CH340"},
+	{"10C4", "EA60", "CP2102"},
+	{"067B", "2303", "PL2303"},
+}
+
+// usbDeviceIDs returns the USB vendor and product ID of a tty device in
+// /sys/class/tty, false if it is not a USB device
+func usbDeviceIDs(device string) (vid, pid string, ok bool) {
+	path, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return "", "", false
+	}
+
+	// The USB IDs are on the USB device, a few levels above the tty
+	for i := 0; i < 6 && path != "/"; i++ {
+		vidBytes, err1 := os.ReadFile(filepath.Join(path, "idVendor"))
+		pidBytes, err2 := os.ReadFile(filepath.Join(path, "idProduct"))
+		if err1 == nil && err2 == nil {
+			return strings.TrimSpace(string(vidBytes)), strings.TrimSpace(string(pidBytes)), true
+		}
+		path = filepath.Dir(path)
+	}
+	return "", "", false
+}
+
+// portUSBID returns the VID:PID of the USB adapter behind portName in upper
+// case, "" if it is unknown (not Linux, or not a USB port)
+func portUSBID(portName string) string {
+	if runtime.GOOS != "linux" {
+		return ""
+	}
+	if resolved, err := filepath.EvalSymlinks(portName); err == nil {
+		portName = resolved
+	}
+	vid, pid, ok := usbDeviceIDs(filepath.Join("/sys/class/tty", filepath.Base(portName), "device"))
+	if !ok {
+		return ""
+	}
+	return strings.ToUpper(vid + ":" + pid)
+}
+
+// FindRadioPort returns the serial port of the only connected programming
+// cable. The USB IDs are read from /sys/class/tty, so this only works on
+// Linux; elsewhere the port has to be given with -port.
+func FindRadioPort() (string, error) {
+	if runtime.GOOS != "linux" {
+		return "", fmt.Errorf("no port given, cable detection is only supported on Linux (use -port)")
+	}
+
+	devices, _ := filepath.Glob("/sys/class/tty/*/device")
+	var found []string
+	for _, device := range devices {
+		vid, pid, ok := usbDeviceIDs(device)
+		if !ok {
+			continue
+		}
+		for _, cable := range knownCables {
+			if strings.EqualFold(vid, cable.VID) && strings.EqualFold(pid, cable.PID) {
+				portName := "/dev/" + filepath.Base(filepath.Dir(device))
+				found = append(found, fmt.Sprintf("%s (%s %s:%s)", portName, cable.Description, cable.VID, cable.PID))
+			}
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no port given and no known programming cable found (use -port)")
+	case 1:
+		return strings.Fields(found[0])[0], nil
+	}
+	return "", fmt.Errorf("several programming cables found, choose one with -port:\n  %s", strings.Join(found, "\n  "))
+}
+
+// portList collects the values of a repeated -port flag
+type portList []string
+
+func (p *portList) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *portList) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
+
+// noWaitStart and forceStart replace the Enter prompts with a countdown or
+// nothing, set by -no-wait and -force
+var noWaitStart, forceStart bool
+
+func printFlashInstructions() {
+	fmt.Println("\nInstructions:")
+	fmt.Println("1. Connect the data cable to the radio")
+	fmt.Println("2. Turn OFF the radio completely")
+	fmt.Println("3. Press and HOLD the PTT key")
+	fmt.Println("4. While holding PTT, turn ON the radio")
+	fmt.Println("5. Keep holding PTT for 2-3 seconds after power on")
+	fmt.Println("6. Release PTT - radio should be in programming mode")
+	fmt.Println("7. Press Enter to start upgrade...")
+	
+	spilib.WaitForStart(noWaitStart, forceStart)
+}
+
+// flashManyFromCLI flashes the same firmware to every port at once
+func flashManyFromCLI(portNames []string, cfg *Config) {
+	jobs := make([]FlashJob, len(portNames))
+	for i, portName := range portNames {
+		jobs[i] = FlashJob{PortName: portName, FirmwareFile: cfg.FirmwareFile, Config: cfg}
+	}
+
+	fmt.Printf("Selected ports: %s\n", strings.Join(portNames, ", "))
+	fmt.Printf("Firmware file: %s\n", cfg.FirmwareFile)
+	fmt.Println("\nPut every radio into programming mode before starting.")
+	printFlashInstructions()
+
+	results := FlashMany(jobs, len(jobs))
+
+	failed := 0
+	fmt.Println("\nResults:")
+	for _, result := range results {
+		if result.Error != nil {
+			failed++
+			fmt.Printf("  %s: FAILED after %v: %v\n", result.JobID, result.Duration.Round(time.Second), result.Error)
+			continue
+		}
+		fmt.Printf("  %s: OK in %v (%d blocks, %d retries)\n", result.JobID, result.Duration.Round(time.Second),
+			result.TransferStats.BlocksSent, result.TransferStats.Retries)
+	}
+
+	if failed > 0 {
+		fmt.Printf("%d of %d radios failed\n", failed, len(results))
+		exitProgram(1)
+	}
+	fmt.Println("All radios updated successfully!")
+}
+
+func runTraceReplayCommand(args []string) {
+	fs := flag.NewFlagSet("trace-replay", flag.ExitOnError)
+	strictTiming := fs.Bool("strict-timing", false, "answer with the recorded delays")
+	protocolFile := fs.String("protocol-file", "", "JSON file with more protocols")
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s trace-replay [-strict-timing] [-protocol-file <json>] <trace_file>\n", os.Args[0])
+		fmt.Println("\nRe-runs a flash recorded with -trace against the recorded radio responses,")
+		fmt.Println("no radio needed. Fails if the flasher sends anything different.")
+	}
+
+	positional, err := parseArgs(fs, args)
+	if err != nil || len(positional) != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	if *protocolFile != "" {
+		if err := loadProtocolFile(*protocolFile); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := replayTrace(positional[0], *strictTiming); err != nil {
+		fmt.Printf("Replay failed: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func runListProtocolsCommand(args []string) {
+	fs := flag.NewFlagSet("list-protocols", flag.ExitOnError)
+	protocolFile := fs.String("protocol-file", "", "JSON file with more protocols")
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s list-protocols [-protocol-file <json>]\n", os.Args[0])
+		fmt.Println("\nLists the protocols that -protocol accepts.")
+	}
+
+	positional, err := parseArgs(fs, args)
+	if err != nil || len(positional) != 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *protocolFile != "" {
+		if err := loadProtocolFile(*protocolFile); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	fmt.Printf("%-12s %-18s %-18s %-9s %s\n", "Name", "Description", "Connect", "Checksum", "Block size")
+	for _, p := range knownProtocols {
+		fmt.Printf("%-12s %-18s %-18s %-9s %d\n", p.Name, p.Description, fmt.Sprintf("% X", p.SendConnect),
+			fmt.Sprintf("+%d", p.ChecksumOffset), p.BlockSize)
+	}
+}
+
+func runListFormatsCommand(args []string) {
+	if len(args) != 0 {
+		fmt.Printf("Usage: %s list-formats\n", os.Args[0])
+		fmt.Println("\nLists the firmware file formats and how they are recognized.")
+		os.Exit(1)
+	}
+	printFormats(firmwareFormats,
+		".rtpkg extension, other extensions, ':' content, 'S' content, binary")
+}
+
+func runReadFirmwareCommand(args []string) {
+	fs := flag.NewFlagSet("read-firmware", flag.ExitOnError)
+	useIRadio := fs.Bool("iradio", false, "use iRadio protocol parameters")
+	hexOutput := fs.Bool("hex-output", false, "write Intel HEX instead of binary")
+	baudRate := fs.Int("baud", 115200, "serial baud rate")
+	fs.BoolVar(&noWaitStart, "no-wait", false, "count down 3 seconds instead of waiting for Enter")
+	fs.BoolVar(&forceStart, "force", false, "start at once, without waiting for Enter or a countdown")
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s read-firmware [-iradio] [-hex-output] [-baud <rate>] [-no-wait] [-force] <port> <output_file>\n", os.Args[0])
+		fmt.Println("\nDownloads the firmware installed on the radio (radio in programming mode).")
+	}
+
+	positional, err := parseArgs(fs, args)
+	if err != nil || len(positional) != 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	flasher := NewFlasher(*useIRadio)
+	flasher.baudRate = *baudRate
+	printFlashInstructions()
+
+	if err := flasher.readFirmware(positional[0], positional[1], *hexOutput); err != nil {
+		fmt.Printf("Read failed: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// FirmwareInfo describes a firmware file, as shown by "info <firmware_file>"
+type FirmwareInfo struct {
+	File           string           `json:"file"`
+	Version        string           `json:"version"`
+	CRC32          string           `json:"crc32"` // Over the populated bytes in address order
+	PopulatedBytes int              `json:"populated_bytes"`
+	EmptyBytes     int              `json:"empty_bytes"`
+	Regions        []FirmwareRegion `json:"regions"`
+}
+
+// FirmwareRegion is a contiguous populated address range, End is inclusive
+type FirmwareRegion struct {
+	Start uint32 `json:"start"`
+	End   uint32 `json:"end"`
+	Size  int    `json:"size"`
+}
+
+var firmwareVersionPattern = regexp.MustCompile(`V[0-9]+\.[0-9]+[A-Z]?`)
+
+// detectFirmwareVersion returns the first version string (e.g. V1.12A) in
+// the image, or "unknown"
+func detectFirmwareVersion(image []byte) string {
+	if version := firmwareVersionPattern.Find(image); version != nil {
+		return string(version)
+	}
+	return "unknown"
+}
+
+// firmwareInfo loads a firmware file like a flash would and summarizes it
+func firmwareInfo(filename string) (*FirmwareInfo, error) {
+	f := NewFlasher(false)
+	if !f.initializeHex(filename) {
+		return nil, protocolErrorf(ErrFirmwareLoad, -1, "failed to load firmware file %s", filename)
+	}
+
+	info := &FirmwareInfo{File: filename, Version: detectFirmwareVersion(f.hex)}
+	crc := crc32.NewIEEE()
+	for _, r := range mergeRegions(f.loadedRanges) {
+		end := min(r.end, len(f.hex))
+		crc.Write(f.hex[r.start:end])
+		info.PopulatedBytes += end - r.start
+		info.Regions = append(info.Regions, FirmwareRegion{
+			Start: uint32(0x08002800 + r.start),
+			End:   uint32(0x08002800 + end - 1),
+			Size:  end - r.start,
+		})
+	}
+	info.EmptyBytes = len(f.hex) - info.PopulatedBytes
+	info.CRC32 = fmt.Sprintf("%08X", crc.Sum32())
+	return info, nil
+}
+
+// runFirmwareInfo implements "info <firmware_file>", no radio needed
+func runFirmwareInfo(filename string, jsonOutput bool) {
+	info, err := firmwareInfo(filename)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if jsonOutput {
+		out, _ := json.MarshalIndent(info, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+	printFirmwareInfo(info, os.Stdout)
+}
+
+// printFirmwareInfo writes the text output of "info <firmware_file>"
+func printFirmwareInfo(info *FirmwareInfo, writer io.Writer) {
+	fmt.Fprintf(writer, "\nFile:            %s\n", info.File)
+	fmt.Fprintf(writer, "Version:         %s\n", info.Version)
+	fmt.Fprintf(writer, "CRC32:           %s\n", info.CRC32)
+	fmt.Fprintf(writer, "Populated bytes: %d\n", info.PopulatedBytes)
+	fmt.Fprintf(writer, "Empty bytes:     %d\n", info.EmptyBytes)
+	fmt.Fprintln(writer, "\nStart       End         Size")
+	for _, r := range info.Regions {
+		fmt.Fprintf(writer, "0x%08X  0x%08X  %d\n", r.Start, r.End, r.Size)
+	}
+}
+
+// FirmwareDiff is the difference between two firmware images, as shown by
+// "compare <file_a> <file_b>"
+type FirmwareDiff struct {
+	AddedRegions   []FirmwareRegion // Populated in image B only
+	RemovedRegions []FirmwareRegion // Populated in image A only
+	ChangedBlocks  []BlockDiff
+}
+
+// BlockDiff describes a block that differs between two firmware images
+type BlockDiff struct {
+	Address      uint32 // Device address of the block
+	ChangedBytes int
+	FirstChanged int // Offset of the first changed byte in the block
+	LastChanged  int // Offset of the last changed byte in the block
+	Hamming      int // Number of differing bits
+}
+
+// CompareFirmware loads two firmware files and compares their images block
+// by block. Bytes that are in neither file hold the fill byte in both
+// images and never differ.
+func CompareFirmware(imageA, imageB string) (*FirmwareDiff, error) {
+	a := NewFlasher(false)
+	if !a.initializeHex(imageA) {
+		return nil, protocolErrorf(ErrFirmwareLoad, -1, "failed to load firmware file %s", imageA)
+	}
+	b := NewFlasher(false)
+	if !b.initializeHex(imageB) {
+		return nil, protocolErrorf(ErrFirmwareLoad, -1, "failed to load firmware file %s", imageB)
+	}
+
+	diff := &FirmwareDiff{
+		AddedRegions:   exclusiveRegions(b.loadedRanges, a.loadedRanges, len(b.hex)),
+		RemovedRegions: exclusiveRegions(a.loadedRanges, b.loadedRanges, len(a.hex)),
+	}
+	for start := 0; start < len(a.hex); start += a.BlockSize {
+		block := BlockDiff{Address: uint32(0x08002800 + start), FirstChanged: -1}
+		for i := start; i < min(start+a.BlockSize, len(a.hex)); i++ {
+			if a.hex[i] == b.hex[i] {
+				continue
+			}
+			if block.FirstChanged < 0 {
+				block.FirstChanged = i - start
+			}
+			block.LastChanged = i - start
+			block.ChangedBytes++
+			block.Hamming += bits.OnesCount8(a.hex[i] ^ b.hex[i])
+		}
+		if block.ChangedBytes > 0 {
+			diff.ChangedBlocks = append(diff.ChangedBlocks, block)
+		}
+	}
+	return diff, nil
+}
+
+// exclusiveRegions returns the parts of the ranges in of an image of size
+// bytes that are not covered by notIn
+func exclusiveRegions(in, notIn []hexRegion, size int) []FirmwareRegion {
+	covered := make([]bool, size)
+	for _, r := range notIn {
+		for i := r.start; i < min(r.end, size); i++ {
+			covered[i] = true
+		}
+	}
+
+	var regions []FirmwareRegion
+	for _, r := range mergeRegions(in) {
+		for i := r.start; i < min(r.end, size); {
+			if covered[i] {
+				i++
+				continue
+			}
+			end := i
+			for end < min(r.end, size) && !covered[end] {
+				end++
+			}
+			regions = append(regions, FirmwareRegion{
+				Start: uint32(0x08002800 + i),
+				End:   uint32(0x08002800 + end - 1),
+				Size:  end - i,
+			})
+			i = end
+		}
+	}
+	return regions
+}
+
+// runCompareCommand implements "compare <file_a> <file_b>", no radio needed
+func runCompareCommand(args []string) {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	symbolsFile := fs.String("symbols", "", "ELF file to name the function of each changed block")
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s compare [-symbols <elf>] <file_a> <file_b>\n", os.Args[0])
+		fmt.Println("\nShows the regions only one firmware file has and the blocks that differ between them.")
+	}
+
+	positional, err := parseArgs(fs, args)
+	if err != nil || len(positional) != 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	// Keep the loading messages out of the tables
+	logLevel = LogQuiet
+
+	names := NewFlasher(false)
+	if *symbolsFile != "" {
+		if err := names.LoadSymbolMap(*symbolsFile); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	diff, err := CompareFirmware(positional[0], positional[1])
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	printRegions := func(title string, regions []FirmwareRegion) {
+		if len(regions) == 0 {
+			return
+		}
+		fmt.Printf("%s:\n", title)
+		for _, r := range regions {
+			fmt.Printf("  0x%08X-0x%08X  %d bytes  %s\n", r.Start, r.End, r.Size, names.symbolAt(r.Start))
+		}
+		fmt.Println()
+	}
+	printRegions("Only in "+positional[1], diff.AddedRegions)
+	printRegions("Only in "+positional[0], diff.RemovedRegions)
+
+	if len(diff.ChangedBlocks) == 0 {
+		fmt.Println("No blocks differ")
+		return
+	}
+	fmt.Printf("%-5s  %-10s  %5s  %-5s  %-5s  %4s  %s\n", "Block", "Address", "Bytes", "First", "Last", "Bits", "Function")
+	changedBytes := 0
+	for _, d := range diff.ChangedBlocks {
+		fmt.Printf("%5d  0x%08X  %5d  0x%03X  0x%03X  %4d  %s\n", int(d.Address-0x08002800)/names.BlockSize, d.Address,
+			d.ChangedBytes, d.FirstChanged, d.LastChanged, d.Hamming, names.symbolAt(d.Address+uint32(d.FirstChanged)))
+		changedBytes += d.ChangedBytes
+	}
+	fmt.Printf("\n%d changed bytes in %d blocks\n", changedBytes, len(diff.ChangedBlocks))
+}
+
+func runInfoCommand(args []string) {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	useIRadio := fs.Bool("iradio", false, "use iRadio protocol parameters")
+	baudRate := fs.Int("baud", 115200, "serial baud rate")
+	jsonOutput := fs.Bool("json", false, "print the result as JSON")
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s info [-iradio] [-baud <rate>] [-json] <port>\n", os.Args[0])
+		fmt.Printf("       %s info [-json] <firmware_file>\n", os.Args[0])
+		fmt.Println("\nShows the model and version of the radio (radio in programming mode), without flashing,")
+		fmt.Println("or the version, CRC32 and address regions of a firmware file.")
+	}
+
+	positional, err := parseArgs(fs, args)
+	if err != nil || len(positional) != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *jsonOutput {
+		// Keep the progress messages out of the JSON document
+		logLevel = LogQuiet
+	}
+
+	// Serial ports are device files, so only a regular file is firmware
+	if st, err := os.Stat(positional[0]); err == nil && st.Mode().IsRegular() {
+		runFirmwareInfo(positional[0], *jsonOutput)
+		return
+	}
+
+	flasher := NewFlasher(*useIRadio)
+	mode := &serial.Mode{
+		BaudRate: *baudRate,
+		DataBits: 8,
+		Parity:   serial.NoParity,
+		StopBits: serial.OneStopBit,
+	}
+	port, err := serial.Open(positional[0], mode)
+	if err != nil {
+		fmt.Printf("Error: failed to open port %s: %v\n", positional[0], err)
+		os.Exit(1)
+	}
+	flasher.port = port
+
+	info, err := flasher.QueryDeviceInfo()
+	port.Close()
+	if err != nil {
+		fmt.Printf("Query failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *jsonOutput {
+		out, _ := json.MarshalIndent(info, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+	fmt.Printf("Model:             %s\n", info.ModelName)
+	fmt.Printf("Firmware version:  %s\n", info.FirmwareVersion)
+	fmt.Printf("Hardware revision: %s\n", info.HardwareRevision)
+	fmt.Printf("Serial number:     %s\n", info.SerialNumber)
+}
+
+// runDumpMemoryMapCommand prints the memory map of a firmware file without
+// talking to a radio
+func runDumpMemoryMapCommand(args []string) {
+	fs := flag.NewFlagSet("dump-memory-map", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s dump-memory-map <firmware_file>\n", os.Args[0])
+		fmt.Println("\nLoads a firmware file like a flash would and prints which parts of the image it fills.")
+	}
+
+	positional, err := parseArgs(fs, args)
+	if err != nil || len(positional) != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	f := NewFlasher(false)
+	f.MemoryMap = true
+	if !f.initializeHex(positional[0]) {
+		os.Exit(1)
+	}
+}
+
+func runStatusCommand(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	useIRadio := fs.Bool("iradio", false, "use iRadio protocol parameters")
+	baudRate := fs.Int("baud", 115200, "serial baud rate")
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s status [-iradio] [-baud <rate>] <port>\n", os.Args[0])
+		fmt.Println("\nChecks whether the radio is in bootloader mode, without flashing.")
+	}
+
+	positional, err := parseArgs(fs, args)
+	if err != nil || len(positional) != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	mode := &serial.Mode{
+		BaudRate: *baudRate,
+		DataBits: 8,
+		Parity:   serial.NoParity,
+		StopBits: serial.OneStopBit,
+	}
+	port, err := serial.Open(positional[0], mode)
+	if err != nil {
+		fmt.Printf("Error: failed to open port %s: %v\n", positional[0], err)
+		os.Exit(1)
+	}
+	defer port.Close()
+
+	flasher := NewFlasher(*useIRadio)
+	flasher.port = port
+	bootloader, err := flasher.queryMode()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if !bootloader {
+		fmt.Println("Radio is in NORMAL mode — enter bootloader with PTT+power")
+		port.Close()
+		os.Exit(1)
+	}
+	fmt.Println("Radio is in BOOTLOADER mode — ready to flash")
+}
+
+// loadFlashRecords reads a stats file written by appendStats
+func loadFlashRecords(statsFile string) ([]FlashRecord, error) {
+	file, err := os.Open(statsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stats file: %v", err)
+	}
+	defer file.Close()
+
+	var records []FlashRecord
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var record FlashRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", statsFile, lineNum, err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read stats file: %v", err)
+	}
+	return records, nil
+}
+
+// printStatsReport summarizes the flashes of a stats file
+func printStatsReport(records []FlashRecord, writer io.Writer) {
+	var succeeded int
+	var totalDuration int64
+	errorCounts := make(map[string]int)
+	for _, r := range records {
+		totalDuration += r.DurationMs
+		if r.Result == "ok" {
+			succeeded++
+			continue
+		}
+		kind := r.ErrorCode
+		if kind == "" {
+			kind = r.Error
+		}
+		errorCounts[kind]++
+	}
+
+	fmt.Fprintf(writer, "Total flashes:    %d\n", len(records))
+	if len(records) == 0 {
+		return
+	}
+	fmt.Fprintf(writer, "Succeeded:        %d (%.1f%%)\n", succeeded, 100*float64(succeeded)/float64(len(records)))
+	fmt.Fprintf(writer, "Failed:           %d\n", len(records)-succeeded)
+	fmt.Fprintf(writer, "Average duration: %.1fs\n", float64(totalDuration)/float64(len(records))/1000)
+	fmt.Fprintf(writer, "First flash:      %s\n", records[0].Timestamp.Format(time.RFC3339))
+	fmt.Fprintf(writer, "Last flash:       %s\n", records[len(records)-1].Timestamp.Format(time.RFC3339))
+	if len(errorCounts) == 0 {
+		return
+	}
+
+	kinds := make([]string, 0, len(errorCounts))
+	for kind := range errorCounts {
+		kinds = append(kinds, kind)
+	}
+	sort.Slice(kinds, func(i, j int) bool {
+		if errorCounts[kinds[i]] != errorCounts[kinds[j]] {
+			return errorCounts[kinds[i]] > errorCounts[kinds[j]]
+		}
+		return kinds[i] < kinds[j]
+	})
+	fmt.Fprintln(writer, "\nMost common errors:")
+	for _, kind := range kinds {
+		fmt.Fprintf(writer, "  %5d  %s\n", errorCounts[kind], kind)
+	}
+}
+
+func runStatsReportCommand(args []string) {
+	fs := flag.NewFlagSet("stats-report", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s stats-report <stats_file>\n", os.Args[0])
+		fmt.Println("\nSummarizes a file written with -stats-file: success rate, average duration and errors.")
+	}
+
+	positional, err := parseArgs(fs, args)
+	if err != nil || len(positional) != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	records, err := loadFlashRecords(positional[0])
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	printStatsReport(records, os.Stdout)
+}
+
+func runDiagnoseCommand(args []string) {
+	fs := flag.NewFlagSet("diagnose", flag.ExitOnError)
+	useIRadio := fs.Bool("iradio", false, "use iRadio protocol parameters")
+	baudRate := fs.Int("baud", 115200, "serial baud rate")
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s diagnose [-iradio] [-baud <rate>] <port>\n", os.Args[0])
+		fmt.Println("\nMeasures latency and throughput of the cable (radio in programming mode).")
+	}
+
+	positional, err := parseArgs(fs, args)
+	if err != nil || len(positional) != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	flasher := NewFlasher(*useIRadio)
+	flasher.baudRate = *baudRate
+	report, err := flasher.DiagnosePort(positional[0])
+	if err != nil {
+		fmt.Printf("Diagnosis failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("\nPort diagnosis:")
+	fmt.Printf("  Latency:        %.1f ms mean (min %.1f, max %.1f)\n", report.MeanLatencyMs, report.MinLatencyMs, report.MaxLatencyMs)
+	fmt.Printf("  Throughput:     %.1f KB/s at %d baud\n", report.ThroughputKBps, *baudRate)
+	fmt.Printf("  Unanswered:     %.0f%%\n", report.ErrorRate*100)
+	fmt.Printf("  Recommendation: %s\n", report.Recommendation)
+}
+
+func runLoopbackTestCommand(args []string) {
+	fs := flag.NewFlagSet("loopback-test", flag.ExitOnError)
+	baudRate := fs.Int("baud", 115200, "serial baud rate")
+	iterations := fs.Int("iterations", 100, "number of 16 byte test packets")
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s loopback-test [-baud <rate>] [-iterations <n>] <port>\n", os.Args[0])
+		fmt.Println("\nTests the cable alone: short the TX and RX pins of the adapter, no radio connected.")
+	}
+
+	positional, err := parseArgs(fs, args)
+	if err != nil || len(positional) != 1 || *iterations < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	flasher := NewFlasher(false)
+	flasher.baudRate = *baudRate
+	result, err := flasher.TestLoopback(positional[0], *iterations)
+	if err != nil {
+		fmt.Printf("Loopback test failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("\nLoopback test:")
+	fmt.Printf("  Packets:    %d of 16 bytes at %d baud\n", result.Packets, *baudRate)
+	fmt.Printf("  Bytes:      %d sent, %d received, %d matched\n", result.BytesSent, result.BytesReceived, result.BytesMatched)
+	fmt.Printf("  Error rate: %.1f%%\n", result.ErrorRate*100)
+	if result.MaxLatencyMs > 0 {
+		fmt.Printf("  Latency:    %.1f ms mean (min %.1f, max %.1f)\n", result.MeanLatencyMs, result.MinLatencyMs, result.MaxLatencyMs)
+	}
+
+	switch {
+	case result.BytesMatched == 0:
+		fmt.Println("\nNo loopback detected — ensure TX and RX pins are connected")
+		os.Exit(1)
+	case result.BytesMatched < result.BytesSent:
+		fmt.Println("\nSome bytes were lost or corrupted, check the cable and try a lower baud rate")
+		os.Exit(1)
+	}
+	fmt.Println("\nCable OK, every byte came back unchanged")
+}
+
+func runBenchmarkCommand(args []string) {
+	fs := flag.NewFlagSet("benchmark-port", flag.ExitOnError)
+	baudRate := fs.Int("baud", 115200, "serial baud rate")
+	duration := fs.Duration("duration", 10*time.Second, "how long to send packets")
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s benchmark-port [-baud <rate>] [-duration <duration>] <port>\n", os.Args[0])
+		fmt.Println("\nMeasures the sustained throughput of the cable with echoed 1028 byte packets.")
+		fmt.Println("Short the TX and RX pins of the adapter as for loopback-test, no radio connected.")
+	}
+
+	positional, err := parseArgs(fs, args)
+	if err != nil || len(positional) != 1 || *duration <= 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	flasher := NewFlasher(false)
+	flasher.baudRate = *baudRate
+	fmt.Printf("Sending packets for %v...\n", *duration)
+	result, err := flasher.BenchmarkPort(positional[0], *duration)
+	if err != nil {
+		fmt.Printf("Benchmark failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("\nPort benchmark:")
+	fmt.Printf("  Packets:     %d sent, %d received (1028 bytes at %d baud)\n", result.PacketsSent, result.PacketsReceived, *baudRate)
+	fmt.Printf("  Bytes:       %d sent, %d received\n", result.BytesSent, result.BytesReceived)
+	fmt.Printf("  Throughput:  %.1f KB/s\n", result.ThroughputKBps)
+	fmt.Printf("  Packet loss: %.1f%%\n", result.PacketLossRate*100)
+	fmt.Printf("  CRC errors:  %.1f%%\n", result.CRCErrorRate*100)
+	if result.PacketsReceived == 0 {
+		fmt.Println("\nNo packet came back — ensure TX and RX pins are connected")
+		os.Exit(1)
+	}
+	fmt.Printf("  Round trip:  %.1f ms mean (min %.1f, max %.1f)\n", result.MeanRoundTripMs, result.MinRoundTripMs, result.MaxRoundTripMs)
+	fmt.Printf("  Recommended block timeout: %v (-timeout)\n", result.RecommendedBlockTimeout.Round(time.Millisecond))
+}
+
+func runHardwareTestCommand(args []string) {
+	fs := flag.NewFlagSet("hardware-test", flag.ExitOnError)
+	useIRadio := fs.Bool("iradio", false, "use iRadio protocol parameters")
+	baudRate := fs.Int("baud", 115200, "serial baud rate")
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s hardware-test [-iradio] [-baud <rate>] <port>\n", os.Args[0])
+		fmt.Println("\nChecks the port, the modem lines and the radio's answer (radio in programming mode).")
+	}
+
+	positional, err := parseArgs(fs, args)
+	if err != nil || len(positional) != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	flasher := NewFlasher(*useIRadio)
+	flasher.baudRate = *baudRate
+	result, err := flasher.HardwareTest(positional[0])
+	if err != nil {
+		fmt.Printf("Hardware test failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("\nHardware test of %s:\n", positional[0])
+	for _, step := range result.Steps {
+		status := "PASS"
+		if !step.Passed {
+			status = "FAIL"
+		}
+		fmt.Printf("  %-12s %s  %s\n", step.Name, status, step.Detail)
+	}
+	fmt.Printf("\n%s\n", result.Summary)
+	if !result.Passed() {
+		os.Exit(1)
+	}
+}
+
+// downloadProgress counts the bytes read from a download and prints the
+// progress in the style of the SPI backup
+type downloadProgress struct {
+	r     io.Reader
+	done  int64
+	total int64 // -1 if the server did not send a length
+}
+
+func (d *downloadProgress) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.done += int64(n)
+	if d.total > 0 {
+		logf(LogNormal, "\rDownloading firmware: %.1f%% (%d/%d bytes)", float64(d.done)/float64(d.total)*100, d.done, d.total)
+	} else {
+		logf(LogNormal, "\rDownloading firmware: %d bytes", d.done)
+	}
+	return n, err
+}
+
+// downloadFirmware fetches a firmware image over HTTP(S) into destPath. A
+// URL ending in .gz is decompressed while downloading. The SHA-256 of the
+// written file is printed so it can be compared with the published one.
+func downloadFirmware(url, destPath string, timeout time.Duration) error {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download %s: %s", url, resp.Status)
+	}
+
+	progress := &downloadProgress{r: resp.Body, total: resp.ContentLength}
+	var body io.Reader = progress
+	if strings.HasSuffix(strings.ToLower(urlPath(url)), ".gz") {
+		gz, err := gzip.NewReader(progress)
+		if err != nil {
+			return fmt.Errorf("failed to decompress %s: %v", url, err)
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	file, err := os.Create(destPath)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", destPath, err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), body)
+	logf(LogNormal, "\n")
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %v", url, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %v", destPath, err)
+	}
+
+	logf(LogNormal, "Downloaded %d bytes to %s\n", size, destPath)
+	fmt.Printf("SHA-256: %x\n", hash.Sum(nil))
+	return nil
+}
+
+// urlPath returns the path of url without query and fragment
+func urlPath(url string) string {
+	if i := strings.IndexAny(url, "?#"); i >= 0 {
+		return url[:i]
+	}
+	return url
+}
+
+// downloadedFirmwarePath returns where the firmware from url is stored:
+// a new temporary directory and the file name of the URL without .gz, so
+// the format can still be told from the extension
+func downloadedFirmwarePath(url string) (string, error) {
+	name := path.Base(urlPath(url))
+	if strings.HasSuffix(strings.ToLower(name), ".gz") {
+		name = name[:len(name)-3]
+	}
+	if name == "" || name == "." || name == "/" {
+		name = "firmware"
+	}
+
+	dir, err := os.MkdirTemp("", "rt6d-firmware-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create download directory: %v", err)
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// waitForFileChange polls filename every 500 ms until its size or
+// modification time differs from last, the state of the file that was
+// loaded. Taking last before the flash catches changes made during it.
+func waitForFileChange(filename string, last os.FileInfo) {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		current, err := os.Stat(filename)
+		if err != nil {
+			// The file may be replaced by the build, wait for it to reappear
+			continue
+		}
+		if last == nil || current.Size() != last.Size() || !current.ModTime().Equal(last.ModTime()) {
+			return
+		}
+	}
+}
+
+// watchAndReflash flashes the firmware again each time the file changes,
+// until the user quits. Failed flashes are reported and watching goes on.
+func watchAndReflash(flasher *Flasher, portName, firmwareFile string, auto bool, loaded os.FileInfo) {
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Printf("\nWatching %s for changes (Ctrl-C to stop)...\n", firmwareFile)
+		waitForFileChange(firmwareFile, loaded)
+
+		// Give the build a moment to finish writing the file
+		time.Sleep(200 * time.Millisecond)
+
+		if !auto {
+			fmt.Print("Firmware changed, press Enter to reflash or q to quit: ")
+			answer, _ := reader.ReadString('\n')
+			if strings.TrimSpace(strings.ToLower(answer)) == "q" {
+				return
+			}
+		} else {
+			fmt.Println("Firmware changed, reflashing")
+		}
+
+		loaded, _ = os.Stat(firmwareFile)
+		if !flasher.initializeHex(firmwareFile) {
+			fmt.Println("Failed to load the new firmware, waiting for the next change")
+			continue
+		}
+		if err := flasher.startUpdate(portName); err != nil {
+			fmt.Printf("Flash failed: %v\n", err)
+			continue
+		}
+		fmt.Println("Update completed successfully!")
+	}
+}
+
+// flasherScriptBackend runs script commands with the flasher settings of
+// cfg. spi-restore is left to spi-tool.
+type flasherScriptBackend struct {
+	cfg *Config
+}
+
+func (b flasherScriptBackend) Flash(port, firmware string) error {
+	f := newConfiguredFlasher(b.cfg)
+	if !f.initializeHex(firmware) {
+		return protocolErrorf(ErrFirmwareLoad, -1, "failed to load firmware file %s", firmware)
+	}
+	return f.startUpdate(port)
+}
+
+func (b flasherScriptBackend) SPIBackup(port, file string) error {
+	f := newConfiguredFlasher(b.cfg)
+	f.BackupPath = filepath.Dir(file)
+	backup, err := f.backupSPIFlash(port)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(backup, file); err != nil {
+		return fmt.Errorf("failed to rename backup to %s: %v", file, err)
+	}
+	fmt.Printf("SPI flash backup saved to %s\n", file)
+	return nil
+}
+
+func (b flasherScriptBackend) SPIRestore(port, file string) error {
+	return fmt.Errorf("spi-restore is not supported by %s, run this script with spi-tool", os.Args[0])
+}
+
+func (flasherScriptBackend) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+// FlashSequence flashes several images one after the other, e.g. a
+// bootloader and then the application, loaded from a YAML file:
+//
+//	steps:
+//	  - firmware_file: bootloader.bin
+//	    delay_after_ms: 3000
+//	    reset_between_steps: true
+//	  - firmware_file: application.hex
+type FlashSequence struct {
+	Steps []FlashStep `yaml:"steps"`
+
+	Defaults *Config `yaml:"-"` // Settings of every step, defaultConfig() if nil
+	DryRun   bool    `yaml:"-"` // Flash every step to a dryRunPort and skip the resets
+}
+
+// FlashStep is one image of a FlashSequence
+type FlashStep struct {
+	FirmwareFile      string `yaml:"firmware_file"`
+	Protocol          string `yaml:"protocol,omitempty"`            // Name of a known protocol, the default protocol if empty
+	DelayAfterMs      int    `yaml:"delay_after_ms,omitempty"`      // Pause before the next step
+	ResetBetweenSteps bool   `yaml:"reset_between_steps,omitempty"` // Pulse DTR/RTS before the next step
+
+	port serial.Port // Used instead of opening the port, e.g. in tests
+}
+
+// LoadFlashSequence reads and checks a sequence file
+func LoadFlashSequence(path string) (*FlashSequence, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sequence file %s: %v", path, err)
+	}
+
+	var seq FlashSequence
+	if err := yaml.Unmarshal(content, &seq); err != nil {
+		return nil, fmt.Errorf("failed to parse sequence file %s: %v", path, err)
+	}
+	if len(seq.Steps) == 0 {
+		return nil, fmt.Errorf("sequence file %s has no steps", path)
+	}
+	for i, step := range seq.Steps {
+		if step.FirmwareFile == "" {
+			return nil, fmt.Errorf("step %d of %s has no firmware_file", i+1, path)
+		}
+		if _, ok := findProtocol(step.Protocol); step.Protocol != "" && !ok {
+			return nil, fmt.Errorf("step %d of %s: unknown protocol '%s' (use %s)", i+1, path, step.Protocol, protocolNames())
+		}
+		if step.DelayAfterMs < 0 {
+			return nil, fmt.Errorf("step %d of %s: delay_after_ms must not be negative", i+1, path)
+		}
+	}
+	return &seq, nil
+}
+
+// runFlashSequence flashes the steps of seq in order and stops at the first
+// one that fails. After every step but the last the radio is reset if the
+// step asks for it, then the step's delay is waited.
+func runFlashSequence(seq *FlashSequence, portName string) error {
+	for i, step := range seq.Steps {
+		cfg := defaultConfig()
+		if seq.Defaults != nil {
+			copied := *seq.Defaults
+			cfg = &copied
+		}
+		if step.Protocol != "" {
+			cfg.Protocol = step.Protocol
+		}
+
+		fmt.Printf("\n=== Step %d/%d: %s ===\n", i+1, len(seq.Steps), step.FirmwareFile)
+		f := newConfiguredFlasher(cfg)
+		f.DryRun = seq.DryRun
+		f.mockPort = step.port
+		if !f.initializeHex(step.FirmwareFile) {
+			return protocolErrorf(ErrFirmwareLoad, -1, "step %d: failed to load firmware file %s", i+1, step.FirmwareFile)
+		}
+		if err := f.startUpdate(portName); err != nil {
+			return fmt.Errorf("step %d (%s): %w", i+1, step.FirmwareFile, err)
+		}
+		fmt.Printf("Step %d/%d completed\n", i+1, len(seq.Steps))
+
+		if i == len(seq.Steps)-1 {
+			break
+		}
+		if step.ResetBetweenSteps {
+			if seq.DryRun {
+				fmt.Println("[DRY RUN] Skipping the DTR/RTS reset")
+			} else if err := resetRadio(portName); err != nil {
+				return fmt.Errorf("reset after step %d: %v", i+1, err)
+			}
+		}
+		if step.DelayAfterMs > 0 {
+			fmt.Printf("Waiting %d ms before step %d\n", step.DelayAfterMs, i+2)
+			time.Sleep(time.Duration(step.DelayAfterMs) * time.Millisecond)
+		}
+	}
+	return nil
+}
+
+// sequenceEditor builds a flash sequence file from answers to menu prompts,
+// for users who don't want to write the YAML by hand. It reads lines from
+// in, so it can be driven by a script as well as by a terminal.
+type sequenceEditor struct {
+	in      *bufio.Scanner
+	out     io.Writer
+	path    string
+	seq     FlashSequence
+	changed bool
+}
+
+// editSequence runs the editor on the sequence file at path, which is
+// loaded first if it exists
+func editSequence(in io.Reader, out io.Writer, path string) error {
+	e := &sequenceEditor{in: bufio.NewScanner(in), out: out, path: path}
+	if _, err := os.Stat(path); err == nil {
+		seq, err := LoadFlashSequence(path)
+		if err != nil {
+			return err
+		}
+		e.seq.Steps = seq.Steps
+		fmt.Fprintf(out, "Loaded %d steps from %s\n", len(seq.Steps), path)
+	}
+
+	for {
+		fmt.Fprintln(out, "\n1) Add step  2) Remove step  3) Print sequence  4) Save  5) Exit")
+		choice, ok := e.prompt("Choice: ")
+		if !ok {
+			return nil
+		}
+		switch choice {
+		case "1":
+			e.addStep()
+		case "2":
+			e.removeStep()
+		case "3":
+			e.print()
+		case "4":
+			if err := e.save(); err != nil {
+				fmt.Fprintf(out, "Error: %v\n", err)
+			}
+		case "5":
+			if e.changed {
+				answer, ok := e.prompt("The sequence has unsaved changes, exit anyway? [y/N]: ")
+				if ok && !strings.EqualFold(answer, "y") {
+					continue
+				}
+			}
+			return nil
+		default:
+			fmt.Fprintf(out, "Unknown choice '%s'\n", choice)
+		}
+	}
+}
+
+// prompt prints text and reads one line, ok is false at the end of the
+// input
+func (e *sequenceEditor) prompt(text string) (string, bool) {
+	fmt.Fprint(e.out, text)
+	if !e.in.Scan() {
+		fmt.Fprintln(e.out)
+		return "", false
+	}
+	return strings.TrimRight(e.in.Text(), " \r"), true
+}
+
+func (e *sequenceEditor) addStep() {
+	var step FlashStep
+	for step.FirmwareFile == "" {
+		answer, ok := e.prompt("Firmware file (Tab and Enter to complete, empty to cancel): ")
+		if !ok || answer == "" {
+			return
+		}
+		if prefix, completing := strings.CutSuffix(answer, "\t"); completing {
+			step.FirmwareFile = e.complete(strings.TrimSpace(prefix))
+			continue
+		}
+		answer = strings.TrimSpace(answer)
+		if _, err := os.Stat(answer); err != nil {
+			fmt.Fprintf(e.out, "Warning: %s does not exist here, make sure it does where the sequence runs\n", answer)
+		}
+		step.FirmwareFile = answer
+	}
+
+	fmt.Fprintln(e.out, "Protocols:")
+	fmt.Fprintln(e.out, "  0) default (-protocol of the flash command)")
+	for i, p := range knownProtocols {
+		fmt.Fprintf(e.out, "  %d) %s - %s\n", i+1, p.Name, p.Description)
+	}
+	for {
+		answer, ok := e.prompt("Protocol [0]: ")
+		if !ok {
+			return
+		}
+		if n, err := strconv.Atoi(answer); err == nil && n >= 0 && n <= len(knownProtocols) {
+			if n > 0 {
+				step.Protocol = knownProtocols[n-1].Name
+			}
+			break
+		}
+		if _, found := findProtocol(answer); found || answer == "" {
+			step.Protocol = answer
+			break
+		}
+		fmt.Fprintf(e.out, "Choose 0-%d or one of %s\n", len(knownProtocols), protocolNames())
+	}
+
+	for {
+		answer, ok := e.prompt("Delay after this step in ms [0]: ")
+		if !ok {
+			return
+		}
+		if answer == "" {
+			break
+		}
+		if n, err := strconv.Atoi(answer); err == nil && n >= 0 {
+			step.DelayAfterMs = n
+			break
+		}
+		fmt.Fprintln(e.out, "Give the delay as a number of milliseconds")
+	}
+
+	answer, ok := e.prompt("Reset the radio (DTR/RTS) before the next step? [y/N]: ")
+	if !ok {
+		return
+	}
+	step.ResetBetweenSteps = strings.EqualFold(answer, "y")
+
+	e.seq.Steps = append(e.seq.Steps, step)
+	e.changed = true
+	fmt.Fprintf(e.out, "Added step %d\n", len(e.seq.Steps))
+}
+
+// complete returns the only file starting with prefix, relative to the
+// current directory. If there are several they are listed and "" is
+// returned, so the name is asked for again.
+func (e *sequenceEditor) complete(prefix string) string {
+	matches, _ := filepath.Glob(prefix + "*")
+	if len(matches) == 1 {
+		if info, err := os.Stat(matches[0]); err == nil && !info.IsDir() {
+			fmt.Fprintf(e.out, "Using %s\n", matches[0])
+			return matches[0]
+		}
+	}
+	if len(matches) == 0 {
+		fmt.Fprintf(e.out, "No file starts with '%s'\n", prefix)
+	}
+	for _, match := range matches {
+		if info, err := os.Stat(match); err == nil && info.IsDir() {
+			match += string(filepath.Separator)
+		}
+		fmt.Fprintf(e.out, "  %s\n", match)
+	}
+	return ""
+}
+
+func (e *sequenceEditor) removeStep() {
+	if len(e.seq.Steps) == 0 {
+		fmt.Fprintln(e.out, "The sequence has no steps")
+		return
+	}
+	e.print()
+	answer, ok := e.prompt(fmt.Sprintf("Step to remove (1-%d): ", len(e.seq.Steps)))
+	if !ok {
+		return
+	}
+	n, err := strconv.Atoi(answer)
+	if err != nil || n < 1 || n > len(e.seq.Steps) {
+		fmt.Fprintf(e.out, "No step '%s'\n", answer)
+		return
+	}
+	e.seq.Steps = append(e.seq.Steps[:n-1], e.seq.Steps[n:]...)
+	e.changed = true
+	fmt.Fprintf(e.out, "Removed step %d\n", n)
+}
+
+func (e *sequenceEditor) print() {
+	if len(e.seq.Steps) == 0 {
+		fmt.Fprintln(e.out, "The sequence has no steps")
+		return
+	}
+	for i, step := range e.seq.Steps {
+		protocol := step.Protocol
+		if protocol == "" {
+			protocol = "default"
+		}
+		fmt.Fprintf(e.out, "  %d. %s, protocol %s, %d ms delay", i+1, step.FirmwareFile, protocol, step.DelayAfterMs)
+		if step.ResetBetweenSteps {
+			fmt.Fprint(e.out, ", reset")
+		}
+		fmt.Fprintln(e.out)
+	}
+}
+
+// save writes the sequence and loads it back the way -sequence does
+func (e *sequenceEditor) save() error {
+	if len(e.seq.Steps) == 0 {
+		return fmt.Errorf("add a step first, a sequence needs at least one")
+	}
+	var content bytes.Buffer
+	encoder := yaml.NewEncoder(&content)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&e.seq); err != nil {
+		return fmt.Errorf("failed to encode sequence: %v", err)
+	}
+	if err := os.WriteFile(e.path, content.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write sequence file: %v", err)
+	}
+	if _, err := LoadFlashSequence(e.path); err != nil {
+		return err
+	}
+	e.changed = false
+	fmt.Fprintf(e.out, "Saved %d steps to %s\n", len(e.seq.Steps), e.path)
+	return nil
+}
+
+func runEditSequenceCommand(args []string) {
+	fs := flag.NewFlagSet("edit-sequence", flag.ExitOnError)
+	protocolFile := fs.String("protocol-file", "", "JSON file with more protocols to choose from")
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s edit-sequence [-protocol-file <json>] <output.yaml>\n", os.Args[0])
+		fmt.Println("\nBuilds a -sequence file step by step, an existing file is loaded for editing.")
+	}
+
+	positional, err := parseArgs(fs, args)
+	if err != nil || len(positional) != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *protocolFile != "" {
+		if err := loadProtocolFile(*protocolFile); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if err := editSequence(os.Stdin, os.Stdout, positional[0]); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
 	}
 }
 
-func (f *Flasher) startUpdate(portName string) error {
+// resetRadio drops DTR and RTS of the cable for 100 ms. Opening the port
+// raises both, so this is a pulse that restarts radios whose cable wires
+// them to the reset line; other cables ignore it.
+func resetRadio(portName string) error {
 	mode := &serial.Mode{
 		BaudRate: 115200,
 		DataBits: 8,
 		Parity:   serial.NoParity,
 		StopBits: serial.OneStopBit,
 	}
-
 	port, err := serial.Open(portName, mode)
 	if err != nil {
-		return fmt.Errorf("failed to open port %s: %v", portName, err)
+		return protocolErrorf(ErrPortOpen, -1, "failed to open port %s: %v", portName, err)
 	}
-	f.port = port
+	defer port.Close()
 
-	f.gWritebytes = 0
-	f.step = 1
-	f.sendcnt = 0
-	f.flgConnect = true
+	fmt.Println("Resetting the radio (DTR/RTS)")
+	return pulseResetLines(port)
+}
 
-	// Start reading in goroutine
-	go f.readData()
+// pulseResetLines drops DTR and RTS of an open port for 100 ms
+func pulseResetLines(port serial.Port) error {
+	if err := port.SetDTR(false); err != nil {
+		return fmt.Errorf("failed to clear DTR: %v", err)
+	}
+	if err := port.SetRTS(false); err != nil {
+		return fmt.Errorf("failed to clear RTS: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := port.SetDTR(true); err != nil {
+		return fmt.Errorf("failed to set DTR: %v", err)
+	}
+	if err := port.SetRTS(true); err != nil {
+		return fmt.Errorf("failed to set RTS: %v", err)
+	}
+	return nil
+}
 
-	// Initial connection attempts
-	fmt.Println("Attempting to connect...")
-	f.port.Write(f.sendConnect)
-	time.Sleep(200 * time.Millisecond)
-	
-	if f.flgConnect {
-		f.sendcnt = 0
-		f.port.Write(f.sendConnect)
-		time.Sleep(200 * time.Millisecond)
+// runDryRun goes through the whole flash protocol against a dryRunPort, to
+// check that a firmware image loads and packs into blocks without a radio
+func runDryRun(flasher *Flasher, firmwareFile string) {
+	fmt.Printf("[DRY RUN] Firmware file: %s\n", firmwareFile)
+	if !flasher.initializeHex(firmwareFile) {
+		fmt.Println("[DRY RUN] Firmware validation: FAILED")
+		exitProgram(1)
 	}
-	
-	if f.flgConnect {
-		f.sendcnt = 0  
-		f.port.Write(f.sendConnect)
-		time.Sleep(200 * time.Millisecond)
+
+	flasher.DryRun = true
+	start := time.Now()
+	err := flasher.startUpdate("dry-run")
+	stats := flasher.Stats()
+
+	fmt.Printf("[DRY RUN] %d/%d blocks would have been sent (%d bytes) in %v\n",
+		stats.BlocksSent, flasher.totalBlocks(), stats.BytesSent, time.Since(start).Round(time.Millisecond))
+	if err != nil {
+		fmt.Printf("[DRY RUN] Firmware validation: FAILED (%v)\n", err)
+		exitProgram(1)
 	}
-	
-	if f.flgConnect {
-		f.sendcnt = 0
-		f.port.Write(f.sendConnect)
-		time.Sleep(200 * time.Millisecond)
+	fmt.Println("[DRY RUN] Firmware validation: passed")
+}
+
+func runSplitCommand(args []string) {
+	fs := flag.NewFlagSet("split", flag.ExitOnError)
+	overflow := fs.String("overflow", "", "HEX file for data outside all regions")
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s split [-overflow <file>] <input_hex> <name,start,end,output>...\n", os.Args[0])
+		fmt.Println("\nSplits a HEX file by address, end addresses are exclusive. Example:")
+		fmt.Printf("  %s split merged.hex boot,0x08000000,0x08002800,boot.hex app,0x08002800,0x08040000,app.hex\n", os.Args[0])
 	}
 
-	if f.flgConnect {
-		f.port.Close()
-		return fmt.Errorf("communication error - no response from device")
+	positional, err := parseArgs(fs, args)
+	if err != nil || len(positional) < 2 {
+		fs.Usage()
+		os.Exit(1)
 	}
-	
-	fmt.Println("Device connected, starting firmware upload...")
-	
-	// Keep the connection alive
-	for f.step < 5 && f.port != nil {
-		time.Sleep(100 * time.Millisecond)
+
+	var regions []SplitRegion
+	for _, spec := range positional[1:] {
+		region, err := parseSplitRegion(spec)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		regions = append(regions, region)
 	}
 
-	return nil
+	if err := SplitIntelHex(positional[0], regions, *overflow); err != nil {
+		fmt.Printf("Split failed: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func runPackCommand(args []string) {
+	fs := flag.NewFlagSet("pack", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s pack <firmware.bin> <metadata.json> <regions.yaml> <output.rtpkg>\n", os.Args[0])
+		fmt.Println("\nBundles a firmware image with its metadata and region map, and <firmware.bin>.sig if")
+		fmt.Println("there is one. The package can be flashed like a firmware file.")
+	}
+
+	positional, err := parseArgs(fs, args)
+	if err != nil || len(positional) != 4 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if err := PackFirmware(positional[0], positional[1], positional[2], positional[3]); err != nil {
+		fmt.Printf("Pack failed: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func runUnpackCommand(args []string) {
+	fs := flag.NewFlagSet("unpack", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s unpack <package.rtpkg> <output_dir>\n", os.Args[0])
+	}
+
+	positional, err := parseArgs(fs, args)
+	if err != nil || len(positional) != 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if err := os.MkdirAll(positional[1], 0755); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := UnpackFirmware(positional[0], positional[1]); err != nil {
+		fmt.Printf("Unpack failed: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Package unpacked to %s\n", positional[1])
+}
+
+// printVersion implements the version command and -version, for bug reports
+func printVersion() {
+	fmt.Printf("rt6d-flasher %s\n", Version)
+	fmt.Printf("Commit:     %s\n", GitCommit)
+	fmt.Printf("Build date: %s\n", BuildDate)
+	fmt.Printf("Go:         %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+func runConfigCommand(args []string) {
+	if len(args) == 1 && args[0] == "example" {
+		fmt.Print(exampleConfig)
+		return
+	}
+	fmt.Printf("Usage: %s config example\n", os.Args[0])
+	fmt.Println("\nPrints a commented config file template. Save it as:")
+	fmt.Printf("  %s\n", defaultConfigPath())
+	os.Exit(1)
 }
 
 func showUsage() {
 	fmt.Printf("Usage: %s [options] <port> <firmware_file>\n", os.Args[0])
+	fmt.Printf("       %s [options] -port <port> [-port <port>...] <firmware_file>\n", os.Args[0])
+	fmt.Printf("       %s read-firmware [-hex-output] <port> <output_file>\n", os.Args[0])
+	fmt.Printf("       %s trace-replay [-strict-timing] <trace_file>\n", os.Args[0])
+	fmt.Printf("       %s list-protocols [-protocol-file <json>]\n", os.Args[0])
+	fmt.Printf("       %s list-formats\n", os.Args[0])
+	fmt.Printf("       %s -script <file> [-dry-run] [options]\n", os.Args[0])
+	fmt.Printf("       %s -sequence <file> [options] <port>\n", os.Args[0])
+	fmt.Printf("       %s edit-sequence [-protocol-file <json>] <output.yaml>\n", os.Args[0])
+	fmt.Printf("       %s info [-json] <port>\n", os.Args[0])
+	fmt.Printf("       %s info [-json] <firmware_file>\n", os.Args[0])
+	fmt.Printf("       %s compare [-symbols <elf>] <file_a> <file_b>\n", os.Args[0])
+	fmt.Printf("       %s dump-memory-map <firmware_file>\n", os.Args[0])
+	fmt.Printf("       %s status [-baud <rate>] <port>\n", os.Args[0])
+	fmt.Printf("       %s diagnose [-baud <rate>] <port>\n", os.Args[0])
+	fmt.Printf("       %s loopback-test [-baud <rate>] [-iterations <n>] <port>\n", os.Args[0])
+	fmt.Printf("       %s hardware-test [-baud <rate>] <port>\n", os.Args[0])
+	fmt.Printf("       %s benchmark-port [-duration <duration>] <port>\n", os.Args[0])
+	fmt.Printf("       %s stats-report <stats_file>\n", os.Args[0])
+	fmt.Printf("       %s version (or -version)\n", os.Args[0])
+	fmt.Printf("       %s split [-overflow <file>] <input_hex> <name,start,end,output>...\n", os.Args[0])
+	fmt.Printf("       %s pack <firmware.bin> <metadata.json> <regions.yaml> <output.rtpkg>\n", os.Args[0])
+	fmt.Printf("       %s unpack <package.rtpkg> <output_dir>\n", os.Args[0])
+	fmt.Printf("       %s config example\n", os.Args[0])
+	fmt.Printf("       %s -json-schema config|stats\n", os.Args[0])
 	fmt.Println("\nArguments:")
-	fmt.Println("  port          Serial port (e.g., /dev/ttyUSB0, COM3)")
+	fmt.Println("  port          Serial port (e.g., /dev/ttyUSB0, COM3), or tcp://host:port of a serial port server")
 	fmt.Println("  firmware_file Firmware file (.hex or .bin)")
 	fmt.Println("\nOptions:")
-	fmt.Println("  -iradio       Use iRadio protocol parameters (for older radio models)")
+	fmt.Println("  -iradio             Use iRadio protocol parameters (for older radio models)")
+	fmt.Println("  -protocol <name>    Radio protocol: radtel, iradio or one from -protocol-file (default radtel)")
+	fmt.Println("  -protocol-file <json> Add the protocols of a JSON file, see list-protocols")
+	fmt.Println("  -config <file>      Load defaults from a YAML config file")
+	fmt.Println("  -port <port>        Serial port, repeat to flash several radios at once")
+	fmt.Println("                      (on Linux a single CH340, CP2102 or PL2303 cable is found automatically)")
+	fmt.Println("  -firmware <file>    Firmware file, instead of the positional argument")
+	fmt.Println("  -firmware-url <url> Download the firmware (.hex, .bin or .gz of them) instead")
+	fmt.Println("  -download-timeout <duration> Limit for the firmware download (default 60s)")
+	fmt.Println("  -use-embedded       Flash the firmware built into this binary (-tags embed_firmware)")
+	fmt.Println("  -script <file>      Run flash, spi-backup, sleep and echo commands from a file")
+	fmt.Println("  -sequence <file>    Flash several images in order (e.g. bootloader, then application)")
+	fmt.Println("  -no-port-check      Open the port even if it is not listed yet, the OS reports a missing port")
+	fmt.Println("  -baud <rate>        Serial baud rate (default 115200)")
+	fmt.Println("  -retries <n>        Retries per block before aborting (default 3)")
+	fmt.Println("  -connect-attempts <n> Connect commands sent before giving up (default 4)")
+	fmt.Println("  -timeout <duration> ACK timeout per block (default 3s)")
+	fmt.Println("  -timeout-block <ms> Like -timeout, limited to 50-30000 ms")
+	fmt.Println("  -timeout-connect <ms> Wait for the answer to each connect command, 50-30000 ms (default 200)")
+	fmt.Println("  -keep-alive <ms>    Keep the bootloader alive after this long without traffic, re-enter it if it left")
+	fmt.Println("                      (no built-in protocol defines send_keep_alive, with them it only re-enters)")
+	fmt.Println("  -total-timeout <duration> Abort the transfer after this long (default 5m, 0 for none)")
+	fmt.Println("  -inter-packet-delay <ms> Pause after connect and update commands (default 50)")
+	fmt.Println("  -data-packet-delay <ms>  Pause before each firmware block (default 0)")
+	fmt.Println("  -verify             Fail if not every block was transferred")
+	fmt.Println("  -trace <file>       Write a hex trace of the serial traffic")
+	fmt.Println("  -stats-file <file>  Append a JSON line about every flash to this file")
+	fmt.Println("  -progress-file <file> Keep the transfer progress in this file as JSON, for GUIs")
+	fmt.Println("  -telemetry-file <file> Append InfluxDB line protocol of the progress to this file (- for stdout)")
+	fmt.Println("  -telemetry-udp <host:port> Send InfluxDB line protocol of the progress over UDP")
+	fmt.Println("  -packet-dump <dir>  Write every sent packet to tx_NNN.bin and the answer to rx_NNN.bin")
+	fmt.Println("  -packet-dump-hex    With -packet-dump, also write a hexdump of every packet to .hex files")
+	fmt.Println("  -log-level <level>  quiet, normal or verbose (default normal)")
+	fmt.Println("  -quiet              Only print errors and the final result (-log-level quiet)")
+	fmt.Println("  -verbose            Add per-byte output and hex dumps (-log-level verbose)")
+	fmt.Println("  -backup-first       Back up the SPI flash (calibration) before flashing")
+	fmt.Println("  -backup-path <dir>  Directory for the SPI backup (default .)")
+	fmt.Println("  -fill-byte <value>  Value for addresses not in the firmware file (default 0xFF)")
+	fmt.Println("  -hexdump-range <start_hex>:<length_hex> Print part of the loaded image before connecting")
+	fmt.Println("  -memory-map         Print a map of the used parts of the loaded image before connecting")
+	fmt.Println("  -symbols <elf>      Show the function at each block address in the packet log (-verbose)")
+	fmt.Println("  -strict-gaps        Fail if the HEX file has gaps between regions")
+	fmt.Println("  -skip-vector-check  Flash even if the image's stack pointer or reset vector look wrong")
+	fmt.Println("  -protect-region <start_hex>:<end_hex> Keep this part of the radio's flash, may be repeated")
+	fmt.Println("  -skip-protected     Write 0xFF to protected bytes that can't be read from the radio")
+	fmt.Println("  -max-firmware-bytes <n> Refuse firmware images larger than n bytes")
+	fmt.Println("  -verify-sig <keyfile> Require a matching <firmware_file>.sig (see rt6d-sign)")
+	fmt.Println("  -require-metadata   Require a <firmware_file>.meta.json metadata file")
+	fmt.Println("  -serial-number <sn> Only flash the radio reporting this serial number (see info)")
+	fmt.Println("  -strict-serial      With -serial-number, also refuse radios that don't report one")
+	fmt.Println("  -flash-size <bytes> Size of the firmware area (default 251904, 246 blocks)")
+	fmt.Println("  -block-size <bytes> Data bytes per packet, at least 128 (default from the protocol, 1024)")
+	fmt.Println("  -window-size <n>    Blocks sent before waiting for an ACK, for buffering bootloaders (default 1)")
+	fmt.Println("  -reconnect          Wait for the cable if it is unplugged during a transfer, then continue")
+	fmt.Println("  -no-rfc2217         Send raw bytes to tcp://host:port ports, without RFC 2217 serial settings")
+	fmt.Println("  -reconnect-timeout <duration> How long -reconnect waits for the cable (default 30s)")
+	fmt.Println("  -sparse             Load HEX files through a sparse address map")
+	fmt.Println("  -base-address <addr> Place the HEX file at this base, ignoring its own addresses")
+	fmt.Println("  -base-address-autodetect Pick the base so the lowest data lands at 0x08002800")
+	fmt.Println("                      (a wrong base address produces garbage firmware)")
+	fmt.Println("  -dry-run            Simulate the transfer without a radio, no port needed")
+	fmt.Println("  -no-wait            Count down 3 seconds instead of waiting for Enter, for scripts")
+	fmt.Println("  -force              Start at once, without waiting for Enter or a countdown")
+	fmt.Println("  -watch              After flashing, reflash whenever the firmware file changes")
+	fmt.Println("  -watch-auto         With -watch, reflash without asking first")
+	fmt.Println("  -auto-baud          Try 115200, 57600, 38400, 19200 and 9600 baud until the radio answers")
+	fmt.Println("\nConfig file:")
+	fmt.Printf("  %s is loaded if present and no -config is given\n", defaultConfigPath())
 	fmt.Println("\nExamples:")
 	fmt.Printf("  %s /dev/cu.wchusbserial112410 firmware.hex\n", os.Args[0])
 	fmt.Printf("  %s -iradio COM3 firmware.bin\n", os.Args[0])
+	fmt.Printf("  %s -config rt880.yaml\n", os.Args[0])
+	fmt.Printf("  %s -port COM3 -port COM4 firmware.hex\n", os.Args[0])
 	fmt.Println("\nAvailable serial ports:")
 	
 	flasher := NewFlasher(false)
-	ports := flasher.getAvailablePorts()
-	for _, port := range ports {
-		fmt.Printf("  %s\n", port)
-	}
+	printPorts(flasher.getPortsWithNames(), os.Stdout)
 }
 
 func main() {
-	// Parse command line arguments
-	useIRadio := false
-	var portName, firmwareFile string
-	
 	args := os.Args[1:] // Remove program name
 	
-	// Check for -iradio flag
-	for i, arg := range args {
-		if arg == "-iradio" {
-			useIRadio = true
-			// Remove the flag from args
-			args = append(args[:i], args[i+1:]...)
-			break
+	if len(args) > 0 && args[0] == "config" {
+		runConfigCommand(args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "pack" {
+		runPackCommand(args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "unpack" {
+		runUnpackCommand(args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "edit-sequence" {
+		runEditSequenceCommand(args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "split" {
+		runSplitCommand(args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "status" {
+		runStatusCommand(args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "loopback-test" {
+		runLoopbackTestCommand(args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "diagnose" {
+		runDiagnoseCommand(args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "hardware-test" {
+		runHardwareTestCommand(args[1:])
+		return
+	}
+	if len(args) > 0 && (args[0] == "benchmark-port" || args[0] == "benchmark") {
+		runBenchmarkCommand(args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "stats-report" {
+		runStatsReportCommand(args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "info" {
+		runInfoCommand(args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "dump-memory-map" {
+		runDumpMemoryMapCommand(args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "compare" {
+		runCompareCommand(args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "read-firmware" {
+		runReadFirmwareCommand(args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "trace-replay" {
+		runTraceReplayCommand(args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "list-protocols" {
+		runListProtocolsCommand(args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "list-formats" {
+		runListFormatsCommand(args[1:])
+		return
+	}
+	if len(args) > 0 && (args[0] == "version" || args[0] == "-version" || args[0] == "--version") {
+		printVersion()
+		return
+	}
+	
+	// Config file values become the defaults of the flags below
+	cfg, err := loadStartupConfig(args)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.Usage = showUsage
+	var portNames portList
+	fs.String("config", "", "YAML config file")
+	useIRadio := fs.Bool("iradio", false, "use iRadio protocol parameters")
+	fs.StringVar(&cfg.Protocol, "protocol", cfg.Protocol, "radio protocol")
+	fs.StringVar(&cfg.ProtocolFile, "protocol-file", cfg.ProtocolFile, "JSON file with more protocols")
+	fs.Var(&portNames, "port", "serial port, may be repeated")
+	fs.StringVar(&cfg.FirmwareFile, "firmware", cfg.FirmwareFile, "firmware file")
+	fs.StringVar(&cfg.FirmwareURL, "firmware-url", cfg.FirmwareURL, "download the firmware from this URL")
+	fs.DurationVar(&cfg.DownloadTimeout, "download-timeout", cfg.DownloadTimeout, "limit for the firmware download")
+	useEmbedded := fs.Bool("use-embedded", false, "flash the firmware built into this binary")
+	scriptFile := fs.String("script", "", "run the commands of a script file")
+	sequenceFile := fs.String("sequence", "", "flash the steps of a sequence file in order")
+	fs.IntVar(&cfg.BaudRate, "baud", cfg.BaudRate, "serial baud rate")
+	fs.IntVar(&cfg.MaxRetries, "retries", cfg.MaxRetries, "retries per block")
+	fs.IntVar(&cfg.ConnectAttempts, "connect-attempts", cfg.ConnectAttempts, "connect commands sent before giving up")
+	fs.DurationVar(&cfg.PacketTimeout, "timeout", cfg.PacketTimeout, "ACK timeout per block")
+	fs.Func("timeout-block", "ACK timeout per block in ms, 50-30000", func(value string) error {
+		if err := parseDelay(value, &cfg.PacketTimeout); err != nil {
+			return err
+		}
+		cfg.PacketTimeout = clampTimeout("-timeout-block", cfg.PacketTimeout)
+		return nil
+	})
+	fs.Func("keep-alive", "keep the bootloader alive after this many ms without traffic (no built-in protocol defines send_keep_alive, with them it only re-enters the bootloader)", func(value string) error {
+		return parseDelay(value, &cfg.KeepAlive)
+	})
+	fs.Func("timeout-connect", "wait for the answer to each connect command in ms, 50-30000", func(value string) error {
+		return parseDelay(value, &cfg.ConnectTimeout)
+	})
+	fs.DurationVar(&cfg.TotalTimeout, "total-timeout", cfg.TotalTimeout, "limit for the whole transfer")
+	fs.Func("inter-packet-delay", "pause after connect and update commands", func(value string) error {
+		return parseDelay(value, &cfg.InterPacketDelay)
+	})
+	fs.Func("data-packet-delay", "pause before each firmware block", func(value string) error {
+		return parseDelay(value, &cfg.DataPacketDelay)
+	})
+	fs.BoolVar(&cfg.VerifyAfterFlash, "verify", cfg.VerifyAfterFlash, "verify all blocks were transferred")
+	fs.StringVar(&cfg.TraceFile, "trace", cfg.TraceFile, "serial trace file")
+	packetDump := fs.String("packet-dump", "", "write every packet to a numbered file in this directory")
+	packetDumpHex := fs.Bool("packet-dump-hex", false, "with -packet-dump, also write a hexdump of every packet")
+	fs.StringVar(&cfg.StatsFile, "stats-file", cfg.StatsFile, "append a JSON line about every flash to this file")
+	fs.StringVar(&cfg.ProgressFile, "progress-file", cfg.ProgressFile, "rewrite this file with the JSON progress after every block")
+	fs.StringVar(&cfg.TelemetryFile, "telemetry-file", cfg.TelemetryFile, "append InfluxDB line protocol telemetry to this file, - for stdout")
+	fs.StringVar(&cfg.TelemetryUDP, "telemetry-udp", cfg.TelemetryUDP, "send InfluxDB line protocol telemetry to this host:port")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "log level")
+	fs.BoolFunc("quiet", "only print errors and the final result", func(string) error {
+		cfg.LogLevel = "quiet"
+		return nil
+	})
+	fs.BoolFunc("verbose", "add per-byte output and hex dumps", func(string) error {
+		cfg.LogLevel = "verbose"
+		return nil
+	})
+	backupFirst := fs.Bool("backup-first", false, "back up the SPI flash before flashing")
+	backupPath := fs.String("backup-path", ".", "directory for the SPI backup")
+	symbolsFile := fs.String("symbols", "", "ELF file of the firmware, to show function names in the packet log")
+	memoryMap := fs.Bool("memory-map", false, "print a map of the used parts of the loaded image")
+	serialNumber := fs.String("serial-number", "", "only flash the radio reporting this serial number")
+	strictSerial := fs.Bool("strict-serial", false, "with -serial-number, refuse radios that don't report one")
+	var hexdumpStart, hexdumpLength int
+	fs.Func("hexdump-range", "print <start_hex>:<length_hex> of the loaded image", func(value string) (err error) {
+		hexdumpStart, hexdumpLength, err = parseHexdumpRange(value)
+		return err
+	})
+	fs.Func("fill-byte", "value for addresses not in the firmware file", func(value string) error {
+		v, err := strconv.ParseUint(value, 0, 8)
+		if err != nil {
+			return fmt.Errorf("invalid byte value '%s'", value)
+		}
+		cfg.FillByte = byte(v)
+		return nil
+	})
+	fs.BoolVar(&cfg.StrictGaps, "strict-gaps", cfg.StrictGaps, "fail if the firmware has gaps between regions")
+	fs.BoolVar(&cfg.SkipVectorCheck, "skip-vector-check", cfg.SkipVectorCheck, "don't check the vector table of the image")
+	fs.IntVar(&cfg.MaxFirmwareBytes, "max-firmware-bytes", cfg.MaxFirmwareBytes, "largest accepted firmware image")
+	fs.StringVar(&cfg.VerifySigKeyFile, "verify-sig", cfg.VerifySigKeyFile, "HMAC key file to verify <firmware>.sig")
+	fs.BoolVar(&cfg.RequireMetadata, "require-metadata", cfg.RequireMetadata, "require a <firmware>.meta.json file")
+	fs.IntVar(&cfg.FlashSize, "flash-size", cfg.FlashSize, "size of the firmware area in bytes")
+	fs.IntVar(&cfg.BlockSize, "block-size", cfg.BlockSize, "data bytes per packet, 0 for the protocol's")
+	fs.IntVar(&cfg.WindowSize, "window-size", cfg.WindowSize, "blocks sent before waiting for an ACK")
+	fs.BoolVar(&cfg.Reconnect, "reconnect", cfg.Reconnect, "wait for the cable if it is unplugged during a transfer")
+	fs.BoolVar(&cfg.NoRFC2217, "no-rfc2217", cfg.NoRFC2217, "send raw bytes to tcp:// ports, without RFC 2217 serial settings")
+	fs.DurationVar(&cfg.ReconnectTimeout, "reconnect-timeout", cfg.ReconnectTimeout, "how long -reconnect waits for the cable")
+	fs.Func("protect-region", "keep <start_hex>:<end_hex> of the radio's flash, may be repeated", func(value string) error {
+		region, err := parseMemoryRegion(value)
+		if err != nil {
+			return err
+		}
+		cfg.ProtectRegions = append(cfg.ProtectRegions, region)
+		return nil
+	})
+	fs.BoolVar(&cfg.SkipProtected, "skip-protected", cfg.SkipProtected, "write 0xFF to protected bytes that can't be read")
+	fs.BoolVar(&cfg.Sparse, "sparse", cfg.Sparse, "load HEX files through a sparse address map")
+	fs.Func("base-address", "base address replacing the HEX file's extended addresses", func(value string) error {
+		v, err := strconv.ParseUint(value, 0, 32)
+		if err != nil {
+			return fmt.Errorf("invalid address '%s'", value)
 		}
+		base := uint32(v)
+		cfg.BaseAddress = &base
+		return nil
+	})
+	fs.BoolVar(&cfg.BaseAutodetect, "base-address-autodetect", cfg.BaseAutodetect, "detect the HEX file's base address")
+	fs.BoolVar(&cfg.AutoBaud, "auto-baud", cfg.AutoBaud, "probe the bootloader baud rate")
+	dryRun := fs.Bool("dry-run", false, "simulate the transfer without a radio")
+	noPortCheck := fs.Bool("no-port-check", false, "open the port even if it is not in the port list")
+	watch := fs.Bool("watch", false, "reflash whenever the firmware file changes")
+	fs.BoolVar(&noWaitStart, "no-wait", false, "count down 3 seconds instead of waiting for Enter")
+	fs.BoolVar(&forceStart, "force", false, "start at once, without waiting for Enter or a countdown")
+	watchAuto := fs.Bool("watch-auto", false, "with -watch, reflash without asking")
+	jsonSchema := fs.String("json-schema", "", "print the JSON schema of the config or stats file and exit")
+	
+	positional, err := parseArgs(fs, args)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		os.Exit(1)
+	}
+	
+	switch *jsonSchema {
+	case "":
+	case "config":
+		fmt.Println(GenerateConfigSchema())
+		return
+	case "stats":
+		fmt.Println(GenerateStatsSchema())
+		return
+	default:
+		fmt.Printf("Error: Unknown schema '%s' (use config or stats)\n", *jsonSchema)
+		os.Exit(1)
+	}
+	
+	logLevel, err = parseLogLevel(cfg.LogLevel)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	
+	if *useEmbedded && cfg.FirmwareURL != "" {
+		fmt.Println("Error: -use-embedded can't be used with -firmware-url")
+		os.Exit(1)
 	}
 	
-	// Check remaining arguments
-	if len(args) != 2 {
+	// Positional arguments override the port and firmware file
+	switch len(positional) {
+	case 0:
+	case 1:
+		if cfg.FirmwareURL != "" || *useEmbedded || *sequenceFile != "" {
+			// The firmware comes from the URL, the binary or the sequence, so the argument is the port
+			portNames = append(portNames, positional[0])
+		} else {
+			cfg.FirmwareFile = positional[0]
+		}
+	case 2:
+		if cfg.FirmwareURL != "" {
+			fmt.Println("Error: give either a firmware file or -firmware-url")
+			os.Exit(1)
+		}
+		if *useEmbedded {
+			fmt.Println("Error: give either a firmware file or -use-embedded")
+			os.Exit(1)
+		}
+		if *sequenceFile != "" {
+			fmt.Println("Error: the firmware files of -sequence are listed in the sequence file")
+			os.Exit(1)
+		}
+		portNames = append(portNames, positional[0])
+		cfg.FirmwareFile = positional[1]
+	default:
 		showUsage()
 		os.Exit(1)
 	}
+	if len(portNames) == 0 && cfg.Port != "" {
+		portNames = portList{cfg.Port}
+	}
+	if *dryRun && len(portNames) == 0 {
+		portNames = portList{"dry-run"}
+	}
+	
+	if *useIRadio {
+		cfg.Protocol = "iradio"
+	}
+	if cfg.ProtocolFile != "" {
+		if err := loadProtocolFile(cfg.ProtocolFile); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	protocol, ok := findProtocol(cfg.Protocol)
+	if !ok {
+		fmt.Printf("Error: Unknown protocol '%s' (use %s)\n", cfg.Protocol, protocolNames())
+		os.Exit(1)
+	}
+	blockSize := cfg.BlockSize
+	if blockSize == 0 {
+		blockSize = protocol.BlockSize
+	}
+	if blockSize < 128 {
+		fmt.Printf("Error: block size must be at least 128 bytes, got %d\n", blockSize)
+		os.Exit(1)
+	}
+	if cfg.FlashSize <= 0 || cfg.FlashSize%blockSize != 0 {
+		fmt.Printf("Error: flash size must be a positive multiple of the %d byte block size, got %d\n", blockSize, cfg.FlashSize)
+		os.Exit(1)
+	}
+	if cfg.WindowSize < 1 {
+		fmt.Printf("Error: window size must be at least 1, got %d\n", cfg.WindowSize)
+		os.Exit(1)
+	}
+	if cfg.ConnectAttempts < 1 {
+		fmt.Printf("Error: connect attempts must be at least 1, got %d\n", cfg.ConnectAttempts)
+		os.Exit(1)
+	}
+	cfg.ConnectTimeout = clampTimeout("connect timeout", cfg.ConnectTimeout)
+	if cfg.KeepAlive < 0 {
+		fmt.Printf("Error: keep-alive interval must not be negative, got %v\n", cfg.KeepAlive)
+		os.Exit(1)
+	}
+	if cfg.KeepAlive > 0 && len(protocol.SendKeepAlive) == 0 {
+		fmt.Fprintf(os.Stderr, "Warning: protocol %s has no keep-alive command, -keep-alive only re-enters the bootloader when the radio leaves it\n", protocol.Name)
+	}
+	for _, r := range cfg.ProtectRegions {
+		if r.StartOffset < 0 || r.EndOffset <= r.StartOffset || r.EndOffset > cfg.FlashSize {
+			fmt.Printf("Error: protected region 0x%X-0x%X is not inside the 0x%X byte flash\n", r.StartOffset, r.EndOffset, cfg.FlashSize)
+			os.Exit(1)
+		}
+	}
+	if cfg.Reconnect && cfg.ReconnectTimeout <= 0 {
+		fmt.Printf("Error: reconnect timeout must be positive, got %v\n", cfg.ReconnectTimeout)
+		os.Exit(1)
+	}
+	telemetrySink, err = openTelemetrySink(cfg.TelemetryFile, cfg.TelemetryUDP)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
 	
-	portName = args[0]
-	firmwareFile = args[1]
+	if *scriptFile != "" {
+		var backend spilib.ScriptBackend = flasherScriptBackend{cfg: cfg}
+		if *dryRun {
+			backend = spilib.DryRunScriptBackend{}
+		}
+		handleSignals()
+		if err := spilib.RunScript(*scriptFile, backend); err != nil {
+			fmt.Printf("Script failed at %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 	
-	// Verify port exists
-	flasher := NewFlasher(useIRadio)
-	ports := flasher.getAvailablePorts()
-	portFound := false
-	for _, port := range ports {
-		if port == portName {
-			portFound = true
-			break
+	var sequence *FlashSequence
+	if *sequenceFile != "" {
+		if cfg.FirmwareURL != "" || *useEmbedded || *watch {
+			fmt.Println("Error: -sequence can't be used with -firmware-url, -use-embedded or -watch")
+			os.Exit(1)
+		}
+		sequence, err = LoadFlashSequence(*sequenceFile)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
 		}
+		sequence.Defaults = cfg
+		sequence.DryRun = *dryRun
 	}
 	
-	if !portFound {
-		fmt.Printf("Error: Port '%s' not found\n\n", portName)
+	if cfg.FirmwareFile == "" && cfg.FirmwareURL == "" && !*useEmbedded && sequence == nil {
 		showUsage()
 		os.Exit(1)
 	}
+	if len(portNames) == 0 {
+		portName, err := FindRadioPort()
+		if err != nil {
+			fmt.Printf("Error: %v\n\n", err)
+			showUsage()
+			os.Exit(1)
+		}
+		logf(LogNormal, "Found programming cable on %s\n", portName)
+		portNames = portList{portName}
+	}
+	
+	// Verify ports exist
+	flasher := newConfiguredFlasher(cfg)
+	flasher.HexdumpStart, flasher.HexdumpLength = hexdumpStart, hexdumpLength
+	flasher.MemoryMap = *memoryMap
+	flasher.SerialNumber, flasher.StrictSerial = *serialNumber, *strictSerial
+	if *symbolsFile != "" {
+		if err := flasher.LoadSymbolMap(*symbolsFile); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *noPortCheck && !*dryRun {
+		fmt.Fprintln(os.Stderr, "Warning: skipping port validation")
+	}
+	for _, portName := range portNames {
+		if isTCPPort(portName) && (*backupFirst || cfg.AutoBaud || cfg.Reconnect) {
+			fmt.Println("Error: -backup-first, -auto-baud and -reconnect need a local port, not a tcp:// port")
+			os.Exit(1)
+		}
+	}
+	ports := flasher.getAvailablePorts()
+	for _, portName := range portNames {
+		if *dryRun || *noPortCheck {
+			break
+		}
+		if isTCPPort(portName) {
+			if _, _, err := parseTCPPort(portName); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			continue
+		}
+		if err := validatePort(portName, ports); err != nil {
+			fmt.Printf("Error: %v\n\n", err)
+			showUsage()
+			os.Exit(1)
+		}
+	}
+	
+	if sequence != nil {
+		if len(portNames) > 1 {
+			fmt.Println("Error: -sequence flashes a single radio, give one port")
+			os.Exit(1)
+		}
+		if *packetDump != "" {
+			fmt.Println("Error: -packet-dump can't be used with -sequence")
+			os.Exit(1)
+		}
+		handleSignals()
+		if !*dryRun {
+			printFlashInstructions()
+		}
+		if err := runFlashSequence(sequence, portNames[0]); err != nil {
+			fmt.Printf("Sequence failed: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("\nAll %d steps completed successfully!\n", len(sequence.Steps))
+		return
+	}
+	
+	if cfg.FirmwareURL != "" {
+		if *watch {
+			fmt.Println("Error: -watch can't be used with -firmware-url")
+			exitProgram(1)
+		}
+		dest, err := downloadedFirmwarePath(cfg.FirmwareURL)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			exitProgram(1)
+		}
+		tempFirmwareDir = filepath.Dir(dest)
+		defer os.RemoveAll(tempFirmwareDir)
+		if err := downloadFirmware(cfg.FirmwareURL, dest, cfg.DownloadTimeout); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			exitProgram(1)
+		}
+		cfg.FirmwareFile = dest
+	}
+	if *useEmbedded {
+		if *watch {
+			fmt.Println("Error: -watch can't be used with -use-embedded")
+			exitProgram(1)
+		}
+		dest, err := writeEmbeddedFirmware()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			exitProgram(1)
+		}
+		tempFirmwareDir = filepath.Dir(dest)
+		defer os.RemoveAll(tempFirmwareDir)
+		cfg.FirmwareFile = dest
+	}
+	firmwareFile := cfg.FirmwareFile
+	
+	handleSignals()
+	
+	if *packetDump != "" {
+		if len(portNames) > 1 {
+			fmt.Println("Error: -packet-dump can only be used with a single port")
+			exitProgram(1)
+		}
+		flasher.packetDump, err = newPacketDumper(*packetDump, *packetDumpHex)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			exitProgram(1)
+		}
+	} else if *packetDumpHex {
+		fmt.Println("Error: -packet-dump-hex needs -packet-dump")
+		exitProgram(1)
+	}
+	if *strictSerial && *serialNumber == "" {
+		fmt.Println("Error: -strict-serial needs -serial-number")
+		exitProgram(1)
+	}
+	
+	if *dryRun {
+		if *backupFirst || len(portNames) > 1 {
+			fmt.Println("Error: -dry-run can't be combined with -backup-first or several ports")
+			exitProgram(1)
+		}
+		runDryRun(flasher, firmwareFile)
+		return
+	}
+	
+	if len(portNames) > 1 {
+		if *watch {
+			fmt.Println("Error: -watch can only be used with a single port")
+			exitProgram(1)
+		}
+		if *backupFirst {
+			fmt.Println("Error: -backup-first can only be used with a single port")
+			exitProgram(1)
+		}
+		if *serialNumber != "" {
+			fmt.Println("Error: -serial-number can only be used with a single port")
+			exitProgram(1)
+		}
+		flashManyFromCLI(portNames, cfg)
+		return
+	}
+	portName := portNames[0]
 	
-	// Load firmware
+	// Load firmware, -watch compares later versions with this one
+	loaded, _ := os.Stat(firmwareFile)
 	if !flasher.initializeHex(firmwareFile) {
-		os.Exit(1)
+		exitProgram(1)
 	}
 
-	fmt.Printf("Selected port: %s\n", portName)
-	fmt.Printf("Firmware file: %s\n", firmwareFile)
+	if cfg.TraceFile != "" {
+		traceFile, err := os.Create(cfg.TraceFile)
+		if err != nil {
+			fmt.Printf("Error: failed to create trace file: %v\n", err)
+			exitProgram(1)
+		}
+		defer traceFile.Close()
+		flasher.trace = traceFile
+	}
 
-	fmt.Println("\nInstructions:")
-	fmt.Println("1. Connect the data cable to the radio")
-	fmt.Println("2. Turn OFF the radio completely")
-	fmt.Println("3. Press and HOLD the PTT key")
-	fmt.Println("4. While holding PTT, turn ON the radio")
-	fmt.Println("5. Keep holding PTT for 2-3 seconds after power on")
-	fmt.Println("6. Release PTT - radio should be in programming mode")
-	fmt.Println("7. Press Enter to start upgrade...")
-	
-	reader := bufio.NewReader(os.Stdin)
-	reader.ReadString('\n')
+	logf(LogNormal, "Selected port: %s\n", portName)
+	logf(LogNormal, "Firmware file: %s\n", firmwareFile)
+
+	if *backupFirst {
+		flasher.BackupBeforeFlash = true
+		flasher.BackupPath = *backupPath
+		fmt.Println("\nInstructions for the SPI backup:")
+		fmt.Println("1. Connect the data cable to the radio")
+		fmt.Println("2. Turn ON the radio normally (no special procedure needed)")
+		fmt.Println("3. Press Enter to start the backup...")
+		spilib.WaitForStart(noWaitStart, forceStart)
+	} else {
+		printFlashInstructions()
+	}
 
-	err := flasher.startUpdate(portName)
+	err = flasher.startUpdate(portName)
+	if err != nil && !*watch {
+		log.Print(err)
+		exitProgram(1)
+	}
 	if err != nil {
-		log.Fatal(err)
+		fmt.Printf("Flash failed: %v\n", err)
+	} else {
+		fmt.Println("Update completed successfully!")
 	}
 
-	fmt.Println("Update completed successfully!")
-}
\ No newline at end of file
+	if *watch {
+		// The SPI backup is only needed before the first flash
+		flasher.BackupBeforeFlash = false
+		watchAndReflash(flasher, portName, firmwareFile, *watchAuto, loaded)
+	}
+}
@@ -0,0 +1,2724 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"go.bug.st/serial"
+)
+
+// The root directory holds one program per file, so the tests of
+// rt6d-flasher are run with its source file:
+//
+//	go test main.go main_test.go
+
+var updateGolden = flag.Bool("update-golden", false, "rewrite the golden files in testdata")
+
+// checkGolden compares got with testdata/<name>, or writes it there with
+// -update-golden
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run with -update-golden to create it)", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output differs from %s:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+func TestMain(m *testing.M) {
+	// Only errors, the flasher reports every block at the normal level
+	logLevel = LogQuiet
+	os.Exit(m.Run())
+}
+
+// testPort is a scripted radio. Every write is recorded and answered with
+// the bytes returned by answer, an ACK for everything when answer is nil.
+type testPort struct {
+	mu          sync.Mutex
+	answer      func(packet []byte) []byte
+	written     [][]byte
+	pending     []byte
+	closed      bool
+	readTimeout time.Duration
+	onClose     func()        // Called by the first Close
+	latency     time.Duration // Delay before an answer can be read
+}
+
+func newTestPort(answer func(packet []byte) []byte) *testPort {
+	return &testPort{answer: answer, readTimeout: 10 * time.Millisecond}
+}
+
+// ackAll answers every packet with an ACK, like a bootloader accepting it
+func ackAll(packet []byte) []byte { return []byte{6} }
+
+func (p *testPort) Write(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return 0, fmt.Errorf("port closed")
+	}
+	p.written = append(p.written, append([]byte(nil), data...))
+	answer := p.answer
+	if answer == nil {
+		answer = ackAll
+	}
+	reply := answer(data)
+	if p.latency > 0 {
+		time.AfterFunc(p.latency, func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			p.pending = append(p.pending, reply...)
+		})
+		return len(data), nil
+	}
+	p.pending = append(p.pending, reply...)
+	return len(data), nil
+}
+
+func (p *testPort) Read(buffer []byte) (int, error) {
+	deadline := time.Now().Add(p.timeout())
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return 0, fmt.Errorf("port closed")
+		}
+		if len(p.pending) > 0 {
+			n := copy(buffer, p.pending)
+			p.pending = p.pending[n:]
+			p.mu.Unlock()
+			return n, nil
+		}
+		p.mu.Unlock()
+
+		if p.timeout() >= 0 && time.Now().After(deadline) {
+			return 0, nil
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (p *testPort) timeout() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.readTimeout
+}
+
+// packets returns a copy of the packets written so far
+func (p *testPort) packets() [][]byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([][]byte(nil), p.written...)
+}
+
+// wrote reports whether one of the written packets equals data
+func (p *testPort) wrote(data []byte) bool {
+	for _, packet := range p.packets() {
+		if bytes.Equal(packet, data) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *testPort) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.closed && p.onClose != nil {
+		p.onClose()
+	}
+	p.closed = true
+	return nil
+}
+
+func (p *testPort) SetReadTimeout(t time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.readTimeout = t
+	return nil
+}
+
+func (p *testPort) ResetInputBuffer() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending = nil
+	return nil
+}
+
+func (p *testPort) SetMode(mode *serial.Mode) error { return nil }
+func (p *testPort) Drain() error                    { return nil }
+func (p *testPort) ResetOutputBuffer() error        { return nil }
+func (p *testPort) Break(d time.Duration) error     { return nil }
+func (p *testPort) SetDTR(dtr bool) error           { return nil }
+func (p *testPort) SetRTS(rts bool) error           { return nil }
+
+func (p *testPort) GetModemStatusBits() (*serial.ModemStatusBits, error) {
+	return &serial.ModemStatusBits{}, nil
+}
+
+// testImage returns a firmware image of size bytes with a valid Cortex-M
+// vector table and a different value in every block
+func testImage(size int) []byte {
+	image := make([]byte, size)
+	for i := range image {
+		image[i] = byte(i/1024 + i)
+	}
+	binary.LittleEndian.PutUint32(image[0:], 0x20003FF0)
+	binary.LittleEndian.PutUint32(image[4:], 0x08002801)
+	return image
+}
+
+// writeTestFirmware saves testImage(size) as a .bin file in a temp dir
+func writeTestFirmware(t *testing.T, size int) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "firmware.bin")
+	if err := os.WriteFile(path, testImage(size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// testConfig is the default config for a small image without the delays
+// meant for real radios
+func testConfig(flashSize int) *Config {
+	cfg := defaultConfig()
+	cfg.FlashSize = flashSize
+	cfg.InterPacketDelay = 0
+	cfg.ConnectTimeout = 50 * time.Millisecond
+	cfg.TotalTimeout = 10 * time.Second
+	cfg.LogLevel = "quiet"
+	return cfg
+}
+
+// dataPackets returns the firmware blocks among the written packets
+func dataPackets(packets [][]byte, blockSize int) [][]byte {
+	var blocks [][]byte
+	for _, packet := range packets {
+		if len(packet) == blockSize+4 && packet[0] == 0x57 {
+			blocks = append(blocks, packet)
+		}
+	}
+	return blocks
+}
+
+func TestFlashMany(t *testing.T) {
+	const flashSize = 8 * 1024
+	firmware := writeTestFirmware(t, flashSize)
+	cfg := testConfig(flashSize)
+	cfg.TraceFile = filepath.Join(t.TempDir(), "trace.txt")
+
+	ports := []*testPort{newTestPort(nil), newTestPort(nil), newTestPort(nil)}
+	jobs := []FlashJob{
+		{JobID: "first", PortName: "COM3", FirmwareFile: firmware, Config: cfg, port: ports[0]},
+		{PortName: "/dev/ttyUSB1", FirmwareFile: firmware, Config: cfg, port: ports[1]},
+		{JobID: "third", PortName: "COM5", FirmwareFile: firmware, Config: cfg, port: ports[2]},
+	}
+
+	results := FlashMany(jobs, 2)
+
+	wantIDs := []string{"first", "/dev/ttyUSB1", "third"}
+	if len(results) != len(jobs) {
+		t.Fatalf("got %d results for %d jobs", len(results), len(jobs))
+	}
+	for i, result := range results {
+		if result.JobID != wantIDs[i] {
+			t.Errorf("result %d: JobID %q, want %q", i, result.JobID, wantIDs[i])
+		}
+		if result.Error != nil {
+			t.Errorf("%s: %v", result.JobID, result.Error)
+		}
+		if result.TransferStats.BlocksSent != flashSize/1024 {
+			t.Errorf("%s: %d blocks sent, want %d", result.JobID, result.TransferStats.BlocksSent, flashSize/1024)
+		}
+		if result.Duration <= 0 {
+			t.Errorf("%s: duration %v", result.JobID, result.Duration)
+		}
+		if blocks := dataPackets(ports[i].packets(), 1024); len(blocks) != flashSize/1024 {
+			t.Errorf("%s: port %d got %d blocks, want %d", result.JobID, i, len(blocks), flashSize/1024)
+		}
+		if !ports[i].wrote(NewFlasher(false).sendEnd) {
+			t.Errorf("%s: port %d did not get the end command", result.JobID, i)
+		}
+
+		// Every port writes its own trace
+		trace, err := os.ReadFile(jobTraceFile(cfg.TraceFile, jobs[i].PortName))
+		if err != nil {
+			t.Errorf("%s: %v", result.JobID, err)
+		} else if !bytes.Contains(trace, []byte(" TX ")) {
+			t.Errorf("%s: trace has no TX lines", result.JobID)
+		}
+	}
+}
+
+func TestJobTraceFile(t *testing.T) {
+	tests := []struct{ trace, port, want string }{
+		{"trace.txt", "COM3", "trace-COM3.txt"},
+		{"logs/trace.txt", "/dev/ttyUSB0", "logs/trace-dev_ttyUSB0.txt"},
+		{"trace", "tcp://pi:4000", "trace-tcp___pi_4000"},
+	}
+	for _, tt := range tests {
+		if got := jobTraceFile(tt.trace, tt.port); got != tt.want {
+			t.Errorf("jobTraceFile(%q, %q) = %q, want %q", tt.trace, tt.port, got, tt.want)
+		}
+	}
+}
+
+// ackHandshake ACKs the connect and update commands but no data block, so
+// the transfer hangs at the first block
+func ackHandshake(packet []byte) []byte {
+	if len(packet) > 100 {
+		return nil
+	}
+	return []byte{6}
+}
+
+func TestSignalClosesPort(t *testing.T) {
+	if os.Getenv("RT6D_SIGNAL_TEST") == "child" {
+		signalTestChild()
+		return
+	}
+	if runtime.GOOS == "windows" {
+		t.Skip("SIGINT can't be sent to a process on Windows")
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSignalClosesPort$")
+	cmd.Env = append(os.Environ(), "RT6D_SIGNAL_TEST=child")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// Don't hang if the signal is not handled
+	kill := time.AfterFunc(10*time.Second, func() { cmd.Process.Kill() })
+	defer kill.Stop()
+	lines := bufio.NewScanner(stdout)
+	waitFor := func(text string) bool {
+		for lines.Scan() {
+			if lines.Text() == text {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !waitFor("transferring") {
+		t.Fatal("the flash did not start")
+	}
+	sent := time.Now()
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor("port closed") {
+		t.Fatal("the port was not closed")
+	}
+	if elapsed := time.Since(sent); elapsed > 500*time.Millisecond {
+		t.Errorf("port closed %v after SIGINT, want at most 500ms", elapsed)
+	}
+	waitFor("")
+	if err := cmd.Wait(); cmd.ProcessState.ExitCode() != 130 {
+		t.Errorf("exit code %d (%v), want 130", cmd.ProcessState.ExitCode(), err)
+	}
+}
+
+// signalTestChild starts a flash that never finishes and waits for the
+// signal handler to end the process
+func signalTestChild() {
+	port := newTestPort(ackHandshake)
+	port.onClose = func() { fmt.Println("port closed") }
+	f := NewFlasher(false, WithFlashSize(8*1024), WithInterPacketDelay(0))
+	f.hex = testImage(8 * 1024)
+	f.mockPort = port
+	f.ConnectTimeout = 50 * time.Millisecond
+	f.packetTimeout = time.Minute
+
+	handleSignals()
+	go f.startUpdate("COM3")
+	for f.State() != StateTransferring {
+		time.Sleep(time.Millisecond)
+	}
+	fmt.Println("transferring")
+	select {}
+}
+
+func TestCheckTimeoutDuringTransfer(t *testing.T) {
+	const flashSize = 32 * 1024
+	f := NewFlasher(false, WithFlashSize(flashSize), WithInterPacketDelay(0))
+	f.hex = testImage(flashSize)
+	f.mockPort = newTestPort(nil)
+	f.ConnectTimeout = 50 * time.Millisecond
+
+	// Check for timeouts and read the state from a second goroutine while
+	// readData handles the ACKs, go test -race reports unguarded fields
+	done := make(chan struct{})
+	polled := make(chan int)
+	go func() {
+		polls := 0
+		for {
+			select {
+			case <-done:
+				polled <- polls
+				return
+			default:
+			}
+			f.checkTimeout()
+			f.State()
+			f.BlocksWritten()
+			f.BytesSent()
+			f.WaitingForAck()
+			f.RetryCount()
+			f.Stats()
+			polls++
+		}
+	}()
+
+	err := f.startUpdate("COM3")
+	close(done)
+	polls := <-polled
+	if err != nil {
+		t.Fatal(err)
+	}
+	if polls == 0 {
+		t.Error("checkTimeout never ran during the transfer")
+	}
+	if got := f.Stats().BlocksSent; got != flashSize/1024 {
+		t.Errorf("%d blocks sent, want %d", got, flashSize/1024)
+	}
+	if f.RetryCount() != 0 || f.Stats().Retries != 0 {
+		t.Errorf("checkTimeout caused %d retries without a timeout", f.Stats().Retries)
+	}
+}
+
+func TestFlashSize512K(t *testing.T) {
+	const flashSize = 512 * 1024
+	port := newTestPort(nil)
+	job := FlashJob{
+		PortName:     "COM3",
+		FirmwareFile: writeTestFirmware(t, flashSize),
+		Config:       testConfig(flashSize),
+		port:         port,
+	}
+
+	result := FlashMany([]FlashJob{job}, 1)[0]
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	if result.TransferStats.BlocksSent != 512 {
+		t.Errorf("%d blocks sent, want 512", result.TransferStats.BlocksSent)
+	}
+
+	// Every block arrives once and in order, the last one included
+	image := testImage(flashSize)
+	blocks := dataPackets(port.packets(), 1024)
+	if len(blocks) != 512 {
+		t.Fatalf("port got %d blocks, want 512", len(blocks))
+	}
+	for i, block := range blocks {
+		if !bytes.Equal(block[3:1027], image[i*1024:(i+1)*1024]) {
+			t.Fatalf("block %d does not hold the image at offset %d", i, i*1024)
+		}
+	}
+}
+
+// silent answers nothing, like a radio that is off or at another baud rate
+func silent(packet []byte) []byte { return nil }
+
+func TestValidateFirmwareSize(t *testing.T) {
+	f := NewFlasher(false)
+	f.GapFillByte = 0xFF
+	f.BlockSize = 1024
+	f.hex = bytes.Repeat([]byte{0xFF}, 4*1024)
+	if err := f.validateFirmwareSize(); err == nil || !strings.Contains(err.Error(), "empty") {
+		t.Errorf("all 0xFF: got %v, want an empty firmware error", err)
+	}
+
+	// Every byte set is what a failed load leaves behind
+	for i := range f.hex {
+		f.hex[i] = byte(i % 255)
+	}
+	if err := f.validateFirmwareSize(); err == nil || !strings.Contains(err.Error(), "load probably failed") {
+		t.Errorf("no 0xFF byte: got %v, want a failed load error", err)
+	}
+
+	f.hex[len(f.hex)-1] = 0xFF
+	if err := f.validateFirmwareSize(); err != nil {
+		t.Errorf("one 0xFF byte: %v", err)
+	}
+}
+
+func TestAutoBaudStartConnect(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		answer func([]byte) []byte
+	}{
+		{"radio stops answering", silent},
+		{"radio answers", nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFlasher(false, WithFlashSize(8*1024), WithInterPacketDelay(0))
+			f.hex = testImage(8 * 1024)
+			f.ConnectTimeout = 20 * time.Millisecond
+			port := newTestPort(tt.answer)
+			f.port = port
+
+			// The state detectBaudRate leaves after its ACK
+			f.resetTransfer(1)
+			go f.readData()
+			err := f.connectWithRetry(3)
+			state := f.State()
+			f.stopReader()
+			port.Close()
+
+			if tt.answer == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if state == StateConnecting2 || state == StateError {
+					t.Errorf("state %s after the connect command was ACKed", state)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("no error without an answer to the connect command")
+			}
+			connects := 0
+			for _, packet := range port.packets() {
+				if bytes.Equal(packet, f.sendConnect) {
+					connects++
+				}
+			}
+			if connects != 3 {
+				t.Errorf("connect command sent %d times, want 3", connects)
+			}
+		})
+	}
+}
+
+func TestProtocolTransitions(t *testing.T) {
+	const invalid = ProtocolState(-1)
+	events := []ProtocolEvent{EventACK, EventNAK, EventTimeout, EventDataSent}
+	// The next state for each event, in the order of events
+	want := map[ProtocolState][4]ProtocolState{
+		StateIdle:          {invalid, invalid, invalid, invalid},
+		StateConnecting1:   {StateConnecting2, StateError, invalid, invalid},
+		StateConnecting2:   {StateConnecting3, StateError, invalid, invalid},
+		StateConnecting3:   {StateSendingUpdate, StateError, invalid, invalid},
+		StateSendingUpdate: {StateTransferring, StateError, invalid, invalid},
+		StateTransferring:  {StateTransferring, StateTransferring, StateTransferring, StateComplete},
+		StateComplete:      {invalid, invalid, invalid, invalid},
+		StateError:         {invalid, invalid, invalid, invalid},
+	}
+	if len(want) != len(protocolStateNames) {
+		t.Fatalf("table covers %d states, there are %d", len(want), len(protocolStateNames))
+	}
+	if len(events) != len(protocolEventNames) {
+		t.Fatalf("table covers %d events, there are %d", len(events), len(protocolEventNames))
+	}
+
+	for state, next := range want {
+		for i, event := range events {
+			f := &Flasher{state: state}
+			err := f.transition(event)
+			if next[i] == invalid {
+				var transitionErr *TransitionError
+				if !errors.As(err, &transitionErr) || transitionErr.State != state || transitionErr.Event != event {
+					t.Errorf("%s + %s: got %v, want a TransitionError", state, event, err)
+				}
+				if f.state != state {
+					t.Errorf("%s + %s: invalid event moved to %s", state, event, f.state)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s + %s: %v", state, event, err)
+			} else if f.state != next[i] {
+				t.Errorf("%s + %s = %s, want %s", state, event, f.state, next[i])
+			}
+		}
+	}
+}
+
+func TestTotalTimeoutSilentRadio(t *testing.T) {
+	f := NewFlasher(false, WithFlashSize(8*1024))
+	f.hex = testImage(8 * 1024)
+	f.mockPort = newTestPort(silent)
+	f.TotalTimeout = 100 * time.Millisecond
+
+	start := time.Now()
+	err := f.startUpdate("COM3")
+	elapsed := time.Since(start)
+
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("got %v, want a timeout", err)
+	}
+	if elapsed > 200*time.Millisecond {
+		t.Errorf("startUpdate returned after %v, want at most 200ms", elapsed)
+	}
+}
+
+func TestFirmwareInfoGolden(t *testing.T) {
+	info, err := firmwareInfo(filepath.Join("testdata", "info.hex"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	printFirmwareInfo(info, &out)
+	checkGolden(t, "info.golden", out.Bytes())
+}
+
+// BenchmarkFlashDataPacketDelay flashes the default 246 block image to a
+// mock port that ACKs at once, so the time is the flasher's own overhead
+// plus the data packet delay
+func BenchmarkFlashDataPacketDelay(b *testing.B) {
+	const flashSize = 251904
+	image := testImage(flashSize)
+	for _, delay := range []time.Duration{0, 10 * time.Millisecond, 50 * time.Millisecond} {
+		b.Run(delay.String(), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				f := NewFlasher(false, WithFlashSize(flashSize), WithInterPacketDelay(0), WithDataPacketDelay(delay))
+				f.hex = image
+				f.mockPort = newTestPort(nil)
+				f.ConnectTimeout = 20 * time.Millisecond
+				if err := f.startUpdate("COM3"); err != nil {
+					b.Fatal(err)
+				}
+				if blocks := f.Stats().BlocksSent; blocks != 246 {
+					b.Fatalf("%d blocks sent, want 246", blocks)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckEntryPoint(t *testing.T) {
+	for _, tt := range []struct {
+		record string
+		warn   bool
+	}{
+		{":0400000508002800C7", false},
+		{":0400000508002AC104", true}, // The reset handler, not the image start
+		{":0400000508000000EF", true},
+	} {
+		f := NewFlasher(false)
+		if err := f.loadIntelHex([]byte(tt.record + "\n:00000001FF\n")); err != nil {
+			t.Fatal(err)
+		}
+		f.LogLevel = LogNormal
+		output := captureStdout(t, f.checkEntryPoint)
+		if !f.hasEntryPoint {
+			t.Fatalf("%s: no entry point loaded", tt.record)
+		}
+		if warned := strings.Contains(output, "WARNING"); warned != tt.warn {
+			t.Errorf("%s: output %q, want a warning %v", tt.record, output, tt.warn)
+		}
+	}
+}
+
+func TestWaitForFileChangeDuringFlash(t *testing.T) {
+	firmware := writeTestFirmware(t, 1024)
+	loaded, err := os.Stat(firmware)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The build writes a new version while the old one is being flashed
+	if err := os.WriteFile(firmware, testImage(2048), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	changed := make(chan struct{})
+	go func() {
+		waitForFileChange(firmware, loaded)
+		close(changed)
+	}()
+	select {
+	case <-changed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("a change made before the watch started was missed")
+	}
+}
+
+func TestExitProgramRemovesTempFirmware(t *testing.T) {
+	if dir := os.Getenv("RT6D_EXIT_TEST_DIR"); dir != "" {
+		tempFirmwareDir = dir
+		exitProgram(1)
+	}
+
+	dir := t.TempDir()
+	tempDir := filepath.Join(dir, "rt6d-firmware-1")
+	if err := os.Mkdir(tempDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tempDir, "firmware.hex"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestExitProgramRemovesTempFirmware$")
+	cmd.Env = append(os.Environ(), "RT6D_EXIT_TEST_DIR="+tempDir)
+	cmd.Run()
+	if code := cmd.ProcessState.ExitCode(); code != 1 {
+		t.Errorf("exit code %d, want 1", code)
+	}
+	if _, err := os.Stat(tempDir); !os.IsNotExist(err) {
+		t.Errorf("temp firmware dir still exists after exitProgram (%v)", err)
+	}
+}
+
+func TestDownloadFirmware(t *testing.T) {
+	image := testImage(4096)
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(image)
+	gz.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/RT6D.bin":
+			w.Write(image)
+		case "/RT6D.bin.gz":
+			w.Write(compressed.Bytes())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	want := fmt.Sprintf("SHA-256: %x\n", sha256.Sum256(image))
+
+	for _, name := range []string{"RT6D.bin", "RT6D.bin.gz?token=1"} {
+		url := server.URL + "/" + name
+		dest, err := downloadedFirmwarePath(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(filepath.Dir(dest))
+		if filepath.Base(dest) != "RT6D.bin" {
+			t.Errorf("%s: stored as %s, want RT6D.bin", name, filepath.Base(dest))
+		}
+
+		output := captureStdout(t, func() {
+			err = downloadFirmware(url, dest, 5*time.Second)
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !strings.Contains(output, want) {
+			t.Errorf("%s: output %q does not hold %q", name, output, want)
+		}
+		content, err := os.ReadFile(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(content, image) {
+			t.Errorf("%s: the written file differs from the image", name)
+		}
+	}
+
+	err := downloadFirmware(server.URL+"/missing.bin", filepath.Join(t.TempDir(), "missing.bin"), 5*time.Second)
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("got %v, want a 404 error", err)
+	}
+}
+
+func TestTraceReplay(t *testing.T) {
+	traceFile := filepath.Join(t.TempDir(), "trace.txt")
+	trace, err := os.Create(traceFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := NewFlasher(false, WithFlashSize(8*1024), WithInterPacketDelay(0))
+	f.hex = testImage(8 * 1024)
+	f.mockPort = newTestPort(nil)
+	f.ConnectTimeout = 50 * time.Millisecond
+	f.trace = trace
+	err = f.startUpdate("COM3")
+	trace.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := replayTrace(traceFile, false); err != nil {
+		t.Errorf("replay of an unchanged trace: %v", err)
+	}
+
+	// A flasher that sends something else at the end no longer matches
+	content, err := os.ReadFile(traceFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	last := len(lines) - 1
+	for !strings.Contains(lines[last], " TX ") {
+		last--
+	}
+	lines[last] = lines[last][:len(lines[last])-2] + "00"
+	if err := os.WriteFile(traceFile, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = replayTrace(traceFile, false)
+	if err == nil || !strings.HasPrefix(err.Error(), "1 of ") {
+		t.Errorf("replay of a changed trace: got %v, want 1 differing TX packet", err)
+	}
+}
+
+func TestFlashBlockSizes(t *testing.T) {
+	const flashSize = 64 * 1024
+	var want []byte
+	for _, blockSize := range []int{256, 512, 1024} {
+		t.Run(fmt.Sprint(blockSize), func(t *testing.T) {
+			f := NewFlasher(false, WithFlashSize(flashSize), WithBlockSize(blockSize), WithInterPacketDelay(0))
+			if !f.initializeHex(filepath.Join("testdata", "info.hex")) {
+				t.Fatal("failed to load testdata/info.hex")
+			}
+			port := newTestPort(nil)
+			f.mockPort = port
+			f.ConnectTimeout = 50 * time.Millisecond
+			if err := f.startUpdate("COM3"); err != nil {
+				t.Fatal(err)
+			}
+
+			blocks := dataPackets(port.packets(), blockSize)
+			if len(blocks) != flashSize/blockSize {
+				t.Fatalf("%d blocks sent, want %d", len(blocks), flashSize/blockSize)
+			}
+			var sent []byte
+			for _, block := range blocks {
+				sent = append(sent, block[3:3+blockSize]...)
+			}
+			if want == nil {
+				want = sent
+			} else if !bytes.Equal(sent, want) {
+				t.Error("the radio receives a different image than with 256 byte blocks")
+			}
+		})
+	}
+	if !bytes.Contains(want, []byte("V1.23B")) {
+		t.Error("the sent image does not hold the HEX file's data")
+	}
+}
+
+// regQueryOutput is reg query HKLM\SYSTEM\CurrentControlSet\Enum /s /v
+// FriendlyName as printed on Windows, shortened
+const regQueryOutput = "\r\n" +
+	"HKEY_LOCAL_MACHINE\\SYSTEM\\CurrentControlSet\\Enum\\USB\\VID_1A86&PID_7523\\5&2C8E2B0&0&2\r\n" +
+	"    FriendlyName    REG_SZ    USB-SERIAL CH340 (COM3)\r\n" +
+	"\r\n" +
+	"HKEY_LOCAL_MACHINE\\SYSTEM\\CurrentControlSet\\Enum\\USB\\VID_046D&PID_C52B\\6&1A2B3C\r\n" +
+	"    FriendlyName    REG_SZ    Logitech USB Input Device\r\n" +
+	"\r\n" +
+	"HKEY_LOCAL_MACHINE\\SYSTEM\\CurrentControlSet\\Enum\\FTDIBUS\\VID_0403+PID_6001+A50285BIA\\0000\r\n" +
+	"    FriendlyName    REG_SZ    USB Serial Port (com12)\r\n" +
+	"\r\n" +
+	"End of search: 3 match(es) found.\r\n"
+
+func TestPortsWithFriendlyNames(t *testing.T) {
+	names := parseFriendlyNames(regQueryOutput)
+	if len(names) != 2 {
+		t.Errorf("got %d ports %v, want 2", len(names), names)
+	}
+
+	ports := []PortInfo{{Name: "COM3"}, {Name: "COM4"}, {Name: "COM12"}}
+	for i := range ports {
+		ports[i].Description = names[strings.ToUpper(ports[i].Name)]
+	}
+	var out bytes.Buffer
+	printPorts(ports, &out)
+	want := "  COM3  - USB-SERIAL CH340 (COM3)\n" +
+		"  COM4\n" +
+		"  COM12  - USB Serial Port (com12)\n"
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+// ioregOutput is ioreg -r -c IOUSBHostDevice -l on a Mac with a CH340
+// cable and an FTDI adapter, shortened
+const ioregOutput = `+-o USB Serial@14100000  <class IOUSBHostDevice, id 0x100001234, registered, matched, active, busy 0 (12 ms), retain 24>
+  | {
+  |   "USB Product Name" = "CH340 USB Serial"
+  |   "idProduct" = 29987
+  |   "idVendor" = 6790
+  |   "USB Vendor Name" = "wch.cn"
+  | }
+  |
+  +-o IOUSBHostInterface@0  <class IOUSBHostInterface, id 0x100001240, registered, matched, active, busy 0 (3 ms), retain 7>
+    +-o IOSerialBSDClient  <class IOSerialBSDClient, id 0x100001250, registered, matched, active, busy 0 (0 ms), retain 6>
+        {
+          "IOCalloutDevice" = "/dev/cu.wchusbserial112410"
+          "IODialinDevice" = "/dev/tty.wchusbserial112410"
+        }
+
++-o FT232R USB UART@14200000  <class IOUSBHostDevice, id 0x100001300, registered, matched, active, busy 0 (10 ms), retain 20>
+  | {
+  |   "USB Product Name" = "FT232R USB UART"
+  |   "USB Serial Number" = "A50285BI"
+  |   "idProduct" = 24577
+  |   "idVendor" = 1027
+  | }
+`
+
+func TestIORegPortNames(t *testing.T) {
+	devices := parseIORegDevices(ioregOutput)
+	if len(devices) != 2 {
+		t.Fatalf("got %d devices, want 2", len(devices))
+	}
+
+	tests := []struct {
+		port string
+		want string
+	}{
+		{"/dev/cu.wchusbserial112410", "CH340 USB Serial (1A86:7523)"},
+		{"/dev/tty.wchusbserial112410", "CH340 USB Serial (1A86:7523)"},
+		{"/dev/cu.usbserial-A50285BI", "FT232R USB UART (0403:6001)"},
+		{"/dev/cu.Bluetooth-Incoming-Port", ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if device := matchUSBDevice(devices, tt.port); device != nil {
+			got = device.description()
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestStatsFileReport(t *testing.T) {
+	const flashSize = 8 * 1024
+	statsFile := filepath.Join(t.TempDir(), "stats.jsonl")
+
+	ok := NewFlasher(false, WithFlashSize(flashSize))
+	ok.hex = testImage(flashSize)
+	ok.mockPort = newTestPort(nil)
+	ok.StatsFile = statsFile
+	if err := ok.startUpdate("COM3"); err != nil {
+		t.Fatal(err)
+	}
+
+	failed := NewFlasher(false, WithFlashSize(flashSize))
+	failed.hex = testImage(flashSize)
+	failed.mockPort = newTestPort(silent)
+	failed.StatsFile = statsFile
+	failed.TotalTimeout = 100 * time.Millisecond
+	if err := failed.startUpdate("COM4"); err == nil {
+		t.Fatal("flash to a silent radio succeeded")
+	}
+
+	records, err := loadFlashRecords(statsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2", len(records))
+	}
+	want := fmt.Sprintf("%08X", crc32.ChecksumIEEE(testImage(flashSize)))
+	for i, r := range records {
+		if r.FirmwareCRC32 != want || r.Hostname == "" || r.Timestamp.IsZero() {
+			t.Errorf("record %d: %+v", i, r)
+		}
+	}
+	if r := records[0]; r.Port != "COM3" || r.Result != "ok" || r.Blocks != flashSize/1024 || r.Error != "" {
+		t.Errorf("successful flash recorded as %+v", r)
+	}
+	if r := records[1]; r.Port != "COM4" || r.Result != "error" || r.ErrorCode != "timeout" || r.Error == "" {
+		t.Errorf("failed flash recorded as %+v", r)
+	}
+
+	var out bytes.Buffer
+	printStatsReport(records, &out)
+	for _, line := range []string{
+		"Total flashes:    2\n",
+		"Succeeded:        1 (50.0%)\n",
+		"Failed:           1\n",
+		"Most common errors:\n      1  timeout\n",
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("report has no %q:\n%s", line, out.String())
+		}
+	}
+}
+
+// handshakeBootloader answers like a bootloader that takes exactly three
+// connect commands before the update command, and NAKs any other order
+func handshakeBootloader(f *Flasher) func(packet []byte) []byte {
+	connects := 0
+	return func(packet []byte) []byte {
+		switch {
+		case bytes.Equal(packet, f.sendConnect):
+			connects++
+			if connects > 3 {
+				return []byte{0xFF}
+			}
+		case bytes.Equal(packet, f.sendUpdate):
+			if connects != 3 {
+				return []byte{0xFF}
+			}
+		}
+		return []byte{6}
+	}
+}
+
+func TestHardwareRevisionQueryCountsAsConnect(t *testing.T) {
+	const flashSize = 8 * 1024
+	f := NewFlasher(false, WithFlashSize(flashSize), WithInterPacketDelay(0))
+	f.hex = testImage(flashSize)
+	f.ConnectTimeout = 50 * time.Millisecond
+	f.Metadata = &FirmwareMetadata{MinHardwareRevision: "1.0", MaxHardwareRevision: "2.0"}
+	port := newTestPort(handshakeBootloader(f))
+	f.mockPort = port
+
+	if err := f.startUpdate("COM3"); err != nil {
+		t.Fatal(err)
+	}
+	connects := 0
+	for _, packet := range port.packets() {
+		if bytes.Equal(packet, f.sendConnect) {
+			connects++
+		}
+	}
+	if connects != 3 {
+		t.Errorf("connect command sent %d times with the query, want 3", connects)
+	}
+	if blocks := dataPackets(port.packets(), 1024); len(blocks) != flashSize/1024 {
+		t.Errorf("got %d blocks, want %d", len(blocks), flashSize/1024)
+	}
+}
+
+func TestFlashSequenceTwoSteps(t *testing.T) {
+	const flashSize = 8 * 1024
+	const delay = 300 * time.Millisecond
+	cfg := testConfig(flashSize)
+
+	// The time each port last and first got a packet
+	var mu sync.Mutex
+	var firstDone, secondStart time.Time
+	first := newTestPort(func(packet []byte) []byte {
+		mu.Lock()
+		firstDone = time.Now()
+		mu.Unlock()
+		return []byte{6}
+	})
+	second := newTestPort(func(packet []byte) []byte {
+		mu.Lock()
+		if secondStart.IsZero() {
+			secondStart = time.Now()
+		}
+		mu.Unlock()
+		return []byte{6}
+	})
+	seq := &FlashSequence{
+		Steps: []FlashStep{
+			{FirmwareFile: writeTestFirmware(t, flashSize), DelayAfterMs: int(delay / time.Millisecond), port: first},
+			{FirmwareFile: writeTestFirmware(t, flashSize), port: second},
+		},
+		Defaults: cfg,
+	}
+
+	if err := runFlashSequence(seq, "COM3"); err != nil {
+		t.Fatal(err)
+	}
+	for i, port := range []*testPort{first, second} {
+		if blocks := dataPackets(port.packets(), 1024); len(blocks) != flashSize/1024 {
+			t.Errorf("step %d sent %d blocks, want %d", i+1, len(blocks), flashSize/1024)
+		}
+		if !port.wrote(NewFlasher(false).sendEnd) {
+			t.Errorf("step %d did not send the end command", i+1)
+		}
+	}
+	if gap := secondStart.Sub(firstDone); gap < delay {
+		t.Errorf("step 2 started %v after step 1, want at least %v", gap, delay)
+	}
+}
+
+func TestPacketDumpDryRun(t *testing.T) {
+	const flashSize = 8 * 1024
+	dir := filepath.Join(t.TempDir(), "packets")
+	f := NewFlasher(false, WithFlashSize(flashSize), WithInterPacketDelay(0))
+	image := testImage(flashSize)
+	f.hex = image
+	f.DryRun = true
+	dumper, err := newPacketDumper(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.packetDump = dumper
+
+	if err := f.startUpdate("COM3"); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(name string) []byte {
+		t.Helper()
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return content
+	}
+	// Three connect commands and the update command come before the blocks
+	for i, want := range [][]byte{f.sendConnect, f.sendConnect, f.sendConnect, f.sendUpdate} {
+		if got := read(fmt.Sprintf("tx_%03d.bin", i+1)); !bytes.Equal(got, want) {
+			t.Errorf("tx_%03d.bin is % X, want % X", i+1, got, want)
+		}
+	}
+	for block := 0; block < 2; block++ {
+		name := fmt.Sprintf("tx_%03d.bin", block+5)
+		packet := read(name)
+		if len(packet) != 1024+4 {
+			t.Fatalf("%s is %d bytes, want %d", name, len(packet), 1024+4)
+		}
+		offset := block * 1024
+		if packet[0] != 0x57 || packet[1] != byte(offset>>8) || packet[2] != byte(offset) {
+			t.Errorf("%s header is % X", name, packet[:3])
+		}
+		if !bytes.Equal(packet[3:1027], image[offset:offset+1024]) {
+			t.Errorf("%s does not hold block %d", name, block)
+		}
+		if sum := f.ChecksumAlgo.Compute(packet[:1027]); packet[1027] != sum {
+			t.Errorf("%s checksum is 0x%02X, want 0x%02X", name, packet[1027], sum)
+		}
+		if rx := read(fmt.Sprintf("rx_%03d.bin", block+5)); !bytes.Equal(rx, []byte{6}) {
+			t.Errorf("rx_%03d.bin is % X, want the ACK", block+5, rx)
+		}
+		if dump := read(fmt.Sprintf("tx_%03d.hex", block+5)); string(dump) != hex.Dump(packet) {
+			t.Errorf("tx_%03d.hex is not a hexdump of the packet", block+5)
+		}
+	}
+}
+
+// blockPhase answers like answer, or with an ACK if nil, and records the
+// time from the first to the last firmware block written
+type blockPhase struct {
+	answer      func([]byte) []byte
+	first, last time.Time
+}
+
+func (b *blockPhase) record(packet []byte) []byte {
+	if len(packet) == 1024+4 && packet[0] == 0x57 {
+		if b.first.IsZero() {
+			b.first = time.Now()
+		}
+		b.last = time.Now()
+	}
+	if b.answer == nil {
+		return []byte{6}
+	}
+	return b.answer(packet)
+}
+
+// flashWithLatency flashes blocks blocks with the window size to a port
+// whose answers arrive 20 ms after each packet. It returns the time taken
+// by the blocks, without the handshake, and the port.
+func flashWithLatency(t *testing.T, blocks, window int, answer func([]byte) []byte) (time.Duration, *testPort) {
+	t.Helper()
+	f := NewFlasher(false, WithFlashSize(blocks*1024), WithInterPacketDelay(0))
+	f.hex = testImage(blocks * 1024)
+	f.ConnectTimeout = 100 * time.Millisecond
+	f.WindowSize = window
+	phase := &blockPhase{answer: answer}
+	port := newTestPort(phase.record)
+	port.latency = 20 * time.Millisecond
+	f.mockPort = port
+
+	if err := f.startUpdate("COM3"); err != nil {
+		t.Fatalf("window %d: %v", window, err)
+	}
+	return phase.last.Sub(phase.first), port
+}
+
+func TestWindowSizeThroughput(t *testing.T) {
+	const blocks = 30
+	single, _ := flashWithLatency(t, blocks, 1, nil)
+
+	// The radio only answers every third block, with three ACKs at once
+	data := 0
+	everyThird := func(packet []byte) []byte {
+		if len(packet) != 1024+4 || packet[0] != 0x57 {
+			return []byte{6}
+		}
+		data++
+		if data%3 != 0 {
+			return nil
+		}
+		return []byte{6, 6, 6}
+	}
+	windowed, port := flashWithLatency(t, blocks, 3, everyThird)
+
+	sent := dataPackets(port.packets(), 1024)
+	if len(sent) != blocks {
+		t.Fatalf("window 3 sent %d blocks, want %d", len(sent), blocks)
+	}
+	for i, packet := range sent {
+		if offset := int(packet[1])<<8 | int(packet[2]); offset != (i*1024)&0xFFFF {
+			t.Errorf("packet %d has offset 0x%04X, want block %d", i, offset, i)
+		}
+	}
+	// Ideally 3 times faster, one round trip for every 3 blocks
+	if speedup := float64(single) / float64(windowed); speedup < 2.5 {
+		t.Errorf("blocks took %v with window 3 and %v with window 1: %.1f times faster, want about 3",
+			windowed, single, speedup)
+	}
+}
+
+func TestValidateVectorTable(t *testing.T) {
+	tests := []struct {
+		stack, reset uint32
+		want         string // Start of the error, "" for a valid table
+	}{
+		{0x20003FF0, 0x08002801, ""},
+		{0x20000000, 0x08000001, ""},
+		{0x20100000, 0x0803FFFF, ""},
+		{0x1FFFFFFC, 0x08002801, "initial stack pointer 0x1FFFFFFC"},
+		{0x20100004, 0x08002801, "initial stack pointer 0x20100004"},
+		{0xFFFFFFFF, 0xFFFFFFFF, "initial stack pointer 0xFFFFFFFF"},
+		{0x20003FF0, 0x08002800, "reset vector 0x08002800"}, // No Thumb bit
+		{0x20003FF0, 0x08040001, "reset vector 0x08040001"},
+		{0x20003FF0, 0x00002801, "reset vector 0x00002801"}, // Image at the wrong offset
+	}
+	for _, tt := range tests {
+		f := NewFlasher(false)
+		f.hex = make([]byte, 1024)
+		binary.LittleEndian.PutUint32(f.hex[0:], tt.stack)
+		binary.LittleEndian.PutUint32(f.hex[4:], tt.reset)
+		err := f.validateVectorTable()
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("stack 0x%08X, reset 0x%08X: %v", tt.stack, tt.reset, err)
+		case tt.want != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.want)):
+			t.Errorf("stack 0x%08X, reset 0x%08X: got %v, want %q", tt.stack, tt.reset, err, tt.want)
+		}
+	}
+
+	f := NewFlasher(false)
+	f.hex = []byte{0xF0, 0x3F, 0x00, 0x20}
+	if err := f.validateVectorTable(); err == nil {
+		t.Error("no error for an image shorter than the vector table")
+	}
+}
+
+func TestResumeOnPortLocks(t *testing.T) {
+	const flashSize = 8 * 1024
+	f := NewFlasher(false, WithFlashSize(flashSize), WithInterPacketDelay(0))
+	f.hex = testImage(flashSize)
+	f.resetTransfer(0)
+	f.state = StateTransferring
+	f.ReconnectOnDisconnect = true
+	f.portName = "/dev/ttyUSB0"
+
+	// The cable comes back as ttyUSB1, then as ttyUSB2
+	var released []string
+	first, second := newTestPort(silent), newTestPort(silent)
+	f.resumeOnPort(first, "/dev/ttyUSB1", func() { released = append(released, "ttyUSB1") })
+	f.resumeOnPort(second, "/dev/ttyUSB2", func() { released = append(released, "ttyUSB2") })
+	if fmt.Sprint(released) != "[ttyUSB1]" {
+		t.Errorf("released %v after moving to ttyUSB2, want [ttyUSB1]", released)
+	}
+	if len(dataPackets(second.packets(), 1024)) != 1 || f.portName != "/dev/ttyUSB2" {
+		t.Error("the transfer did not resume on the new port")
+	}
+	f.releaseReconnectLock()
+	if fmt.Sprint(released) != "[ttyUSB1 ttyUSB2]" {
+		t.Errorf("released %v at the end, want [ttyUSB1 ttyUSB2]", released)
+	}
+}
+
+func TestReconnectNeedsLocalPort(t *testing.T) {
+	f := NewFlasher(false, WithFlashSize(8*1024))
+	f.hex = testImage(8 * 1024)
+	f.ReconnectOnDisconnect = true
+	err := f.startUpdate("tcp://192.0.2.1:4000")
+	if !errors.Is(err, ErrPortOpen) || !strings.Contains(err.Error(), "local port") {
+		t.Errorf("got %v, want a local port error", err)
+	}
+}
+
+func TestVersionCommand(t *testing.T) {
+	if arg := os.Getenv("RT6D_VERSION_TEST"); arg != "" {
+		os.Args = []string{"rt6d-flasher", arg}
+		main()
+		return
+	}
+	if Version == "" {
+		t.Fatal("Version is empty")
+	}
+
+	for _, arg := range []string{"version", "-version", "--version"} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestVersionCommand$")
+		cmd.Env = append(os.Environ(), "RT6D_VERSION_TEST="+arg)
+		output, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("%s: %v", arg, err)
+		}
+		if !strings.Contains(string(output), "rt6d-flasher "+Version+"\n") {
+			t.Errorf("%s printed %q", arg, output)
+		}
+	}
+}
+
+func TestDumpHexArray(t *testing.T) {
+	f := NewFlasher(false)
+	f.hex = append([]byte("RT6D flasher V1."), 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15)
+
+	var output bytes.Buffer
+	if err := f.dumpHexArray(0, 32, &output); err != nil {
+		t.Fatal(err)
+	}
+	want := "00000000  52 54 36 44 20 66 6c 61  73 68 65 72 20 56 31 2e  |RT6D flasher V1.|\n" +
+		"00000010  00 01 02 03 04 05 06 07  08 09 0a 0b 0c 0d 0e 0f  |................|\n"
+	if output.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", output.String(), want)
+	}
+
+	// A range past the end stops at the end of the image, on a short line
+	output.Reset()
+	if err := f.dumpHexArray(0x1C, 16, &output); err != nil {
+		t.Fatal(err)
+	}
+	want = "0000001c  0c 0d 0e 0f                                       |....|\n"
+	if output.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", output.String(), want)
+	}
+	if err := f.dumpHexArray(32, 16, &output); err == nil {
+		t.Error("no error for a start past the image")
+	}
+}
+
+func TestSkipProtectedWritesFF(t *testing.T) {
+	const flashSize = 8 * 1024
+	cfg := testConfig(flashSize)
+	// Part of block 1 and all of the last block, which can't be read back
+	// from the radio
+	cfg.ProtectRegions = []MemoryRegion{{StartOffset: 0x400, EndOffset: 0x408}, {StartOffset: 0x1C00, EndOffset: 0x2000}}
+	firmware := writeTestFirmware(t, flashSize)
+
+	// Without -skip-protected nothing is flashed
+	port := newTestPort(nil)
+	result := FlashMany([]FlashJob{{PortName: "COM3", FirmwareFile: firmware, Config: cfg, port: port}}, 1)[0]
+	if result.Error == nil || !strings.Contains(result.Error.Error(), "protected block 1") {
+		t.Errorf("got %v, want a protected block error", result.Error)
+	}
+	if blocks := dataPackets(port.packets(), 1024); len(blocks) != 0 {
+		t.Errorf("%d blocks sent for unreadable protected regions", len(blocks))
+	}
+
+	cfg.SkipProtected = true
+	port = newTestPort(nil)
+	result = FlashMany([]FlashJob{{PortName: "COM3", FirmwareFile: firmware, Config: cfg, port: port}}, 1)[0]
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	want := testImage(flashSize)
+	for _, r := range cfg.ProtectRegions {
+		copy(want[r.StartOffset:r.EndOffset], bytes.Repeat([]byte{0xFF}, r.EndOffset-r.StartOffset))
+	}
+	blocks := dataPackets(port.packets(), 1024)
+	if len(blocks) != flashSize/1024 {
+		t.Fatalf("%d blocks sent, want %d", len(blocks), flashSize/1024)
+	}
+	for _, block := range blocks {
+		offset := int(block[1])<<8 | int(block[2])
+		if !bytes.Equal(block[3:1027], want[offset:offset+1024]) {
+			t.Errorf("block %d: got % X..., want % X...", offset/1024, block[3:19], want[offset:offset+16])
+		}
+	}
+	if !port.wrote(NewFlasher(false).sendEnd) {
+		t.Error("end command not sent")
+	}
+}
+
+func TestLockPortRace(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	for round := 0; round < 50; round++ {
+		var wg sync.WaitGroup
+		unlocks := make([]func(), 2)
+		errs := make([]error, 2)
+		for i := range unlocks {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				unlocks[i], errs[i] = lockPort("/dev/ttyUSB0")
+			}(i)
+		}
+		wg.Wait()
+
+		winners := 0
+		for _, err := range errs {
+			if err == nil {
+				winners++
+			} else if !strings.Contains(err.Error(), "port /dev/ttyUSB0 is in use") {
+				t.Fatalf("round %d: got %v, want an in use error", round, err)
+			}
+		}
+		if winners != 1 {
+			t.Fatalf("round %d: %d goroutines got the lock, want 1", round, winners)
+		}
+		for _, unlock := range unlocks {
+			if unlock != nil {
+				unlock()
+			}
+		}
+	}
+
+	// The PID of the holder is reported once it is written
+	unlock, err := lockPort("/dev/ttyUSB0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	_, err = lockPort("/dev/ttyUSB0")
+	if want := fmt.Sprintf("port /dev/ttyUSB0 is in use by PID %d", os.Getpid()); err == nil || err.Error() != want {
+		t.Errorf("got %v, want %q", err, want)
+	}
+}
+
+// writeTestELF saves a 32-bit ARM ELF file with only a symbol table, as
+// linkers write for firmware, holding the given symbols by name
+func writeTestELF(t *testing.T, symbolsByName map[string]elf.Sym32) string {
+	t.Helper()
+	strtab := []byte{0}
+	var symbols []elf.Sym32
+	for name, sym := range symbolsByName {
+		sym.Name = uint32(len(strtab))
+		strtab = append(strtab, name+"\x00"...)
+		symbols = append(symbols, sym)
+	}
+	shstrtab := []byte("\x00.symtab\x00.strtab\x00.shstrtab\x00")
+
+	var symtab bytes.Buffer
+	binary.Write(&symtab, binary.LittleEndian, elf.Sym32{}) // Symbol 0 is always null
+	binary.Write(&symtab, binary.LittleEndian, symbols)
+
+	const headerSize = 52
+	symtabOffset := headerSize
+	strtabOffset := symtabOffset + symtab.Len()
+	shstrtabOffset := strtabOffset + len(strtab)
+	sectionsOffset := shstrtabOffset + len(shstrtab)
+
+	var file bytes.Buffer
+	header := elf.Header32{
+		Type: uint16(elf.ET_EXEC), Machine: uint16(elf.EM_ARM), Version: uint32(elf.EV_CURRENT),
+		Shoff: uint32(sectionsOffset), Ehsize: headerSize, Shentsize: 40, Shnum: 4, Shstrndx: 3,
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS32)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	binary.Write(&file, binary.LittleEndian, header)
+	file.Write(symtab.Bytes())
+	file.Write(strtab)
+	file.Write(shstrtab)
+	binary.Write(&file, binary.LittleEndian, []elf.Section32{
+		{},
+		{Name: 1, Type: uint32(elf.SHT_SYMTAB), Off: uint32(symtabOffset), Size: uint32(symtab.Len()), Link: 2, Info: 1, Entsize: 16},
+		{Name: 9, Type: uint32(elf.SHT_STRTAB), Off: uint32(strtabOffset), Size: uint32(len(strtab))},
+		{Name: 17, Type: uint32(elf.SHT_STRTAB), Off: uint32(shstrtabOffset), Size: uint32(len(shstrtab))},
+	})
+
+	path := filepath.Join(t.TempDir(), "firmware.elf")
+	if err := os.WriteFile(path, file.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSymbolMap(t *testing.T) {
+	function := elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC)
+	path := writeTestELF(t, map[string]elf.Sym32{
+		"_reset":        {Value: 0x08002801, Info: function, Shndx: uint16(elf.SHN_ABS)},
+		"_radio_init":   {Value: 0x0802F601, Info: function, Shndx: uint16(elf.SHN_ABS)},
+		"channel_table": {Value: 0x0802F700, Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_OBJECT), Shndx: uint16(elf.SHN_ABS)},
+	})
+
+	f := NewFlasher(false)
+	if got := f.describeAddress(0x0802F800); got != "0x0802F800" {
+		t.Errorf("without a symbol map got %q, want the bare address", got)
+	}
+	if err := f.LoadSymbolMap(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Symbols) != 2 {
+		t.Errorf("loaded %v, want the 2 functions only", f.Symbols)
+	}
+	for addr, want := range map[uint32]string{
+		0x08002800: "0x08002800 <_reset>",
+		0x08002C00: "0x08002C00 <_reset+0x400>",
+		0x0802F800: "0x0802F800 <_radio_init+0x200>",
+		0x08002000: "0x08002000",
+	} {
+		if got := f.describeAddress(addr); got != want {
+			t.Errorf("0x%08X: got %q, want %q", addr, got, want)
+		}
+	}
+
+	if err := f.LoadSymbolMap(filepath.Join(t.TempDir(), "missing.elf")); err == nil {
+		t.Error("no error for a missing ELF file")
+	}
+}
+
+func TestCompareFirmware(t *testing.T) {
+	// compare.hex is info.hex with 3 bytes changed, 2 in block 0 and 1 in
+	// block 2
+	diff, err := CompareFirmware(filepath.Join("testdata", "info.hex"), filepath.Join("testdata", "compare.hex"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.AddedRegions) != 0 || len(diff.RemovedRegions) != 0 {
+		t.Errorf("added %v and removed %v, want none", diff.AddedRegions, diff.RemovedRegions)
+	}
+	want := []BlockDiff{
+		{Address: 0x08002800, ChangedBytes: 2, FirstChanged: 0x0A, LastChanged: 0x16, Hamming: 1 + 8},
+		{Address: 0x08003000, ChangedBytes: 1, FirstChanged: 0x1F, LastChanged: 0x1F, Hamming: 1},
+	}
+	if fmt.Sprint(diff.ChangedBlocks) != fmt.Sprint(want) {
+		t.Errorf("changed blocks %+v, want %+v", diff.ChangedBlocks, want)
+	}
+
+	// The regions of a file missing from the other are added or removed
+	partial := filepath.Join(t.TempDir(), "partial.hex")
+	content := ":020000040800F2\n:10280000F03F00200128000852543838302056315B\n:00000001FF\n"
+	if err := os.WriteFile(partial, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	diff, err = CompareFirmware(filepath.Join("testdata", "info.hex"), partial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed := []FirmwareRegion{{Start: 0x08002810, End: 0x08002817, Size: 8}, {Start: 0x08003000, End: 0x0800301F, Size: 32},
+		{Start: 0x08010000, End: 0x0801000F, Size: 16}}
+	if len(diff.AddedRegions) != 0 || fmt.Sprint(diff.RemovedRegions) != fmt.Sprint(removed) {
+		t.Errorf("added %v and removed %v, want none and %v", diff.AddedRegions, diff.RemovedRegions, removed)
+	}
+}
+
+func TestSplitIntelHexRoundTrip(t *testing.T) {
+	load := func(file string) map[uint32]byte {
+		t.Helper()
+		content, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := &Flasher{UseSparse: true, GapFillByte: 0xFF}
+		if err := f.loadIntelHex(content); err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		return f.sparse.data
+	}
+	input := filepath.Join("testdata", "info.hex")
+	dir := t.TempDir()
+	regions := []SplitRegion{
+		{Name: "header", StartAddress: 0x08002800, EndAddress: 0x08003000, OutputFile: filepath.Join(dir, "header.hex")},
+		{Name: "data", StartAddress: 0x08003000, EndAddress: 0x08003010, OutputFile: filepath.Join(dir, "data.hex")},
+	}
+	overflow := filepath.Join(dir, "overflow.hex")
+	captureStdout(t, func() {
+		if err := SplitIntelHex(input, regions, overflow); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// Every file holds only its own addresses, and together they hold the
+	// original image
+	merged := make(map[uint32]byte)
+	for i, file := range []string{regions[0].OutputFile, regions[1].OutputFile, overflow} {
+		for addr, val := range load(file) {
+			if i < len(regions) && (addr < regions[i].StartAddress || addr >= regions[i].EndAddress) {
+				t.Errorf("%s holds 0x%08X, outside its region", filepath.Base(file), addr)
+			}
+			if _, ok := merged[addr]; ok {
+				t.Errorf("0x%08X is in more than one file", addr)
+			}
+			merged[addr] = val
+		}
+	}
+	original := load(input)
+	if len(merged) != len(original) {
+		t.Errorf("the split files hold %d bytes, the original %d", len(merged), len(original))
+	}
+	for addr, val := range original {
+		if got, ok := merged[addr]; !ok || got != val {
+			t.Errorf("0x%08X: got 0x%02X (present %v), want 0x%02X", addr, got, ok, val)
+		}
+	}
+}
+
+func TestJSONSchemas(t *testing.T) {
+	var config, stats map[string]interface{}
+	if err := json.Unmarshal([]byte(GenerateConfigSchema()), &config); err != nil {
+		t.Fatalf("config schema is not valid JSON: %v", err)
+	}
+	if err := json.Unmarshal([]byte(GenerateStatsSchema()), &stats); err != nil {
+		t.Fatalf("stats schema is not valid JSON: %v", err)
+	}
+
+	// Config keys default when missing, the start and end of a protected
+	// region don't
+	if _, ok := config["required"]; ok {
+		t.Errorf("config schema requires %v, want no top-level key", config["required"])
+	}
+	regions := config["properties"].(map[string]interface{})["protect_regions"].(map[string]interface{})
+	item := regions["items"].(map[string]interface{})
+	if fmt.Sprint(item["required"]) != "[start end]" {
+		t.Errorf("protect_regions items require %v, want [start end]", item["required"])
+	}
+	if item["properties"].(map[string]interface{})["start"].(map[string]interface{})["description"] == nil {
+		t.Error("the description after required is lost")
+	}
+
+	// Stats fields without omitempty are always written
+	want := "[ts hostname port firmware firmware_crc32 blocks retries duration_ms result]"
+	if fmt.Sprint(stats["required"]) != want {
+		t.Errorf("stats schema requires %v, want %s", stats["required"], want)
+	}
+}
+
+// The fuzz targets below run their seeds and testdata/fuzz with the other
+// tests. To search for new crashers, run one of them at a time, e.g.
+//
+//	go test -run '^$' -fuzz '^FuzzRevDateOperation$' -fuzztime 30s main.go main_test.go
+
+func FuzzRevDateOperation(f *testing.F) {
+	for _, step := range []byte{0, 1, 4} {
+		for _, seed := range [][]byte{{0x06}, {0xFF}, {0x32}, {0x00}} {
+			f.Add(step, seed)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, step byte, received []byte) {
+		const flashSize = 8 * 1024
+		flasher := NewFlasher(false, WithFlashSize(flashSize), WithInterPacketDelay(0))
+		flasher.hex = testImage(flashSize)
+		flasher.port = newTestPort(silent)
+		flasher.resetTransfer(0)
+		flasher.state = ProtocolState(step % byte(StateError+1))
+
+		for i, b := range received {
+			flasher.recvbuf[0] = b
+			flasher.recvcnt = 1
+			flasher.revDateOperation()
+			if flasher.sendcnt < 0 || flasher.gWritebytes < 0 || flasher.sendcnt > flashSize {
+				t.Fatalf("byte %d (0x%02X): sendcnt %d, gWritebytes %d", i, b, flasher.sendcnt, flasher.gWritebytes)
+			}
+		}
+	})
+}
+
+func FuzzProcessIntelHexRecord(f *testing.F) {
+	f.Add(":10280000F03F00200128000852543838302056315B", 0x08000000)
+	f.Add(":020000040800F2", 0)
+	f.Add(":00000001FF", 0)
+	f.Add(":0300000002", 0x08000000)
+
+	f.Fuzz(func(t *testing.T, record string, extendedAddress int) {
+		flasher := NewFlasher(false, WithFlashSize(8*1024))
+		flasher.hex = make([]byte, 8*1024)
+		flasher.firstSegment = -1
+		flasher.processIntelHexRecord(record, &extendedAddress)
+	})
+}
+
+func FuzzStringOperation(f *testing.F) {
+	f.Add(":020000040800F2\n:10280000F03F00200128000852543838302056315B\n:00000001FF\n")
+	f.Add("::::")
+	f.Add(":0")
+
+	f.Fuzz(func(t *testing.T, allcode string) {
+		flasher := NewFlasher(false, WithFlashSize(8*1024))
+		flasher.hex = make([]byte, 8*1024)
+		flasher.allcode = allcode
+		// Every record moves cntcode on, so this ends
+		for i := 0; i <= len(allcode); i++ {
+			if !flasher.stringOperation() {
+				break
+			}
+		}
+		if flasher.cntcode < 0 || flasher.cntcode > len(allcode) {
+			t.Fatalf("cntcode %d outside the %d byte input", flasher.cntcode, len(allcode))
+		}
+	})
+}
+
+func TestValidatePort(t *testing.T) {
+	ports := []string{"/dev/ttyUSB0", "/dev/ttyUSB1", "COM3"}
+	tests := []struct {
+		name  string
+		ports []string
+		want  string
+	}{
+		{"/dev/ttyUSB1", ports, ""},
+		{"COM3", ports, ""},
+		{"/dev/ttyUSB2", ports, "Port '/dev/ttyUSB2' not found"},
+		{"com3", ports, "Port 'com3' not found"},
+		{"/dev/ttyUSB0", nil, "Port '/dev/ttyUSB0' not found"},
+	}
+	for _, tt := range tests {
+		got := ""
+		if err := validatePort(tt.name, tt.ports); err != nil {
+			got = err.Error()
+		}
+		if got != tt.want {
+			t.Errorf("validatePort(%q, %v) = %q, want %q", tt.name, tt.ports, got, tt.want)
+		}
+	}
+}
+
+func TestLoopback(t *testing.T) {
+	tests := []struct {
+		name              string
+		answer            func(packet []byte) []byte
+		packets           int // Each silent packet waits a second
+		received, matched int
+		errorRate         float64
+	}{
+		{"shorted", func(packet []byte) []byte { return packet }, 10, 160, 160, 0},
+		{"not shorted", silent, 1, 0, 0, 1},
+		{"one bad byte", func(packet []byte) []byte {
+			echo := append([]byte(nil), packet...)
+			echo[5] ^= 0x10
+			return echo
+		}, 10, 160, 150, 1.0 / 16},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := newTestPort(tt.answer)
+			port.latency = 2 * time.Millisecond
+			f := NewFlasher(false)
+			f.mockPort = port
+			result, err := f.TestLoopback("COM3", tt.packets)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sent := 16 * tt.packets; result.BytesSent != sent || result.BytesReceived != tt.received || result.BytesMatched != tt.matched {
+				t.Errorf("sent %d, received %d, matched %d bytes, want %d, %d, %d",
+					result.BytesSent, result.BytesReceived, result.BytesMatched, sent, tt.received, tt.matched)
+			}
+			if result.ErrorRate != tt.errorRate {
+				t.Errorf("error rate %v, want %v", result.ErrorRate, tt.errorRate)
+			}
+			if tt.received == 0 {
+				if result.MaxLatencyMs != 0 {
+					t.Errorf("latency %v ms without any packet back", result.MaxLatencyMs)
+				}
+				return
+			}
+			if result.MinLatencyMs < 2 || result.MinLatencyMs > result.MeanLatencyMs || result.MeanLatencyMs > result.MaxLatencyMs {
+				t.Errorf("latency min %.1f, mean %.1f, max %.1f ms, want 2 ms or more in order",
+					result.MinLatencyMs, result.MeanLatencyMs, result.MaxLatencyMs)
+			}
+		})
+	}
+}
+
+func TestPackUnpackFirmware(t *testing.T) {
+	dir := t.TempDir()
+	image := testImage(8 * 1024)
+	metadata := fmt.Sprintf(`{"version": "V1.12A", "radio_model": "RT-6D", "crc32": "%08X"}`, crc32.ChecksumIEEE(image))
+	regions, err := os.ReadFile("rt6d-firmware-regions.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"firmware.bin":           image,
+		"firmware.bin.sig":       bytes.Repeat([]byte{0x5A}, 32),
+		"firmware.bin.meta.json": []byte(metadata),
+		"regions.yaml":           regions,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pkg := filepath.Join(dir, "firmware.rtpkg")
+	if err := PackFirmware(filepath.Join(dir, "firmware.bin"), filepath.Join(dir, "firmware.bin.meta.json"),
+		filepath.Join(dir, "regions.yaml"), pkg); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "unpacked")
+	if err := os.Mkdir(out, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := UnpackFirmware(pkg, out); err != nil {
+		t.Fatal(err)
+	}
+	for packaged, original := range map[string]string{
+		packageFirmware:  "firmware.bin",
+		packageMetadata:  "firmware.bin.meta.json",
+		packageRegions:   "regions.yaml",
+		packageSignature: "firmware.bin.sig",
+	} {
+		got, err := os.ReadFile(filepath.Join(out, packaged))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, files[original]) {
+			t.Errorf("%s differs from %s", packaged, original)
+		}
+	}
+
+	// The flasher loads the image of the package with its metadata
+	f := NewFlasher(false)
+	if !f.initializeHex(pkg) {
+		t.Fatal("failed to load the package")
+	}
+	if !bytes.Equal(f.hex[:len(image)], image) {
+		t.Error("the loaded image differs from firmware.bin")
+	}
+	if f.Metadata == nil || f.Metadata.Version != "V1.12A" {
+		t.Errorf("metadata %+v, want version V1.12A", f.Metadata)
+	}
+}
+
+func TestProgressFileValidJSON(t *testing.T) {
+	const flashSize = 32 * 1024
+	cfg := testConfig(flashSize)
+	cfg.ProgressFile = filepath.Join(t.TempDir(), "progress.json")
+
+	readProgress := func() (ProgressRecord, error) {
+		var record ProgressRecord
+		content, err := os.ReadFile(cfg.ProgressFile)
+		if err == nil {
+			err = json.Unmarshal(content, &record)
+		}
+		return record, err
+	}
+
+	// Every 10 blocks the file is read the way a GUI polling it would
+	var checked []int
+	var problems []string
+	port := newTestPort(func(packet []byte) []byte {
+		if len(packet) != 1024+4 || packet[0] != 0x57 {
+			return []byte{6}
+		}
+		block := (int(packet[1])<<8 | int(packet[2])) / 1024
+		if block == 0 || block%10 != 0 {
+			return []byte{6}
+		}
+		checked = append(checked, block)
+		record, err := readProgress()
+		switch {
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("block %d: %v", block, err))
+		case record.Phase != "uploading" || record.BlockTotal != flashSize/1024 || record.BlockDone > block || record.BlockDone < block-1:
+			problems = append(problems, fmt.Sprintf("block %d: got %+v", block, record))
+		}
+		return []byte{6}
+	})
+
+	result := FlashMany([]FlashJob{{PortName: "COM3", FirmwareFile: writeTestFirmware(t, flashSize), Config: cfg, port: port}}, 1)[0]
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	if fmt.Sprint(checked) != "[10 20 30]" {
+		t.Errorf("progress checked at blocks %v, want [10 20 30]", checked)
+	}
+	for _, problem := range problems {
+		t.Error(problem)
+	}
+	record, err := readProgress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Phase != "done" || record.BlockDone != flashSize/1024 || record.Pct != 100 {
+		t.Errorf("final progress %+v, want done with all blocks", record)
+	}
+}
+
+func TestEditSequenceScript(t *testing.T) {
+	if len(knownProtocols) < 2 {
+		t.Fatalf("%d known protocols, the script picks the second", len(knownProtocols))
+	}
+	dir := t.TempDir()
+	first := writeTestFirmware(t, 8*1024)
+	second := filepath.Join(dir, "missing.bin")
+	path := filepath.Join(dir, "sequence.yaml")
+
+	script := strings.Join([]string{
+		"1", first, "0", "250", "y", // Step 1
+		"1", "removed.bin", "", "", "", // Step 2, removed again below
+		"1", second, "2", "abc", "", "n", // Step 3, a bad delay asks again
+		"2", "2",
+		"3",
+		"4",
+		"5",
+	}, "\n") + "\n"
+	var out bytes.Buffer
+	if err := editSequence(strings.NewReader(script), &out, path); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Added step 3", "Removed step 2", "Give the delay as a number of milliseconds", "does not exist here"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output has no %q:\n%s", want, out.String())
+		}
+	}
+
+	seq, err := LoadFlashSequence(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []FlashStep{
+		{FirmwareFile: first, DelayAfterMs: 250, ResetBetweenSteps: true},
+		{FirmwareFile: second, Protocol: knownProtocols[1].Name},
+	}
+	if len(seq.Steps) != len(want) {
+		t.Fatalf("got %d steps %+v, want %d", len(seq.Steps), seq.Steps, len(want))
+	}
+	for i := range want {
+		if seq.Steps[i] != want[i] {
+			t.Errorf("step %d is %+v, want %+v", i+1, seq.Steps[i], want[i])
+		}
+	}
+}
+
+func TestConnectWithRetryErrorMessage(t *testing.T) {
+	f := NewFlasher(false, WithFlashSize(8*1024), WithInterPacketDelay(0))
+	f.hex = testImage(8 * 1024)
+	f.ConnectTimeout = 10 * time.Millisecond
+	port := newTestPort(silent)
+	f.mockPort = port
+
+	err := f.startUpdate("COM3")
+	const want = "communication error - no response from device after 4 connection attempts"
+	if err == nil || err.Error() != want {
+		t.Fatalf("got %v, want %q", err, want)
+	}
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("error %v is not ErrTimeout", err)
+	}
+	port.mu.Lock()
+	closed := port.closed
+	port.mu.Unlock()
+	if !closed {
+		t.Error("port left open after the failed connect")
+	}
+}
+
+func TestDumpMemoryMapFirstQuarter(t *testing.T) {
+	const flashSize = 251904
+	f := NewFlasher(false, WithFlashSize(flashSize))
+	f.hex = bytes.Repeat([]byte{0xFF}, flashSize)
+	for i := 0; i < flashSize/4; i++ {
+		f.hex[i] = byte(i)
+		if f.hex[i] == 0xFF {
+			f.hex[i] = 0
+		}
+	}
+
+	var output bytes.Buffer
+	f.dumpMemoryMap(&output)
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	if len(lines) != memoryMapRows+1 {
+		t.Fatalf("got %d lines, want a header and %d rows:\n%s", len(lines), memoryMapRows, output.String())
+	}
+	for _, line := range lines {
+		if width := utf8.RuneCountInString(line); width > 80 {
+			t.Errorf("line %q is %d columns wide", line, width)
+		}
+	}
+	for row, line := range lines[1:] {
+		fields := strings.Fields(line)
+		want := "·"
+		if row < memoryMapRows/4 {
+			want = "▓"
+		}
+		if len(fields) < 2 || fields[0] != strconv.Itoa(row) || fields[1] != want {
+			t.Errorf("row %d is %q, want %s", row, line, want)
+		}
+	}
+	if !strings.HasSuffix(lines[1], " 0x08002800-") {
+		t.Errorf("first row %q does not start the run at 0x08002800", lines[1])
+	}
+	if !strings.HasSuffix(lines[16], "-0x08011DFF") {
+		t.Errorf("row 15 %q does not end the run at 0x08011DFF", lines[16])
+	}
+}
+
+func TestDiagnoseUnknownByte(t *testing.T) {
+	tests := []struct {
+		b    byte
+		want string // Start of the cause, a remedy follows it
+	}{
+		{0x15, "possible NAK from alternate protocol, "},
+		{0x0D, "newline detected — device may be sending text, check baud rate"},
+		{0x0A, "newline detected — device may be sending text, check baud rate"},
+		{0x57, "device echoing our own send byte — loopback or TX-RX short, "},
+		{0xAA, "possible calibration bootloader response, "},
+		{0x55, "possible calibration bootloader response, "},
+		{0x00, ""},
+		{0x42, ""},
+	}
+	for _, tt := range tests {
+		got := diagnoseUnknownByte(tt.b)
+		if tt.want == "" {
+			if got != "" {
+				t.Errorf("0x%02X: got %q for a byte without a known meaning", tt.b, got)
+			}
+			continue
+		}
+		if !strings.HasPrefix(got, tt.want) || len(got) == len(tt.want) {
+			t.Errorf("0x%02X: got %q, want %q and a remedy", tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestConnectTimeout50ms(t *testing.T) {
+	f := NewFlasher(false, WithFlashSize(8*1024), WithInterPacketDelay(0))
+	f.hex = testImage(8 * 1024)
+	f.ConnectTimeout = 50 * time.Millisecond
+	port := newTestPort(silent)
+	f.port = port
+
+	f.resetTransfer(0)
+	go f.readData()
+	start := time.Now()
+	err := f.connectWithRetry(4)
+	elapsed := time.Since(start)
+	f.stopReader()
+
+	if err == nil {
+		t.Fatal("no error without an answer to the connect command")
+	}
+	connects := 0
+	for _, packet := range port.packets() {
+		if bytes.Equal(packet, f.sendConnect) {
+			connects++
+		}
+	}
+	if connects != 4 {
+		t.Errorf("connect command sent %d times, want 4", connects)
+	}
+	if elapsed < 4*f.ConnectTimeout || elapsed >= 300*time.Millisecond {
+		t.Errorf("4 attempts took %v, want at least 200ms and less than 300ms", elapsed)
+	}
+}
+
+// influxLine is a parsed InfluxDB line protocol line
+type influxLine struct {
+	measurement string
+	tags        map[string]string
+	fields      map[string]interface{} // int64, float64, bool or string
+	timestamp   int64
+}
+
+// parseInfluxLine parses line by the grammar of the line protocol:
+//
+//	measurement[,tag_key=tag_value...] field_key=field_value[,...] [timestamp]
+//
+// Commas and spaces are escaped with a backslash in measurements, and
+// equal signs too in tag and field keys and tag values.
+func parseInfluxLine(line string) (*influxLine, error) {
+	// next returns the unescaped text up to the first unescaped byte of
+	// stops and what follows it. The other bytes of escapable have to be
+	// escaped.
+	next := func(s, stops, escapable string) (string, string, error) {
+		var text strings.Builder
+		for i := 0; i < len(s); i++ {
+			switch {
+			case s[i] == '\\' && i+1 < len(s) && strings.IndexByte(escapable, s[i+1]) >= 0:
+				i++
+				text.WriteByte(s[i])
+			case strings.IndexByte(stops, s[i]) >= 0:
+				return text.String(), s[i:], nil
+			case strings.IndexByte(escapable, s[i]) >= 0:
+				return "", "", fmt.Errorf("unescaped %q in %q", s[i], s)
+			default:
+				text.WriteByte(s[i])
+			}
+		}
+		return text.String(), "", nil
+	}
+
+	parsed := &influxLine{tags: map[string]string{}, fields: map[string]interface{}{}}
+	measurement, rest, err := next(line, ", ", ", ")
+	if err != nil || measurement == "" {
+		return nil, fmt.Errorf("bad measurement in %q: %v", line, err)
+	}
+	parsed.measurement = measurement
+
+	for strings.HasPrefix(rest, ",") {
+		var key, value string
+		if key, rest, err = next(rest[1:], "=", ", ="); err != nil || key == "" || !strings.HasPrefix(rest, "=") {
+			return nil, fmt.Errorf("bad tag key in %q", line)
+		}
+		if value, rest, err = next(rest[1:], ", ", ", ="); err != nil || value == "" {
+			return nil, fmt.Errorf("bad value of tag %s in %q", key, line)
+		}
+		parsed.tags[key] = value
+	}
+	if !strings.HasPrefix(rest, " ") {
+		return nil, fmt.Errorf("no fields in %q", line)
+	}
+
+	rest = rest[1:]
+	for {
+		var key string
+		if key, rest, err = next(rest, "=", ", ="); err != nil || key == "" || !strings.HasPrefix(rest, "=") {
+			return nil, fmt.Errorf("bad field key in %q", line)
+		}
+		rest = rest[1:]
+		var value string
+		if strings.HasPrefix(rest, "\"") {
+			end := 1
+			for end < len(rest) && rest[end] != '"' {
+				if rest[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(rest) {
+				return nil, fmt.Errorf("unterminated string field %s in %q", key, line)
+			}
+			parsed.fields[key] = strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(rest[1:end])
+			rest = rest[end+1:]
+		} else {
+			end := strings.IndexAny(rest, ", ")
+			if end < 0 {
+				end = len(rest)
+			}
+			value, rest = rest[:end], rest[end:]
+			switch {
+			case value == "t" || value == "T" || value == "true" || value == "True" || value == "TRUE":
+				parsed.fields[key] = true
+			case value == "f" || value == "F" || value == "false" || value == "False" || value == "FALSE":
+				parsed.fields[key] = false
+			case strings.HasSuffix(value, "i"):
+				n, err := strconv.ParseInt(strings.TrimSuffix(value, "i"), 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("bad integer field %s=%s in %q", key, value, line)
+				}
+				parsed.fields[key] = n
+			default:
+				n, err := strconv.ParseFloat(value, 64)
+				if err != nil || strings.ContainsAny(value, "xXpP_") {
+					return nil, fmt.Errorf("bad float field %s=%s in %q", key, value, line)
+				}
+				parsed.fields[key] = n
+			}
+		}
+		if !strings.HasPrefix(rest, ",") {
+			break
+		}
+		rest = rest[1:]
+	}
+
+	if rest == "" {
+		return parsed, nil
+	}
+	if !strings.HasPrefix(rest, " ") {
+		return nil, fmt.Errorf("trailing %q in %q", rest, line)
+	}
+	if parsed.timestamp, err = strconv.ParseInt(rest[1:], 10, 64); err != nil {
+		return nil, fmt.Errorf("bad timestamp in %q", line)
+	}
+	return parsed, nil
+}
+
+func TestTelemetryLineProtocol(t *testing.T) {
+	for value, want := range map[string]string{
+		"COM3":         "COM3",
+		"RT6D Pro":     `RT6D\ Pro`,
+		"a,b=c d":      `a\,b\=c\ d`,
+		`/dev/tty\USB`: `/dev/tty\USB`,
+	} {
+		if got := escapeInfluxTag(value); got != want {
+			t.Errorf("escapeInfluxTag(%q) = %q, want %q", value, got, want)
+		}
+	}
+
+	const flashSize = 8 * 1024
+	const portName = "COM 3,bench=2"
+	var sink bytes.Buffer
+	f := NewFlasher(false, WithFlashSize(flashSize), WithInterPacketDelay(0))
+	f.hex = testImage(flashSize)
+	f.ConnectTimeout = 50 * time.Millisecond
+	f.Metadata = &FirmwareMetadata{RadioModel: "RT6D Pro"}
+	f.TelemetrySink = &sink
+	f.mockPort = newTestPort(handshakeBootloader(f))
+	start := time.Now()
+	if err := f.startUpdate(portName); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(sink.String(), "\n"), "\n")
+	if len(lines) != flashSize/1024+1 {
+		t.Fatalf("got %d lines, want a progress line for every block and a result:\n%s", len(lines), sink.String())
+	}
+	for i, line := range lines {
+		parsed, err := parseInfluxLine(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.tags["port"] != portName || parsed.tags["model"] != "RT6D Pro" || len(parsed.tags) != 2 {
+			t.Errorf("line %q has tags %v", line, parsed.tags)
+		}
+		if parsed.timestamp < start.UnixNano() || parsed.timestamp > time.Now().UnixNano() {
+			t.Errorf("line %q has a timestamp outside of the flash", line)
+		}
+
+		want := map[string]string{"block": "int64", "pct": "float64", "rate_kbps": "float64"}
+		measurement := "flash_progress"
+		if i == len(lines)-1 {
+			want = map[string]string{"success": "bool", "blocks": "int64", "retries": "int64", "duration_s": "float64"}
+			measurement = "flash_result"
+		}
+		if parsed.measurement != measurement {
+			t.Errorf("line %q is a %s, want %s", line, parsed.measurement, measurement)
+		}
+		if len(parsed.fields) != len(want) {
+			t.Errorf("line %q has fields %v", line, parsed.fields)
+		}
+		for key, kind := range want {
+			if got := fmt.Sprintf("%T", parsed.fields[key]); got != kind {
+				t.Errorf("field %s of %q is %s, want %s", key, line, got, kind)
+			}
+		}
+	}
+	if result, _ := parseInfluxLine(lines[len(lines)-1]); result.fields["success"] != true || result.fields["blocks"] != int64(flashSize/1024) {
+		t.Errorf("result %q does not report all blocks written", lines[len(lines)-1])
+	}
+
+	for _, bad := range []string{
+		"flash_progress,port=COM 3 block=1i 1",
+		"flash_progress,port= block=1i 1",
+		"flash_progress block=1x 1",
+		"flash_progress block=1i,",
+		"flash_progress 1",
+	} {
+		if _, err := parseInfluxLine(bad); err == nil {
+			t.Errorf("parser accepts %q", bad)
+		}
+	}
+}
+
+func TestKeepAliveReentryFailure(t *testing.T) {
+	// The help has to match the built-in protocols
+	for _, p := range mustParseProtocols(builtinProtocols, "protocols.json") {
+		if len(p.SendKeepAlive) > 0 {
+			t.Errorf("built-in protocol %s defines send_keep_alive, update the -keep-alive help", p.Name)
+		}
+	}
+	if !strings.Contains(captureStdout(t, showUsage), "no built-in protocol defines send_keep_alive") {
+		t.Error("the -keep-alive help does not say that no built-in protocol has a keep-alive command")
+	}
+
+	// A radio that does not come back after the DTR/RTS pulse
+	f := NewFlasher(false, WithFlashSize(8*1024), WithInterPacketDelay(0))
+	f.hex = testImage(8 * 1024)
+	f.ConnectTimeout = 10 * time.Millisecond
+	f.ConnectAttempts = 2
+	port := newTestPort(silent)
+	f.port = port
+	f.resetTransfer(0)
+	f.mu.Lock()
+	f.state = StateTransferring
+	f.gWritebytes = 3
+	f.mu.Unlock()
+
+	f.reenterAfterTimeout()
+	f.mu.Lock()
+	state, abortErr := f.state, f.abortErr
+	f.mu.Unlock()
+	if state != StateError || !errors.Is(abortErr, ErrTimeout) {
+		t.Errorf("got state %s and abort error %v, want %s and a timeout", state, abortErr, StateError)
+	}
+	port.mu.Lock()
+	closed := port.closed
+	port.mu.Unlock()
+	if closed {
+		t.Error("reenterAfterTimeout closed the port")
+	}
+}
+
+// captureStdout returns what run prints to os.Stdout
+func captureStdout(t *testing.T, run func()) string {
+	t.Helper()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	defer func() { os.Stdout = stdout }()
+	output := make(chan []byte)
+	go func() {
+		content, _ := io.ReadAll(reader)
+		output <- content
+	}()
+	run()
+	writer.Close()
+	return string(<-output)
+}
+
+// listedFormats returns the names of the formats printed by printFormats
+func listedFormats(t *testing.T, output string) []string {
+	t.Helper()
+	var names []string
+	for _, line := range strings.Split(output, "\n") {
+		if line != "" && !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "Fallback order: ") {
+			names = append(names, line)
+		}
+	}
+	if strings.Count(output, "  Header:") != len(names) {
+		t.Errorf("not every format has a sample header:\n%s", output)
+	}
+	if !strings.Contains(output, "\nFallback order: ") {
+		t.Errorf("no fallback order:\n%s", output)
+	}
+	return names
+}
+
+func TestListFormats(t *testing.T) {
+	names := listedFormats(t, captureStdout(t, func() { printFormats(firmwareFormats, "test") }))
+	if len(names) < 3 {
+		t.Fatalf("listed formats %q, want at least 3", names)
+	}
+	for _, want := range []string{"Intel HEX", "S-record", "Binary"} {
+		found := false
+		for _, name := range names {
+			found = found || name == want
+		}
+		if !found {
+			t.Errorf("%s is not among the listed formats %q", want, names)
+		}
+	}
+}
+
+func TestDeviceQuerySharedByChecks(t *testing.T) {
+	const flashSize = 8 * 1024
+	for _, tt := range []struct {
+		name     string
+		serial   string
+		metadata *FirmwareMetadata
+	}{
+		{"serial number", "sn-0042", nil},
+		{"hardware revision", "", &FirmwareMetadata{MinHardwareRevision: "1.0", MaxHardwareRevision: "2.0"}},
+		{"both", "SN-0042", &FirmwareMetadata{MinHardwareRevision: "1.0", MaxHardwareRevision: "2.0"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFlasher(false, WithFlashSize(flashSize), WithInterPacketDelay(0))
+			f.hex = testImage(flashSize)
+			f.ConnectTimeout = 50 * time.Millisecond
+			f.SerialNumber = tt.serial
+			f.StrictSerial = true
+			f.Metadata = tt.metadata
+
+			// The first connect command is the query, answered with the
+			// fields of the radio after the ACK
+			handshake := handshakeBootloader(f)
+			queried := false
+			port := newTestPort(func(packet []byte) []byte {
+				answer := handshake(packet)
+				if bytes.Equal(packet, f.sendConnect) && !queried {
+					queried = true
+					answer = append(answer, []byte("RT6D\x001.12\x001.5\x00SN-0042")...)
+				}
+				return answer
+			})
+			f.mockPort = port
+
+			if err := f.startUpdate("COM3"); err != nil {
+				t.Fatal(err)
+			}
+			connects := 0
+			for _, packet := range port.packets() {
+				if bytes.Equal(packet, f.sendConnect) {
+					connects++
+				}
+			}
+			if connects != 3 {
+				t.Errorf("connect command sent %d times with the query, want 3", connects)
+			}
+			if blocks := dataPackets(port.packets(), 1024); len(blocks) != flashSize/1024 {
+				t.Errorf("got %d blocks, want %d", len(blocks), flashSize/1024)
+			}
+		})
+	}
+}
+
+func TestHardwareTest(t *testing.T) {
+	t.Run("port missing", func(t *testing.T) {
+		result, err := NewFlasher(false).HardwareTest(filepath.Join(t.TempDir(), "ttyUSB9"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Steps) != 1 || result.Steps[0].Name != "Open port" || result.Passed() {
+			t.Errorf("got steps %+v, want only a failed port open", result.Steps)
+		}
+		if !strings.Contains(result.Summary, "driver") {
+			t.Errorf("summary %q does not point at the driver", result.Summary)
+		}
+	})
+
+	tests := []struct {
+		name    string
+		answer  func(port *testPort) func(packet []byte) []byte
+		failed  string // Name of the step expected to fail, "" if all pass
+		summary string
+	}{
+		{"radio answers", func(*testPort) func([]byte) []byte { return ackAll }, "", "cable and radio look good"},
+		{"radio off", func(*testPort) func([]byte) []byte { return silent }, "Connect", "check that the radio is on"},
+		{"shorted", func(*testPort) func([]byte) []byte {
+			return func(packet []byte) []byte { return packet }
+		}, "Connect", "TX and RX look shorted"},
+		{"noise", func(port *testPort) func([]byte) []byte {
+			// Bytes keep arriving after the ACK, while the line should be
+			// quiet
+			return func(packet []byte) []byte {
+				time.AfterFunc(500*time.Millisecond, func() {
+					port.mu.Lock()
+					defer port.mu.Unlock()
+					port.pending = append(port.pending, 0x00, 0x80, 0x00)
+				})
+				return []byte{6}
+			}
+		}, "Idle line", "noise on the line"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			port := newTestPort(nil)
+			port.answer = tt.answer(port)
+			f := NewFlasher(false)
+			f.mockPort = port
+			result, err := f.HardwareTest("COM3")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var names []string
+			for _, step := range result.Steps {
+				names = append(names, step.Name)
+				if step.Passed == (step.Name == tt.failed) {
+					t.Errorf("step %s passed %t: %s", step.Name, step.Passed, step.Detail)
+				}
+			}
+			if fmt.Sprint(names) != "[Open port Modem lines Connect Idle line]" {
+				t.Errorf("ran steps %v", names)
+			}
+			if result.Passed() != (tt.failed == "") {
+				t.Errorf("result passed %t", result.Passed())
+			}
+			if !strings.Contains(result.Summary, tt.summary) {
+				t.Errorf("summary %q, want %q", result.Summary, tt.summary)
+			}
+			if !port.wrote(f.sendConnect) {
+				t.Error("no connect command sent")
+			}
+		})
+	}
+}
+
+func TestBenchmarkPort(t *testing.T) {
+	// echo returns an answer echoing the packets, passing the number of
+	// each packet to change
+	echo := func(change func(n int, echo []byte) []byte) func([]byte) []byte {
+		n := 0
+		return func(packet []byte) []byte {
+			n++
+			return change(n, append([]byte(nil), packet...))
+		}
+	}
+	tests := []struct {
+		name     string
+		answer   func([]byte) []byte
+		duration time.Duration
+		loss     bool
+		crc      bool
+	}{
+		{"intact", echo(func(n int, echo []byte) []byte { return echo }), 200 * time.Millisecond, false, false},
+		{"every second packet corrupted", echo(func(n int, echo []byte) []byte {
+			if n%2 == 0 {
+				echo[100] ^= 0x01
+			}
+			return echo
+		}), 200 * time.Millisecond, false, true},
+		// The lost packet is waited for 2 s, so the run ends after it
+		{"second packet lost", echo(func(n int, echo []byte) []byte {
+			if n == 2 {
+				return nil
+			}
+			return echo
+		}), 50 * time.Millisecond, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			port := newTestPort(tt.answer)
+			port.latency = 2 * time.Millisecond
+			f := NewFlasher(false)
+			f.mockPort = port
+			result, err := f.BenchmarkPort("COM3", tt.duration)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if result.PacketsSent < 2 || result.BytesSent != 1028*result.PacketsSent || len(port.packets()) != result.PacketsSent {
+				t.Fatalf("sent %d packets of %d bytes, the port got %d", result.PacketsSent, result.BytesSent, len(port.packets()))
+			}
+			lost := 0
+			if tt.loss {
+				lost = 1
+			}
+			if result.PacketsReceived != result.PacketsSent-lost || result.BytesReceived != 1028*result.PacketsReceived {
+				t.Errorf("received %d of %d packets, %d bytes", result.PacketsReceived, result.PacketsSent, result.BytesReceived)
+			}
+			if want := float64(lost) / float64(result.PacketsSent); result.PacketLossRate != want {
+				t.Errorf("packet loss %v, want %v", result.PacketLossRate, want)
+			}
+			wantCRC := 0.0
+			if tt.crc {
+				wantCRC = float64(result.PacketsReceived/2) / float64(result.PacketsReceived)
+			}
+			if result.CRCErrorRate != wantCRC {
+				t.Errorf("CRC error rate %v, want %v", result.CRCErrorRate, wantCRC)
+			}
+
+			if result.MinRoundTripMs < 2 || result.MinRoundTripMs > result.MeanRoundTripMs || result.MeanRoundTripMs > result.MaxRoundTripMs {
+				t.Errorf("round trip min %.1f, mean %.1f, max %.1f ms, want 2 ms or more in order",
+					result.MinRoundTripMs, result.MeanRoundTripMs, result.MaxRoundTripMs)
+			}
+			if want := time.Duration(3 * result.MaxRoundTripMs * float64(time.Millisecond)); result.RecommendedBlockTimeout-want > time.Microsecond || want-result.RecommendedBlockTimeout > time.Microsecond {
+				t.Errorf("recommended timeout %v, want 3 times the %.1f ms round trip", result.RecommendedBlockTimeout, result.MaxRoundTripMs)
+			}
+			if want := float64(result.BytesSent) / 1024 / result.Duration.Seconds(); result.ThroughputKBps != want {
+				t.Errorf("throughput %v KB/s, want %v", result.ThroughputKBps, want)
+			}
+			if result.Duration < tt.duration {
+				t.Errorf("ran for %v, want at least %v", result.Duration, tt.duration)
+			}
+		})
+	}
+}
+
+func TestAbortFlashSendsEnd(t *testing.T) {
+	if err := NewFlasher(false).AbortFlash(); err == nil || err.Error() != "no flash in progress" {
+		t.Errorf("got %v before a flash, want no flash in progress", err)
+	}
+
+	port := newTestPort(ackHandshake)
+	f := NewFlasher(false, WithFlashSize(8*1024), WithInterPacketDelay(0))
+	f.hex = testImage(8 * 1024)
+	f.mockPort = port
+	f.ConnectTimeout = 50 * time.Millisecond
+	f.packetTimeout = time.Minute
+
+	result := make(chan error, 1)
+	go func() { result <- f.startUpdate("COM3") }()
+	deadline := time.Now().Add(5 * time.Second)
+	for f.State() != StateTransferring {
+		if time.Now().After(deadline) {
+			t.Fatal("the flash did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := f.AbortFlash(); err != nil {
+		t.Fatal(err)
+	}
+	if !port.wrote(f.sendEnd) {
+		t.Error("end command not sent to the port")
+	}
+	port.mu.Lock()
+	closed := port.closed
+	port.mu.Unlock()
+	if !closed {
+		t.Error("port left open")
+	}
+	select {
+	case err := <-result:
+		if err == nil || !strings.Contains(err.Error(), "flash aborted") {
+			t.Errorf("startUpdate returned %v, want flash aborted", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("startUpdate did not return after the abort")
+	}
+
+	// The transfer is over, so the end command is not sent again
+	if err := f.AbortFlash(); err == nil || err.Error() != "no flash in progress" {
+		t.Errorf("got %v after the abort, want no flash in progress", err)
+	}
+	ends := 0
+	for _, packet := range port.packets() {
+		if bytes.Equal(packet, f.sendEnd) {
+			ends++
+		}
+	}
+	if ends != 1 {
+		t.Errorf("end command sent %d times, want once", ends)
+	}
+}
+
+// pipeServer is the serial port server end of a net.Pipe, collecting what
+// the tcpSerialPort sends
+type pipeServer struct {
+	conn     net.Conn
+	mu       sync.Mutex
+	received []byte
+}
+
+func newPipeServer(t *testing.T) (*pipeServer, net.Conn) {
+	server, client := net.Pipe()
+	s := &pipeServer{conn: server}
+	go func() {
+		buffer := make([]byte, 256)
+		for {
+			n, err := server.Read(buffer)
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.received = append(s.received, buffer[:n]...)
+			s.mu.Unlock()
+		}
+	}()
+	t.Cleanup(func() { server.Close() })
+	return s, client
+}
+
+// expect waits for the bytes received next to be want
+func (s *pipeServer) expect(t *testing.T, what string, want ...byte) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		s.mu.Lock()
+		got := append([]byte(nil), s.received...)
+		if len(got) >= len(want) {
+			s.received = s.received[len(want):]
+		}
+		s.mu.Unlock()
+		if len(got) >= len(want) || time.Now().After(deadline) {
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s: server got % X, want % X", what, got, want)
+			}
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTCPSerialPortTelnet(t *testing.T) {
+	const (
+		IAC  = telnetIAC
+		SB   = telnetSB
+		SE   = telnetSE
+		WILL = telnetWILL
+		DO   = telnetDO
+		COM  = comPortOption
+	)
+	server, client := newPipeServer(t)
+	f := NewFlasher(false)
+	if err := f.useTCPConn(client); err != nil {
+		t.Fatal(err)
+	}
+	port := f.port.(*tcpSerialPort)
+	server.expect(t, "serial settings",
+		IAC, WILL, COM,
+		IAC, SB, COM, comPortSetBaudRate, 0x00, 0x01, 0xC2, 0x00, IAC, SE, // 115200
+		IAC, SB, COM, comPortSetDataSize, 8, IAC, SE,
+		IAC, SB, COM, comPortSetParity, 1, IAC, SE,
+		IAC, SB, COM, comPortSetStopSize, 1, IAC, SE)
+
+	// 0xFF is doubled in data and option values
+	if n, err := port.Write([]byte{0x57, 0xFF, 0x01, 0xFF}); err != nil || n != 4 {
+		t.Fatalf("wrote %d bytes: %v", n, err)
+	}
+	server.expect(t, "data", 0x57, IAC, IAC, 0x01, IAC, IAC)
+	if err := port.SetMode(&serial.Mode{BaudRate: 0xFFFF, DataBits: 8}); err != nil {
+		t.Fatal(err)
+	}
+	server.expect(t, "baud rate with 0xFF",
+		IAC, SB, COM, comPortSetBaudRate, 0x00, 0x00, IAC, IAC, IAC, IAC, IAC, SE,
+		IAC, SB, COM, comPortSetDataSize, 8, IAC, SE,
+		IAC, SB, COM, comPortSetParity, 1, IAC, SE,
+		IAC, SB, COM, comPortSetStopSize, 1, IAC, SE)
+
+	// The server's telnet commands are stripped and its doubled 0xFF
+	// undone, also when split across writes
+	port.SetReadTimeout(100 * time.Millisecond)
+	go func() {
+		for _, chunk := range [][]byte{
+			{IAC, DO, COM, 0x06, IAC},
+			{IAC, 0x10, IAC, SB, COM, 101, 0x00, 0x01},
+			{IAC, IAC, 0xC2, 0x00, IAC, SE, 0x20, IAC},
+			{0xF1, 0x30}, // IAC NOP
+		} {
+			server.conn.Write(chunk)
+		}
+	}()
+	var got []byte
+	buffer := make([]byte, 16)
+	for len(got) < 5 {
+		n, err := port.Read(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			break
+		}
+		got = append(got, buffer[:n]...)
+	}
+	if want := []byte{0x06, 0xFF, 0x10, 0x20, 0x30}; !bytes.Equal(got, want) {
+		t.Errorf("read % X, want % X", got, want)
+	}
+	if n, err := port.Read(buffer); n != 0 || err != nil {
+		t.Errorf("read %d bytes (%v) after the timeout, want 0", n, err)
+	}
+
+	// Without RFC 2217 the bytes go through unchanged
+	server, client = newPipeServer(t)
+	f = NewFlasher(false)
+	f.NoRFC2217 = true
+	if err := f.useTCPConn(client); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.port.Write([]byte{0x57, 0xFF, 0x01}); err != nil {
+		t.Fatal(err)
+	}
+	server.expect(t, "data without RFC 2217", 0x57, 0xFF, 0x01)
+	go server.conn.Write([]byte{IAC, DO, COM})
+	f.port.SetReadTimeout(100 * time.Millisecond)
+	got = got[:0]
+	for len(got) < 3 {
+		n, err := f.port.Read(buffer)
+		if err != nil || n == 0 {
+			break
+		}
+		got = append(got, buffer[:n]...)
+	}
+	if want := []byte{IAC, DO, COM}; !bytes.Equal(got, want) {
+		t.Errorf("read % X without RFC 2217, want % X", got, want)
+	}
+	if err := f.port.SetDTR(true); err == nil {
+		t.Error("no error for DTR without RFC 2217")
+	}
+}
@@ -1,228 +1,220 @@
 package main
 
 import (
+	"bytes"
+	"flag"
 	"fmt"
 	"os"
-	"sort"
 	"strconv"
-	"time"
 
-	"go.bug.st/serial"
+	"rt6d-flasher/internal/spilib"
 )
 
+// SPIFlash dumps the SPI flash with the +82 command checksum of the
+// original tool, through the SPI client shared with spi-tool
 type SPIFlash struct {
-	port serial.Port
+	*spilib.SPIClient
+	ChecksumMode ChecksumMode
 }
 
+// ChecksumMode selects the packet checksum, newer firmware variants are
+// reported to use CRC16-CCITT
+type ChecksumMode int
+
 const (
-	CHUNK_SIZE     = 1024
-	SPI_FLASH_SIZE = 4 * 1024 * 1024 // 4MB
-	SPI_FLASH_FULL_SIZE = 32 * 1024 * 1024 // 32MB
+	ChecksumModeSum82 ChecksumMode = iota // Byte sum, +82 for commands
+	ChecksumModeCRC16                     // CRC16-CCITT, 2 bytes high byte first
 )
 
-func NewSPIFlash() *SPIFlash {
-	return &SPIFlash{}
-}
-
-func (s *SPIFlash) calculateChecksum(command []byte) byte {
-	var sum byte = 0
-	for _, b := range command {
-		sum += b
-	}
-	return sum + 82
-}
+const (
+	CHUNK_SIZE     = spilib.CHUNK_SIZE
+	SPI_FLASH_SIZE = spilib.SPI_FLASH_SIZE // 4MB
+)
 
-func (s *SPIFlash) verify(command []byte) bool {
-	if len(command) < 1 {
-		return false
-	}
-	
-	lastIdx := len(command) - 1
-	var calculatedSum byte = 0
-	
-	for _, b := range command[:lastIdx] {
-		calculatedSum += b
-	}
-	
-	return command[lastIdx] == calculatedSum
+func NewSPIFlash() *SPIFlash {
+	client := spilib.NewSPIClient(SPI_FLASH_SIZE, 82)
+	// Blocks with a bad checksum are read again instead of being accepted
+	client.StrictChecksum = true
+	return &SPIFlash{SPIClient: client}
 }
 
-func (s *SPIFlash) printHex(data []byte) {
+// crc16CCITT is CRC16-CCITT with polynomial 0x1021 and initial value
+// 0xFFFF, without reflection or final XOR
+func crc16CCITT(data []byte) uint16 {
+	crc := uint16(0xFFFF)
 	for _, b := range data {
-		fmt.Printf("%02X ", b)
-	}
-	fmt.Println()
-}
-
-func (s *SPIFlash) connectToPort(portName string, baudRate int) error {
-	mode := &serial.Mode{
-		BaudRate: baudRate,
-		DataBits: 8,
-		Parity:   serial.NoParity,
-		StopBits: serial.OneStopBit,
-	}
-	
-	port, err := serial.Open(portName, mode)
-	if err != nil {
-		return fmt.Errorf("failed to open port %s: %v", portName, err)
-	}
-	
-	s.port = port
-	
-	// Set read timeout to 2 seconds like in the Rust code
-	return nil
-}
-
-// Implementación exacta del código Rust command_readspiflash
-func (s *SPIFlash) commandReadSPIFlash(offset uint32) ([]byte, error) {
-	command := make([]byte, 4)
-	command[0] = 0x52
-	command[1] = byte((offset >> 8) & 0xFF)  // Solo usamos los 2 bytes menos significativos
-	command[2] = byte(offset & 0xFF)
-	command[3] = s.calculateChecksum(command[:3]) // Checksum de los primeros 3 bytes
-	
-	fmt.Printf("TX (readspiflash): ")
-	s.printHex(command)
-	
-	_, err := s.port.Write(command)
-	if err != nil {
-		return nil, err
-	}
-	
-	// Leer primer bloque
-	block := make([]byte, 1028)
-	_, err = s.port.Read(block)
-	if err != nil {
-		return nil, err
-	}
-	
-	fmt.Printf("RX (readspiflash, bloque 1): ")
-	s.printHex(block[:16])
-	fmt.Println("...")
-	
-	// Si no pasa la verificación, leer segundo bloque
-	if !s.verify(block) {
-		_, err = s.port.Read(block)
-		if err != nil {
-			return nil, err
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
 		}
-		fmt.Printf("RX (readspiflash, bloque 2): ")
-		s.printHex(block[:16])
-		fmt.Println("...")
 	}
-	
-	if s.verify(block) {
-		data := make([]byte, 1024)
-		copy(data, block[3:1027])
-		return data, nil
-	}
-	
-	return nil, fmt.Errorf("verification failed")
+	return crc
 }
 
 func (s *SPIFlash) dumpSPIFlash(filename string) error {
 	fmt.Println("Starting SPI flash dump...")
 	
+	s.CRC16 = nil
+	if s.ChecksumMode == ChecksumModeCRC16 {
+		s.CRC16 = crc16CCITT
+	}
+	
 	file, err := os.Create(filename)
 	if err != nil {
 		return fmt.Errorf("failed to create file: %v", err)
 	}
 	defer file.Close()
 	
-	for offset := uint32(0); offset < 4096; offset++ { // 4MB / 1024 = 4096 iteraciones
-		maxRetries := 3
-		var data []byte
-		
-		for retries := 0; retries < maxRetries; retries++ {
-			result, err := s.commandReadSPIFlash(offset)
-			if err == nil {
-				fmt.Printf("\rDumping SPI flash from address %#08x", offset*1024)
-				data = result
-				break
-			}
-			
-			if retries < maxRetries-1 {
-				fmt.Printf("\rTimeout at %#08x, retrying (%d/%d)", offset*1024, retries+1, maxRetries)
-				time.Sleep(100 * time.Millisecond)
-			} else {
-				return fmt.Errorf("failed after %d retries at offset %#08x: %v", maxRetries, offset*1024, err)
-			}
-		}
-		
-		if data != nil {
-			_, err := file.Write(data)
-			if err != nil {
-				return fmt.Errorf("failed to write to file: %v", err)
-			}
-		}
-		
+	blockSize := s.ResponseSize - 4
+	crcs, readTimes, err := s.Dump(file, func(block int, tracker *spilib.TransferTracker) {
 		// Progress indication
-		if (offset+1)%100 == 0 {
-			progress := float64(offset+1) / 4096.0 * 100
-			fmt.Printf(" (%.1f%%)", progress)
-		}
+		fmt.Printf("\rDumping SPI flash from address %#08x: %-60s", block*blockSize, tracker)
+	})
+	if err != nil {
+		return err
 	}
 	
 	fmt.Printf("\nSPI flash dump complete: %s\n", filename)
-	return nil
+	spilib.PrintReadTimes(readTimes, blockSize)
+	return spilib.WriteBlockIndex(filename, crcs, readTimes)
 }
 
-func (s *SPIFlash) getAvailablePorts() []string {
-	ports, err := serial.GetPortsList()
-	if err != nil {
-		return []string{}
-	}
-	sort.Strings(ports)
-	return ports
+// formatInfo describes a file format for list-formats. Header is the start
+// of a typical file, Detection how the format is chosen.
+type formatInfo struct {
+	Name        string
+	Extensions  string
+	Description string
+	Detection   []string
+	Header      []byte
+}
+
+// dumpFormats lists the files spi-flash writes
+var dumpFormats = []formatInfo{
+	{
+		Name:        "Binary backup",
+		Extensions:  "any, usually .bin",
+		Description: "Raw 4MB SPI flash contents, erased areas read as FF",
+		Detection:   []string{"always written (100%), no header"},
+		Header:      bytes.Repeat([]byte{0xFF}, 16),
+	},
+	{
+		Name:        "Block index",
+		Extensions:  "<backup_file>.idx",
+		Description: "CRC32 then read time in microseconds of every block, little endian",
+		Detection:   []string{"backup file name + .idx (100%), read by spi-tool verify-backup"},
+		Header:      bytes.Repeat([]byte{0xF4, 0xFF, 0x3A, 0xB8}, 4),
+	},
 }
 
-func (s *SPIFlash) disconnect() {
-	if s.port != nil {
-		s.port.Close()
-		s.port = nil
+func printFormats(formats []formatInfo, fallback string) {
+	for i, format := range formats {
+		if i > 0 {
+			fmt.Println()
+		}
+		ascii := make([]byte, len(format.Header))
+		for j, b := range format.Header {
+			ascii[j] = '.'
+			if b >= 0x20 && b < 0x7F {
+				ascii[j] = b
+			}
+		}
+		fmt.Printf("%s\n", format.Name)
+		fmt.Printf("  Extensions:  %s\n", format.Extensions)
+		fmt.Printf("  Description: %s\n", format.Description)
+		for j, detection := range format.Detection {
+			label := "Detection:"
+			if j > 0 {
+				label = ""
+			}
+			fmt.Printf("  %-12s %s\n", label, detection)
+		}
+		fmt.Printf("  Header:      % X  %s\n", format.Header, ascii)
 	}
+	fmt.Printf("\nFallback order: %s\n", fallback)
 }
 
 func showUsage() {
-	fmt.Printf("Usage: %s <port> <backup_file> [baudrate]\n", os.Args[0])
+	fmt.Printf("Usage: %s [--no-wait] [--force] [--checksum-crc16] <port> <backup_file> [baudrate]\n", os.Args[0])
+	fmt.Printf("       %s list-formats\n", os.Args[0])
 	fmt.Println("\nArguments:")
 	fmt.Println("  port        Serial port (e.g., /dev/ttyUSB0, COM3)")
 	fmt.Println("  backup_file Output file for SPI flash backup")
+	fmt.Println("\nOptions:")
+	fmt.Println("  --no-wait   Count down 3 seconds instead of waiting for Enter, for scripts")
+	fmt.Println("  --force     Start at once, without waiting for Enter or a countdown")
+	fmt.Println("  --checksum-crc16 Use CRC16-CCITT packet checksums, for newer firmware variants")
 	fmt.Println("\nExamples:")
 	fmt.Printf("  %s /dev/cu.wchusbserial112410 spi_backup.bin 115200\n", os.Args[0])
 	fmt.Printf("  %s COM3 spi_backup.bin 115200\n", os.Args[0])
 	fmt.Println("\nAvailable serial ports:")
 	
-	flasher := NewSPIFlash()
-	ports := flasher.getAvailablePorts()
+	ports := spilib.AvailablePorts()
 	for _, port := range ports {
 		fmt.Printf("  %s\n", port)
 	}
 }
 
+// parseArgs parses flags that may appear before, between or after the
+// positional arguments
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
 func main() {
-	if len(os.Args) < 3 {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.Usage = showUsage
+	noWait := fs.Bool("no-wait", false, "count down 3 seconds instead of waiting for Enter")
+	force := fs.Bool("force", false, "start at once, without waiting for Enter or a countdown")
+	checksumCRC16 := fs.Bool("checksum-crc16", false, "use CRC16-CCITT packet checksums")
+	
+	positional, err := parseArgs(fs, os.Args[1:])
+	if err != nil {
+		os.Exit(1)
+	}
+	if len(positional) == 1 && positional[0] == "list-formats" {
+		printFormats(dumpFormats, "spi-flash only writes raw binary backups")
+		return
+	}
+	if len(positional) < 2 {
 		showUsage()
 		os.Exit(1)
 	}
 	
-	portName := os.Args[1]
-	filename := os.Args[2]
+	portName := positional[0]
+	filename := positional[1]
 	
 	// Set default baud rate if not provided
 	baudRate := 115200
-	if len(os.Args) >= 4 {
-		var err error
-		baudRate, err = strconv.Atoi(os.Args[3])
+	if len(positional) >= 3 {
+		baudRate, err = strconv.Atoi(positional[2])
 		if err != nil {
-			fmt.Printf("Error: Invalid baud rate '%s'. Using default: 115200\n", os.Args[4])
+			fmt.Printf("Error: Invalid baud rate '%s'. Using default: 115200\n", positional[2])
 			baudRate = 115200
 		}
 	}
 	
 	// Verify port exists
 	flasher := NewSPIFlash()
-	ports := flasher.getAvailablePorts()
+	if *checksumCRC16 {
+		flasher.ChecksumMode = ChecksumModeCRC16
+	}
+	ports := spilib.AvailablePorts()
 	portFound := false
 	for _, port := range ports {
 		if port == portName {
@@ -238,12 +230,11 @@ func main() {
 	}
 	
 	// Connect to port
-	err := flasher.connectToPort(portName, baudRate)
+	err = flasher.Connect(portName, baudRate)
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		os.Exit(1)
 	}
-	defer flasher.disconnect()
 	
 	fmt.Printf("Connected to port: %s (%d)\n", portName, baudRate)
 	fmt.Printf("Output file: %s\n", filename)
@@ -254,10 +245,12 @@ func main() {
 	fmt.Println("2. Radio should be in NORMAL mode (not programming mode)")
 	fmt.Println("3. Press Enter to start SPI flash dump...")
 	
-	var input string
-	fmt.Scanln(&input)
+	spilib.WaitForStart(*noWait, *force)
 	
+	// Disconnect before os.Exit, which skips deferred calls, so the USB
+	// latency timer is put back
 	err = flasher.dumpSPIFlash(filename)
+	flasher.Disconnect()
 	if err != nil {
 		fmt.Printf("Backup failed: %v\n", err)
 		fmt.Println("\nTroubleshooting:")
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+// The root directory holds one program per file, so the tests of
+// spi-flash are run with its source file:
+//
+//	go test spi-flash.go spi-flash_test.go
+
+func TestCRC16CCITT(t *testing.T) {
+	// CRC-16/CCITT-FALSE check values. "123" is 0x5BCE, not the 0x3218
+	// sometimes quoted for it, which no common CRC16 variant gives.
+	tests := []struct {
+		data string
+		want uint16
+	}{
+		{"", 0xFFFF},
+		{"123", 0x5BCE},
+		{"123456789", 0x29B1},
+	}
+	for _, tt := range tests {
+		if got := crc16CCITT([]byte(tt.data)); got != tt.want {
+			t.Errorf("crc16CCITT(%q) = 0x%04X, want 0x%04X", tt.data, got, tt.want)
+		}
+	}
+}
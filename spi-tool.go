@@ -1,511 +1,2374 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"math/bits"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
-	"go.bug.st/serial"
+	"gopkg.in/yaml.v3"
+
+	"rt6d-flasher/internal/spilib"
 )
 
+// SPITool backs up and restores the SPI flash through the SPI client
+// shared with spi-flash
 type SPITool struct {
-	port serial.Port
+	*spilib.SPIClient
+	regionMap     *SPIRegionMap
+	skipHashCheck bool // Restore even if the .sha256 sidecar does not match
+
+	EraseBeforeWrite bool    // Erase each 4096 byte sector before a full restore writes it
+	WriteLogFile     string  // Block write log of a full restore, see blockWriteLog
+	VerifyWrites     bool    // Read every written block back and compare it
+	MaxReadRateKBps  float64 // Limit for backup block reads in KB/s, 0 for no limit
 }
 
 const (
-	CHUNK_SIZE    = 1024
-	SPI_FLASH_SIZE = 4 * 1024 * 1024 // 4MB typical SPI flash size
-	SPI_FLASH_FULL_SIZE = 32 * 1024 * 1024 // 32MB full SPI flash size
+	CHUNK_SIZE      = spilib.CHUNK_SIZE
+	SPI_FLASH_SIZE  = spilib.SPI_FLASH_SIZE // 4MB typical SPI flash size
+	SPI_SECTOR_SIZE = spilib.SPI_SECTOR_SIZE
 )
 
-// SPI Commands based on the Rust code
+// Calibration files written by calibration-backup start with
+// CALIBRATION_MAGIC, the radio model padded with zeros to 8 bytes and the
+// CRC32 of the calibration data, little endian
 const (
-	CMD_READ_SPI_FLASH = 0x52
+	CALIBRATION_MAGIC       = "RTCAL\x00"
+	CALIBRATION_MODEL       = "RT6D"
+	CALIBRATION_HEADER_SIZE = 6 + 8 + 4
+
+	// Calibration region of the RT6D (write command 0x48), used when the
+	// region map has no region named calibration
+	CALIBRATION_OFFSET = 3928064
+	CALIBRATION_SIZE   = 4096
 )
 
-// SPI Write Commands for different ranges
+// Channel memory files written with --eeprom-region start with
+// EEPROM_MAGIC, then the SPI offset and size of the data and its CRC32,
+// little endian
 const (
-	CMD_WRITE_SPI_0x40 = 0x40 // Range 0-2949119
-	CMD_WRITE_SPI_0x41 = 0x41 // Range 2949120-3112959
-	CMD_WRITE_SPI_0x42 = 0x42 // Range 3112960-3252223
-	CMD_WRITE_SPI_0x43 = 0x43 // Range 3252224-3260415
-	CMD_WRITE_SPI_0x47 = 0x47 // Range 3887104-3928063
-	CMD_WRITE_SPI_0x48 = 0x48 // Range 3928064-3932159 (Calibration)
-	CMD_WRITE_SPI_0x49 = 0x49 // Range 3936256-3977215
-	CMD_WRITE_SPI_0x4B = 0x4B // Range 4030464-4071423
-	CMD_WRITE_SPI_0x4C = 0x4C // Range 3260416-3887103
+	EEPROM_MAGIC       = "RTEEP\x00"
+	EEPROM_HEADER_SIZE = 6 + 4 + 4 + 4
 )
 
-type SPIRange struct {
-	cmd    byte
-	offset uint32
-	size   uint32
+// SPIRegion is a named area of the SPI flash
+type SPIRegion struct {
+	Name        string `yaml:"name"`
+	StartOffset uint32 `yaml:"start_offset"`
+	Size        uint32 `yaml:"size"`
+	Protected   bool   `yaml:"protected"` // Per-radio data such as calibration
 }
 
-func NewSPITool() *SPITool {
-	return &SPITool{}
-}
+// SPIRegionMap describes the layout of the SPI flash
+type SPIRegionMap struct {
+	Regions []SPIRegion `yaml:"regions"`
 
-func (s *SPITool) calculateChecksum(command []byte) byte {
-	var sum byte = 0
-	for _, b := range command[:len(command)-1] {
-		sum += b
-	}
-	return sum // No +82, just sum
+	// Packet sizes of radio variants that don't use 1028 byte packets,
+	// 0 for the default. --response-size and --command-size take precedence.
+	ResponseSize int `yaml:"response_size"`
+	CommandSize  int `yaml:"command_size"`
 }
 
-func (s *SPITool) setChecksum(command []byte) {
-	var sum byte = 0
-	for _, b := range command[:len(command)-1] {
-		sum += b
+// Layout of the RT6D, used when no --region-map is given
+//
+//go:embed rt6d-regions.yaml
+var defaultRegionMap []byte
+
+// LoadSPIRegionMap reads a region map file, or the built-in RT6D map if
+// path is empty
+func LoadSPIRegionMap(path string) (*SPIRegionMap, error) {
+	content := defaultRegionMap
+	if path != "" {
+		var err error
+		content, err = os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read region map: %v", err)
+		}
 	}
-	command[len(command)-1] = sum // No +82, just sum
-}
 
-func (s *SPITool) verifyChecksum(data []byte) bool {
-	if len(data) < 1 {
-		return false
+	m := &SPIRegionMap{}
+	if err := yaml.Unmarshal(content, m); err != nil {
+		return nil, fmt.Errorf("failed to parse region map: %v", err)
 	}
-	
-	lastIdx := len(data) - 1
-	var calculatedSum byte = 0
-	
-	// Solo sumar los bytes de datos, no el checksum
-	for _, b := range data[:lastIdx] {
-		calculatedSum += b
+
+	for _, r := range m.Regions {
+		if r.Name == "" || r.Size == 0 {
+			return nil, fmt.Errorf("region map entries need a name and a size")
+		}
+		if r.StartOffset%CHUNK_SIZE != 0 || r.Size%CHUNK_SIZE != 0 {
+			return nil, fmt.Errorf("region %s is not aligned to %d byte blocks", r.Name, CHUNK_SIZE)
+		}
+		if r.StartOffset+r.Size > SPI_FLASH_SIZE {
+			return nil, fmt.Errorf("region %s ends beyond the %d byte SPI flash", r.Name, SPI_FLASH_SIZE)
+		}
 	}
-	
-	return data[lastIdx] == calculatedSum
+	return m, nil
 }
 
-func (s *SPITool) commandReadSPIFlash(blockNum uint16) ([]byte, error) {
-	command := make([]byte, 4)
-	command[0] = CMD_READ_SPI_FLASH
-	command[1] = byte((blockNum >> 8) & 0xFF) // High byte del número de bloque
-	command[2] = byte(blockNum & 0xFF)        // Low byte del número de bloque
-	s.setChecksum(command)
-	
-	fmt.Printf("TX (read SPI flash block %d): ", blockNum)
-	s.printHex(command)
-	
-	_, err := s.port.Write(command)
-	if err != nil {
-		return nil, fmt.Errorf("failed to write read command: %v", err)
+func (m *SPIRegionMap) find(name string) (SPIRegion, bool) {
+	for _, r := range m.Regions {
+		if r.Name == name {
+			return r, true
+		}
 	}
-	
-	// Añadir delay después del envío
-	time.Sleep(50 * time.Millisecond)
-	
-	// Read response block (1028 bytes: 3 header + 1024 data + 1 checksum)
-	block := make([]byte, 1028)
-	
-	// Try to read the complete response with timeout
-	totalRead := 0
-	startTime := time.Now()
-	readTimeout := 3 * time.Second
-	
-	for totalRead < 1028 {
-		if time.Since(startTime) > readTimeout {
-			return nil, fmt.Errorf("timeout reading response after %v (got %d bytes)", readTimeout, totalRead)
+	return SPIRegion{}, false
+}
+
+// splitProtected covers the whole SPI flash with the regions that may be
+// restored, areas outside the map included, and returns the protected
+// regions separately
+func (m *SPIRegionMap) splitProtected() (restore, skip []SPIRegion) {
+	sorted := append([]SPIRegion(nil), m.Regions...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].StartOffset < sorted[j].StartOffset })
+
+	offset := uint32(0)
+	for _, r := range sorted {
+		if r.StartOffset > offset {
+			restore = append(restore, SPIRegion{
+				Name:        fmt.Sprintf("unmapped@0x%06X", offset),
+				StartOffset: offset,
+				Size:        r.StartOffset - offset,
+			})
 		}
-		
-		n, err := s.port.Read(block[totalRead:])
-		if err != nil {
-			return nil, fmt.Errorf("failed to read response at byte %d: %v", totalRead, err)
+		if r.Protected {
+			skip = append(skip, r)
+		} else {
+			restore = append(restore, r)
 		}
-		
-		if n > 0 {
-			totalRead += n
-			fmt.Printf("Read %d bytes, total: %d/1028\r", n, totalRead)
+		offset = r.StartOffset + r.Size
+	}
+	if offset < SPI_FLASH_SIZE {
+		restore = append(restore, SPIRegion{
+			Name:        fmt.Sprintf("unmapped@0x%06X", offset),
+			StartOffset: offset,
+			Size:        SPI_FLASH_SIZE - offset,
+		})
+	}
+	return restore, skip
+}
+
+// withoutProtected splits regions into those a region restore writes and
+// the protected ones it leaves alone, unless allowProtected is set
+func withoutProtected(regions []SPIRegion, allowProtected bool) (restore, skip []SPIRegion) {
+	for _, r := range regions {
+		if r.Protected && !allowProtected {
+			skip = append(skip, r)
 		} else {
-			// No data available, small delay
-			time.Sleep(10 * time.Millisecond)
+			restore = append(restore, r)
 		}
 	}
-	
-	fmt.Printf("\nRX (read SPI flash, %d bytes): ", totalRead)
-	s.printHex(block[:16]) // Print first 16 bytes for debugging
-	fmt.Println("...")
-	
-	// Check if this looks like a valid SPI response (header matches command)
-	if block[0] == CMD_READ_SPI_FLASH && block[1] == command[1] && block[2] == command[2] {
-		fmt.Printf("Valid SPI response header detected\n")
-		
-		// Verify checksum - if fails, try reading again (like in Rust code)
-		if !s.verifyChecksum(block) {
-			fmt.Printf("Checksum failed, trying second read...\n")
-			
-			// Try reading again
-			_, err = s.port.Read(block)
-			if err != nil {
-				return nil, fmt.Errorf("failed to read second response: %v", err)
+	return restore, skip
+}
+
+func printRestoreSummary(restore, skip []SPIRegion) {
+	describe := func(regions []SPIRegion) string {
+		text := ""
+		for i, r := range regions {
+			if i > 0 {
+				text += ", "
 			}
-			
-			fmt.Printf("RX (second read, %d bytes): ", len(block))
-			s.printHex(block[:16])
-			fmt.Println("...")
+			text += fmt.Sprintf("%s (%d bytes)", r.Name, r.Size)
 		}
-		
-		// If checksum still fails but header is correct, accept it anyway (SPI may be all FF)
-		if !s.verifyChecksum(block) {
-			fmt.Printf("Checksum verification failed but header is valid - accepting response\n")
-			fmt.Printf("Calculated checksum for debug: ")
-			
-			// Calculate what checksum should be
-			var expectedSum byte = 0
-			for _, b := range block[:1027] {
-				expectedSum += b
-			}
-			fmt.Printf("Expected: 0x%02X, Got: 0x%02X\n", expectedSum, block[1027])
+		if text == "" {
+			text = "nothing"
 		}
-	} else {
-		return nil, fmt.Errorf("invalid SPI response header: got %02X %02X %02X, expected %02X %02X %02X", 
-			block[0], block[1], block[2], CMD_READ_SPI_FLASH, command[1], command[2])
+		return text
 	}
-	
-	// Extract data (skip 3 header bytes, take 1024 data bytes)
-	data := make([]byte, 1024)
-	copy(data, block[3:1027])
-	
-	return data, nil
+	fmt.Printf("Restoring: %s, skipping: %s\n", describe(restore), describe(skip))
 }
 
-func (s *SPITool) commandWriteSPIFlash(blockNum uint16, data []byte) error {
-	if len(data) != 1024 {
-		return fmt.Errorf("data must be exactly 1024 bytes, got %d", len(data))
+func (m *SPIRegionMap) print() {
+	fmt.Printf("%-14s %-10s %-10s %10s\n", "Name", "Start", "End", "Size")
+	for _, r := range m.Regions {
+		protected := ""
+		if r.Protected {
+			protected = "  (protected)"
+		}
+		fmt.Printf("%-14s 0x%06X   0x%06X   %10d%s\n", r.Name, r.StartOffset, r.StartOffset+r.Size-1, r.Size, protected)
 	}
-	
-	// Simple write command without range logic
-	command := make([]byte, 1028)
-	command[0] = 0x57 // Simple write command
-	command[1] = byte((blockNum >> 8) & 0xFF) // High byte del número de bloque
-	command[2] = byte(blockNum & 0xFF)        // Low byte del número de bloque
-	copy(command[3:1027], data)
-	s.setChecksum(command)
-	
-	fmt.Printf("TX (write SPI flash block %d): ", blockNum)
-	s.printHex(command[:16])
-	fmt.Println("...")
-	
-	_, err := s.port.Write(command)
-	if err != nil {
-		return fmt.Errorf("failed to write command: %v", err)
+}
+
+func NewSPITool() *SPITool {
+	client := spilib.NewSPIClient(SPI_FLASH_SIZE, 0) // No +82, just sum
+	client.BlockDelay = 20 * time.Millisecond
+	return &SPITool{SPIClient: client}
+}
+
+// blockSize is the number of data bytes per block, ResponseSize-4. main
+// checks with packetBlockSize that writes carry as many.
+func (s *SPITool) blockSize() int {
+	return s.ResponseSize - 4
+}
+
+// packetBlockSize returns the data bytes per block of a read response and
+// a write command of the given sizes. Backups are restored block by block,
+// so both must carry the same amount, and the regions and sectors are
+// aligned to 1024 byte blocks, so the blocks must divide that.
+func packetBlockSize(responseSize, commandSize int) (int, error) {
+	if responseSize != commandSize {
+		return 0, fmt.Errorf("response size %d and command size %d must be equal, backups are restored block by block", responseSize, commandSize)
 	}
-	
-	// Añadir delay después del envío
-	time.Sleep(100 * time.Millisecond) // Longer delay for write operations
-	
-	// Read response with timeout
-	response := make([]byte, 1)
-	startTime := time.Now()
-	readTimeout := 5 * time.Second // Longer timeout for writes
-	
-	for {
-		if time.Since(startTime) > readTimeout {
-			return fmt.Errorf("timeout waiting for write response after %v", readTimeout)
-		}
-		
-		n, err := s.port.Read(response)
-		if err != nil {
-			return fmt.Errorf("failed to read response: %v", err)
-		}
-		
-		if n > 0 {
-			break
-		}
-		
-		time.Sleep(10 * time.Millisecond)
+	blockSize := responseSize - 4
+	if blockSize < 128 || CHUNK_SIZE%blockSize != 0 {
+		return 0, fmt.Errorf("a %d byte packet carries %d data bytes, which must be at least 128 and divide %d", responseSize, blockSize, CHUNK_SIZE)
 	}
-	
-	fmt.Printf("RX (write SPI flash): ")
-	s.printHex(response)
-	
-	switch response[0] {
-	case 0x06: // ACK
+	return blockSize, nil
+}
+
+// readInterval is the minimum time between the starts of two block reads
+// for MaxReadRateKBps, 0 without a limit
+func (s *SPITool) readInterval() time.Duration {
+	if s.MaxReadRateKBps <= 0 {
+		return 0
+	}
+	return time.Duration(float64(s.blockSize()) / (s.MaxReadRateKBps * 1024) * float64(time.Second))
+}
+
+// writeBlock writes one block and, with VerifyWrites, reads it back. A
+// mismatch is reported with a hex dump around the first differing byte.
+func (s *SPITool) writeBlock(block int, data []byte) error {
+	if err := s.WriteBlock(uint16(block), data); err != nil {
+		return fmt.Errorf("failed to write block %d: %v", block, err)
+	}
+	if !s.VerifyWrites {
 		return nil
-	default:
-		return fmt.Errorf("device rejected write command, response: 0x%02X", response[0])
 	}
+	
+	got, err := s.ReadBlockWithRetry(block)
+	if err != nil {
+		return fmt.Errorf("failed to read back block %d: %v", block, err)
+	}
+	if diff := spilib.FormatBlockDiff(data, got); diff != "" {
+		return fmt.Errorf("block %d (offset 0x%06X) reads back different from what was written, %s",
+			block, block*s.blockSize(), diff)
+	}
+	return nil
 }
 
 func (s *SPITool) backupSPIFlash(filename string) error {
 	fmt.Println("Starting SPI flash backup...")
 	
-	file, err := os.Create(filename)
+	file, err := createBackupWriter(filename)
 	if err != nil {
 		return fmt.Errorf("failed to create backup file: %v", err)
 	}
 	defer file.Close()
 	
-	// 4096 blocks of 1024 bytes = 4MB total
-	totalBlocks := 4096
-	
-	for block := 0; block < totalBlocks; block++ {
-		blockNum := uint16(block)
-		
-		maxRetries := 3
-		var data []byte
-		
-		for retries := 0; retries < maxRetries; retries++ {
-			result, err := s.commandReadSPIFlash(blockNum)
-			if err == nil {
-				fmt.Printf("\rDumping SPI flash from address %#06x", block*1024)
-				data = result
-				break
-			}
-			
-			if retries < maxRetries-1 {
-				fmt.Printf("\rTimeout at %#06x, retrying (%d/%d)", block*1024, retries+1, maxRetries)
-				time.Sleep(100 * time.Millisecond)
-			} else {
-				fmt.Printf("\nFailed after %d retries at block %d: %v\n", maxRetries, block, err)
-				fmt.Println("Make sure the radio is ON and in normal mode (not programming mode).")
-				return fmt.Errorf("failed to read block %d: %v", block, err)
-			}
-		}
-		
-		if data != nil {
-			_, err := file.Write(data)
-			if err != nil {
-				return fmt.Errorf("failed to write to backup file: %v", err)
-			}
-		}
-		
-		// Small delay between blocks to not overwhelm the radio
-		time.Sleep(20 * time.Millisecond)
-		
+	// 4096 blocks of 1024 bytes = 4MB total with the default packets
+	crcs, readTimes, err := s.Dump(file, func(block int, tracker *spilib.TransferTracker) {
 		// Progress indication
-		if (block+1)%100 == 0 {
-			progress := float64(block+1) / float64(totalBlocks) * 100
-			fmt.Printf(" (%.1f%%)", progress)
+		if (block+1)%10 == 0 {
+			fmt.Printf("\rBacking up: %-60s", tracker)
 		}
+	})
+	if err != nil {
+		return err
 	}
+	fmt.Println()
+	
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to finish backup file: %v", err)
+	}
+	printCompression(filename, SPI_FLASH_SIZE)
+	if err := writeHashSidecar(filename); err != nil {
+		return err
+	}
+	if err := spilib.WriteBlockIndex(filename, crcs, readTimes); err != nil {
+		return err
+	}
+	spilib.PrintReadTimes(readTimes, s.blockSize())
 	
 	fmt.Printf("\nBackup completed successfully! %d bytes written to %s\n", SPI_FLASH_SIZE, filename)
 	return nil
 }
 
-func (s *SPITool) restoreSPIFlash(filename string) error {
-	fmt.Println("Starting SPI flash restore...")
-	fmt.Println("WARNING: This will overwrite the SPI flash content!")
+// SREC_RECORD_SIZE is the number of data bytes per S3 record written by
+// backupSPIFlashAsSREC
+const SREC_RECORD_SIZE = 32
+
+// backupSPIFlashAsSREC backs up the SPI flash as Motorola S-records for
+// factory programming tools: an S0 header with the file name and time, S3
+// records with the SPI offset as address and an S7 end record
+func (s *SPITool) backupSPIFlashAsSREC(filename string) error {
+	fmt.Println("Starting SPI flash backup (S-record format)...")
 	
-	file, err := os.Open(filename)
+	file, err := createBackupWriter(filename)
 	if err != nil {
-		return fmt.Errorf("failed to open restore file: %v", err)
+		return fmt.Errorf("failed to create backup file: %v", err)
 	}
 	defer file.Close()
 	
-	// Get file size
-	fileInfo, err := file.Stat()
-	if err != nil {
-		return fmt.Errorf("failed to get file info: %v", err)
+	header := fmt.Sprintf("%s %s", filepath.Base(filename), time.Now().UTC().Format(time.RFC3339))
+	if len(header) > 252 {
+		header = header[len(header)-252:]
+	}
+	if _, err := io.WriteString(file, srecRecord('0', []byte{0, 0}, []byte(header))); err != nil {
+		return fmt.Errorf("failed to write to backup file: %v", err)
 	}
 	
-	fileSize := fileInfo.Size()
-	if fileSize != SPI_FLASH_SIZE {
-		return fmt.Errorf("restore file must be exactly %d bytes, got %d", SPI_FLASH_SIZE, fileSize)
+	records := &srecWriter{w: file, recordSize: SREC_RECORD_SIZE}
+	_, readTimes, err := s.Dump(records, func(block int, tracker *spilib.TransferTracker) {
+		if (block+1)%10 == 0 {
+			fmt.Printf("\rBacking up: %-60s", tracker)
+		}
+	})
+	if err != nil {
+		return err
 	}
+	fmt.Println()
 	
-	totalBlocks := int(fileSize) / CHUNK_SIZE
-	buffer := make([]byte, CHUNK_SIZE)
+	if err := records.Close(); err != nil {
+		return fmt.Errorf("failed to write to backup file: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to finish backup file: %v", err)
+	}
+	spilib.PrintReadTimes(readTimes, s.blockSize())
 	
-	for block := 0; block < totalBlocks; block++ {
-		blockNum := uint16(block)
-		
-		// Read block from file
-		n, err := file.Read(buffer)
-		if err != nil && n == 0 {
-			break
-		}
-		
-		// Pad with 0xFF if partial block (typical for flash memory)
-		if n < CHUNK_SIZE {
-			for i := n; i < CHUNK_SIZE; i++ {
-				buffer[i] = 0xFF
-			}
-		}
-		
-		fmt.Printf("Writing block %d/%d...\n", block+1, totalBlocks)
-		
-		err = s.commandWriteSPIFlash(blockNum, buffer)
-		if err != nil {
-			return fmt.Errorf("failed to write block %d: %v", block, err)
-		}
-		
-		// Small delay between blocks to not overwhelm the radio
-		time.Sleep(20 * time.Millisecond)
-		
-		// Progress indication
-		if (block+1)%100 == 0 {
-			progress := float64(block+1) / float64(totalBlocks) * 100
-			fmt.Printf("Progress: %.1f%% (%d/%d blocks)\n", progress, block+1, totalBlocks)
+	fmt.Printf("\nBackup completed successfully! %d bytes written to %s as %d S3 records\n",
+		records.address, filename, records.records)
+	return nil
+}
+
+// srecWriter turns the bytes written to it into S3 records of recordSize
+// bytes, addressed from 0. Close writes the last partial record and the S7
+// end record.
+type srecWriter struct {
+	w          io.Writer
+	recordSize int
+	address    uint32 // Address of the first byte in pending
+	pending    []byte
+	records    int
+}
+
+func (s *srecWriter) Write(data []byte) (int, error) {
+	s.pending = append(s.pending, data...)
+	for len(s.pending) >= s.recordSize {
+		if err := s.flush(s.recordSize); err != nil {
+			return 0, err
 		}
 	}
-	
-	fmt.Printf("Restore completed successfully! %d blocks written from %s\n", totalBlocks, filename)
+	return len(data), nil
+}
+
+func (s *srecWriter) flush(n int) error {
+	address := binary.BigEndian.AppendUint32(nil, s.address)
+	if _, err := io.WriteString(s.w, srecRecord('3', address, s.pending[:n])); err != nil {
+		return err
+	}
+	s.pending = s.pending[n:]
+	s.address += uint32(n)
+	s.records++
 	return nil
 }
 
-func (s *SPITool) getAvailablePorts() []string {
-	ports, err := serial.GetPortsList()
-	if err != nil {
-		return []string{}
+func (s *srecWriter) Close() error {
+	if len(s.pending) > 0 {
+		if err := s.flush(len(s.pending)); err != nil {
+			return err
+		}
 	}
-	sort.Strings(ports)
-	return ports
+	_, err := io.WriteString(s.w, srecRecord('7', []byte{0, 0, 0, 0}, nil))
+	return err
 }
 
-func (s *SPITool) printHex(data []byte) {
+// srecRecord formats one S-record line like hex2bin does. The count covers
+// address, data and checksum, the checksum is the one's complement of the
+// sum of the count, address and data bytes.
+func srecRecord(recordType byte, address, data []byte) string {
+	count := byte(len(address) + len(data) + 1)
+	sum := count
+	for _, b := range address {
+		sum += b
+	}
 	for _, b := range data {
-		fmt.Printf("%02X ", b)
+		sum += b
 	}
-	fmt.Println()
+	return fmt.Sprintf("S%c%02X%X%X%02X\n", recordType, count, address, data, ^sum)
 }
 
-func (s *SPITool) connectToPort(portName string, baudRate int) error {
-	mode := &serial.Mode{
-		BaudRate: baudRate,
-		DataBits: 8,
-		Parity:   serial.NoParity,
-		StopBits: serial.OneStopBit,
+// backupWriter writes a backup file, gzip compressed for .gz file names
+type backupWriter struct {
+	io.Writer
+	gz   *gzip.Writer
+	file *os.File
+}
+
+func createBackupWriter(filename string) (*backupWriter, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
 	}
 	
-	port, err := serial.Open(portName, mode)
+	w := &backupWriter{Writer: file, file: file}
+	if strings.HasSuffix(strings.ToLower(filename), ".gz") {
+		w.gz = gzip.NewWriter(file)
+		w.Writer = w.gz
+	}
+	return w, nil
+}
+
+// Close flushes the gzip stream, if any, and closes the file
+func (w *backupWriter) Close() error {
+	if w.gz != nil {
+		if err := w.gz.Close(); err != nil {
+			w.file.Close()
+			return err
+		}
+	}
+	return w.file.Close()
+}
+
+// loadBackupFile reads a backup file, decompressing .gz files
+func loadBackupFile(filename string) ([]byte, error) {
+	file, err := os.Open(filename)
 	if err != nil {
-		return fmt.Errorf("failed to open port %s: %v", portName, err)
+		return nil, err
 	}
+	defer file.Close()
 	
-	// Set read timeout to 2 seconds like in Rust code
-	err = port.SetReadTimeout(2 * time.Second)
-	if err != nil {
-		port.Close()
-		return fmt.Errorf("failed to set read timeout: %v", err)
+	var reader io.Reader = file
+	if strings.HasSuffix(strings.ToLower(filename), ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open gzip stream: %v", err)
+		}
+		defer gz.Close()
+		reader = gz
 	}
 	
-	s.port = port
-	return nil
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	printCompression(filename, len(data))
+	return data, nil
 }
 
-func (s *SPITool) disconnect() {
-	if s.port != nil {
-		s.port.Close()
-		s.port = nil
+// printCompression shows the size of a compressed backup compared to the
+// size of the SPI data it holds
+func printCompression(filename string, rawSize int) {
+	if !strings.HasSuffix(strings.ToLower(filename), ".gz") {
+		return
 	}
+	info, err := os.Stat(filename)
+	if err != nil || rawSize == 0 {
+		return
+	}
+	fmt.Printf("\nCompressed size: %d bytes (%.1f%% of %d bytes)\n",
+		info.Size(), float64(info.Size())/float64(rawSize)*100, rawSize)
 }
 
-func showUsage() {
-	fmt.Printf("Usage: %s <command> <port> <file> [baudrate]\n", os.Args[0])
-	fmt.Println("\nCommands:")
-	fmt.Println("  backup   - Backup SPI flash to file")
-	fmt.Println("  restore  - Restore SPI flash from file")
-	fmt.Println("\nArguments:")
-	fmt.Println("  port     - Serial port (e.g., /dev/ttyUSB0, COM3)")
-	fmt.Println("  file     - Backup/restore file path")
-	fmt.Println("\nExamples:")
-	fmt.Printf("  %s backup /dev/cu.wchusbserial112410 spi_backup.bin 115200\n", os.Args[0])
-	fmt.Printf("  %s restore /dev/cu.wchusbserial112410 spi_backup.bin 115200\n", os.Args[0])
-	fmt.Println("\nAvailable serial ports:")
+// fileSHA256 returns the hex encoded SHA-256 of a file
+func fileSHA256(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
 	
-	tool := NewSPITool()
-	ports := tool.getAvailablePorts()
-	for _, port := range ports {
-		fmt.Printf("  %s\n", port)
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
 	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
-func main() {
-	if len(os.Args) < 4 {
-		showUsage()
-		os.Exit(1)
+// writeHashSidecar stores the SHA-256 of a backup in <filename>.sha256,
+// in the format of sha256sum
+func writeHashSidecar(filename string) error {
+	sum, err := fileSHA256(filename)
+	if err != nil {
+		return fmt.Errorf("failed to hash backup file: %v", err)
 	}
 	
-	command := os.Args[1]
-	portName := os.Args[2]
-	filename := os.Args[3]
+	sidecar := filename + ".sha256"
+	content := fmt.Sprintf("%s  %s\n", sum, filepath.Base(filename))
+	if err := os.WriteFile(sidecar, []byte(content), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", sidecar, err)
+	}
+	fmt.Printf("\nSHA-256: %s (saved to %s)\n", sum, sidecar)
+	return nil
+}
+
+// verifyHashSidecar compares a restore file with its .sha256 sidecar, if
+// there is one. It must pass before the first block is written.
+func (s *SPITool) verifyHashSidecar(filename string) error {
+	sum, err := fileSHA256(filename)
+	if err != nil {
+		return fmt.Errorf("failed to hash restore file: %v", err)
+	}
+	fmt.Printf("Restore file SHA-256: %s\n", sum)
 	
-	// Validate command
-	if command != "backup" && command != "restore" {
-		fmt.Printf("Error: Invalid command '%s'. Use 'backup' or 'restore'\n\n", command)
-		showUsage()
-		os.Exit(1)
+	content, err := os.ReadFile(filename + ".sha256")
+	if os.IsNotExist(err) {
+		fmt.Println("No .sha256 sidecar found, skipping integrity check")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read hash sidecar: %v", err)
 	}
 	
-	// Set default baud rate if not provided
-	baudRate := 115200
-	if len(os.Args) >= 5 {
-		var err error
-		baudRate, err = strconv.Atoi(os.Args[4])
-		if err != nil {
-			fmt.Printf("Error: Invalid baud rate '%s'. Using default: 115200\n", os.Args[4])
-			baudRate = 115200
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return fmt.Errorf("hash sidecar %s.sha256 is empty", filename)
+	}
+	if !strings.EqualFold(fields[0], sum) {
+		if s.skipHashCheck {
+			fmt.Println("WARNING: SHA-256 does not match the sidecar, continuing because of --skip-hash-check")
+			return nil
 		}
+		return fmt.Errorf("SHA-256 mismatch, the backup file is corrupted or was modified (expected %s, use --skip-hash-check to override)", fields[0])
+	}
+	fmt.Println("SHA-256 matches the sidecar file")
+	return nil
+}
+
+// blockCRCs returns the CRC32 of every blockSize byte block of data
+func blockCRCs(data []byte, blockSize int) []uint32 {
+	crcs := make([]uint32, 0, len(data)/blockSize)
+	for offset := 0; offset+blockSize <= len(data); offset += blockSize {
+		crcs = append(crcs, crc32.ChecksumIEEE(data[offset:offset+blockSize]))
+	}
+	return crcs
+}
+
+// analyzeBackup lists the slowest blocks recorded in the .idx sidecar of a
+// backup of blockSize byte blocks without talking to a radio
+func analyzeBackup(filename string, blockSize int) error {
+	content, err := loadBackupFile(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open backup file: %v", err)
+	}
+	_, readTimes, err := spilib.LoadBlockIndex(filename, len(content)/blockSize)
+	if err != nil {
+		return err
+	}
+	if readTimes == nil {
+		return fmt.Errorf("%s.idx has no block read times, make a new backup to record them", filename)
 	}
 	
-	// Verify port exists
-	tool := NewSPITool()
-	ports := tool.getAvailablePorts()
-	portFound := false
-	for _, port := range ports {
-		if port == portName {
-			portFound = true
-			break
+	spilib.PrintReadTimes(readTimes, blockSize)
+	
+	blocks := make([]int, 0, len(readTimes))
+	for block, t := range readTimes {
+		if t > 0 {
+			blocks = append(blocks, block)
 		}
 	}
+	sort.SliceStable(blocks, func(i, j int) bool { return readTimes[blocks[i]] > readTimes[blocks[j]] })
+	if len(blocks) > 10 {
+		blocks = blocks[:10]
+	}
 	
-	if !portFound {
-		fmt.Printf("Error: Port '%s (%d)' not found\n\n", portName, baudRate)
-		showUsage()
-		os.Exit(1)
+	fmt.Println("\nSlowest blocks:")
+	for _, block := range blocks {
+		fmt.Printf("  block %4d  offset 0x%06X  %.1f ms\n", block, block*blockSize, float64(readTimes[block])/1000)
+	}
+	
+	slow := spilib.SlowBlocks(readTimes)
+	switch {
+	case len(slow) == 0:
+		fmt.Println("\nNo block took more than 3x the median, the flash chip looks healthy.")
+	case len(slow) < 10:
+		fmt.Printf("\n%d blocks took more than 3x the median. Make another backup; if the same blocks\n", len(slow))
+		fmt.Println("are slow again, the flash chip is wearing out and should be replaced soon.")
+	default:
+		fmt.Printf("\n%d blocks took more than 3x the median, consider replacing the flash chip.\n", len(slow))
+	}
+	return nil
+}
+
+// checkBlock compares block number block of a backup with its index entry.
+// A nil index means there is nothing to check.
+func checkBlock(crcs []uint32, block int, data []byte) error {
+	if crcs == nil {
+		return nil
+	}
+	if block >= len(crcs) {
+		return fmt.Errorf("block %d is not in the block index", block)
+	}
+	if crc := crc32.ChecksumIEEE(data); crc != crcs[block] {
+		return fmt.Errorf("block %d is corrupted (CRC32 %08X, index says %08X)", block, crc, crcs[block])
+	}
+	return nil
+}
+
+// corruptBlocks returns the blocks of blockSize bytes of a backup that
+// differ from their index entry, printing each of them
+func corruptBlocks(content []byte, crcs []uint32, blockSize int) []int {
+	var bad []int
+	for block := range crcs {
+		if err := checkBlock(crcs, block, content[block*blockSize:(block+1)*blockSize]); err != nil {
+			fmt.Printf("Block %d (offset 0x%06X): %v\n", block, block*blockSize, err)
+			bad = append(bad, block)
+		}
+	}
+	return bad
+}
+
+// verifyBackup checks every blockSize byte block of a backup against its
+// .idx sidecar without talking to a radio
+func verifyBackup(filename string, blockSize int) error {
+	content, err := loadBackupFile(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open backup file: %v", err)
+	}
+	if len(content)%blockSize != 0 {
+		return fmt.Errorf("backup has %d bytes, not a whole number of blocks", len(content))
+	}
+	
+	crcs, _, err := spilib.LoadBlockIndex(filename, len(content)/blockSize)
+	if err != nil {
+		return err
+	}
+	if crcs == nil {
+		return fmt.Errorf("no block index %s.idx found", filename)
+	}
+	
+	if bad := corruptBlocks(content, crcs, blockSize); len(bad) > 0 {
+		return fmt.Errorf("%d of %d blocks are corrupted", len(bad), len(crcs))
+	}
+	fmt.Printf("All %d blocks match the index\n", len(crcs))
+	return nil
+}
+
+// ChangedRegion is a run of consecutive blocks that differ between two
+// SPI backups
+type ChangedRegion struct {
+	StartOffset   uint32
+	EndOffset     uint32 // First offset after the run
+	BlocksChanged int
+}
+
+// compareSPIBackups compares two backups block by block and returns the
+// runs of changed blocks
+func compareSPIBackups(fileA, fileB string) ([]ChangedRegion, error) {
+	a, b, err := loadBackupPair(fileA, fileB)
+	if err != nil {
+		return nil, err
+	}
+	return compareSPIImages(a, b), nil
+}
+
+// loadBackupPair loads two backups of the same size
+func loadBackupPair(fileA, fileB string) ([]byte, []byte, error) {
+	a, err := loadBackupFile(fileA)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open %s: %v", fileA, err)
+	}
+	b, err := loadBackupFile(fileB)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open %s: %v", fileB, err)
+	}
+	if len(a) != len(b) {
+		return nil, nil, fmt.Errorf("%s has %d bytes but %s has %d", fileA, len(a), fileB, len(b))
+	}
+	if len(a)%CHUNK_SIZE != 0 {
+		return nil, nil, fmt.Errorf("backups have %d bytes, not a whole number of blocks", len(a))
+	}
+	return a, b, nil
+}
+
+func compareSPIImages(a, b []byte) []ChangedRegion {
+	var changes []ChangedRegion
+	for offset := 0; offset < len(a); offset += CHUNK_SIZE {
+		if bytes.Equal(a[offset:offset+CHUNK_SIZE], b[offset:offset+CHUNK_SIZE]) {
+			continue
+		}
+		if n := len(changes); n > 0 && changes[n-1].EndOffset == uint32(offset) {
+			changes[n-1].EndOffset += CHUNK_SIZE
+			changes[n-1].BlocksChanged++
+			continue
+		}
+		changes = append(changes, ChangedRegion{
+			StartOffset:   uint32(offset),
+			EndOffset:     uint32(offset + CHUNK_SIZE),
+			BlocksChanged: 1,
+		})
+	}
+	return changes
+}
+
+// regionNames lists the regions overlapping start to end (excluded)
+func (m *SPIRegionMap) regionNames(start, end uint32) string {
+	var names []string
+	for _, r := range m.Regions {
+		if r.StartOffset < end && start < r.StartOffset+r.Size {
+			names = append(names, r.Name)
+		}
+	}
+	if len(names) == 0 {
+		return "unmapped"
+	}
+	return strings.Join(names, ", ")
+}
+
+// printSPIComparison implements compare-spi. With hexDiff the bytes around
+// the first difference of every changed block are shown.
+func printSPIComparison(fileA, fileB string, regionMap *SPIRegionMap, hexDiff bool) error {
+	a, b, err := loadBackupPair(fileA, fileB)
+	if err != nil {
+		return err
+	}
+	changes := compareSPIImages(a, b)
+	if len(changes) == 0 {
+		fmt.Println("The backups are identical")
+		return nil
+	}
+	
+	fmt.Printf("%-10s %-10s %10s %7s  %s\n", "Start", "End", "Size", "Blocks", "Region")
+	for _, c := range changes {
+		fmt.Printf("0x%06X   0x%06X   %10d %7d  %s\n", c.StartOffset, c.EndOffset-1, c.EndOffset-c.StartOffset,
+			c.BlocksChanged, regionMap.regionNames(c.StartOffset, c.EndOffset))
+		if !hexDiff {
+			continue
+		}
+		for block := c.StartOffset; block < c.EndOffset; block += CHUNK_SIZE {
+			diff := spilib.FormatBlockDiff(a[block:block+CHUNK_SIZE], b[block:block+CHUNK_SIZE])
+			if diff == "" {
+				continue
+			}
+			lines := strings.Split(strings.TrimSuffix(diff, "\n"), "\n")
+			fmt.Printf("  block %d, %s\n", block/CHUNK_SIZE, lines[0])
+			for _, line := range lines[1:] {
+				fmt.Printf("    %s\n", line)
+			}
+		}
+	}
+	
+	total := 0
+	for _, c := range changes {
+		total += c.BlocksChanged
+	}
+	fmt.Printf("\n%d changed blocks in %d regions\n", total, len(changes))
+	return nil
+}
+
+// backupSPIRegions reads only the blocks of the given regions. With
+// fullLayout the file is a complete 4MB image where everything outside the
+// regions is 0xFF, otherwise the regions are stored back to back.
+func (s *SPITool) backupSPIRegions(filename string, regions []SPIRegion, fullLayout bool) error {
+	fmt.Println("Starting SPI flash region backup...")
+	
+	blockSize := s.blockSize()
+	var image []byte
+	var readTimes []uint32 // 0 for the blocks outside the regions
+	if fullLayout {
+		image = make([]byte, SPI_FLASH_SIZE)
+		for i := range image {
+			image[i] = 0xFF
+		}
+		readTimes = make([]uint32, SPI_FLASH_SIZE/blockSize)
+	}
+	
+	limiter := s.NewReadLimiter()
+	defer limiter.Stop()
+	first := true
+	for _, r := range regions {
+		fmt.Printf("\nBacking up region %s (%d bytes)\n", r.Name, r.Size)
+		
+		firstBlock := int(r.StartOffset) / blockSize
+		for block := firstBlock; block < firstBlock+int(r.Size)/blockSize; block++ {
+			if !first {
+				limiter.Wait()
+			}
+			first = false
+			start := time.Now()
+			data, err := s.ReadBlockWithRetry(block)
+			if err != nil {
+				return err
+			}
+			readTime := spilib.ReadTimeMicros(time.Since(start))
+			if fullLayout {
+				copy(image[block*blockSize:], data)
+				readTimes[block] = readTime
+			} else {
+				image = append(image, data...)
+				readTimes = append(readTimes, readTime)
+			}
+			
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	
+	file, err := createBackupWriter(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create backup file: %v", err)
+	}
+	defer file.Close()
+	
+	if _, err := file.Write(image); err != nil {
+		return fmt.Errorf("failed to write to backup file: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to finish backup file: %v", err)
+	}
+	printCompression(filename, len(image))
+	if err := writeHashSidecar(filename); err != nil {
+		return err
+	}
+	if err := spilib.WriteBlockIndex(filename, blockCRCs(image, blockSize), readTimes); err != nil {
+		return err
+	}
+	spilib.PrintReadTimes(readTimes, blockSize)
+	
+	fmt.Printf("\nRegion backup completed successfully! Saved to %s\n", filename)
+	return nil
+}
+
+// restoreSPIRegion restores only the region regionName, all other blocks of
+// the radio are left untouched
+func (s *SPITool) restoreSPIRegion(filename string, regionName string) error {
+	region, ok := s.regionMap.find(regionName)
+	if !ok {
+		return fmt.Errorf("unknown region '%s'", regionName)
+	}
+	
+	var skip []SPIRegion
+	for _, r := range s.regionMap.Regions {
+		if r.Name != regionName {
+			skip = append(skip, r)
+		}
+	}
+	printRestoreSummary([]SPIRegion{region}, skip)
+	
+	return s.restoreSPIRegions(filename, []SPIRegion{region})
+}
+
+// restoreUnprotected restores the whole SPI flash except the regions marked
+// protected in the region map (e.g. calibration)
+func (s *SPITool) restoreUnprotected(filename string) error {
+	restore, skip := s.regionMap.splitProtected()
+	printRestoreSummary(restore, skip)
+	
+	return s.restoreSPIRegions(filename, restore)
+}
+
+// restoreSPIRegions writes only the blocks of the given regions. The file
+// may be a complete 4MB image or, for a single region, just that region.
+func (s *SPITool) restoreSPIRegions(filename string, regions []SPIRegion) error {
+	fmt.Println("Starting SPI flash region restore...")
+	
+	if err := s.verifyHashSidecar(filename); err != nil {
+		return err
+	}
+	
+	content, err := loadBackupFile(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open restore file: %v", err)
+	}
+	file := bytes.NewReader(content)
+	
+	fullLayout := file.Size() == SPI_FLASH_SIZE
+	if !fullLayout && (len(regions) != 1 || file.Size() != int64(regions[0].Size)) {
+		return fmt.Errorf("restore file must be a %d byte SPI image or exactly the size of a single region, got %d bytes",
+			SPI_FLASH_SIZE, file.Size())
+	}
+	
+	blockSize := s.blockSize()
+	crcs, _, err := spilib.LoadBlockIndex(filename, int(file.Size())/blockSize)
+	if err != nil {
+		return err
+	}
+	
+	buffer := make([]byte, blockSize)
+	for _, r := range regions {
+		fmt.Printf("Restoring region %s (%d bytes)\n", r.Name, r.Size)
+		fileOffset := int64(0)
+		if fullLayout {
+			fileOffset = int64(r.StartOffset)
+		}
+		
+		firstBlock := int(r.StartOffset) / blockSize
+		totalBlocks := int(r.Size) / blockSize
+		for i := 0; i < totalBlocks; i++ {
+			if _, err := file.ReadAt(buffer, fileOffset+int64(i*blockSize)); err != nil {
+				return fmt.Errorf("failed to read restore file: %v", err)
+			}
+			if err := checkBlock(crcs, int(fileOffset)/blockSize+i, buffer); err != nil {
+				return fmt.Errorf("not restoring: %v", err)
+			}
+			
+			block := firstBlock + i
+			fmt.Printf("Writing block %d (%d/%d of %s)...\n", block, i+1, totalBlocks, r.Name)
+			if err := s.writeBlock(block, buffer); err != nil {
+				return err
+			}
+			
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	
+	fmt.Printf("Region restore completed successfully from %s\n", filename)
+	return nil
+}
+
+func (s *SPITool) restoreSPIFlash(filename string) error {
+	fmt.Println("Starting SPI flash restore...")
+	fmt.Println("WARNING: This will overwrite the SPI flash content!")
+	
+	if err := s.verifyHashSidecar(filename); err != nil {
+		return err
+	}
+	
+	// .gz backups are decompressed transparently
+	content, err := loadBackupFile(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open restore file: %v", err)
+	}
+	file := bytes.NewReader(content)
+	
+	fileSize := file.Size()
+	if fileSize != SPI_FLASH_SIZE {
+		return fmt.Errorf("restore file must be exactly %d bytes, got %d", SPI_FLASH_SIZE, fileSize)
+	}
+	
+	blockSize := s.blockSize()
+	totalBlocks := int(fileSize) / blockSize
+	buffer := make([]byte, blockSize)
+	
+	crcs, _, err := spilib.LoadBlockIndex(filename, totalBlocks)
+	if err != nil {
+		return err
+	}
+	tracker := spilib.NewTransferTracker(totalBlocks * blockSize)
+	
+	var writeLog *blockWriteLog
+	if s.WriteLogFile != "" {
+		writeLog = newBlockWriteLog(s.WriteLogFile, totalBlocks)
+		if err := writeLog.save(); err != nil {
+			return err
+		}
+		fmt.Printf("Logging written blocks to %s\n", s.WriteLogFile)
+	}
+	
+	for block := 0; block < totalBlocks; block++ {
+		// Read block from file
+		n, err := file.Read(buffer)
+		if err != nil && n == 0 {
+			break
+		}
+		
+		// Pad with 0xFF if partial block (typical for flash memory)
+		if n < blockSize {
+			for i := n; i < blockSize; i++ {
+				buffer[i] = 0xFF
+			}
+		}
+		
+		if err := checkBlock(crcs, block, buffer); err != nil {
+			return fmt.Errorf("not restoring: %v", err)
+		}
+		
+		if s.EraseBeforeWrite && (block*blockSize)%SPI_SECTOR_SIZE == 0 {
+			if err := s.EraseSector(uint32(block * blockSize)); err != nil {
+				return fmt.Errorf("failed to erase sector at block %d: %v", block, err)
+			}
+		}
+		
+		fmt.Printf("Writing block %d/%d...\n", block+1, totalBlocks)
+		
+		if err := s.writeBlock(block, buffer); err != nil {
+			return err
+		}
+		if writeLog != nil {
+			if err := writeLog.markWritten(block); err != nil {
+				return err
+			}
+		}
+		
+		// Small delay between blocks to not overwhelm the radio
+		time.Sleep(20 * time.Millisecond)
+		
+		// Progress indication
+		tracker.Update(blockSize)
+		if (block+1)%100 == 0 {
+			fmt.Printf("Progress: %s (%d/%d blocks)\n", tracker, block+1, totalBlocks)
+		}
+	}
+	
+	fmt.Printf("Restore completed successfully! %d blocks written from %s\n", totalBlocks, filename)
+	return nil
+}
+
+// blockWriteLog records which blocks of a full restore the radio has
+// acknowledged, one bit per block (block n is bit n%8 of byte n/8). The
+// file is replaced after every block, so an interrupted restore leaves a
+// complete log behind.
+type blockWriteLog struct {
+	path string
+	bits []byte
+}
+
+func newBlockWriteLog(path string, blocks int) *blockWriteLog {
+	return &blockWriteLog{path: path, bits: make([]byte, (blocks+7)/8)}
+}
+
+// loadBlockWriteLog reads the write log of a restore of the given number
+// of blocks
+func loadBlockWriteLog(path string, blocks int) (*blockWriteLog, error) {
+	bits, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read write log: %v", err)
+	}
+	if len(bits) != (blocks+7)/8 {
+		return nil, fmt.Errorf("write log %s has %d bytes, expected %d for %d blocks", path, len(bits), (blocks+7)/8, blocks)
+	}
+	return &blockWriteLog{path: path, bits: bits}, nil
+}
+
+func (l *blockWriteLog) written(block int) bool {
+	return l.bits[block/8]&(1<<(block%8)) != 0
+}
+
+// count returns the number of blocks marked written
+func (l *blockWriteLog) count() int {
+	n := 0
+	for _, b := range l.bits {
+		n += bits.OnesCount8(b)
+	}
+	return n
+}
+
+// markWritten sets the bit of block and saves the log
+func (l *blockWriteLog) markWritten(block int) error {
+	l.bits[block/8] |= 1 << (block % 8)
+	return l.save()
+}
+
+// save writes the log to a temporary file and renames it over the old one
+func (l *blockWriteLog) save() error {
+	tmp := l.path + ".tmp"
+	if err := os.WriteFile(tmp, l.bits, 0644); err != nil {
+		return fmt.Errorf("failed to write write log: %v", err)
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		return fmt.Errorf("failed to write write log: %v", err)
+	}
+	return nil
+}
+
+// recoverPartialRestore finishes a full restore that was interrupted,
+// writing only the blocks of backupFile that logFile does not mark as
+// written. logFile is updated as blocks are written, so the recovery can
+// itself be resumed.
+func (s *SPITool) recoverPartialRestore(backupFile, logFile string) error {
+	if err := s.verifyHashSidecar(backupFile); err != nil {
+		return err
+	}
+	
+	content, err := loadBackupFile(backupFile)
+	if err != nil {
+		return fmt.Errorf("failed to open restore file: %v", err)
+	}
+	if len(content) != SPI_FLASH_SIZE {
+		return fmt.Errorf("restore file must be exactly %d bytes, got %d", SPI_FLASH_SIZE, len(content))
+	}
+	
+	blockSize := s.blockSize()
+	totalBlocks := len(content) / blockSize
+	crcs, _, err := spilib.LoadBlockIndex(backupFile, totalBlocks)
+	if err != nil {
+		return err
+	}
+	writeLog, err := loadBlockWriteLog(logFile, totalBlocks)
+	if err != nil {
+		return err
+	}
+	
+	written := writeLog.count()
+	remaining := totalBlocks - written
+	fmt.Printf("%d blocks already written, retransmitting %d remaining blocks\n", written, remaining)
+	
+	tracker := spilib.NewTransferTracker(remaining * blockSize)
+	sent := 0
+	for block := 0; block < totalBlocks; block++ {
+		if writeLog.written(block) {
+			continue
+		}
+		
+		buffer := content[block*blockSize : (block+1)*blockSize]
+		if err := checkBlock(crcs, block, buffer); err != nil {
+			return fmt.Errorf("not restoring: %v", err)
+		}
+		
+		sent++
+		fmt.Printf("Writing block %d (%d/%d)...\n", block, sent, remaining)
+		if err := s.writeBlock(block, buffer); err != nil {
+			return err
+		}
+		if err := writeLog.markWritten(block); err != nil {
+			return err
+		}
+		
+		// Small delay between blocks to not overwhelm the radio
+		time.Sleep(20 * time.Millisecond)
+		
+		tracker.Update(blockSize)
+		if sent%100 == 0 {
+			fmt.Printf("Progress: %s (%d/%d blocks)\n", tracker, sent, remaining)
+		}
+	}
+	
+	fmt.Printf("Recovery completed successfully! %d blocks written from %s\n", remaining, backupFile)
+	return nil
+}
+
+// readRegion reads the blocks of one region
+func (s *SPITool) readRegion(region SPIRegion) ([]byte, error) {
+	blockSize := s.blockSize()
+	data := make([]byte, 0, region.Size)
+	firstBlock := int(region.StartOffset) / blockSize
+	for block := firstBlock; block < firstBlock+int(region.Size)/blockSize; block++ {
+		blockData, err := s.ReadBlockWithRetry(block)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, blockData...)
+		
+		time.Sleep(20 * time.Millisecond)
+	}
+	return data, nil
+}
+
+// writeRegion writes data, a whole number of blocks, starting at the
+// block aligned offset
+func (s *SPITool) writeRegion(offset uint32, data []byte) error {
+	blockSize := s.blockSize()
+	firstBlock := int(offset) / blockSize
+	totalBlocks := len(data) / blockSize
+	for i := 0; i < totalBlocks; i++ {
+		fmt.Printf("Writing block %d (%d/%d)...\n", firstBlock+i, i+1, totalBlocks)
+		if err := s.writeBlock(firstBlock+i, data[i*blockSize:(i+1)*blockSize]); err != nil {
+			return err
+		}
+		
+		// Small delay between blocks to not overwhelm the radio
+		time.Sleep(20 * time.Millisecond)
+	}
+	return nil
+}
+
+// calibrationRegion returns the region named calibration of the region
+// map, or the RT6D calibration region if the map has none
+func (s *SPITool) calibrationRegion() SPIRegion {
+	if s.regionMap != nil {
+		if r, ok := s.regionMap.find("calibration"); ok {
+			return r
+		}
+	}
+	return SPIRegion{Name: "calibration", StartOffset: CALIBRATION_OFFSET, Size: CALIBRATION_SIZE, Protected: true}
+}
+
+// backupCalibrationRegion reads only the calibration region and saves it
+// with a header identifying the radio model and the CRC32 of the data
+func (s *SPITool) backupCalibrationRegion(outputFile string) error {
+	region := s.calibrationRegion()
+	fmt.Printf("Backing up calibration region (0x%06X, %d bytes)...\n", region.StartOffset, region.Size)
+	
+	payload, err := s.readRegion(region)
+	if err != nil {
+		return err
+	}
+	
+	if err := os.WriteFile(outputFile, buildCalibrationFile(payload), 0644); err != nil {
+		return fmt.Errorf("failed to write calibration file: %v", err)
+	}
+	fmt.Printf("\nCalibration backup completed successfully! %d bytes saved to %s (CRC32 %08X)\n",
+		len(payload), outputFile, crc32.ChecksumIEEE(payload))
+	return nil
+}
+
+// buildCalibrationFile puts the calibration file header in front of payload
+func buildCalibrationFile(payload []byte) []byte {
+	file := make([]byte, CALIBRATION_HEADER_SIZE, CALIBRATION_HEADER_SIZE+len(payload))
+	copy(file, CALIBRATION_MAGIC)
+	copy(file[6:14], CALIBRATION_MODEL)
+	binary.LittleEndian.PutUint32(file[14:], crc32.ChecksumIEEE(payload))
+	return append(file, payload...)
+}
+
+// parseCalibrationFile checks the header of a calibration file and returns
+// the calibration data after it
+func parseCalibrationFile(content []byte) ([]byte, error) {
+	if len(content) < CALIBRATION_HEADER_SIZE || string(content[:6]) != CALIBRATION_MAGIC {
+		return nil, fmt.Errorf("not a calibration file, it does not start with %q", CALIBRATION_MAGIC)
+	}
+	if model := string(bytes.TrimRight(content[6:14], "\x00")); model != CALIBRATION_MODEL {
+		return nil, fmt.Errorf("calibration file is for a %s, not a %s", model, CALIBRATION_MODEL)
+	}
+	payload := content[CALIBRATION_HEADER_SIZE:]
+	if crc, expected := crc32.ChecksumIEEE(payload), binary.LittleEndian.Uint32(content[14:]); crc != expected {
+		return nil, fmt.Errorf("calibration data is corrupted (CRC32 %08X, header says %08X)", crc, expected)
+	}
+	return payload, nil
+}
+
+// restoreCalibrationRegion writes a file from backupCalibrationRegion back
+// to the calibration region after checking its header
+func (s *SPITool) restoreCalibrationRegion(inputFile string) error {
+	content, err := os.ReadFile(inputFile)
+	if err != nil {
+		return fmt.Errorf("failed to read calibration file: %v", err)
+	}
+	payload, err := parseCalibrationFile(content)
+	if err != nil {
+		return err
+	}
+	region := s.calibrationRegion()
+	if len(payload) != int(region.Size) {
+		return fmt.Errorf("calibration file holds %d bytes, the calibration region is %d bytes", len(payload), region.Size)
+	}
+	
+	fmt.Printf("Restoring calibration region (0x%06X, %d bytes)...\n", region.StartOffset, region.Size)
+	if err := s.writeRegion(region.StartOffset, payload); err != nil {
+		return err
+	}
+	
+	fmt.Printf("Calibration restore completed successfully from %s\n", inputFile)
+	return nil
+}
+
+// eepromRegion returns the channel memory, which other tools call the
+// EEPROM: the region named channels of the region map, or else the blocks
+// holding the channel table of the codeplug region
+func (s *SPITool) eepromRegion() SPIRegion {
+	start := uint32(codeplugChannelOffset)
+	if s.regionMap != nil {
+		if r, ok := s.regionMap.find("channels"); ok {
+			return r
+		}
+		if codeplug, ok := s.regionMap.find("codeplug"); ok {
+			start += codeplug.StartOffset
+		}
+	}
+	blocks := (codeplugMaxChannels*codeplugChannelSize + CHUNK_SIZE - 1) / CHUNK_SIZE
+	return SPIRegion{Name: "channels", StartOffset: start, Size: uint32(blocks * CHUNK_SIZE)}
+}
+
+// backupEEPROMRegion reads only the channel memory and saves it after a
+// header recording where it came from, so it can be cloned to another radio
+func (s *SPITool) backupEEPROMRegion(output string) error {
+	region := s.eepromRegion()
+	fmt.Printf("Backing up channel memory (0x%06X, %d bytes)...\n", region.StartOffset, region.Size)
+	
+	payload, err := s.readRegion(region)
+	if err != nil {
+		return err
+	}
+	
+	file := make([]byte, EEPROM_HEADER_SIZE, EEPROM_HEADER_SIZE+len(payload))
+	copy(file, EEPROM_MAGIC)
+	binary.LittleEndian.PutUint32(file[6:], region.StartOffset)
+	binary.LittleEndian.PutUint32(file[10:], region.Size)
+	binary.LittleEndian.PutUint32(file[14:], crc32.ChecksumIEEE(payload))
+	file = append(file, payload...)
+	if err := os.WriteFile(output, file, 0644); err != nil {
+		return fmt.Errorf("failed to write channel memory file: %v", err)
+	}
+	fmt.Printf("\nChannel memory backup completed successfully! %d bytes saved to %s\n", len(payload), output)
+	return nil
+}
+
+// parseEEPROMFile checks the header of a backupEEPROMRegion file and
+// returns the SPI offset and the data
+func parseEEPROMFile(content []byte) (uint32, []byte, error) {
+	if len(content) < EEPROM_HEADER_SIZE || string(content[:6]) != EEPROM_MAGIC {
+		return 0, nil, fmt.Errorf("not a channel memory file, it does not start with %q", EEPROM_MAGIC)
+	}
+	offset := binary.LittleEndian.Uint32(content[6:])
+	size := binary.LittleEndian.Uint32(content[10:])
+	payload := content[EEPROM_HEADER_SIZE:]
+	if uint64(len(payload)) != uint64(size) {
+		return 0, nil, fmt.Errorf("channel memory file holds %d bytes, its header says %d", len(payload), size)
+	}
+	if crc, expected := crc32.ChecksumIEEE(payload), binary.LittleEndian.Uint32(content[14:]); crc != expected {
+		return 0, nil, fmt.Errorf("channel memory data is corrupted (CRC32 %08X, header says %08X)", crc, expected)
+	}
+	if offset%CHUNK_SIZE != 0 || size%CHUNK_SIZE != 0 || uint64(offset)+uint64(size) > SPI_FLASH_SIZE {
+		return 0, nil, fmt.Errorf("channel memory at 0x%06X (%d bytes) is not a block aligned part of the SPI flash", offset, size)
+	}
+	return offset, payload, nil
+}
+
+// restoreEEPROMRegion writes a backupEEPROMRegion file back to the offset
+// recorded in its header, refusing to touch protected regions
+func (s *SPITool) restoreEEPROMRegion(input string) error {
+	content, err := os.ReadFile(input)
+	if err != nil {
+		return fmt.Errorf("failed to read channel memory file: %v", err)
+	}
+	offset, payload, err := parseEEPROMFile(content)
+	if err != nil {
+		return err
+	}
+	end := offset + uint32(len(payload))
+	for _, r := range s.regionMap.Regions {
+		if r.Protected && offset < r.StartOffset+r.Size && r.StartOffset < end {
+			return fmt.Errorf("channel memory at 0x%06X-0x%06X overlaps the protected region %s", offset, end-1, r.Name)
+		}
+	}
+	
+	fmt.Printf("Restoring channel memory (0x%06X, %d bytes)...\n", offset, len(payload))
+	if err := s.writeRegion(offset, payload); err != nil {
+		return err
+	}
+	
+	fmt.Printf("Channel memory restore completed successfully from %s\n", input)
+	return nil
+}
+
+// fillSPIRegion writes blocks repeating pattern to the blocks startBlock
+// to endBlock, both included
+func (s *SPITool) fillSPIRegion(startBlock, endBlock uint16, pattern []byte) error {
+	blockSize := s.blockSize()
+	if startBlock > endBlock {
+		return fmt.Errorf("start block %d is after end block %d", startBlock, endBlock)
+	}
+	if int(endBlock) >= SPI_FLASH_SIZE/blockSize {
+		return fmt.Errorf("end block %d is beyond the %d byte SPI flash", endBlock, SPI_FLASH_SIZE)
+	}
+	if len(pattern) == 0 || blockSize%len(pattern) != 0 {
+		return fmt.Errorf("pattern length must divide %d, got %d bytes", blockSize, len(pattern))
+	}
+	
+	// Erasing works on whole sectors, a partial one would wipe data outside the range
+	blocksPerSector := SPI_SECTOR_SIZE / blockSize
+	if s.EraseBeforeWrite && (int(startBlock)%blocksPerSector != 0 || (int(endBlock)+1)%blocksPerSector != 0) {
+		return fmt.Errorf("--erase-before-write needs a range aligned to %d byte sectors", SPI_SECTOR_SIZE)
+	}
+	
+	buffer := bytes.Repeat(pattern, blockSize/len(pattern))
+	totalBlocks := int(endBlock-startBlock) + 1
+	fmt.Printf("Filling blocks %d-%d with pattern % X...\n", startBlock, endBlock, pattern)
+	
+	for i := 0; i < totalBlocks; i++ {
+		block := int(startBlock) + i
+		
+		if s.EraseBeforeWrite && (block*blockSize)%SPI_SECTOR_SIZE == 0 {
+			if err := s.EraseSector(uint32(block * blockSize)); err != nil {
+				return fmt.Errorf("failed to erase sector at block %d: %v", block, err)
+			}
+		}
+		
+		fmt.Printf("Writing block %d/%d...\n", i+1, totalBlocks)
+		if err := s.writeBlock(block, buffer); err != nil {
+			return err
+		}
+		
+		// Small delay between blocks to not overwhelm the radio
+		time.Sleep(20 * time.Millisecond)
+	}
+	
+	fmt.Printf("Fill completed successfully! %d blocks written\n", totalBlocks)
+	return nil
+}
+
+// parseFillRange converts the byte addresses of the fill command, end
+// excluded, to the range of blockSize byte blocks of fillSPIRegion
+func parseFillRange(startArg, endArg string, blockSize int) (startBlock, endBlock uint16, err error) {
+	start, err := strconv.ParseUint(strings.TrimPrefix(startArg, "0x"), 16, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid start address '%s'", startArg)
+	}
+	end, err := strconv.ParseUint(strings.TrimPrefix(endArg, "0x"), 16, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid end address '%s'", endArg)
+	}
+	if start%uint64(blockSize) != 0 || end%uint64(blockSize) != 0 {
+		return 0, 0, fmt.Errorf("addresses must be multiples of %d (0x%X)", blockSize, blockSize)
+	}
+	if end <= start || end > SPI_FLASH_SIZE {
+		return 0, 0, fmt.Errorf("address range 0x%06X-0x%06X is empty or beyond the %d byte SPI flash", start, end, SPI_FLASH_SIZE)
+	}
+	return uint16(start / uint64(blockSize)), uint16(end/uint64(blockSize) - 1), nil
+}
+
+// formatInfo describes a file format for list-formats. Header is the start
+// of a typical file, Detection how the format is recognized.
+type formatInfo struct {
+	Name        string
+	Extensions  string
+	Description string
+	Detection   []string
+	Header      []byte
+}
+
+// spiFormats lists the files spi-tool reads and writes
+var spiFormats = []formatInfo{
+	{
+		Name:        "Binary backup",
+		Extensions:  ".bin",
+		Description: "Raw SPI flash contents, erased areas read as FF",
+		Detection:   []string{"any file without a .gz extension (50%), no header"},
+		Header:      bytes.Repeat([]byte{0xFF}, 16),
+	},
+	{
+		Name:        "Compressed backup",
+		Extensions:  ".gz",
+		Description: "Binary backup compressed with gzip, read and written transparently",
+		Detection:   []string{"extension .gz (100%)"},
+		Header:      []byte{0x1F, 0x8B, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xFF, 0xEC, 0xC0, 0x01, 0x0D, 0x00, 0x00},
+	},
+	{
+		Name:        "S-record backup",
+		Extensions:  ".srec",
+		Description: "Full backup as S3 records for factory programmers, written only",
+		Detection: []string{
+			"--format srec (100%)",
+			"starts with 'S' followed by record type digit",
+		},
+		Header: []byte("S02700007370695F"),
+	},
+	{
+		Name:        "Calibration file",
+		Extensions:  "any",
+		Description: "Calibration region after a header with the radio model and CRC32",
+		Detection:   []string{"starts with \"RTCAL\\0\" (100%), checked by calibration-restore"},
+		Header:      []byte("RTCAL\x00RT6D\x00\x00\x00\x00\x3C\x6E"),
+	},
+	{
+		Name:        "Channel memory file",
+		Extensions:  "any",
+		Description: "--eeprom-region backup, header with SPI offset, size and CRC32",
+		Detection:   []string{"starts with \"RTEEP\\0\" (100%), checked by --eeprom-region restore"},
+		Header:      []byte("RTEEP\x00\x00\x00\x00\x00\x00\x80\x00\x00\x3C\x6E"),
+	},
+	{
+		Name:        "Channel list",
+		Extensions:  ".csv",
+		Description: "Name,RxFreq,TxFreq,CTCSS,DCS,PowerLevel, input of convert-codeplug",
+		Detection:   []string{"convert-codeplug only (100%), the header line is optional"},
+		Header:      []byte("Name,RxFreq,TxFr"),
+	},
+}
+
+func printFormats(formats []formatInfo, fallback string) {
+	for i, format := range formats {
+		if i > 0 {
+			fmt.Println()
+		}
+		ascii := make([]byte, len(format.Header))
+		for j, b := range format.Header {
+			ascii[j] = '.'
+			if b >= 0x20 && b < 0x7F {
+				ascii[j] = b
+			}
+		}
+		fmt.Printf("%s\n", format.Name)
+		fmt.Printf("  Extensions:  %s\n", format.Extensions)
+		fmt.Printf("  Description: %s\n", format.Description)
+		for j, detection := range format.Detection {
+			label := "Detection:"
+			if j > 0 {
+				label = ""
+			}
+			fmt.Printf("  %-12s %s\n", label, detection)
+		}
+		fmt.Printf("  Header:      % X  %s\n", format.Header, ascii)
+	}
+	fmt.Printf("\nFallback order: %s\n", fallback)
+}
+
+func showUsage() {
+	fmt.Printf("Usage: %s <command> [options] <port> <file> [baudrate]\n", os.Args[0])
+	fmt.Printf("       %s list-regions [--region-map <file>]\n", os.Args[0])
+	fmt.Printf("       %s list-formats\n", os.Args[0])
+	fmt.Printf("       %s verify-backup <file>\n", os.Args[0])
+	fmt.Printf("       %s analyze-backup <file>\n", os.Args[0])
+	fmt.Printf("       %s compare-spi [--hex-diff] [--region-map <file>] <file_a> <file_b>\n", os.Args[0])
+	fmt.Printf("       %s restore --write-log <log_file> <port> <file> [baudrate]\n", os.Args[0])
+	fmt.Printf("       %s recover-from-partial <port> <file> <log_file> [baudrate]\n", os.Args[0])
+	fmt.Printf("       %s calibration-backup|calibration-restore [--region-map <file>] <port> <file> [baudrate]\n", os.Args[0])
+	fmt.Printf("       %s fill [--erase-before-write] <port> <start_addr_hex> <end_addr_hex> <pattern_hex> [baudrate]\n", os.Args[0])
+	fmt.Printf("       %s --script <file> [--dry-run] [--region-map <file>]\n", os.Args[0])
+	fmt.Printf("       %s --export-codeplug <file.json> [--region-map <file>] <backup_file>\n", os.Args[0])
+	fmt.Printf("       %s convert-codeplug [--region-map <file>] <channels.csv> <codeplug.bin>\n", os.Args[0])
+	fmt.Println("\nCommands:")
+	fmt.Println("  backup       - Backup SPI flash to file")
+	fmt.Println("  restore      - Restore SPI flash from file")
+	fmt.Println("  recover-from-partial - Write the blocks an interrupted restore --write-log did not")
+	fmt.Println("  calibration-backup - Save only the calibration region, with a header naming the radio model")
+	fmt.Println("  calibration-restore - Write a calibration-backup file back after checking its header")
+	fmt.Println("  list-regions - Show the SPI flash region map")
+	fmt.Println("  list-formats - Show the file formats with a sample header of each")
+	fmt.Println("  verify-backup - Check a backup against its .idx block CRCs (no radio needed)")
+	fmt.Println("  analyze-backup - Show the slowest blocks of a backup from its .idx read times")
+	fmt.Println("  fill         - Write a repeating byte pattern to an address range (end excluded)")
+	fmt.Println("  compare-spi  - List the blocks that differ between two backups (no radio needed)")
+	fmt.Println("  convert-codeplug - Encode the channels of a CSV file for restore --region codeplug (no radio needed)")
+	fmt.Println("\nArguments:")
+	fmt.Println("  port     - Serial port (e.g., /dev/ttyUSB0, COM3)")
+	fmt.Println("  file     - Backup/restore file path")
+	fmt.Println("\nOptions:")
+	fmt.Println("  --region-map <file> - YAML region map (default: built-in RT6D map),")
+	fmt.Println("                        only the blocks inside its regions are read/written")
+	fmt.Println("  --region <name>     - Back up or restore only the named region")
+	fmt.Println("  --eeprom-region     - Back up or restore only the channel memory, to clone channels")
+	fmt.Println("  --protect-calibration - Restore everything except protected regions")
+	fmt.Println("  --allow-protected   - Let --region or --region-map restores write protected regions")
+	fmt.Println("  --skip-hash-check   - Restore even if the .sha256 sidecar does not match")
+	fmt.Println("  --erase-before-write - Erase each 4KB sector before a full restore or fill writes it")
+	fmt.Println("  --write-log <file>  - With a full restore, record the written blocks for recover-from-partial")
+	fmt.Println("  --verify-writes     - Read every written block back and show where it differs")
+	fmt.Println("  --response-size <n> - Bytes of a read response incl. header and checksum (default 1028)")
+	fmt.Println("  --command-size <n>  - Bytes of a write command incl. header and checksum (default 1028)")
+	fmt.Println("  --max-read-rate <kbps> - Limit backup reads to this many KB/s, for radios that reset")
+	fmt.Println("  --format srec       - Write a full backup as S3 records (32 bytes each) for factory programmers")
+	fmt.Println("  --hex-diff          - With compare-spi, hex dump the first difference of each block")
+	fmt.Println("  --no-wait           - Count down 3 seconds instead of waiting for Enter, for scripts")
+	fmt.Println("  --force             - Start at once, without waiting for Enter or a countdown")
+	fmt.Println("  --export-codeplug <file.json> - After a full backup, write its channels and contacts as JSON")
+	fmt.Println("  --script <file>     - Run the spi-backup, spi-restore, sleep and echo commands of a script")
+	fmt.Println("\nExamples:")
+	fmt.Printf("  %s backup /dev/cu.wchusbserial112410 spi_backup.bin 115200\n", os.Args[0])
+	fmt.Printf("  %s restore /dev/cu.wchusbserial112410 spi_backup.bin 115200\n", os.Args[0])
+	fmt.Printf("  %s backup --region calibration COM3 calibration.bin\n", os.Args[0])
+	fmt.Printf("  %s calibration-backup COM3 calibration.cal\n", os.Args[0])
+	fmt.Printf("  %s backup --eeprom-region COM3 channels.eep\n", os.Args[0])
+	fmt.Printf("  %s fill COM3 0x3F0000 0x400000 AA55\n", os.Args[0])
+	fmt.Println("\nAvailable serial ports:")
+	
+	ports := spilib.AvailablePorts()
+	for _, port := range ports {
+		fmt.Printf("  %s\n", port)
+	}
+}
+
+// Assumed codeplug layout inside the "codeplug" region of the SPI flash,
+// offsets relative to the region start. Not yet confirmed against the
+// radio's menus, so compare an export with the channels shown on the radio
+// before relying on it.
+const (
+	codeplugChannelOffset = 0x0000 // Channel table
+	codeplugChannelSize   = 32
+	codeplugMaxChannels   = 1000
+
+	codeplugContactOffset = 0x10000 // Contact table
+	codeplugContactSize   = 16
+	codeplugMaxContacts   = 1000
+
+	codeplugNameLength = 12 // ASCII, padded with 0x00 or 0xFF
+)
+
+// Channel record fields
+const (
+	channelRxFreq = 0x00 // uint32 LE, 10 Hz units, 0 or 0xFFFFFFFF for an empty slot
+	channelTxFreq = 0x04 // uint32 LE, 10 Hz units
+	channelRxTone = 0x08 // uint16 LE, CTCSS in 0.1 Hz, 0 or 0xFFFF for none
+	channelTxTone = 0x0A // uint16 LE, same encoding as channelRxTone
+	channelName   = 0x14 // codeplugNameLength bytes
+	// TODO: 0x0C-0x13 hold power, bandwidth, scan and squelch settings,
+	// not identified yet. channelPower is a guess used by convert-codeplug.
+	channelPower = 0x0C // 0 high, 1 mid, 2 low
+)
+
+// Contact record fields
+const (
+	contactID   = 0x00 // uint32 LE, 0 or 0xFFFFFFFF for an empty slot
+	contactName = 0x04 // codeplugNameLength bytes
+	// TODO: the call type is probably in the remaining bytes
+)
+
+// Codeplug holds the radio settings decoded from an SPI backup
+type Codeplug struct {
+	Channels []Channel `json:"channels"`
+	Contacts []Contact `json:"contacts"`
+}
+
+// Channel is a memory channel, frequencies in MHz
+type Channel struct {
+	Number      int     `json:"number"`
+	Name        string  `json:"name"`
+	Frequency   float64 `json:"frequency"`
+	TxFrequency float64 `json:"tx_frequency"`
+	CTCSS       string  `json:"ctcss"`    // Receive tone in Hz, "" for none
+	TxCTCSS     string  `json:"tx_ctcss"` // Transmit tone in Hz, "" for none
+}
+
+// Contact is an entry of the contact list
+type Contact struct {
+	Number int    `json:"number"`
+	Name   string `json:"name"`
+	ID     uint32 `json:"id"`
+}
+
+// ExtractCodeplug decodes the channels and contacts from the codeplug
+// region of an SPI backup, using the layout constants above
+func ExtractCodeplug(spiDumpFile string, regionMap *SPIRegionMap) (*Codeplug, error) {
+	region, ok := regionMap.find("codeplug")
+	if !ok {
+		return nil, fmt.Errorf("the region map has no codeplug region")
+	}
+	content, err := loadBackupFile(spiDumpFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open backup file: %v", err)
+	}
+	if uint64(len(content)) < uint64(region.StartOffset)+uint64(region.Size) {
+		return nil, fmt.Errorf("backup has %d bytes, the codeplug region ends at 0x%06X", len(content), region.StartOffset+region.Size)
+	}
+	data := content[region.StartOffset : region.StartOffset+region.Size]
+	
+	codeplug := &Codeplug{Channels: []Channel{}, Contacts: []Contact{}}
+	for i := 0; i < codeplugMaxChannels; i++ {
+		offset := codeplugChannelOffset + i*codeplugChannelSize
+		if offset+codeplugChannelSize > len(data) {
+			break
+		}
+		record := data[offset : offset+codeplugChannelSize]
+		rx := binary.LittleEndian.Uint32(record[channelRxFreq:])
+		if rx == 0 || rx == 0xFFFFFFFF {
+			continue
+		}
+		codeplug.Channels = append(codeplug.Channels, Channel{
+			Number:      i + 1,
+			Name:        codeplugString(record[channelName : channelName+codeplugNameLength]),
+			Frequency:   float64(rx) / 100000,
+			TxFrequency: float64(binary.LittleEndian.Uint32(record[channelTxFreq:])) / 100000,
+			CTCSS:       decodeCTCSS(binary.LittleEndian.Uint16(record[channelRxTone:])),
+			TxCTCSS:     decodeCTCSS(binary.LittleEndian.Uint16(record[channelTxTone:])),
+		})
+	}
+	
+	for i := 0; i < codeplugMaxContacts; i++ {
+		offset := codeplugContactOffset + i*codeplugContactSize
+		if offset+codeplugContactSize > len(data) {
+			break
+		}
+		record := data[offset : offset+codeplugContactSize]
+		id := binary.LittleEndian.Uint32(record[contactID:])
+		if id == 0 || id == 0xFFFFFFFF {
+			continue
+		}
+		codeplug.Contacts = append(codeplug.Contacts, Contact{
+			Number: i + 1,
+			Name:   codeplugString(record[contactName : contactName+codeplugNameLength]),
+			ID:     id,
+		})
+	}
+	return codeplug, nil
+}
+
+// codeplugString returns a name field up to the first padding byte
+func codeplugString(field []byte) string {
+	if end := bytes.IndexAny(field, "\x00\xff"); end >= 0 {
+		field = field[:end]
+	}
+	return strings.TrimSpace(string(field))
+}
+
+// decodeCTCSS formats a tone field as e.g. "88.5", "" if no tone is set
+func decodeCTCSS(tone uint16) string {
+	// TODO: DCS codes are expected to set the high bits, they are not
+	// decoded yet
+	if tone < 600 || tone > 2600 {
+		return ""
+	}
+	return fmt.Sprintf("%d.%d", tone/10, tone%10)
+}
+
+// encodeCTCSS is the tone field of a CTCSS tone in Hz like "88.5", 0xFFFF
+// (none) for ""
+func encodeCTCSS(tone string) (uint16, error) {
+	if tone == "" {
+		return 0xFFFF, nil
+	}
+	hz, err := strconv.ParseFloat(tone, 64)
+	if err != nil || hz < 60 || hz > 260 {
+		return 0, fmt.Errorf("invalid CTCSS tone '%s'", tone)
+	}
+	return uint16(hz*10 + 0.5), nil
+}
+
+// encodeDCS is the tone field of a DCS code like "023" or "D023N"
+func encodeDCS(code string) (uint16, error) {
+	// TODO: assumed from the expectation that DCS codes set the high bits
+	// of the tone field, see decodeCTCSS. Not confirmed on a radio yet.
+	digits := strings.TrimSuffix(strings.TrimPrefix(strings.ToUpper(code), "D"), "N")
+	value, err := strconv.ParseUint(digits, 8, 16)
+	if err != nil || value == 0 || value > 0777 {
+		return 0, fmt.Errorf("invalid DCS code '%s'", code)
+	}
+	return 0x8000 | uint16(value), nil
+}
+
+// parseCodeplugFrequency converts a frequency in MHz like "145.500" to the
+// 10 Hz units of the channel record
+func parseCodeplugFrequency(value string) (uint32, error) {
+	mhz, err := strconv.ParseFloat(value, 64)
+	if err != nil || mhz <= 0 || mhz >= 1000 {
+		return 0, fmt.Errorf("invalid frequency '%s'", value)
+	}
+	return uint32(mhz*100000 + 0.5), nil
+}
+
+// convertCodeplug encodes the channels of a CSV file with the columns
+// Name,RxFreq,TxFreq,CTCSS,DCS,PowerLevel into an image of the codeplug
+// region, which restore --region codeplug can write to the radio. The
+// first line is skipped if it is the header. Frequencies are in MHz, an
+// empty TxFreq is the receive frequency and PowerLevel is high, mid or low
+// (high when empty). Everything but the channel records reads as erased
+// flash, so the contacts of the radio are cleared.
+func convertCodeplug(csvFile, outputBin string, regionMap *SPIRegionMap) error {
+	region, ok := regionMap.find("codeplug")
+	if !ok {
+		return fmt.Errorf("the region map has no codeplug region")
+	}
+	input, err := os.Open(csvFile)
+	if err != nil {
+		return fmt.Errorf("failed to open CSV file: %v", err)
+	}
+	defer input.Close()
+	reader := csv.NewReader(input)
+	reader.FieldsPerRecord = 6
+	reader.TrimLeadingSpace = true
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", csvFile, err)
+	}
+	if len(rows) > 0 && strings.EqualFold(rows[0][0], "Name") {
+		rows = rows[1:]
+	}
+	if len(rows) > codeplugMaxChannels {
+		return fmt.Errorf("%s has %d channels, the radio holds %d", csvFile, len(rows), codeplugMaxChannels)
+	}
+	if codeplugChannelOffset+len(rows)*codeplugChannelSize > int(region.Size) {
+		return fmt.Errorf("%d channels don't fit in the 0x%X byte codeplug region", len(rows), region.Size)
+	}
+
+	data := bytes.Repeat([]byte{0xFF}, int(region.Size))
+	for i, row := range rows {
+		name, rxFreq, txFreq, ctcss, dcs, power := row[0], row[1], row[2], row[3], row[4], row[5]
+		channel := i + 1
+		if len(name) > codeplugNameLength {
+			return fmt.Errorf("channel %d: name '%s' is longer than %d characters", channel, name, codeplugNameLength)
+		}
+		for _, c := range name {
+			if c < 0x20 || c > 0x7E {
+				return fmt.Errorf("channel %d: name '%s' is not printable ASCII", channel, name)
+			}
+		}
+		rx, err := parseCodeplugFrequency(rxFreq)
+		if err != nil {
+			return fmt.Errorf("channel %d: %v", channel, err)
+		}
+		tx := rx
+		if txFreq != "" {
+			if tx, err = parseCodeplugFrequency(txFreq); err != nil {
+				return fmt.Errorf("channel %d: %v", channel, err)
+			}
+		}
+		if ctcss != "" && dcs != "" {
+			return fmt.Errorf("channel %d: set either CTCSS or DCS, not both", channel)
+		}
+		var tone uint16
+		if dcs != "" {
+			tone, err = encodeDCS(dcs)
+		} else {
+			tone, err = encodeCTCSS(ctcss)
+		}
+		if err != nil {
+			return fmt.Errorf("channel %d: %v", channel, err)
+		}
+		var powerLevel byte
+		switch strings.ToLower(power) {
+		case "", "high":
+			powerLevel = 0
+		case "mid":
+			powerLevel = 1
+		case "low":
+			powerLevel = 2
+		default:
+			return fmt.Errorf("channel %d: invalid power level '%s', use high, mid or low", channel, power)
+		}
+
+		offset := codeplugChannelOffset + i*codeplugChannelSize
+		record := data[offset : offset+codeplugChannelSize]
+		binary.LittleEndian.PutUint32(record[channelRxFreq:], rx)
+		binary.LittleEndian.PutUint32(record[channelTxFreq:], tx)
+		binary.LittleEndian.PutUint16(record[channelRxTone:], tone)
+		binary.LittleEndian.PutUint16(record[channelTxTone:], tone)
+		record[channelPower] = powerLevel
+		copy(record[channelName:channelName+codeplugNameLength], name)
+		for j := channelName + len(name); j < channelName+codeplugNameLength; j++ {
+			record[j] = 0x00
+		}
+	}
+
+	if err := os.WriteFile(outputBin, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", outputBin, err)
+	}
+	fmt.Printf("Encoded %d channels into %s (%d bytes, region %s at 0x%06X)\n",
+		len(rows), outputBin, len(data), region.Name, region.StartOffset)
+	return nil
+}
+
+// exportCodeplug writes the codeplug of an SPI backup as JSON
+func exportCodeplug(spiDumpFile, jsonFile string, regionMap *SPIRegionMap) error {
+	codeplug, err := ExtractCodeplug(spiDumpFile, regionMap)
+	if err != nil {
+		return err
+	}
+	output, err := json.MarshalIndent(codeplug, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode codeplug: %v", err)
+	}
+	if err := os.WriteFile(jsonFile, append(output, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", jsonFile, err)
+	}
+	fmt.Printf("Exported %d channels and %d contacts to %s\n", len(codeplug.Channels), len(codeplug.Contacts), jsonFile)
+	return nil
+}
+
+// spiScriptBackend runs the SPI commands of a script. flash is left to
+// rt6d-flasher.
+type spiScriptBackend struct {
+	regionMap *SPIRegionMap
+}
+
+func (b spiScriptBackend) connect(port string) (*SPITool, error) {
+	tool := NewSPITool()
+	tool.regionMap = b.regionMap
+	if err := tool.Connect(port, 115200); err != nil {
+		return nil, err
+	}
+	return tool, nil
+}
+
+func (b spiScriptBackend) Flash(port, firmware string) error {
+	return fmt.Errorf("flash is not supported by %s, run this script with rt6d-flasher", os.Args[0])
+}
+
+func (b spiScriptBackend) SPIBackup(port, file string) error {
+	tool, err := b.connect(port)
+	if err != nil {
+		return err
+	}
+	defer tool.Disconnect()
+	return tool.backupSPIFlash(file)
+}
+
+func (b spiScriptBackend) SPIRestore(port, file string) error {
+	tool, err := b.connect(port)
+	if err != nil {
+		return err
+	}
+	defer tool.Disconnect()
+	return tool.restoreSPIFlash(file)
+}
+
+func (spiScriptBackend) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+// runOptionCommand handles the calls without a command:
+// "spi-tool --script <file> [--dry-run]" and
+// "spi-tool --export-codeplug <file.json> <backup_file>"
+func runOptionCommand(args []string) {
+	fs := flag.NewFlagSet("script", flag.ContinueOnError)
+	fs.Usage = showUsage
+	scriptFile := fs.String("script", "", "run the commands of a script file")
+	dryRun := fs.Bool("dry-run", false, "print what each line would do")
+	regionMapFile := fs.String("region-map", "", "YAML region map")
+	exportCodeplugFile := fs.String("export-codeplug", "", "write the codeplug of a backup as JSON")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		os.Exit(1)
+	}
+	
+	regionMap, err := LoadSPIRegionMap(*regionMapFile)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	
+	if *exportCodeplugFile != "" && *scriptFile == "" && len(positional) == 1 {
+		if err := exportCodeplug(positional[0], *exportCodeplugFile, regionMap); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *scriptFile == "" || *exportCodeplugFile != "" || len(positional) > 0 {
+		showUsage()
+		os.Exit(1)
+	}
+	
+	var backend spilib.ScriptBackend = spiScriptBackend{regionMap: regionMap}
+	if *dryRun {
+		backend = spilib.DryRunScriptBackend{}
+	}
+	if err := spilib.RunScript(*scriptFile, backend); err != nil {
+		fmt.Printf("Script failed at %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// parseArgs parses flags that may appear before, between or after the
+// positional arguments
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		showUsage()
+		os.Exit(1)
+	}
+	
+	command := os.Args[1]
+	if strings.HasPrefix(command, "-") {
+		runOptionCommand(os.Args[1:])
+		return
+	}
+	
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	fs.Usage = showUsage
+	regionMapFile := fs.String("region-map", "", "YAML region map")
+	regionName := fs.String("region", "", "only back up or restore this region")
+	protectCalibration := fs.Bool("protect-calibration", false, "restore everything except protected regions")
+	allowProtected := fs.Bool("allow-protected", false, "let a region restore write protected regions")
+	skipHashCheck := fs.Bool("skip-hash-check", false, "restore even if the .sha256 sidecar does not match")
+	eraseBeforeWrite := fs.Bool("erase-before-write", false, "erase each sector before a full restore writes it")
+	hexDiff := fs.Bool("hex-diff", false, "with compare-spi, hex dump the first difference of each block")
+	exportCodeplugFile := fs.String("export-codeplug", "", "after a backup, write the codeplug as JSON")
+	writeLogFile := fs.String("write-log", "", "with a full restore, record the written blocks in this file")
+	verifyWrites := fs.Bool("verify-writes", false, "read every written block back and compare it")
+	eepromRegion := fs.Bool("eeprom-region", false, "back up or restore only the channel memory")
+	noWait := fs.Bool("no-wait", false, "count down 3 seconds instead of waiting for Enter")
+	force := fs.Bool("force", false, "start at once, without waiting for Enter or a countdown")
+	responseSize := fs.Int("response-size", 0, "bytes of a read response, 0 for the region map's or 1028")
+	backupFormat := fs.String("format", "bin", "backup file format: bin or srec")
+	commandSize := fs.Int("command-size", 0, "bytes of a write command, 0 for the region map's or 1028")
+	maxReadRate := fs.Float64("max-read-rate", 0, "limit backup reads to this many KB/s, 0 for no limit")
+	
+	positional, err := parseArgs(fs, os.Args[2:])
+	if err != nil {
+		os.Exit(1)
+	}
+	
+	regionMap, err := LoadSPIRegionMap(*regionMapFile)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	
+	if *responseSize == 0 {
+		*responseSize = regionMap.ResponseSize
+	}
+	if *commandSize == 0 {
+		*commandSize = regionMap.CommandSize
+	}
+	if *responseSize == 0 {
+		*responseSize = spilib.PACKET_SIZE
+	}
+	if *commandSize == 0 {
+		*commandSize = spilib.PACKET_SIZE
+	}
+	blockSize, err := packetBlockSize(*responseSize, *commandSize)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if *maxReadRate < 0 {
+		fmt.Println("Error: --max-read-rate must be 0 (no limit) or a positive rate in KB/s")
+		os.Exit(1)
+	}
+	
+	if command == "list-regions" {
+		regionMap.print()
+		return
+	}
+	
+	if command == "list-formats" {
+		printFormats(spiFormats, ".gz extension, raw binary; calibration and channel memory files by their header")
+		return
+	}
+	
+	if command == "convert-codeplug" {
+		if len(positional) != 2 {
+			showUsage()
+			os.Exit(1)
+		}
+		if err := convertCodeplug(positional[0], positional[1], regionMap); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	
+	if command == "compare-spi" {
+		if len(positional) != 2 {
+			showUsage()
+			os.Exit(1)
+		}
+		if err := printSPIComparison(positional[0], positional[1], regionMap, *hexDiff); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	
+	if command == "verify-backup" || command == "analyze-backup" {
+		if len(positional) != 1 {
+			showUsage()
+			os.Exit(1)
+		}
+		check := verifyBackup
+		if command == "analyze-backup" {
+			check = analyzeBackup
+		}
+		if err := check(positional[0], blockSize); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	
+	// Validate command
+	calibrationCommand := command == "calibration-backup" || command == "calibration-restore"
+	if command != "backup" && command != "restore" && command != "fill" && command != "recover-from-partial" && !calibrationCommand {
+		fmt.Printf("Error: Invalid command '%s'. Use 'backup', 'restore', 'recover-from-partial', 'fill', 'calibration-backup', 'calibration-restore', 'compare-spi', 'convert-codeplug', 'verify-backup', 'analyze-backup', 'list-regions' or 'list-formats'\n\n", command)
+		showUsage()
+		os.Exit(1)
+	}
+	
+	// fill takes an address range and pattern instead of the file
+	var fillStart, fillEnd uint16
+	var fillPattern []byte
+	if command == "fill" {
+		if len(positional) < 4 {
+			showUsage()
+			os.Exit(1)
+		}
+		fillStart, fillEnd, err = parseFillRange(positional[1], positional[2], blockSize)
+		if err == nil {
+			fillPattern, err = hex.DecodeString(strings.TrimPrefix(positional[3], "0x"))
+			if err != nil {
+				err = fmt.Errorf("invalid pattern '%s': %v", positional[3], err)
+			}
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		// Leave the port and baud rate where backup and restore have them
+		positional = append([]string{positional[0], ""}, positional[4:]...)
+		if *regionName != "" || *regionMapFile != "" || *protectCalibration {
+			fmt.Println("Error: fill takes an address range, not regions")
+			os.Exit(1)
+		}
+	}
+	
+	// recover-from-partial takes the write log after the backup file
+	var recoverLogFile string
+	if command == "recover-from-partial" {
+		if len(positional) < 3 {
+			showUsage()
+			os.Exit(1)
+		}
+		recoverLogFile = positional[2]
+		positional = append(positional[:2:2], positional[3:]...)
+		if *regionName != "" || *regionMapFile != "" || *protectCalibration || *eraseBeforeWrite || *writeLogFile != "" {
+			fmt.Println("Error: recover-from-partial only takes the port, backup file, write log and baud rate")
+			os.Exit(1)
+		}
+	}
+	
+	if *eepromRegion && ((command != "backup" && command != "restore") || *regionName != "" || *protectCalibration ||
+		*eraseBeforeWrite || *writeLogFile != "" || *exportCodeplugFile != "") {
+		fmt.Println("Error: --eeprom-region can only be used with backup or restore, and only with --region-map and --verify-writes")
+		os.Exit(1)
+	}
+	
+	if calibrationCommand && (*regionName != "" || *protectCalibration || *eraseBeforeWrite || *writeLogFile != "" || *exportCodeplugFile != "") {
+		fmt.Printf("Error: %s only takes --region-map and --verify-writes\n", command)
+		os.Exit(1)
+	}
+	
+	if len(positional) < 2 {
+		showUsage()
+		os.Exit(1)
+	}
+	portName := positional[0]
+	filename := positional[1]
+	
+	if *writeLogFile != "" && (command != "restore" || *regionName != "" || *regionMapFile != "" || *protectCalibration) {
+		fmt.Println("Error: --write-log can only be used with a full restore")
+		os.Exit(1)
+	}
+	
+	if *protectCalibration && (command != "restore" || *regionName != "") {
+		fmt.Println("Error: --protect-calibration can only be used with restore and without --region")
+		os.Exit(1)
+	}
+	
+	if *allowProtected && (command != "restore" || (*regionName == "" && *regionMapFile == "") || *protectCalibration) {
+		fmt.Println("Error: --allow-protected can only be used with a --region or --region-map restore")
+		os.Exit(1)
+	}
+	
+	// Region edges are not sector aligned, erasing there would wipe neighbouring data
+	if *eraseBeforeWrite && (command == "backup" || *regionName != "" || *regionMapFile != "" || *protectCalibration) {
+		fmt.Println("Error: --erase-before-write can only be used with a full restore or fill")
+		os.Exit(1)
+	}
+	
+	if *verifyWrites && (command == "backup" || command == "calibration-backup") {
+		fmt.Println("Error: --verify-writes can only be used with restore, recover-from-partial, calibration-restore or fill")
+		os.Exit(1)
+	}
+	
+	if *backupFormat != "bin" && *backupFormat != "srec" {
+		fmt.Printf("Error: Unknown format '%s', use bin or srec\n", *backupFormat)
+		os.Exit(1)
+	}
+	if *backupFormat == "srec" && (command != "backup" || *regionName != "" || *regionMapFile != "" ||
+		*eepromRegion || *exportCodeplugFile != "") {
+		fmt.Println("Error: --format srec can only be used with a full backup")
+		os.Exit(1)
+	}
+	
+	if *exportCodeplugFile != "" && (command != "backup" || *regionName != "" || *regionMapFile != "") {
+		fmt.Println("Error: --export-codeplug can only be used with a full backup, or on its own with a backup file")
+		os.Exit(1)
+	}
+	
+	// Regions to work on, nil means the whole flash
+	var regions []SPIRegion
+	if *regionName != "" {
+		region, ok := regionMap.find(*regionName)
+		if !ok {
+			fmt.Printf("Error: Unknown region '%s'\n\n", *regionName)
+			regionMap.print()
+			os.Exit(1)
+		}
+		regions = []SPIRegion{region}
+		if command == "restore" && region.Protected && !*allowProtected {
+			fmt.Printf("Error: region '%s' is protected, add --allow-protected to overwrite it\n", region.Name)
+			os.Exit(1)
+		}
+	} else if *regionMapFile != "" && !calibrationCommand && !*eepromRegion {
+		regions = regionMap.Regions
+	}
+	
+	// Set default baud rate if not provided
+	baudRate := 115200
+	if len(positional) >= 3 {
+		baudRate, err = strconv.Atoi(positional[2])
+		if err != nil {
+			fmt.Printf("Error: Invalid baud rate '%s'. Using default: 115200\n", positional[2])
+			baudRate = 115200
+		}
+	}
+	
+	// Verify port exists
+	tool := NewSPITool()
+	tool.regionMap = regionMap
+	tool.skipHashCheck = *skipHashCheck
+	tool.EraseBeforeWrite = *eraseBeforeWrite
+	tool.WriteLogFile = *writeLogFile
+	tool.VerifyWrites = *verifyWrites
+	tool.MaxReadRateKBps = *maxReadRate
+	tool.ResponseSize = *responseSize
+	tool.CommandSize = *commandSize
+	tool.ReadInterval = tool.readInterval()
+	ports := spilib.AvailablePorts()
+	portFound := false
+	for _, port := range ports {
+		if port == portName {
+			portFound = true
+			break
+		}
+	}
+	
+	if !portFound {
+		fmt.Printf("Error: Port '%s (%d)' not found\n\n", portName, baudRate)
+		showUsage()
+		os.Exit(1)
 	}
 	
 	// Connect to port
-	err := tool.connectToPort(portName, baudRate)
+	err = tool.Connect(portName, baudRate)
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		os.Exit(1)
 	}
-	defer tool.disconnect()
 	
 	fmt.Printf("Connected to port: %s (%d)\n", portName, baudRate)
 	fmt.Printf("Command: %s\n", command)
-	fmt.Printf("File: %s\n", filename)
+	if command == "fill" {
+		fmt.Printf("Range: 0x%06X-0x%06X\n", int(fillStart)*blockSize, (int(fillEnd)+1)*blockSize)
+	} else if calibrationCommand || *eepromRegion {
+		region := tool.calibrationRegion()
+		if *eepromRegion {
+			region = tool.eepromRegion()
+		}
+		fmt.Printf("File: %s\n", filename)
+		fmt.Printf("Region: %s (0x%06X, %d bytes)\n", region.Name, region.StartOffset, region.Size)
+	} else {
+		fmt.Printf("File: %s\n", filename)
+	}
+	for _, r := range regions {
+		fmt.Printf("Region: %s (0x%06X, %d bytes)\n", r.Name, r.StartOffset, r.Size)
+	}
+	if tool.ReadInterval > 0 {
+		fmt.Printf("Read rate limit: %.1f KB/s (one block every %v)\n", tool.MaxReadRateKBps, tool.ReadInterval)
+	}
 	fmt.Println()
 	
-	// Execute command
-	switch command {
-	case "backup":
-		fmt.Println("Instructions for backup mode:")
-		fmt.Println("1. Connect the data cable to the radio")
-		fmt.Println("2. Turn ON the radio normally (no special procedure needed)")
-		fmt.Println("3. Press Enter to start backup...")
-		
-		var input string
-		fmt.Scanln(&input)
-		
-		err = tool.backupSPIFlash(filename)
-		if err != nil {
-			fmt.Printf("Backup failed: %v\n", err)
-			os.Exit(1)
+	// Run the command in a function, so the port is closed and the USB
+	// latency timer put back before os.Exit, which skips deferred calls
+	run := func() error {
+		var err error
+		switch command {
+		case "backup":
+			fmt.Println("Instructions for backup mode:")
+			fmt.Println("1. Connect the data cable to the radio")
+			fmt.Println("2. Turn ON the radio normally (no special procedure needed)")
+			fmt.Println("3. Press Enter to start backup...")
+			
+			spilib.WaitForStart(*noWait, *force)
+			
+			if *eepromRegion {
+				err = tool.backupEEPROMRegion(filename)
+			} else if regions != nil {
+				err = tool.backupSPIRegions(filename, regions, *regionName == "")
+			} else if *backupFormat == "srec" {
+				err = tool.backupSPIFlashAsSREC(filename)
+			} else {
+				err = tool.backupSPIFlash(filename)
+			}
+			if err != nil {
+				return fmt.Errorf("backup failed: %v", err)
+			}
+			if *exportCodeplugFile != "" {
+				if err := exportCodeplug(filename, *exportCodeplugFile, regionMap); err != nil {
+					return fmt.Errorf("codeplug export failed: %v", err)
+				}
+			}
+			
+		case "restore":
+			fmt.Println("Instructions for restore mode:")
+			fmt.Println("1. Connect the data cable to the radio")
+			fmt.Println("2. Turn ON the radio normally (no special procedure needed)")
+			fmt.Println("3. WARNING: This will overwrite the SPI flash content!")
+			fmt.Println("4. Press Enter to start restore...")
+			
+			spilib.WaitForStart(*noWait, *force)
+			
+			if *eepromRegion {
+				err = tool.restoreEEPROMRegion(filename)
+			} else if *protectCalibration {
+				err = tool.restoreUnprotected(filename)
+			} else if *regionName != "" {
+				err = tool.restoreSPIRegion(filename, *regionName)
+			} else if regions != nil {
+				restore, skip := withoutProtected(regions, *allowProtected)
+				printRestoreSummary(restore, skip)
+				err = tool.restoreSPIRegions(filename, restore)
+			} else {
+				err = tool.restoreSPIFlash(filename)
+			}
+			if err != nil {
+				return fmt.Errorf("restore failed: %v", err)
+			}
+			
+		case "recover-from-partial":
+			fmt.Println("Instructions for recovery mode:")
+			fmt.Println("1. Connect the data cable to the radio")
+			fmt.Println("2. Turn ON the radio normally (no special procedure needed)")
+			fmt.Println("3. WARNING: This will overwrite the SPI flash blocks not yet restored!")
+			fmt.Println("4. Press Enter to start recovery...")
+			
+			spilib.WaitForStart(*noWait, *force)
+			
+			err = tool.recoverPartialRestore(filename, recoverLogFile)
+			if err != nil {
+				return fmt.Errorf("recovery failed: %v", err)
+			}
+			
+		case "fill":
+			fmt.Println("Instructions for fill mode:")
+			fmt.Println("1. Connect the data cable to the radio")
+			fmt.Println("2. Turn ON the radio normally (no special procedure needed)")
+			fmt.Println("3. WARNING: This will overwrite the SPI flash content in the range!")
+			fmt.Println("4. Press Enter to start filling...")
+			
+			spilib.WaitForStart(*noWait, *force)
+			
+			err = tool.fillSPIRegion(fillStart, fillEnd, fillPattern)
+			if err != nil {
+				return fmt.Errorf("fill failed: %v", err)
+			}
+			
+		case "calibration-backup":
+			fmt.Println("Instructions for calibration backup mode:")
+			fmt.Println("1. Connect the data cable to the radio")
+			fmt.Println("2. Turn ON the radio normally (no special procedure needed)")
+			fmt.Println("3. Press Enter to start backup...")
+			
+			spilib.WaitForStart(*noWait, *force)
+			
+			err = tool.backupCalibrationRegion(filename)
+			if err != nil {
+				return fmt.Errorf("calibration backup failed: %v", err)
+			}
+			
+		case "calibration-restore":
+			fmt.Println("Instructions for calibration restore mode:")
+			fmt.Println("1. Connect the data cable to the radio")
+			fmt.Println("2. Turn ON the radio normally (no special procedure needed)")
+			fmt.Println("3. WARNING: This will overwrite the calibration data of the radio!")
+			fmt.Println("4. Press Enter to start restore...")
+			
+			spilib.WaitForStart(*noWait, *force)
+			
+			err = tool.restoreCalibrationRegion(filename)
+			if err != nil {
+				return fmt.Errorf("calibration restore failed: %v", err)
+			}
 		}
 		
-	case "restore":
-		fmt.Println("Instructions for restore mode:")
-		fmt.Println("1. Connect the data cable to the radio")
-		fmt.Println("2. Turn ON the radio normally (no special procedure needed)")
-		fmt.Println("3. WARNING: This will overwrite the SPI flash content!")
-		fmt.Println("4. Press Enter to start restore...")
-		
-		var input string
-		fmt.Scanln(&input)
-		
-		err = tool.restoreSPIFlash(filename)
-		if err != nil {
-			fmt.Printf("Restore failed: %v\n", err)
-			os.Exit(1)
+		return nil
+	}
+	err = run()
+	tool.Disconnect()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		if command == "restore" && *writeLogFile != "" {
+			fmt.Printf("Resume with: %s recover-from-partial %s %s %s\n", os.Args[0], portName, filename, *writeLogFile)
 		}
+		os.Exit(1)
 	}
 	
 	fmt.Println("Operation completed successfully!")
-}
\ No newline at end of file
+}
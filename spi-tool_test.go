@@ -0,0 +1,727 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.bug.st/serial"
+
+	"rt6d-flasher/internal/spilib"
+)
+
+// The root directory holds one program per file, so the tests of spi-tool
+// are run with its source file:
+//
+//	go test spi-tool.go spi-tool_test.go
+
+// spiTestPort is a radio in normal mode with a simulated SPI flash. It
+// answers the read, write and erase commands of spilib.SPIClient with
+// blockSize data bytes per packet and sum checksums.
+type spiTestPort struct {
+	mu        sync.Mutex
+	flash     []byte
+	blockSize int // CHUNK_SIZE, the default 1028 byte packets
+	pending   []byte
+	read      []int // Blocks read, in order
+	written   []int // Blocks written, in order
+}
+
+func newSPITestPort() *spiTestPort {
+	flash := make([]byte, SPI_FLASH_SIZE)
+	for i := range flash {
+		flash[i] = byte(i/CHUNK_SIZE + i)
+	}
+	return &spiTestPort{flash: flash, blockSize: CHUNK_SIZE}
+}
+
+func checksum(data []byte) byte {
+	var sum byte
+	for _, b := range data {
+		sum += b
+	}
+	return sum
+}
+
+func (p *spiTestPort) Write(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(data) < 4 || checksum(data[:len(data)-1]) != data[len(data)-1] {
+		p.pending = append(p.pending, 0x15)
+		return len(data), nil
+	}
+
+	block := int(data[1])<<8 | int(data[2])
+	switch {
+	case data[0] == spilib.CMD_READ_SPI_FLASH && len(data) == 4:
+		response := append([]byte{data[0], data[1], data[2]}, p.flash[block*p.blockSize:(block+1)*p.blockSize]...)
+		p.read = append(p.read, block)
+		p.pending = append(p.pending, append(response, checksum(response))...)
+	case data[0] == spilib.CMD_ERASE_SPI_SECTOR && len(data) == 5:
+		sector := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+		copy(p.flash[sector:sector+spilib.SPI_SECTOR_SIZE], bytes.Repeat([]byte{0xFF}, spilib.SPI_SECTOR_SIZE))
+		p.pending = append(p.pending, 0x06)
+	case len(data) == p.blockSize+4:
+		copy(p.flash[block*p.blockSize:], data[3:3+p.blockSize])
+		p.written = append(p.written, block)
+		p.pending = append(p.pending, 0x06)
+	default:
+		p.pending = append(p.pending, 0x15)
+	}
+	return len(data), nil
+}
+
+func (p *spiTestPort) Read(buffer []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := copy(buffer, p.pending)
+	p.pending = p.pending[n:]
+	return n, nil
+}
+
+func (p *spiTestPort) block(block int) []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]byte(nil), p.flash[block*CHUNK_SIZE:(block+1)*CHUNK_SIZE]...)
+}
+
+func (p *spiTestPort) SetMode(mode *serial.Mode) error      { return nil }
+func (p *spiTestPort) Drain() error                         { return nil }
+func (p *spiTestPort) ResetInputBuffer() error              { return nil }
+func (p *spiTestPort) ResetOutputBuffer() error             { return nil }
+func (p *spiTestPort) SetDTR(dtr bool) error                { return nil }
+func (p *spiTestPort) SetRTS(rts bool) error                { return nil }
+func (p *spiTestPort) SetReadTimeout(t time.Duration) error { return nil }
+func (p *spiTestPort) Close() error                         { return nil }
+func (p *spiTestPort) Break(d time.Duration) error          { return nil }
+
+func (p *spiTestPort) GetModemStatusBits() (*serial.ModemStatusBits, error) {
+	return &serial.ModemStatusBits{}, nil
+}
+
+// newTestTool returns an SPITool connected to a simulated radio
+func newTestTool() (*SPITool, *spiTestPort) {
+	port := newSPITestPort()
+	tool := NewSPITool()
+	tool.Port = port
+	tool.BlockDelay = 0
+	return tool, port
+}
+
+func TestWithoutProtected(t *testing.T) {
+	regionMap, err := LoadSPIRegionMap("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restore, skip := withoutProtected(regionMap.Regions, false)
+	if len(skip) != 1 || skip[0].Name != "calibration" {
+		t.Errorf("skipped %v, want only calibration", skip)
+	}
+	if len(restore)+len(skip) != len(regionMap.Regions) {
+		t.Errorf("%d restored and %d skipped of %d regions", len(restore), len(skip), len(regionMap.Regions))
+	}
+	for _, r := range restore {
+		if r.Protected {
+			t.Errorf("protected region %s is restored", r.Name)
+		}
+	}
+
+	restore, skip = withoutProtected(regionMap.Regions, true)
+	if len(skip) != 0 || len(restore) != len(regionMap.Regions) {
+		t.Errorf("with allowProtected %d restored and %d skipped, want all %d restored",
+			len(restore), len(skip), len(regionMap.Regions))
+	}
+}
+
+func TestVerifyHashSidecar(t *testing.T) {
+	backup := filepath.Join(t.TempDir(), "spi_backup.bin")
+	if err := os.WriteFile(backup, []byte("SPI flash contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tool := NewSPITool()
+
+	// Absent: restores without a sidecar are still allowed
+	if err := tool.verifyHashSidecar(backup); err != nil {
+		t.Errorf("without sidecar: %v", err)
+	}
+
+	// Matching
+	if err := writeHashSidecar(backup); err != nil {
+		t.Fatal(err)
+	}
+	sidecar, err := os.ReadFile(backup + ".sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(sidecar), "  spi_backup.bin\n") {
+		t.Errorf("sidecar %q is not in sha256sum format", sidecar)
+	}
+	if err := tool.verifyHashSidecar(backup); err != nil {
+		t.Errorf("matching sidecar: %v", err)
+	}
+
+	// Mismatching
+	if err := os.WriteFile(backup, []byte("SPI flash contentz"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = tool.verifyHashSidecar(backup)
+	if err == nil || !strings.Contains(err.Error(), "SHA-256 mismatch") {
+		t.Errorf("modified file: got %v, want a SHA-256 mismatch", err)
+	}
+	tool.skipHashCheck = true
+	if err := tool.verifyHashSidecar(backup); err != nil {
+		t.Errorf("modified file with --skip-hash-check: %v", err)
+	}
+}
+
+func TestVerifyBackupCorruptBlock(t *testing.T) {
+	const blocks = 16
+	content := make([]byte, blocks*CHUNK_SIZE)
+	for i := range content {
+		content[i] = byte(i/CHUNK_SIZE + i)
+	}
+	backup := filepath.Join(t.TempDir(), "spi_backup.bin")
+	if err := os.WriteFile(backup, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := spilib.WriteBlockIndex(backup, blockCRCs(content, CHUNK_SIZE), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyBackup(backup, CHUNK_SIZE); err != nil {
+		t.Fatalf("intact backup: %v", err)
+	}
+
+	// One flipped bit in block 5
+	content[5*CHUNK_SIZE+100] ^= 0x10
+	if err := os.WriteFile(backup, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := verifyBackup(backup, CHUNK_SIZE)
+	if err == nil || err.Error() != fmt.Sprintf("1 of %d blocks are corrupted", blocks) {
+		t.Errorf("got %v, want 1 corrupted block", err)
+	}
+	crcs, _, err := spilib.LoadBlockIndex(backup, blocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bad := corruptBlocks(content, crcs, CHUNK_SIZE); len(bad) != 1 || bad[0] != 5 {
+		t.Errorf("corrupt blocks %v, want [5]", bad)
+	}
+}
+
+func TestFillSPIRegion(t *testing.T) {
+	tool, port := newTestTool()
+	tool.VerifyWrites = true
+	before, after := port.block(7), port.block(12)
+
+	if err := tool.fillSPIRegion(8, 11, []byte{0xFF}); err != nil {
+		t.Fatal(err)
+	}
+
+	erased := bytes.Repeat([]byte{0xFF}, CHUNK_SIZE)
+	for block := 8; block <= 11; block++ {
+		if !bytes.Equal(port.block(block), erased) {
+			t.Errorf("block %d is not filled with 0xFF", block)
+		}
+		data, err := tool.ReadBlockWithRetry(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, erased) {
+			t.Errorf("block %d reads back different from the fill", block)
+		}
+	}
+	if !bytes.Equal(port.block(7), before) || !bytes.Equal(port.block(12), after) {
+		t.Error("blocks outside the range were changed")
+	}
+	if fmt.Sprint(port.written) != "[8 9 10 11]" {
+		t.Errorf("blocks %v written, want [8 9 10 11]", port.written)
+	}
+}
+
+func TestCompareSPIBackups(t *testing.T) {
+	dir := t.TempDir()
+	a := make([]byte, 8*CHUNK_SIZE)
+	for i := range a {
+		a[i] = byte(i)
+	}
+	b := append([]byte(nil), a...)
+	b[3*CHUNK_SIZE] ^= 0xFF
+	b[7*CHUNK_SIZE+CHUNK_SIZE-1] ^= 0x01
+
+	fileA, fileB := filepath.Join(dir, "a.bin"), filepath.Join(dir, "b.bin")
+	if err := os.WriteFile(fileA, a, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fileB, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := compareSPIBackups(fileA, fileB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ChangedRegion{
+		{StartOffset: 3 * CHUNK_SIZE, EndOffset: 4 * CHUNK_SIZE, BlocksChanged: 1},
+		{StartOffset: 7 * CHUNK_SIZE, EndOffset: 8 * CHUNK_SIZE, BlocksChanged: 1},
+	}
+	if fmt.Sprint(changes) != fmt.Sprint(want) {
+		t.Errorf("changed regions %+v, want %+v", changes, want)
+	}
+}
+
+func TestRecoverPartialRestore(t *testing.T) {
+	tool, port := newTestTool()
+	dir := t.TempDir()
+	content := make([]byte, SPI_FLASH_SIZE)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	backup := filepath.Join(dir, "spi_backup.bin")
+	if err := os.WriteFile(backup, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The interrupted restore got every block but these written
+	const blocks = SPI_FLASH_SIZE / CHUNK_SIZE
+	missing := []int{0, 9, 513, blocks - 1}
+	logFile := filepath.Join(dir, "restore.log")
+	writeLog := newBlockWriteLog(logFile, blocks)
+	for block := 0; block < blocks; block++ {
+		writeLog.bits[block/8] |= 1 << (block % 8)
+	}
+	for _, block := range missing {
+		writeLog.bits[block/8] &^= 1 << (block % 8)
+	}
+	if err := writeLog.save(); err != nil {
+		t.Fatal(err)
+	}
+	untouched := port.block(10)
+
+	if err := tool.recoverPartialRestore(backup, logFile); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(port.written) != fmt.Sprint(missing) {
+		t.Errorf("blocks %v written, want %v", port.written, missing)
+	}
+	for _, block := range missing {
+		if !bytes.Equal(port.block(block), content[block*CHUNK_SIZE:(block+1)*CHUNK_SIZE]) {
+			t.Errorf("block %d does not hold the backup", block)
+		}
+	}
+	if !bytes.Equal(port.block(10), untouched) {
+		t.Error("a block marked written was written again")
+	}
+	recovered, err := loadBlockWriteLog(logFile, blocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recovered.count() != blocks {
+		t.Errorf("write log marks %d of %d blocks written", recovered.count(), blocks)
+	}
+}
+
+func TestBackupRestoreSmallBlocks(t *testing.T) {
+	tool, port := newTestTool()
+	tool.ResponseSize, tool.CommandSize = 516, 516
+	tool.FlashSize = 16 * 1024 // Every read takes 50 ms
+	port.blockSize = 512
+	dir := t.TempDir()
+	backup := filepath.Join(dir, "spi_backup.bin")
+
+	if err := tool.backupSPIFlash(backup); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(port.read) != fmt.Sprint(sequence(32)) {
+		t.Fatalf("blocks %v read, want the 32 blocks of 512 bytes", port.read)
+	}
+	content, err := os.ReadFile(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, port.flash[:16*1024]) {
+		t.Fatal("the backup differs from the flash")
+	}
+	if err := verifyBackup(backup, 512); err != nil {
+		t.Errorf("the index does not match 512 byte blocks: %v", err)
+	}
+
+	// Restore a 2 KB region from a file of just that region, blocks 128 to
+	// 131 of 512 bytes
+	region := SPIRegion{Name: "test", StartOffset: 0x10000, Size: 0x800}
+	data := bytes.Repeat([]byte{0x5A, 0xA5, 0x00}, 0x800/3+1)[:0x800]
+	regionFile := filepath.Join(dir, "region.bin")
+	if err := os.WriteFile(regionFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := spilib.WriteBlockIndex(regionFile, blockCRCs(data, 512), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := tool.restoreSPIRegions(regionFile, []SPIRegion{region}); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(port.written) != "[128 129 130 131]" {
+		t.Errorf("blocks %v written, want [128 129 130 131]", port.written)
+	}
+	if !bytes.Equal(port.flash[0x10000:0x10800], data) {
+		t.Error("the region does not hold the file")
+	}
+}
+
+// sequence returns 0 to n-1
+func sequence(n int) []int {
+	s := make([]int, n)
+	for i := range s {
+		s[i] = i
+	}
+	return s
+}
+
+func TestPacketBlockSize(t *testing.T) {
+	tests := []struct {
+		response, command int
+		want              int
+	}{
+		{1028, 1028, 1024},
+		{516, 516, 512},
+		{132, 132, 128},
+		{516, 1028, 0},  // Backups would not line up with the restore
+		{2052, 2052, 0}, // Larger than the 1024 byte blocks of the regions
+		{1004, 1004, 0},
+		{68, 68, 0},
+	}
+	for _, tt := range tests {
+		got, err := packetBlockSize(tt.response, tt.command)
+		if got != tt.want || (err != nil) != (tt.want == 0) {
+			t.Errorf("%d/%d: got %d, %v, want %d", tt.response, tt.command, got, err, tt.want)
+		}
+	}
+}
+
+func TestCalibrationRoundTrip(t *testing.T) {
+	tool, port := newTestTool()
+	file := filepath.Join(t.TempDir(), "calibration.bin")
+	first := CALIBRATION_OFFSET / CHUNK_SIZE
+	last := first + CALIBRATION_SIZE/CHUNK_SIZE - 1
+
+	var original []byte
+	for block := first; block <= last; block++ {
+		original = append(original, port.block(block)...)
+	}
+	if err := tool.backupCalibrationRegion(file); err != nil {
+		t.Fatal(err)
+	}
+
+	// The calibration is lost, e.g. to a bad restore
+	lost := bytes.Repeat([]byte{0xFF}, CHUNK_SIZE)
+	port.mu.Lock()
+	for block := first; block <= last; block++ {
+		copy(port.flash[block*CHUNK_SIZE:], lost)
+	}
+	port.mu.Unlock()
+	before, after := port.block(first-1), port.block(last+1)
+
+	if err := tool.restoreCalibrationRegion(file); err != nil {
+		t.Fatal(err)
+	}
+	var restored []byte
+	for block := first; block <= last; block++ {
+		restored = append(restored, port.block(block)...)
+	}
+	if !bytes.Equal(restored, original) {
+		t.Error("the restored calibration differs from the backup")
+	}
+	if !bytes.Equal(port.block(first-1), before) || !bytes.Equal(port.block(last+1), after) {
+		t.Error("blocks next to the calibration region were changed")
+	}
+
+	// A damaged file is refused before anything is written
+	content, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[CALIBRATION_HEADER_SIZE+10] ^= 0x01
+	if err := os.WriteFile(file, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	writes := len(port.written)
+	if err := tool.restoreCalibrationRegion(file); err == nil || !strings.Contains(err.Error(), "corrupted") {
+		t.Errorf("got %v, want a corrupted file error", err)
+	}
+	if len(port.written) != writes {
+		t.Error("blocks were written from a corrupted file")
+	}
+}
+
+func TestEEPROMRegionBlocks(t *testing.T) {
+	tool, port := newTestTool()
+	regionMap, err := LoadSPIRegionMap("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tool.regionMap = regionMap
+	region := tool.eepromRegion()
+	first := int(region.StartOffset) / CHUNK_SIZE
+	blocks := int(region.Size) / CHUNK_SIZE
+	var want []int
+	for block := first; block < first+blocks; block++ {
+		want = append(want, block)
+	}
+
+	file := filepath.Join(t.TempDir(), "channels.bin")
+	if err := tool.backupEEPROMRegion(file); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(port.read) != fmt.Sprint(want) {
+		t.Errorf("read blocks %v, want %v", port.read, want)
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset, payload, err := parseEEPROMFile(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != region.StartOffset {
+		t.Errorf("header offset 0x%06X, want 0x%06X", offset, region.StartOffset)
+	}
+	for i := 0; i < blocks; i++ {
+		if !bytes.Equal(payload[i*CHUNK_SIZE:(i+1)*CHUNK_SIZE], port.block(first+i)) {
+			t.Fatalf("block %d of the file differs from the flash", i)
+		}
+	}
+
+	if err := tool.restoreEEPROMRegion(file); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(port.written) != fmt.Sprint(want) {
+		t.Errorf("wrote blocks %v, want %v", port.written, want)
+	}
+}
+
+func TestBackupSREC(t *testing.T) {
+	tool, port := newTestTool()
+	tool.FlashSize = 4096
+	file := filepath.Join(t.TempDir(), "backup.srec")
+	if err := tool.backupSPIFlashAsSREC(file); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	var image []byte
+	for i, line := range lines {
+		record, err := hex.DecodeString(line[2:])
+		if err != nil || len(record) < 1 || int(record[0]) != len(record)-1 {
+			t.Fatalf("line %d: malformed S-record %q", i+1, line)
+		}
+		var sum byte
+		for _, b := range record[:len(record)-1] {
+			sum += b
+		}
+		if ^sum != record[len(record)-1] {
+			t.Errorf("line %d: checksum 0x%02X, want 0x%02X", i+1, record[len(record)-1], ^sum)
+		}
+
+		switch {
+		case i == 0:
+			if line[1] != '0' || !strings.HasPrefix(string(record[3:]), "backup.srec ") {
+				t.Errorf("first record %q is not an S0 header with the file name", line)
+			}
+		case i == len(lines)-1:
+			if line != "S70500000000FA" {
+				t.Errorf("last record is %q, want the S7 end record", line)
+			}
+		default:
+			address := int(binary.BigEndian.Uint32(record[1:]))
+			if line[1] != '3' || address != len(image) || len(record) != 1+4+SREC_RECORD_SIZE+1 {
+				t.Fatalf("line %d: %q is not the next %d byte S3 record", i+1, line, SREC_RECORD_SIZE)
+			}
+			image = append(image, record[5:len(record)-1]...)
+		}
+	}
+
+	var want []byte
+	for block := 0; block < 4; block++ {
+		want = append(want, port.block(block)...)
+	}
+	if !bytes.Equal(image, want) {
+		t.Error("the S3 records differ from the flash")
+	}
+}
+
+func TestMaxReadRate(t *testing.T) {
+	tool, port := newTestTool()
+	tool.FlashSize = 10 * CHUNK_SIZE
+	tool.MaxReadRateKBps = 10
+	tool.ReadInterval = tool.readInterval()
+
+	// 10 KB at 10 KB/s, the limiter holds the reads to one every 100 ms
+	start := time.Now()
+	if err := tool.backupSPIFlash(filepath.Join(t.TempDir(), "backup.bin")); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	if len(port.read) != 10 {
+		t.Fatalf("read %d blocks, want 10", len(port.read))
+	}
+	if elapsed < 900*time.Millisecond || elapsed > 1100*time.Millisecond {
+		t.Errorf("10 blocks took %v, want 1s within 10%%", elapsed)
+	}
+}
+
+func TestCodeplugCSVRoundTrip(t *testing.T) {
+	regionMap, err := LoadSPIRegionMap("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	region, ok := regionMap.find("codeplug")
+	if !ok {
+		t.Fatal("the default region map has no codeplug region")
+	}
+	dir := t.TempDir()
+	csvFile := filepath.Join(dir, "channels.csv")
+	csvContent := strings.Join([]string{
+		"Name,RxFreq,TxFreq,CTCSS,DCS,PowerLevel",
+		"Calling,145.500,,,,high",
+		"Repeater 1,145.625,145.025,88.5,,mid",
+		"PMR 1,446.00625,,,,low",
+		"DCS test,433.100,,,D023N,",
+		"Max length12,438.825,431.225,123.0,,high",
+	}, "\n") + "\n"
+	if err := os.WriteFile(csvFile, []byte(csvContent), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	image := filepath.Join(dir, "codeplug.bin")
+	if err := convertCodeplug(csvFile, image, regionMap); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != int(region.Size) {
+		t.Fatalf("image is %d bytes, want the %d of the codeplug region", len(data), region.Size)
+	}
+
+	// The image goes into an erased backup at the offset of the region
+	backup := bytes.Repeat([]byte{0xFF}, int(region.StartOffset+region.Size))
+	copy(backup[region.StartOffset:], data)
+	backupFile := filepath.Join(dir, "backup.bin")
+	if err := os.WriteFile(backupFile, backup, 0644); err != nil {
+		t.Fatal(err)
+	}
+	codeplug, err := ExtractCodeplug(backupFile, regionMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Channel{
+		{Number: 1, Name: "Calling", Frequency: 145.5, TxFrequency: 145.5},
+		{Number: 2, Name: "Repeater 1", Frequency: 145.625, TxFrequency: 145.025, CTCSS: "88.5", TxCTCSS: "88.5"},
+		{Number: 3, Name: "PMR 1", Frequency: 446.00625, TxFrequency: 446.00625},
+		{Number: 4, Name: "DCS test", Frequency: 433.1, TxFrequency: 433.1},
+		{Number: 5, Name: "Max length12", Frequency: 438.825, TxFrequency: 431.225, CTCSS: "123.0", TxCTCSS: "123.0"},
+	}
+	if len(codeplug.Channels) != len(want) {
+		t.Fatalf("got %d channels %+v, want %d", len(codeplug.Channels), codeplug.Channels, len(want))
+	}
+	for i, channel := range codeplug.Channels {
+		if channel != want[i] {
+			t.Errorf("channel %d is %+v, want %+v", i+1, channel, want[i])
+		}
+	}
+	if len(codeplug.Contacts) != 0 {
+		t.Errorf("got %d contacts from an image without any", len(codeplug.Contacts))
+	}
+}
+
+// benchmarkBackup backs up a flash of 4096 all-zero blocks to filename,
+// without the delays of a real radio
+func benchmarkBackup(b *testing.B, filename string) {
+	tool, port := newTestTool()
+	port.flash = make([]byte, SPI_FLASH_SIZE)
+	tool.ReadDelay = 0
+	tool.Quiet = true
+	backup := filepath.Join(b.TempDir(), filename)
+	b.SetBytes(SPI_FLASH_SIZE)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		captureStdout(b, func() {
+			if err := tool.backupSPIFlash(backup); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+	b.StopTimer()
+	if info, err := os.Stat(backup); err == nil {
+		b.ReportMetric(float64(info.Size()), "file-bytes")
+	}
+}
+
+func BenchmarkBackupCompressed(b *testing.B) {
+	benchmarkBackup(b, "backup.bin.gz")
+}
+
+func BenchmarkBackupUncompressed(b *testing.B) {
+	benchmarkBackup(b, "backup.bin")
+}
+
+// captureStdout returns what run prints to os.Stdout
+func captureStdout(t testing.TB, run func()) string {
+	t.Helper()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	defer func() { os.Stdout = stdout }()
+	output := make(chan []byte)
+	go func() {
+		content, _ := io.ReadAll(reader)
+		output <- content
+	}()
+	run()
+	writer.Close()
+	return string(<-output)
+}
+
+// listedFormats returns the names of the formats printed by printFormats
+func listedFormats(t *testing.T, output string) []string {
+	t.Helper()
+	var names []string
+	for _, line := range strings.Split(output, "\n") {
+		if line != "" && !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "Fallback order: ") {
+			names = append(names, line)
+		}
+	}
+	if strings.Count(output, "  Header:") != len(names) {
+		t.Errorf("not every format has a sample header:\n%s", output)
+	}
+	if !strings.Contains(output, "\nFallback order: ") {
+		t.Errorf("no fallback order:\n%s", output)
+	}
+	return names
+}
+
+func TestListFormats(t *testing.T) {
+	names := listedFormats(t, captureStdout(t, func() { printFormats(spiFormats, "raw binary") }))
+	if len(names) < 3 || len(names) != len(spiFormats) {
+		t.Errorf("listed formats %q, want the %d of spiFormats", names, len(spiFormats))
+	}
+}